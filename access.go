@@ -0,0 +1,129 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Every key remembers when it was last accessed and a logarithmic access
+// frequency counter, the same two clocks Redis keeps for OBJECT IDLETIME and
+// OBJECT FREQ. The counter uses Redis' defaults: it starts at 5, is bumped
+// with a probability that shrinks as it grows (lfu-log-factor 10) and decays
+// by one for every minute without access (lfu-decay-time 1).
+
+const (
+	lfuInitValue  = 5
+	lfuLogFactor  = 10
+	lfuDecayTime  = time.Minute
+	lfuMaxCounter = 255
+)
+
+type keyAccess struct {
+	lastAccess time.Time
+	lastDecay  time.Time
+	counter    uint8
+}
+
+// decayedCounter returns the frequency counter after applying the decay for
+// the time elapsed since it was last decremented.
+func (a *keyAccess) decayedCounter(now time.Time) uint8 {
+	periods := int(now.Sub(a.lastDecay) / lfuDecayTime)
+	if periods >= int(a.counter) {
+		return 0
+	}
+	return a.counter - uint8(periods)
+}
+
+func (a *keyAccess) touch(now time.Time) {
+	counter := a.decayedCounter(now)
+	if now.Sub(a.lastDecay) >= lfuDecayTime {
+		a.lastDecay = now
+	}
+	if counter < lfuMaxCounter {
+		base := float64(counter) - lfuInitValue
+		if base < 0 {
+			base = 0
+		}
+		if rand.Float64() < 1.0/(base*lfuLogFactor+1) {
+			counter++
+		}
+	}
+	a.counter = counter
+	a.lastAccess = now
+}
+
+// recordAccess bumps the clocks of the keys the command in parts refers to,
+// once it has run. Keys that do not exist afterwards are forgotten.
+func (kv *KeyValueStore) recordAccess(parts []string) {
+	spec := commandTable[parts[0]]
+	if spec.flags&flagNoTouch != 0 {
+		return
+	}
+	keys := commandKeys(parts)
+	if len(keys) == 0 {
+		return
+	}
+	now := time.Now()
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	kv.accessMu.Lock()
+	defer kv.accessMu.Unlock()
+	for _, key := range keys {
+		if !kv.keyExists(key) {
+			delete(kv.access, key)
+			continue
+		}
+		access, exists := kv.access[key]
+		if !exists {
+			access = &keyAccess{lastDecay: now, counter: lfuInitValue}
+			kv.access[key] = access
+		}
+		access.touch(now)
+	}
+}
+
+// keyAccessOf returns the clocks of key, which the caller has checked exists.
+// Keys loaded from disk have not been accessed yet, so they start fresh.
+func (kv *KeyValueStore) keyAccessOf(key string) keyAccess {
+	kv.accessMu.Lock()
+	defer kv.accessMu.Unlock()
+	if access, exists := kv.access[key]; exists {
+		return *access
+	}
+	now := time.Now()
+	access := &keyAccess{lastAccess: now, lastDecay: now, counter: lfuInitValue}
+	kv.access[key] = access
+	return *access
+}
+
+// moveKeyAccess hands the clocks of src over to dst, for RENAME.
+func (kv *KeyValueStore) moveKeyAccess(src, dst string) {
+	kv.accessMu.Lock()
+	defer kv.accessMu.Unlock()
+	if access, exists := kv.access[src]; exists {
+		kv.access[dst] = access
+		delete(kv.access, src)
+	} else {
+		delete(kv.access, dst)
+	}
+}
+
+// setKeyAccess sets the clocks of key for RESTORE. A negative idleTime or
+// freq leaves that clock alone.
+func (kv *KeyValueStore) setKeyAccess(key string, idleTime, freq int64) {
+	kv.accessMu.Lock()
+	defer kv.accessMu.Unlock()
+	now := time.Now()
+	access, exists := kv.access[key]
+	if !exists {
+		access = &keyAccess{lastAccess: now, lastDecay: now, counter: lfuInitValue}
+		kv.access[key] = access
+	}
+	if idleTime >= 0 {
+		access.lastAccess = now.Add(-time.Duration(idleTime) * time.Second)
+	}
+	if freq >= 0 {
+		access.counter = uint8(freq)
+		access.lastDecay = now
+	}
+}
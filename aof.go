@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dhravya/radish/internal/rdb"
+)
+
+// With appendonly on, every write command is appended to the append-only
+// file in RESP as it runs, and the file is replayed on startup instead of
+// loading the data file. How often it is flushed to disk is up to
+// appendfsync: after every command, once a second from the background, or
+// whenever the OS sees fit. BGREWRITEAOF compacts the file in the
+// background: a copy of the dataset is written as an RDB preamble to a new
+// file while commands keep being appended to the old one and buffered, and
+// once done the buffer is appended to the new file, which replaces the old
+// one. A file that ends in the middle of a command, as after a crash, is
+// truncated to its last complete command when aof-load-truncated is on.
+
+type fsyncPolicy int
+
+const (
+	fsyncAlways fsyncPolicy = iota
+	fsyncEverySec
+	fsyncNo
+)
+
+var fsyncPolicyNames = []string{"always", "everysec", "no"}
+
+func (p fsyncPolicy) String() string {
+	return fsyncPolicyNames[p]
+}
+
+func parseFsyncPolicy(s string) (fsyncPolicy, bool) {
+	for i, name := range fsyncPolicyNames {
+		if strings.EqualFold(s, name) {
+			return fsyncPolicy(i), true
+		}
+	}
+	return 0, false
+}
+
+var (
+	appendFsync      = fsyncEverySec
+	aofLoadTruncated = true
+)
+
+// loadingData is set while the dataset is being loaded at startup, when
+// commands are replayed without enforcing maxmemory.
+var loadingData atomic.Bool
+
+// maxBulkLen is the longest argument a command can have, like Redis'
+// proto-max-bulk-len.
+const maxBulkLen = 512 << 20
+
+var errBadAOFFormat = errors.New("bad file format reading the append only file")
+
+// appendOnly is the append-only file, nil when appendonly is off.
+var appendOnly *AppendOnlyFile
+
+type AppendOnlyFile struct {
+	path string
+	mu   sync.Mutex
+	file *os.File
+	// db is the database the last logged command ran in, -1 when the next
+	// command has to be preceded by a SELECT
+	db int
+	// dirty is set when there are writes that haven't been fsynced
+	dirty bool
+	// rewriting is set while BGREWRITEAOF runs, and rewriteBuf holds the
+	// commands logged since it started
+	rewriting  bool
+	rewriteBuf []byte
+	// rewriteStale is set when the dataset was replaced during a rewrite,
+	// which is then thrown away
+	rewriteStale bool
+	// fsyncedOffset is the replication offset up to which the file is known
+	// to be on disk
+	fsyncedOffset atomic.Int64
+}
+
+// startAppendOnly loads the dataset from the append-only file at path, or,
+// when there is none yet, from the data file of p, which is then written as
+// the first append-only file. Afterwards write commands are appended to it.
+func startAppendOnly(path string, p *Persistence) error {
+	aof := &AppendOnlyFile{path: path, db: -1}
+	loadingData.Store(true)
+	defer loadingData.Store(false)
+	if _, err := os.Stat(path); err == nil {
+		if err := loadAppendOnlyFile(path, p.databases); err != nil {
+			return err
+		}
+	} else if errors.Is(err, os.ErrNotExist) {
+		if err := p.load(); err != nil {
+			return err
+		}
+		if err := aof.writeBase(p.databases); err != nil {
+			return err
+		}
+	} else {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	aof.file = file
+	appendOnly = aof
+	go aof.fsyncEverySecond()
+	return nil
+}
+
+// loadAppendOnlyFile replays the append-only file at path into databases.
+func loadAppendOnlyFile(path string, databases []*KeyValueStore) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	counter := &countingReader{r: file}
+	r := bufio.NewReader(counter)
+	if magic, _ := r.Peek(len(rdb.Magic)); string(magic) == rdb.Magic {
+		if err := readRDB(r, databases, nil); err != nil {
+			return fmt.Errorf("loading the RDB preamble of the append only file: %w", err)
+		}
+	}
+
+	db, replayed := 0, 0
+	for {
+		valid := counter.n - int64(r.Buffered())
+		parts, err := readAOFCommand(r)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			if !aofLoadTruncated {
+				return fmt.Errorf("the append only file ends with a partial command at offset %d, start with -aof-load-truncated to truncate it", valid)
+			}
+			log.Printf("The append only file ends with a partial command, truncating it to the last complete one at offset %d", valid)
+			if err := file.Truncate(valid); err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w at offset %d: %v", errBadAOFFormat, valid, err)
+		}
+
+		parts[0] = strings.ToUpper(parts[0])
+		if parts[0] == "SELECT" {
+			index := -1
+			if len(parts) == 2 {
+				index, _ = strconv.Atoi(parts[1])
+			}
+			if index < 0 || index >= len(databases) {
+				return fmt.Errorf("%w at offset %d: SELECT of a database that doesn't exist", errBadAOFFormat, valid)
+			}
+			db = index
+			continue
+		}
+		if _, ok := commandTable[parts[0]]; !ok {
+			return fmt.Errorf("%w at offset %d: unknown command %s", errBadAOFFormat, valid, parts[0])
+		}
+		databases[db].executeCommand(parts)
+		replayed++
+	}
+	log.Printf("Replayed %d commands from the append only file", replayed)
+	return nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// readAOFCommand reads a command written by appendRESPCommand. It returns
+// io.EOF at the end of the file, and io.ErrUnexpectedEOF when the file ends
+// in the middle of the command.
+func readAOFCommand(r *bufio.Reader) ([]string, error) {
+	n, err := readAOFLength(r, '*')
+	if err != nil {
+		return nil, err
+	}
+	if n < 1 {
+		return nil, errors.New("empty command")
+	}
+	parts := make([]string, 0, min(n, 1024))
+	for i := 0; i < n; i++ {
+		size, err := readAOFLength(r, '$')
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if size > maxBulkLen {
+			return nil, fmt.Errorf("argument of %d bytes is too long", size)
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if !bytes.HasSuffix(arg, []byte("\r\n")) {
+			return nil, errors.New("missing CRLF after argument")
+		}
+		parts = append(parts, string(arg[:size]))
+	}
+	return parts, nil
+}
+
+// readAOFLength reads a line holding prefix and a non-negative number. It
+// returns io.EOF when there is nothing left to read.
+func readAOFLength(r *bufio.Reader, prefix byte) (int, error) {
+	line, err := r.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return 0, io.EOF
+	}
+	if err == io.EOF {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(line) < 3 || line[0] != prefix || line[len(line)-2] != '\r' {
+		return 0, fmt.Errorf("expected '%c'", prefix)
+	}
+	n, err := strconv.Atoi(line[1 : len(line)-2])
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid length %q", line[1:len(line)-2])
+	}
+	return n, nil
+}
+
+func appendRESPCommand(b []byte, parts ...string) []byte {
+	b = append(b, '*')
+	b = strconv.AppendInt(b, int64(len(parts)), 10)
+	b = append(b, "\r\n"...)
+	for _, part := range parts {
+		b = append(b, '$')
+		b = strconv.AppendInt(b, int64(len(part)), 10)
+		b = append(b, "\r\n"...)
+		b = append(b, part...)
+		b = append(b, "\r\n"...)
+	}
+	return b
+}
+
+// feed appends a command that ran in database db. It is a no-op when the
+// append-only file is off.
+func (aof *AppendOnlyFile) feed(db int, parts []string) {
+	if aof == nil {
+		return
+	}
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	var buf []byte
+	if db != aof.db {
+		buf = appendRESPCommand(buf, "SELECT", strconv.Itoa(db))
+		aof.db = db
+	}
+	buf = appendRESPCommand(buf, parts...)
+	if aof.rewriting {
+		aof.rewriteBuf = append(aof.rewriteBuf, buf...)
+	}
+	if _, err := aof.file.Write(buf); err != nil {
+		log.Printf("Error writing to the append only file: %v", err)
+		return
+	}
+	if appendFsync == fsyncAlways {
+		if err := aof.file.Sync(); err != nil {
+			log.Printf("Error syncing the append only file: %v", err)
+		}
+		return
+	}
+	aof.dirty = true
+}
+
+// fsyncEverySecond flushes the file to disk once a second under the
+// everysec policy, and keeps track of the offset synced under always.
+func (aof *AppendOnlyFile) fsyncEverySecond() {
+	for range time.Tick(time.Second) {
+		if appendFsync == fsyncNo {
+			continue
+		}
+		if err := aof.fsync(); err != nil {
+			log.Printf("Error syncing the append only file: %v", err)
+		}
+	}
+}
+
+// fsync flushes what was written to the file to disk, whatever the policy,
+// and records the replication offset that covers. The offset is read first,
+// as every command it counts was written before it was counted. The sync
+// runs outside the lock, so it doesn't hold up the commands being appended
+// meanwhile.
+func (aof *AppendOnlyFile) fsync() error {
+	offset := replication.currentOffset()
+	aof.mu.Lock()
+	file, dirty := aof.file, aof.dirty
+	aof.dirty = false
+	aof.mu.Unlock()
+	if dirty {
+		// The file may have been replaced by a rewrite, which synced it
+		if err := file.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+			aof.mu.Lock()
+			aof.dirty = true
+			aof.mu.Unlock()
+			return err
+		}
+	}
+	for {
+		synced := aof.fsyncedOffset.Load()
+		if synced >= offset || aof.fsyncedOffset.CompareAndSwap(synced, offset) {
+			return nil
+		}
+	}
+}
+
+// writeBase writes databases as the RDB preamble of a new append-only file
+// and moves it in place. The caller must make sure they don't change.
+func (aof *AppendOnlyFile) writeBase(databases []*KeyValueStore) error {
+	tmpFile := aof.path + ".tmp"
+	file, err := os.Create(tmpFile)
+	if err != nil {
+		return err
+	}
+	if err := writeRDB(file, databases); err != nil {
+		file.Close()
+		os.Remove(tmpFile)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmpFile)
+		return err
+	}
+	file.Close()
+	if err := os.Rename(tmpFile, aof.path); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	return nil
+}
+
+// BgRewriteAOFCommand implements BGREWRITEAOF.
+func BgRewriteAOFCommand() string {
+	if appendOnly == nil {
+		return "ERR Append only file is not enabled"
+	}
+	// No write command runs while the snapshot starts, so it and the
+	// commands buffered from then on line up exactly
+	propagateMu.Lock()
+	appendOnly.mu.Lock()
+	if appendOnly.rewriting {
+		appendOnly.mu.Unlock()
+		propagateMu.Unlock()
+		return "ERR Background append only file rewriting already in progress"
+	}
+	appendOnly.rewriting = true
+	appendOnly.rewriteBuf = nil
+	appendOnly.db = -1
+	appendOnly.mu.Unlock()
+	snapshot := startSnapshot(databases)
+	propagateMu.Unlock()
+
+	go func() {
+		if err := appendOnly.rewrite(snapshot.finish()); err != nil {
+			log.Printf("Background append only file rewriting failed: %v", err)
+		} else {
+			log.Printf("Background append only file rewriting terminated with success")
+		}
+	}()
+	return "Background append only file rewriting started"
+}
+
+// rewrite writes snapshot as a new append-only file, followed by the
+// commands logged since it was taken, and switches over to it.
+func (aof *AppendOnlyFile) rewrite(snapshot []*KeyValueStore) error {
+	tmpFile := aof.path + ".rewrite"
+	err := (&AppendOnlyFile{path: tmpFile}).writeBase(snapshot)
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	aof.rewriting = false
+	buffered := aof.rewriteBuf
+	aof.rewriteBuf = nil
+	if err == nil && aof.rewriteStale {
+		err = errors.New("the dataset was replaced meanwhile")
+		os.Remove(tmpFile)
+	}
+	aof.rewriteStale = false
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_APPEND, 0644)
+	if err == nil {
+		_, err = file.Write(buffered)
+		if err == nil {
+			err = file.Sync()
+		}
+		if err == nil {
+			err = os.Rename(tmpFile, aof.path)
+		}
+		if err != nil {
+			file.Close()
+		}
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	aof.file.Close()
+	aof.file = file
+	aof.dirty = false
+	return nil
+}
+
+// replaceDataset starts the file over with databases, which replace the
+// whole dataset, as when a replica loads the one of its master. A rewrite
+// running meanwhile would bring the old dataset back and is thrown away.
+// The caller must hold propagateMu.
+func (aof *AppendOnlyFile) replaceDataset(databases []*KeyValueStore) error {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	if err := aof.writeBase(databases); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(aof.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	aof.file.Close()
+	aof.file = file
+	aof.db = -1
+	aof.dirty = false
+	aof.rewriteStale = aof.rewriting
+	return nil
+}
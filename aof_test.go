@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestAppendOnly turns the append-only file on for dbs, in a fresh
+// directory, and returns its path.
+func startTestAppendOnly(t *testing.T, dbs []*KeyValueStore) string {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "appendonly.aof")
+	databases = dbs
+	p := &Persistence{databases: dbs, dataFile: filepath.Join(dir, "data.gob")}
+	if err := startAppendOnly(path, p); err != nil {
+		t.Fatalf("Expected the append only file to start, Got: %v", err)
+	}
+	t.Cleanup(func() {
+		appendOnly.file.Close()
+		appendOnly, databases = nil, nil
+	})
+	return path
+}
+
+func replayAppendOnly(t *testing.T, path string, n int) []*KeyValueStore {
+	t.Helper()
+	dbs := newDatabases(n)
+	loadingData.Store(true)
+	defer loadingData.Store(false)
+	if err := loadAppendOnlyFile(path, dbs); err != nil {
+		t.Fatalf("Expected the append only file to load, Got: %v", err)
+	}
+	return dbs
+}
+
+func TestAppendOnlyReplay(t *testing.T) {
+	dbs := newDatabases(2)
+	path := startTestAppendOnly(t, dbs)
+	kv := dbs[0]
+	kv.executeCommand([]string{"SET", "string", "binary\x00\r\nvalue"})
+	kv.executeCommand([]string{"SET", "ttl", "v"})
+	kv.executeCommand([]string{"EXPIRE", "ttl", "100"})
+	kv.executeCommand([]string{"SADD", "set", "a", "b", "c", "d"})
+	kv.executeCommand([]string{"SPOP", "set", "2"})
+	kv.executeCommand([]string{"ZADD", "zset", "1", "a", "2", "b"})
+	kv.executeCommand([]string{"BZPOPMIN", "missing", "zset", "0"})
+	kv.executeCommand([]string{"HSET", "hash", "f1", "v1", "f2", "v2"})
+	kv.executeCommand([]string{"HEXPIRE", "hash", "100", "FIELDS", "1", "f1"})
+	kv.executeCommand([]string{"INCR", "failed", "extra"})
+	dbs[1].executeCommand([]string{"RPUSH", "list", "a", "b"})
+	kv.executeCommand([]string{"LPOP", "list"})
+
+	contents, _ := os.ReadFile(path)
+	for _, logged := range []string{"PEXPIREAT", "SREM", "ZMPOP", "HPEXPIREAT"} {
+		if !strings.Contains(string(contents), logged) {
+			t.Fatalf("Expected %s in the append only file", logged)
+		}
+	}
+
+	loaded := replayAppendOnly(t, path, 2)
+	for _, command := range [][]string{
+		{"GET", "string"}, {"SMEMBERS", "set"}, {"ZRANGE", "zset", "0", "-1"}, {"HGETALL", "hash"},
+	} {
+		if got, expected := loaded[0].executeCommand(command), kv.executeCommand(command); got != expected {
+			t.Fatalf("%s: expected %q, Got: %q", command[0], expected, got)
+		}
+	}
+	if got := loaded[0].Expirations["ttl"]; got.Sub(kv.Expirations["ttl"]).Abs() > 10*time.Millisecond {
+		t.Fatalf("Expected the TTL to be replayed, Got: %v", got)
+	}
+	if time.Until(loaded[0].HashFieldExpirations["hash"]["f1"]) < 99*time.Second {
+		t.Fatalf("Expected the field TTL to be replayed")
+	}
+	if got := loaded[1].executeCommand([]string{"LRANGE", "list", "0", "-1"}); got != "a b" {
+		t.Fatalf("Expected the second database to be replayed, Got: %q", got)
+	}
+}
+
+func TestAppendOnlyRewrite(t *testing.T) {
+	dbs := newDatabases(2)
+	path := startTestAppendOnly(t, dbs)
+	for i := 0; i < 100; i++ {
+		dbs[0].executeCommand([]string{"INCR", "counter"})
+	}
+	dbs[1].executeCommand([]string{"SET", "other", "db"})
+	before, _ := os.Stat(path)
+
+	if got := BgRewriteAOFCommand(); got != "Background append only file rewriting started" {
+		t.Fatalf("Expected the rewrite to start, Got: %q", got)
+	}
+	// Commands that run during the rewrite end up after the preamble
+	dbs[0].executeCommand([]string{"INCR", "counter"})
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		appendOnly.mu.Lock()
+		rewriting := appendOnly.rewriting
+		appendOnly.mu.Unlock()
+		if !rewriting {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the rewrite to finish")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	dbs[0].executeCommand([]string{"INCR", "counter"})
+
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size() {
+		t.Fatalf("Expected the rewrite to shrink the file, from %d to %d bytes", before.Size(), after.Size())
+	}
+	loaded := replayAppendOnly(t, path, 2)
+	if got := loaded[0].executeCommand([]string{"GET", "counter"}); got != "102" {
+		t.Fatalf("Expected the counter to survive the rewrite, Got: %q", got)
+	}
+	if got := loaded[1].executeCommand([]string{"GET", "other"}); got != "db" {
+		t.Fatalf("Expected the second database to survive the rewrite, Got: %q", got)
+	}
+}
+
+func TestAppendOnlyTruncatedTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	complete := string(appendRESPCommand(nil, "SET", "a", "1"))
+	partial := string(appendRESPCommand(nil, "SET", "b", "2"))
+	partial = partial[:len(partial)-4]
+	os.WriteFile(path, []byte(complete+partial), 0644)
+
+	aofLoadTruncated = false
+	if err := loadAppendOnlyFile(path, newDatabases(1)); err == nil {
+		t.Fatalf("Expected a truncated file to be refused")
+	}
+	aofLoadTruncated = true
+	loaded := replayAppendOnly(t, path, 1)
+	if got := loaded[0].executeCommand([]string{"GET", "a"}); got != "1" {
+		t.Fatalf("Expected the complete command to be replayed, Got: %q", got)
+	}
+	if contents, _ := os.ReadFile(path); string(contents) != complete {
+		t.Fatalf("Expected the partial command to be cut off, Got: %q", contents)
+	}
+
+	os.WriteFile(path, []byte(complete+"garbage\r\n"), 0644)
+	if err := loadAppendOnlyFile(path, newDatabases(1)); err == nil {
+		t.Fatalf("Expected a corrupted file to be refused")
+	}
+}
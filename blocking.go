@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// Blocking commands such as BZPOPMIN park the client on a channel per key.
+// Commands that add elements call signalKeyReady, which wakes every client
+// waiting on that key so it can retry. Both sides run under kv.mu, so a
+// wakeup can never be missed between a failed attempt and the registration.
+
+// waitForKeys registers interest in keys and returns the channel that is
+// closed once any of them receives data. The caller must hold the write lock.
+func (kv *KeyValueStore) waitForKeys(keys []string) chan struct{} {
+	ready := make(chan struct{})
+	for _, key := range keys {
+		kv.blocked[key] = append(kv.blocked[key], ready)
+	}
+	return ready
+}
+
+// stopWaiting drops a registration made by waitForKeys.
+func (kv *KeyValueStore) stopWaiting(keys []string, ready chan struct{}) {
+	for _, key := range keys {
+		waiters := kv.blocked[key]
+		for i, ch := range waiters {
+			if ch == ready {
+				waiters = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(waiters) == 0 {
+			delete(kv.blocked, key)
+		} else {
+			kv.blocked[key] = waiters
+		}
+	}
+}
+
+// signalKeyReady wakes up the clients blocked on key. The caller must hold
+// the write lock.
+func (kv *KeyValueStore) signalKeyReady(key string) {
+	waiters, exists := kv.blocked[key]
+	if !exists {
+		return
+	}
+	delete(kv.blocked, key)
+	for _, ready := range waiters {
+		select {
+		case <-ready:
+		default:
+			close(ready)
+		}
+	}
+}
+
+// parseBlockingTimeout parses a timeout in seconds, where 0 means forever.
+func parseBlockingTimeout(s string) (time.Duration, string) {
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, "ERR timeout is not a float or out of range"
+	}
+	if seconds < 0 {
+		return 0, "ERR timeout is negative"
+	}
+	return time.Duration(seconds * float64(time.Second)), ""
+}
+
+// blockUntil calls attempt under the write lock until it reports success or
+// the timeout expires, sleeping on keys in between. It returns the reply of
+// the successful attempt, or "(nil)" on timeout. The caller must hold
+// propagateMu, which is released while sleeping.
+func (kv *KeyValueStore) blockUntil(keys []string, timeout time.Duration, attempt func() (string, bool)) string {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	var ready chan struct{}
+	for {
+		kv.mu.Lock()
+		if ready != nil {
+			kv.stopWaiting(keys, ready)
+		}
+		// A snapshot may have started while sleeping
+		kv.preserveKeys(keys...)
+		if reply, ok := attempt(); ok {
+			kv.mu.Unlock()
+			return reply
+		}
+		ready = kv.waitForKeys(keys)
+		kv.mu.Unlock()
+
+		// Let other write commands run, and be propagated, while waiting
+		propagateMu.Unlock()
+		select {
+		case <-ready:
+			propagateMu.Lock()
+		case <-deadline:
+			propagateMu.Lock()
+			kv.mu.Lock()
+			kv.stopWaiting(keys, ready)
+			kv.mu.Unlock()
+			return "(nil)"
+		}
+	}
+}
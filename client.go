@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dhravya/radish/redisproto"
+)
+
+// redisError is an error reply sent by the other side, as opposed to a
+// network or protocol failure.
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// redisClient is a minimal synchronous RESP client, used when one instance
+// has to talk to another, e.g. for MIGRATE.
+type redisClient struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writer  *redisproto.Writer
+	timeout time.Duration
+}
+
+func dialRedis(addr string, timeout time.Duration) (*redisClient, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &redisClient{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		writer:  redisproto.NewWriter(bufio.NewWriter(conn)),
+		timeout: timeout,
+	}, nil
+}
+
+func (c *redisClient) Close() error {
+	return c.conn.Close()
+}
+
+// Do sends a command and returns its reply. Arrays are flattened into a
+// space separated string, like the replies of this server.
+func (c *redisClient) Do(args ...string) (string, error) {
+	if c.timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	if err := c.writer.WriteBulkStrings(args); err != nil {
+		return "", err
+	}
+	if err := c.writer.Flush(); err != nil {
+		return "", err
+	}
+	return c.readReply()
+}
+
+func (c *redisClient) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		return "", errors.New("protocol error: missing CRLF")
+	}
+	return line[:len(line)-2], nil
+}
+
+func (c *redisClient) readReply() (string, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return "", err
+	}
+	if line == "" {
+		return "", errors.New("protocol error: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return "", redisError(line[1:])
+	case ':':
+		return "(integer) " + line[1:], nil
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", fmt.Errorf("protocol error: bad bulk length %q", line[1:])
+		}
+		if n < 0 {
+			return "(nil)", nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, buf); err != nil {
+			return "", err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", fmt.Errorf("protocol error: bad array length %q", line[1:])
+		}
+		if n < 0 {
+			return "(nil)", nil
+		}
+		elements := make([]string, 0, n)
+		for i := 0; i < n; i++ {
+			element, err := c.readReply()
+			if err != nil {
+				return "", err
+			}
+			elements = append(elements, element)
+		}
+		return strings.Join(elements, " "), nil
+	}
+	return "", fmt.Errorf("protocol error: unexpected reply type %q", line[0])
+}
+
+// expectOK runs a command that should reply OK. This server sends its errors
+// as bulk strings, so any other reply counts as an error.
+func (c *redisClient) expectOK(args ...string) error {
+	reply, err := c.Do(args...)
+	if err != nil {
+		return err
+	}
+	if reply != "OK" {
+		return redisError(reply)
+	}
+	return nil
+}
+
+// serverLink is a connection to another server, dialed when needed and
+// authenticated with auth if it isn't empty.
+type serverLink struct {
+	addr   string
+	auth   string
+	mu     sync.Mutex
+	client *redisClient
+}
+
+// do sends a command and returns its reply. Any failure other than an error
+// reply drops the connection, so the next command dials again.
+func (l *serverLink) do(timeout time.Duration, args ...string) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.client == nil {
+		c, err := dialRedis(l.addr, timeout)
+		if err != nil {
+			return "", err
+		}
+		if l.auth != "" {
+			if err := c.expectOK("AUTH", l.auth); err != nil {
+				c.Close()
+				return "", err
+			}
+		}
+		l.client = c
+	}
+	reply, err := l.client.Do(args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		l.client.Close()
+		l.client = nil
+	}
+	return reply, err
+}
+
+func (l *serverLink) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.client != nil {
+		l.client.Close()
+		l.client = nil
+	}
+}
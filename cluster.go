@@ -0,0 +1,1245 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dhravya/radish/redisproto"
+)
+
+// Cluster mode (-cluster-enabled) shards the keyspace over several servers
+// like Redis Cluster. Every key belongs to one of 16384 hash slots, the CRC16
+// of the key or of its {hashtag} modulo 16384, and every slot to one node.
+// A node that gets a command for keys of a slot it doesn't serve replies
+// MOVED with the address of the node that does, so cluster-aware clients
+// learn where slots are and go there directly. Keys of one command must be
+// in one slot, or the command fails with CROSSSLOT.
+//
+// Nodes talk over a cluster bus on their port + 10000, where they ping each
+// other and gossip: every ping carries the slots of its sender with their
+// configuration epoch, and a few other nodes it knows about, so nodes met
+// with CLUSTER MEET get to know the whole cluster. A claim of a slot with a
+// higher epoch wins. A node that doesn't answer pings for node-timeout is
+// suspected to fail (PFAIL), and once a majority of the nodes serving slots
+// suspect it, it is failed (FAIL) everywhere and the cluster goes down until
+// it is back, since its slots aren't served anymore.
+//
+// To move a slot, it is set IMPORTING on the node it goes to and MIGRATING
+// on the one it leaves, and its keys are moved with MIGRATE. Meanwhile, the
+// node it leaves answers for the keys it still has, and replies ASK for the
+// others, for the client to send ASKING and the command to the other node.
+// CLUSTER SETSLOT NODE then gives the slot to its new node. The configuration
+// of a node is kept in its cluster config file.
+
+const (
+	clusterSlots         = 16384
+	clusterBusPortOffset = 10000
+	clusterCronPeriod    = 100 * time.Millisecond
+	// clusterGossipEntries is how many other nodes a ping tells about,
+	// besides the ones suspected to fail
+	clusterGossipEntries = 3
+	// clusterForgetTime is how long a forgotten node isn't added back from
+	// gossip
+	clusterForgetTime = time.Minute
+)
+
+type clusterNode struct {
+	id      string
+	ip      string
+	port    int
+	busPort int
+	myself  bool
+	// handshake is set on a node met with CLUSTER MEET, under a made up id,
+	// until it answers with its own
+	handshake   bool
+	pfail       bool
+	fail        bool
+	configEpoch int64
+	link        *serverLink
+	// pinging is set while a ping is on its way, sent at pingSent
+	pinging      bool
+	pingSent     time.Time
+	pongReceived time.Time
+	addedAt      time.Time
+	// failReports maps the nodes that gossiped it is failing to when they
+	// last did
+	failReports map[string]time.Time
+}
+
+func newClusterNode(id, ip string, port, busPort int) *clusterNode {
+	now := time.Now()
+	node := &clusterNode{id: id, ip: ip, port: port, busPort: busPort, addedAt: now, pongReceived: now, failReports: make(map[string]time.Time)}
+	node.link = &serverLink{addr: node.busAddr()}
+	return node
+}
+
+func (node *clusterNode) addr() string {
+	return net.JoinHostPort(node.ip, strconv.Itoa(node.port))
+}
+
+func (node *clusterNode) busAddr() string {
+	return net.JoinHostPort(node.ip, strconv.Itoa(node.busPort))
+}
+
+// flags describes the node the way CLUSTER NODES does.
+func (node *clusterNode) flags() string {
+	var flags []string
+	if node.myself {
+		flags = append(flags, "myself")
+	}
+	flags = append(flags, "master")
+	switch {
+	case node.fail:
+		flags = append(flags, "fail")
+	case node.pfail:
+		flags = append(flags, "fail?")
+	}
+	if node.handshake {
+		flags = append(flags, "handshake")
+	}
+	return strings.Join(flags, ",")
+}
+
+type clusterState struct {
+	mu     sync.Mutex
+	kv     *KeyValueStore
+	myself *clusterNode
+	nodes  map[string]*clusterNode
+	// slots are the nodes serving each slot, nil when none does, and
+	// importing and migrating the nodes a slot is moved from or to
+	slots        [clusterSlots]*clusterNode
+	importing    [clusterSlots]*clusterNode
+	migrating    [clusterSlots]*clusterNode
+	currentEpoch int64
+	nodeTimeout  time.Duration
+	configFile   string
+	// forgotten maps the nodes removed with CLUSTER FORGET to until when
+	// they aren't added back
+	forgotten map[string]time.Time
+	stop      chan struct{}
+	stopped   bool
+}
+
+// cluster is the cluster state of this server in cluster mode, nil
+// otherwise.
+var cluster *clusterState
+
+// newClusterState loads the configuration of the node from configFile, or
+// makes up a new node when there is none. kv is the database the node
+// serves, the only one in cluster mode. An empty ip is learned from the
+// first node that pings this one.
+func newClusterState(kv *KeyValueStore, ip string, port, busPort int, nodeTimeout time.Duration, configFile string) (*clusterState, error) {
+	c := &clusterState{
+		kv:          kv,
+		nodes:       make(map[string]*clusterNode),
+		nodeTimeout: nodeTimeout,
+		configFile:  configFile,
+		forgotten:   make(map[string]time.Time),
+		stop:        make(chan struct{}),
+	}
+	if err := c.loadConfig(); err != nil {
+		return nil, err
+	}
+	if c.myself == nil {
+		c.myself = newClusterNode(newReplID(), ip, port, busPort)
+		c.myself.myself = true
+		c.nodes[c.myself.id] = c.myself
+		log.Printf("No cluster configuration found, I'm %s", c.myself.id)
+	}
+	c.myself.port, c.myself.busPort = port, busPort
+	if ip != "" {
+		c.myself.ip = ip
+	}
+	if err := c.saveConfig(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *clusterState) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		return
+	}
+	c.stopped = true
+	close(c.stop)
+	for _, node := range c.nodes {
+		node.link.close()
+	}
+}
+
+// run pings the other nodes and checks them until the state is closed.
+func (c *clusterState) run() {
+	ticker := time.NewTicker(clusterCronPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+		c.cron()
+	}
+}
+
+// pingInterval is how often every other node is pinged.
+func (c *clusterState) pingInterval() time.Duration {
+	return min(c.nodeTimeout/4, time.Second)
+}
+
+func (c *clusterState) cron() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for id, node := range c.nodes {
+		if node.myself {
+			continue
+		}
+		if node.handshake && now.Sub(node.addedAt) > c.nodeTimeout {
+			log.Printf("Cluster handshake with %s timed out", node.busAddr())
+			c.removeNode(id)
+			continue
+		}
+		for reporter, at := range node.failReports {
+			if now.Sub(at) > 2*c.nodeTimeout {
+				delete(node.failReports, reporter)
+			}
+		}
+		if !node.pinging && now.Sub(node.pingSent) >= c.pingInterval() {
+			node.pinging, node.pingSent = true, now
+			go c.ping(node)
+		}
+		if !node.handshake && !node.pfail && now.Sub(node.pongReceived) > c.nodeTimeout {
+			log.Printf("Cluster node %s is not answering, marking it as possibly failing", id)
+			node.pfail = true
+		}
+		if node.pfail && !node.fail {
+			c.markFailing(node)
+		}
+	}
+	for id, until := range c.forgotten {
+		if now.After(until) {
+			delete(c.forgotten, id)
+		}
+	}
+}
+
+// removeNode drops a node and whatever it served. The caller must hold
+// c.mu.
+func (c *clusterState) removeNode(id string) {
+	node := c.nodes[id]
+	delete(c.nodes, id)
+	node.link.close()
+	for slot := range c.slots {
+		if c.slots[slot] == node {
+			c.slots[slot] = nil
+		}
+		if c.importing[slot] == node {
+			c.importing[slot] = nil
+		}
+		if c.migrating[slot] == node {
+			c.migrating[slot] = nil
+		}
+	}
+	for _, other := range c.nodes {
+		delete(other.failReports, id)
+	}
+}
+
+// bumpConfigEpoch moves this node to an epoch above any it knows of. The
+// caller must hold c.mu.
+func (c *clusterState) bumpConfigEpoch() {
+	for _, node := range c.nodes {
+		c.currentEpoch = max(c.currentEpoch, node.configEpoch)
+	}
+	c.currentEpoch++
+	c.myself.configEpoch = c.currentEpoch
+}
+
+// slotCounts returns how many slots each node serves. The caller must hold
+// c.mu.
+func (c *clusterState) slotCounts() map[*clusterNode]int {
+	counts := make(map[*clusterNode]int)
+	for _, node := range c.slots {
+		if node != nil {
+			counts[node]++
+		}
+	}
+	return counts
+}
+
+// markFailing fails a node suspected to fail once a majority of the nodes
+// serving slots suspect it too, and tells every other node. The caller
+// must hold c.mu.
+func (c *clusterState) markFailing(node *clusterNode) {
+	counts := c.slotCounts()
+	reports := 0
+	if counts[c.myself] > 0 {
+		reports++
+	}
+	for reporter := range node.failReports {
+		if other := c.nodes[reporter]; other != nil && counts[other] > 0 {
+			reports++
+		}
+	}
+	if reports < len(counts)/2+1 {
+		return
+	}
+	log.Printf("Marking cluster node %s as failing (quorum reached)", node.id)
+	node.fail = true
+	for _, other := range c.nodes {
+		if !other.myself && !other.handshake && other != node {
+			go other.link.do(c.nodeTimeout, "CLUSTERBUS", "FAIL", c.myself.id, node.id)
+		}
+	}
+}
+
+// message returns a bus message of kind: the header describing this node,
+// then gossip about other nodes. The caller must hold c.mu.
+func (c *clusterState) message(kind string) []string {
+	args := append([]string{"CLUSTERBUS", kind}, c.header()...)
+	others := make([]*clusterNode, 0, len(c.nodes))
+	for _, node := range c.nodes {
+		if !node.myself && !node.handshake {
+			others = append(others, node)
+		}
+	}
+	rand.Shuffle(len(others), func(i, j int) { others[i], others[j] = others[j], others[i] })
+	for i, node := range others {
+		if i < clusterGossipEntries || node.pfail || node.fail {
+			args = append(args, node.id, node.ip, strconv.Itoa(node.port), strconv.Itoa(node.busPort), node.flags())
+		}
+	}
+	return args
+}
+
+// header describes this node: its id, address, epochs and slots. The
+// caller must hold c.mu.
+func (c *clusterState) header() []string {
+	ip := c.myself.ip
+	if ip == "" {
+		ip = "-"
+	}
+	slots := formatSlotRanges(c.slotRanges(c.myself), ",")
+	if slots == "" {
+		slots = "-"
+	}
+	return []string{c.myself.id, ip, strconv.Itoa(c.myself.port), strconv.Itoa(c.myself.busPort),
+		strconv.FormatInt(c.currentEpoch, 10), strconv.FormatInt(c.myself.configEpoch, 10), slots}
+}
+
+// clusterHeader is the header of a bus message, as sent by header.
+type clusterHeader struct {
+	id           string
+	ip           string
+	port         int
+	busPort      int
+	currentEpoch int64
+	configEpoch  int64
+	slots        [][2]int
+	gossip       []clusterGossip
+}
+
+type clusterGossip struct {
+	id      string
+	ip      string
+	port    int
+	busPort int
+	flags   string
+}
+
+func parseClusterHeader(fields []string) (clusterHeader, error) {
+	if len(fields) < 7 || (len(fields)-7)%5 != 0 {
+		return clusterHeader{}, errors.New("bad cluster bus message")
+	}
+	h := clusterHeader{id: fields[0], ip: fields[1]}
+	var errs [5]error
+	h.port, errs[0] = strconv.Atoi(fields[2])
+	h.busPort, errs[1] = strconv.Atoi(fields[3])
+	h.currentEpoch, errs[2] = strconv.ParseInt(fields[4], 10, 64)
+	h.configEpoch, errs[3] = strconv.ParseInt(fields[5], 10, 64)
+	if fields[6] != "-" {
+		h.slots, errs[4] = parseSlotRanges(strings.Split(fields[6], ","))
+	}
+	if err := errors.Join(errs[:]...); err != nil {
+		return clusterHeader{}, fmt.Errorf("bad cluster bus message: %w", err)
+	}
+	for i := 7; i < len(fields); i += 5 {
+		port, err1 := strconv.Atoi(fields[i+2])
+		busPort, err2 := strconv.Atoi(fields[i+3])
+		if err1 != nil || err2 != nil {
+			return clusterHeader{}, errors.New("bad cluster bus gossip")
+		}
+		h.gossip = append(h.gossip, clusterGossip{fields[i], fields[i+1], port, busPort, fields[i+4]})
+	}
+	return h, nil
+}
+
+// ping sends a PING, or a MEET to a node in handshake, and takes in the
+// PONG it answers with.
+func (c *clusterState) ping(node *clusterNode) {
+	c.mu.Lock()
+	kind := "PING"
+	if node.handshake {
+		kind = "MEET"
+	}
+	args := c.message(kind)
+	link := node.link
+	c.mu.Unlock()
+
+	reply, err := link.do(c.nodeTimeout, args...)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	node.pinging = false
+	fields := strings.Fields(reply)
+	if err != nil || c.stopped || c.nodes[node.id] != node || len(fields) == 0 || fields[0] != "PONG" {
+		return
+	}
+	h, err := parseClusterHeader(fields[1:])
+	if err != nil {
+		log.Printf("Error from cluster node %s: %v", node.busAddr(), err)
+		return
+	}
+	if node.handshake {
+		// Now that it said who it is, the node is known by its id
+		delete(c.nodes, node.id)
+		if h.id == c.myself.id || c.nodes[h.id] != nil {
+			node.link.close()
+			return
+		}
+		log.Printf("Cluster handshake with %s done, it is %s", node.busAddr(), h.id)
+		node.id, node.handshake = h.id, false
+		c.nodes[node.id] = node
+	}
+	node.pongReceived = time.Now()
+	node.pfail = false
+	if node.fail {
+		log.Printf("Clearing the failing state of cluster node %s, it is reachable again", node.id)
+		node.fail = false
+	}
+	c.processHeader(node, h, node.ip)
+}
+
+// processHeader takes in what a known node says about itself and others.
+// The caller must hold c.mu.
+func (c *clusterState) processHeader(sender *clusterNode, h clusterHeader, remoteIP string) {
+	changed := false
+	ip := h.ip
+	if ip == "-" {
+		ip = remoteIP
+	}
+	if sender.ip != ip || sender.port != h.port || sender.busPort != h.busPort {
+		sender.ip, sender.port, sender.busPort = ip, h.port, h.busPort
+		sender.link.close()
+		sender.link = &serverLink{addr: sender.busAddr()}
+		changed = true
+	}
+	if h.currentEpoch > c.currentEpoch {
+		c.currentEpoch = h.currentEpoch
+		changed = true
+	}
+	if sender.configEpoch != h.configEpoch {
+		sender.configEpoch = h.configEpoch
+		changed = true
+	}
+	for _, r := range h.slots {
+		for slot := r[0]; slot <= r[1]; slot++ {
+			owner := c.slots[slot]
+			if owner == sender || c.importing[slot] != nil || owner != nil && owner.configEpoch >= h.configEpoch {
+				continue
+			}
+			if owner == c.myself {
+				log.Printf("Cluster slot %d was taken over by %s", slot, sender.id)
+				c.migrating[slot] = nil
+			}
+			c.slots[slot] = sender
+			changed = true
+		}
+	}
+	// Two nodes must not serve slots in the same epoch, or neither claim
+	// would win: the one with the lower id moves to a new epoch
+	if h.configEpoch == c.myself.configEpoch && c.myself.id < sender.id {
+		c.bumpConfigEpoch()
+		changed = true
+	}
+
+	counts := c.slotCounts()
+	now := time.Now()
+	for _, g := range h.gossip {
+		if g.id == c.myself.id {
+			continue
+		}
+		node := c.nodes[g.id]
+		if node == nil {
+			if _, forgotten := c.forgotten[g.id]; !forgotten && !strings.Contains(g.flags, "handshake") {
+				log.Printf("Cluster node %s learned about from %s", g.id, sender.id)
+				c.nodes[g.id] = newClusterNode(g.id, g.ip, g.port, g.busPort)
+				changed = true
+			}
+			continue
+		}
+		if counts[sender] == 0 {
+			continue
+		}
+		if strings.Contains(g.flags, "fail") {
+			node.failReports[sender.id] = now
+		} else {
+			delete(node.failReports, sender.id)
+		}
+	}
+	if changed {
+		c.saveConfigLogged()
+	}
+}
+
+// busMessage handles a message of another node on the bus, where remoteIP
+// is the address it comes from and localIP the one it reached this node at.
+func (c *clusterState) busMessage(parts []string, remoteIP, localIP string) string {
+	if len(parts) < 2 {
+		return "ERR wrong number of arguments for 'clusterbus' command"
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		return "ERR cluster node is shutting down"
+	}
+	switch kind := strings.ToUpper(parts[1]); kind {
+	case "PING", "MEET":
+		h, err := parseClusterHeader(parts[2:])
+		if err != nil {
+			return "ERR " + err.Error()
+		}
+		if c.myself.ip == "" {
+			c.myself.ip = localIP
+			log.Printf("Cluster IP address for this node updated to %s", localIP)
+		}
+		sender := c.nodes[h.id]
+		if sender == nil && kind == "MEET" && h.id != c.myself.id {
+			ip := h.ip
+			if ip == "-" {
+				ip = remoteIP
+			}
+			sender = newClusterNode(h.id, ip, h.port, h.busPort)
+			c.nodes[h.id] = sender
+		}
+		// Nodes not known yet are answered, but only believed once another
+		// node vouches for them in its gossip
+		if sender != nil && !sender.handshake {
+			c.processHeader(sender, h, remoteIP)
+		}
+		return strings.Join(append([]string{"PONG"}, c.message("PONG")[2:]...), " ")
+	case "FAIL":
+		if len(parts) != 4 {
+			return "ERR wrong number of arguments for 'clusterbus fail' command"
+		}
+		if node := c.nodes[parts[3]]; node != nil && !node.myself && !node.fail && c.nodes[parts[2]] != nil {
+			log.Printf("FAIL message received from %s about %s", parts[2], parts[3])
+			node.fail = true
+		}
+		return "OK"
+	}
+	return fmt.Sprintf("ERR unknown cluster bus message '%s'", parts[1])
+}
+
+// serveBus answers the other nodes on the cluster bus.
+func (c *clusterState) serveBus(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go c.handleBusConnection(conn)
+	}
+}
+
+func (c *clusterState) handleBusConnection(conn net.Conn) {
+	defer conn.Close()
+	parser := redisproto.NewParser(conn)
+	writer := redisproto.NewWriter(bufio.NewWriter(conn))
+	remoteIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	localIP, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	for {
+		command, err := parser.ReadCommand()
+		if err != nil {
+			return
+		}
+		parts := commandParts(command)
+		response := "ERR this is the cluster bus port, only other nodes talk here"
+		if strings.EqualFold(parts[0], "CLUSTERBUS") {
+			response = c.busMessage(parts, remoteIP, localIP)
+		}
+		if writer.WriteBulkString(response) != nil || command.IsLast() && writer.Flush() != nil {
+			return
+		}
+	}
+}
+
+// stateLocked reports whether every slot is served by a node that isn't
+// failing, as "ok" or "fail". The caller must hold c.mu.
+func (c *clusterState) stateLocked() string {
+	for _, node := range c.slots {
+		if node == nil || node.fail {
+			return "fail"
+		}
+	}
+	return "ok"
+}
+
+// redirect checks that the keys of a command are served here. It returns
+// the error that sends the client elsewhere, or "". asking is whether the
+// client sent ASKING right before.
+func (c *clusterState) redirect(parts []string, asking bool) string {
+	keys := commandKeys(parts)
+	if len(keys) == 0 {
+		return ""
+	}
+	slot := keyHashSlot(keys[0])
+	for _, key := range keys[1:] {
+		if keyHashSlot(key) != slot {
+			return "CROSSSLOT Keys in request don't hash to the same slot"
+		}
+	}
+	c.mu.Lock()
+	owner, importing, migrating := c.slots[slot], c.importing[slot], c.migrating[slot]
+	state := c.stateLocked()
+	c.mu.Unlock()
+	switch {
+	case owner == nil:
+		return "CLUSTERDOWN Hash slot not served"
+	case state != "ok":
+		return "CLUSTERDOWN The cluster is down"
+	case owner == c.myself && migrating != nil:
+		// Keys that aren't here anymore may have been moved already
+		if missing := c.missingKeys(keys); missing == len(keys) {
+			return fmt.Sprintf("ASK %d %s", slot, migrating.addr())
+		} else if missing > 0 {
+			return "TRYAGAIN Multiple keys request during rehashing of slot"
+		}
+	case owner != c.myself && importing != nil && asking:
+		if len(keys) > 1 && c.missingKeys(keys) > 0 {
+			return "TRYAGAIN Multiple keys request during rehashing of slot"
+		}
+	case owner != c.myself:
+		return fmt.Sprintf("MOVED %d %s", slot, owner.addr())
+	}
+	return ""
+}
+
+// missingKeys counts the keys that don't exist here.
+func (c *clusterState) missingKeys(keys []string) int {
+	c.kv.mu.RLock()
+	defer c.kv.mu.RUnlock()
+	missing := 0
+	for _, key := range keys {
+		if !c.kv.keyExists(key) || c.kv.keyExpired(key) {
+			missing++
+		}
+	}
+	return missing
+}
+
+// keysInSlot returns the sorted keys of the slot, at most count of them
+// when count isn't negative.
+func (c *clusterState) keysInSlot(slot, count int) []string {
+	c.kv.mu.RLock()
+	defer c.kv.mu.RUnlock()
+	keys := make([]string, 0)
+	c.kv.eachKey(func(key string) {
+		if keyHashSlot(key) == slot {
+			keys = append(keys, key)
+		}
+	})
+	sort.Strings(keys)
+	if count >= 0 && len(keys) > count {
+		keys = keys[:count]
+	}
+	return keys
+}
+
+// slotRanges returns the ranges of slots a node serves. The caller must
+// hold c.mu.
+func (c *clusterState) slotRanges(node *clusterNode) [][2]int {
+	var ranges [][2]int
+	for slot := 0; slot < clusterSlots; slot++ {
+		if c.slots[slot] != node {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1][1] == slot-1 {
+			ranges[n-1][1] = slot
+		} else {
+			ranges = append(ranges, [2]int{slot, slot})
+		}
+	}
+	return ranges
+}
+
+// formatSlotRanges writes ranges like CLUSTER NODES does, "0-5460" or
+// "5461" for a single slot.
+func formatSlotRanges(ranges [][2]int, sep string) string {
+	list := make([]string, len(ranges))
+	for i, r := range ranges {
+		list[i] = strconv.Itoa(r[0])
+		if r[1] != r[0] {
+			list[i] += "-" + strconv.Itoa(r[1])
+		}
+	}
+	return strings.Join(list, sep)
+}
+
+func parseSlotRanges(list []string) ([][2]int, error) {
+	ranges := make([][2]int, 0, len(list))
+	for _, s := range list {
+		first, last, isRange := strings.Cut(s, "-")
+		if !isRange {
+			last = first
+		}
+		start, err1 := parseSlot(first)
+		end, err2 := parseSlot(last)
+		if err1 != nil || err2 != nil || start > end {
+			return nil, fmt.Errorf("bad slot range %q", s)
+		}
+		ranges = append(ranges, [2]int{start, end})
+	}
+	return ranges, nil
+}
+
+func parseSlot(s string) (int, error) {
+	slot, err := strconv.Atoi(s)
+	if err != nil || slot < 0 || slot >= clusterSlots {
+		return 0, errors.New("Invalid or out of range slot")
+	}
+	return slot, nil
+}
+
+// nodeLine describes a node for CLUSTER NODES and the config file. The
+// caller must hold c.mu.
+func (c *clusterState) nodeLine(node *clusterNode) string {
+	pingSent, pongReceived := int64(0), int64(0)
+	if !node.myself {
+		if node.pinging {
+			pingSent = node.pingSent.UnixMilli()
+		}
+		pongReceived = node.pongReceived.UnixMilli()
+	}
+	linkState := "connected"
+	if node.pfail || node.fail {
+		linkState = "disconnected"
+	}
+	line := fmt.Sprintf("%s %s:%d@%d %s - %d %d %d %s", node.id, node.ip, node.port, node.busPort,
+		node.flags(), pingSent, pongReceived, node.configEpoch, linkState)
+	if slots := formatSlotRanges(c.slotRanges(node), " "); slots != "" {
+		line += " " + slots
+	}
+	if node.myself {
+		for slot := 0; slot < clusterSlots; slot++ {
+			if other := c.migrating[slot]; other != nil {
+				line += fmt.Sprintf(" [%d->-%s]", slot, other.id)
+			}
+			if other := c.importing[slot]; other != nil {
+				line += fmt.Sprintf(" [%d-<-%s]", slot, other.id)
+			}
+		}
+	}
+	return line
+}
+
+// nodeLines describes every node, ordered by id. The caller must hold c.mu.
+func (c *clusterState) nodeLines() []string {
+	ids := make([]string, 0, len(c.nodes))
+	for id := range c.nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	lines := make([]string, len(ids))
+	for i, id := range ids {
+		lines[i] = c.nodeLine(c.nodes[id])
+	}
+	return lines
+}
+
+// saveConfig writes the nodes the way CLUSTER NODES lists them, and the
+// current epoch. The caller must hold c.mu, or be the only user of c.
+func (c *clusterState) saveConfig() error {
+	var lines []string
+	for _, line := range c.nodeLines() {
+		if !strings.Contains(strings.Fields(line)[2], "handshake") {
+			lines = append(lines, line)
+		}
+	}
+	lines = append(lines, fmt.Sprintf("vars currentEpoch %d lastVoteEpoch 0", c.currentEpoch))
+	tmp, err := os.CreateTemp(filepath.Dir(c.configFile), filepath.Base(c.configFile)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.configFile)
+}
+
+func (c *clusterState) saveConfigLogged() {
+	if err := c.saveConfig(); err != nil {
+		log.Printf("Error saving the cluster config file: %v", err)
+	}
+}
+
+// loadConfig reads the config file written by saveConfig, if there is one.
+func (c *clusterState) loadConfig() error {
+	b, err := os.ReadFile(c.configFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	type slotMove struct {
+		slot      int
+		importing bool
+		node      string
+	}
+	var moves []slotMove
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[0] == "vars" {
+			for i := 1; i+1 < len(fields); i += 2 {
+				if fields[i] == "currentEpoch" {
+					c.currentEpoch, _ = strconv.ParseInt(fields[i+1], 10, 64)
+				}
+			}
+			continue
+		}
+		if len(fields) < 8 {
+			return fmt.Errorf("bad cluster config line %q", line)
+		}
+		addr, busPort, _ := strings.Cut(fields[1], "@")
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("bad cluster config line %q: %w", line, err)
+		}
+		portNumber, err1 := strconv.Atoi(port)
+		busPortNumber, err2 := strconv.Atoi(busPort)
+		if err1 != nil || err2 != nil {
+			return fmt.Errorf("bad cluster config line %q", line)
+		}
+		node := newClusterNode(fields[0], host, portNumber, busPortNumber)
+		node.configEpoch, _ = strconv.ParseInt(fields[6], 10, 64)
+		if strings.Contains(fields[2], "myself") {
+			node.myself = true
+			c.myself = node
+		}
+		c.nodes[node.id] = node
+		for _, s := range fields[8:] {
+			if strings.HasPrefix(s, "[") {
+				slot, other, importing := strings.Cut(strings.Trim(s, "[]"), "-<-")
+				if !importing {
+					slot, other, _ = strings.Cut(strings.Trim(s, "[]"), "->-")
+				}
+				n, err := parseSlot(slot)
+				if err != nil {
+					return fmt.Errorf("bad cluster config line %q", line)
+				}
+				moves = append(moves, slotMove{n, importing, other})
+				continue
+			}
+			ranges, err := parseSlotRanges([]string{s})
+			if err != nil {
+				return fmt.Errorf("bad cluster config line %q: %w", line, err)
+			}
+			for slot := ranges[0][0]; slot <= ranges[0][1]; slot++ {
+				c.slots[slot] = node
+			}
+		}
+	}
+	if c.myself == nil {
+		return errors.New("cluster config file without myself")
+	}
+	for _, m := range moves {
+		if m.importing {
+			c.importing[m.slot] = c.nodes[m.node]
+		} else {
+			c.migrating[m.slot] = c.nodes[m.node]
+		}
+	}
+	return nil
+}
+
+// info returns the lines of CLUSTER INFO.
+func (c *clusterState) info() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	assigned, ok, pfail, fail := 0, 0, 0, 0
+	for _, node := range c.slots {
+		switch {
+		case node == nil:
+			continue
+		case node.fail:
+			fail++
+		case node.pfail:
+			pfail++
+		default:
+			ok++
+		}
+		assigned++
+	}
+	known := 0
+	for _, node := range c.nodes {
+		if !node.handshake {
+			known++
+		}
+	}
+	var b strings.Builder
+	b.WriteString("cluster_enabled:1\r\n")
+	b.WriteString(fmt.Sprintf("cluster_state:%s\r\n", c.stateLocked()))
+	b.WriteString(fmt.Sprintf("cluster_slots_assigned:%d\r\n", assigned))
+	b.WriteString(fmt.Sprintf("cluster_slots_ok:%d\r\n", ok))
+	b.WriteString(fmt.Sprintf("cluster_slots_pfail:%d\r\n", pfail))
+	b.WriteString(fmt.Sprintf("cluster_slots_fail:%d\r\n", fail))
+	b.WriteString(fmt.Sprintf("cluster_known_nodes:%d\r\n", known))
+	b.WriteString(fmt.Sprintf("cluster_size:%d\r\n", len(c.slotCounts())))
+	b.WriteString(fmt.Sprintf("cluster_current_epoch:%d\r\n", c.currentEpoch))
+	b.WriteString(fmt.Sprintf("cluster_my_epoch:%d\r\n", c.myself.configEpoch))
+	return b.String()
+}
+
+// slotsReply lists the slot ranges for CLUSTER SLOTS, one per line as start,
+// end and the ip, port and id of the node serving them.
+func (c *clusterState) slotsReply() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var lines []string
+	for slot := 0; slot < clusterSlots; {
+		node := c.slots[slot]
+		end := slot
+		for end+1 < clusterSlots && c.slots[end+1] == node {
+			end++
+		}
+		if node != nil {
+			lines = append(lines, fmt.Sprintf("%d %d %s %d %s", slot, end, node.ip, node.port, node.id))
+		}
+		slot = end + 1
+	}
+	if len(lines) == 0 {
+		return "(empty array)"
+	}
+	return strings.Join(lines, "\n")
+}
+
+// shardsReply describes every node as a shard for CLUSTER SHARDS, one per
+// line.
+func (c *clusterState) shardsReply() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var lines []string
+	for _, id := range sortedKeys(c.nodes) {
+		node := c.nodes[id]
+		if node.handshake {
+			continue
+		}
+		health := "online"
+		if node.fail || node.pfail {
+			health = "fail"
+		}
+		line := []string{"slots"}
+		for _, r := range c.slotRanges(node) {
+			line = append(line, strconv.Itoa(r[0]), strconv.Itoa(r[1]))
+		}
+		line = append(line, "nodes", fmt.Sprintf("id %s port %d ip %s endpoint %s role master replication-offset 0 health %s",
+			node.id, node.port, node.ip, node.ip, health))
+		lines = append(lines, strings.Join(line, " "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// parseSlotArgs parses the slots of ADDSLOTS and DELSLOTS, or the ranges of
+// ADDSLOTSRANGE and DELSLOTSRANGE.
+func parseSlotArgs(args []string, ranges bool) ([]int, string) {
+	if len(args) == 0 || ranges && len(args)%2 != 0 {
+		return nil, ""
+	}
+	var slots []int
+	seen := make(map[int]bool)
+	step := 1
+	if ranges {
+		step = 2
+	}
+	for i := 0; i < len(args); i += step {
+		start, err := parseSlot(args[i])
+		end := start
+		if err == nil && ranges {
+			end, err = parseSlot(args[i+1])
+		}
+		if err != nil {
+			return nil, "ERR Invalid or out of range slot"
+		}
+		if start > end {
+			return nil, fmt.Sprintf("ERR start slot number %d is greater than end slot number %d", start, end)
+		}
+		for slot := start; slot <= end; slot++ {
+			if seen[slot] {
+				return nil, fmt.Sprintf("ERR Slot %d specified multiple times", slot)
+			}
+			seen[slot] = true
+			slots = append(slots, slot)
+		}
+	}
+	return slots, ""
+}
+
+// setSlot implements CLUSTER SETSLOT slot IMPORTING|MIGRATING|NODE id and
+// CLUSTER SETSLOT slot STABLE. The caller must hold c.mu.
+func (c *clusterState) setSlot(parts []string) string {
+	slot, err := parseSlot(parts[2])
+	if err != nil {
+		return "ERR " + err.Error()
+	}
+	action := strings.ToUpper(parts[3])
+	if action == "STABLE" && len(parts) == 4 {
+		c.importing[slot], c.migrating[slot] = nil, nil
+		c.saveConfigLogged()
+		return "OK"
+	}
+	if len(parts) != 5 || action != "IMPORTING" && action != "MIGRATING" && action != "NODE" {
+		return "ERR Invalid CLUSTER SETSLOT action or number of arguments"
+	}
+	node := c.nodes[parts[4]]
+	if node == nil || node.handshake {
+		return "ERR I don't know about node " + parts[4]
+	}
+	switch action {
+	case "IMPORTING":
+		if c.slots[slot] == c.myself {
+			return fmt.Sprintf("ERR I'm already the owner of hash slot %d", slot)
+		}
+		if node.myself {
+			return "ERR Target node is myself"
+		}
+		c.importing[slot] = node
+	case "MIGRATING":
+		if c.slots[slot] != c.myself {
+			return fmt.Sprintf("ERR I'm not the owner of hash slot %d", slot)
+		}
+		if node.myself {
+			return "ERR Target node is myself"
+		}
+		c.migrating[slot] = node
+	case "NODE":
+		if c.slots[slot] == c.myself && !node.myself && len(c.keysInSlot(slot, 1)) > 0 {
+			return fmt.Sprintf("ERR Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot)
+		}
+		if !node.myself {
+			c.migrating[slot] = nil
+		} else if c.importing[slot] != nil {
+			// The slot moved here: a new epoch makes the other nodes take
+			// this claim over the old one
+			c.importing[slot] = nil
+			c.bumpConfigEpoch()
+			log.Printf("Configuration epoch of this node set to %d after importing slot %d", c.currentEpoch, slot)
+		}
+		c.slots[slot] = node
+	}
+	c.saveConfigLogged()
+	return "OK"
+}
+
+// command implements the CLUSTER subcommands.
+func (c *clusterState) command(parts []string) string {
+	subcommand := strings.ToUpper(parts[1])
+	switch {
+	case subcommand == "INFO" && len(parts) == 2:
+		return c.info()
+	case subcommand == "MYID" && len(parts) == 2:
+		return c.myself.id
+	case subcommand == "NODES" && len(parts) == 2:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return strings.Join(c.nodeLines(), "\n")
+	case subcommand == "SLOTS" && len(parts) == 2:
+		return c.slotsReply()
+	case subcommand == "SHARDS" && len(parts) == 2:
+		return c.shardsReply()
+	case subcommand == "KEYSLOT" && len(parts) == 3:
+		return fmt.Sprintf("(integer) %d", keyHashSlot(parts[2]))
+	case subcommand == "COUNTKEYSINSLOT" && len(parts) == 3:
+		slot, err := parseSlot(parts[2])
+		if err != nil {
+			return "ERR " + err.Error()
+		}
+		return fmt.Sprintf("(integer) %d", len(c.keysInSlot(slot, -1)))
+	case subcommand == "GETKEYSINSLOT" && len(parts) == 4:
+		slot, err := parseSlot(parts[2])
+		if err != nil {
+			return "ERR " + err.Error()
+		}
+		count, err := strconv.Atoi(parts[3])
+		if err != nil || count < 0 {
+			return "ERR Invalid number of keys"
+		}
+		keys := c.keysInSlot(slot, count)
+		if len(keys) == 0 {
+			return "(empty array)"
+		}
+		return strings.Join(keys, " ")
+	case subcommand == "ADDSLOTS" || subcommand == "ADDSLOTSRANGE" || subcommand == "DELSLOTS" || subcommand == "DELSLOTSRANGE":
+		slots, errMsg := parseSlotArgs(parts[2:], strings.HasSuffix(subcommand, "RANGE"))
+		if errMsg != "" {
+			return errMsg
+		}
+		if slots == nil {
+			break
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		add := strings.HasPrefix(subcommand, "ADD")
+		for _, slot := range slots {
+			if add && c.slots[slot] != nil {
+				return fmt.Sprintf("ERR Slot %d is already busy", slot)
+			}
+			if !add && c.slots[slot] == nil {
+				return fmt.Sprintf("ERR Slot %d is already unassigned", slot)
+			}
+		}
+		for _, slot := range slots {
+			c.importing[slot] = nil
+			if add {
+				c.slots[slot] = c.myself
+			} else {
+				c.slots[slot], c.migrating[slot] = nil, nil
+			}
+		}
+		c.saveConfigLogged()
+		return "OK"
+	case subcommand == "SETSLOT" && len(parts) >= 4:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.setSlot(parts)
+	case subcommand == "MEET" && (len(parts) == 4 || len(parts) == 5):
+		port, err1 := strconv.Atoi(parts[3])
+		busPort := port + clusterBusPortOffset
+		var err2 error
+		if len(parts) == 5 {
+			busPort, err2 = strconv.Atoi(parts[4])
+		}
+		if err1 != nil || err2 != nil || net.ParseIP(parts[2]) == nil || port <= 0 || port > 65535 || busPort <= 0 || busPort > 65535 {
+			return fmt.Sprintf("ERR Invalid node address specified: %s:%s", parts[2], parts[3])
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		node := newClusterNode(newReplID(), parts[2], port, busPort)
+		node.handshake = true
+		c.nodes[node.id] = node
+		return "OK"
+	case subcommand == "FORGET" && len(parts) == 3:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		node := c.nodes[parts[2]]
+		switch {
+		case node == c.myself:
+			return "ERR I tried hard but I can't forget myself..."
+		case node == nil || node.handshake:
+			return "ERR Unknown node " + parts[2]
+		}
+		c.removeNode(node.id)
+		c.forgotten[node.id] = time.Now().Add(clusterForgetTime)
+		c.saveConfigLogged()
+		return "OK"
+	case subcommand == "COUNT-FAILURE-REPORTS" && len(parts) == 3:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		node := c.nodes[parts[2]]
+		if node == nil {
+			return "ERR Unknown node " + parts[2]
+		}
+		return fmt.Sprintf("(integer) %d", len(node.failReports))
+	case subcommand == "BUMPEPOCH" && len(parts) == 2:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		// The epoch only needs to go up when another node shares it
+		for _, node := range c.nodes {
+			if node != c.myself && node.configEpoch >= c.myself.configEpoch {
+				c.bumpConfigEpoch()
+				c.saveConfigLogged()
+				return fmt.Sprintf("BUMPED %d", c.myself.configEpoch)
+			}
+		}
+		return fmt.Sprintf("STILL %d", c.myself.configEpoch)
+	case subcommand == "SAVECONFIG" && len(parts) == 2:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if err := c.saveConfig(); err != nil {
+			return "ERR error saving the cluster node config: " + err.Error()
+		}
+		return "OK"
+	}
+	return fmt.Sprintf("ERR unknown subcommand or wrong number of arguments for '%s'", parts[1])
+}
+
+// ClusterCommand implements CLUSTER subcommand [argument ...].
+func ClusterCommand(parts []string) string {
+	if len(parts) < 2 {
+		return "ERR wrong number of arguments for 'cluster' command"
+	}
+	if cluster == nil {
+		return "ERR This instance has cluster support disabled"
+	}
+	return cluster.command(parts)
+}
+
+// clusterRedirect returns the error that sends a client elsewhere for the
+// command in parts, or "" when it runs here.
+func clusterRedirect(parts []string, asking bool) string {
+	if cluster == nil {
+		return ""
+	}
+	parts[0] = strings.ToUpper(parts[0])
+	return cluster.redirect(parts, asking)
+}
+
+// askingCommand implements ASKING, which lets the next command of the
+// client use a slot this node is importing.
+func askingCommand(parts []string) (string, bool) {
+	if len(parts) != 1 {
+		return "ERR wrong number of arguments for 'asking' command", false
+	}
+	if cluster == nil {
+		return "ERR This instance has cluster support disabled", false
+	}
+	return "OK", true
+}
+
+// clusterInfo returns the lines of the INFO cluster section.
+func clusterInfo() string {
+	if cluster == nil {
+		return "cluster_enabled:0\r\n"
+	}
+	return "cluster_enabled:1\r\n"
+}
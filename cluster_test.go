@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyHashSlot(t *testing.T) {
+	for key, expected := range map[string]int{
+		"123456789":            12739,
+		"foo":                  12182,
+		"bar":                  5061,
+		"{user1000}.following": keyHashSlot("user1000"),
+		"{user1000}.followers": keyHashSlot("user1000"),
+		"foo{bar}{zap}":        keyHashSlot("bar"),
+		"foo{{bar}}zap":        keyHashSlot("{bar"),
+		"foo{}{bar}":           int(crc16("foo{}{bar}")) % clusterSlots,
+	} {
+		if slot := keyHashSlot(key); slot != expected {
+			t.Errorf("Expected %q to be in slot %d, Got: %d", key, expected, slot)
+		}
+	}
+}
+
+// testClusterNode is a cluster node of the test process, serving its own
+// database, with a made up client port.
+type testClusterNode struct {
+	*clusterState
+	bus net.Listener
+}
+
+func (node *testClusterNode) kill() {
+	node.close()
+	node.bus.Close()
+}
+
+func startTestClusterNode(t *testing.T, port int, nodeTimeout time.Duration, configFile string) *testClusterNode {
+	t.Helper()
+	bus := listenTest(t, nil)
+	c, err := newClusterState(newDatabases(1)[0], "127.0.0.1", port, bus.Addr().(*net.TCPAddr).Port, nodeTimeout, configFile)
+	if err != nil {
+		t.Fatalf("Expected the cluster node to start, Got: %v", err)
+	}
+	go c.serveBus(bus)
+	go c.run()
+	t.Cleanup(c.close)
+	return &testClusterNode{c, bus}
+}
+
+// startTestCluster starts three nodes that share the slots, and waits until
+// they agree the cluster is ok.
+func startTestCluster(t *testing.T, nodeTimeout time.Duration) []*testClusterNode {
+	t.Helper()
+	nodes := make([]*testClusterNode, 3)
+	for i := range nodes {
+		nodes[i] = startTestClusterNode(t, 7000+i, nodeTimeout, filepath.Join(t.TempDir(), "nodes.conf"))
+	}
+	// The third node is only met through the second one
+	meet := func(from, to *testClusterNode) {
+		if reply := from.command([]string{"CLUSTER", "MEET", "127.0.0.1", fmt.Sprint(to.myself.port), fmt.Sprint(to.myself.busPort)}); reply != "OK" {
+			t.Fatalf("Expected CLUSTER MEET to succeed, Got: %q", reply)
+		}
+	}
+	meet(nodes[0], nodes[1])
+	meet(nodes[1], nodes[2])
+	for i, slots := range [][]string{{"0", "5460"}, {"5461", "10922"}, {"10923", "16383"}} {
+		if reply := nodes[i].command(append([]string{"CLUSTER", "ADDSLOTSRANGE"}, slots...)); reply != "OK" {
+			t.Fatalf("Expected CLUSTER ADDSLOTSRANGE to succeed, Got: %q", reply)
+		}
+	}
+	waitUntil(t, "the nodes to agree the cluster is ok", func() bool {
+		for _, node := range nodes {
+			info := node.command([]string{"CLUSTER", "INFO"})
+			if !strings.Contains(info, "cluster_state:ok\r\n") || !strings.Contains(info, "cluster_known_nodes:3\r\n") {
+				return false
+			}
+		}
+		return true
+	})
+	// Like after redis-cli --cluster create, every node serves its slots
+	// in an epoch of its own, and all of them know it
+	waitUntil(t, "the nodes to agree on different epochs", func() bool {
+		var views []string
+		for _, node := range nodes {
+			epochs := make(map[string]bool)
+			var view []string
+			for _, line := range strings.Split(node.command([]string{"CLUSTER", "NODES"}), "\n") {
+				fields := strings.Fields(line)
+				epochs[fields[6]] = true
+				view = append(view, fields[0]+" "+fields[6])
+			}
+			if len(epochs) != 3 {
+				return false
+			}
+			views = append(views, strings.Join(view, ","))
+		}
+		return views[0] == views[1] && views[1] == views[2]
+	})
+	return nodes
+}
+
+func TestClusterRedirects(t *testing.T) {
+	nodes := startTestCluster(t, 2*time.Second)
+
+	moved := fmt.Sprintf("MOVED %d 127.0.0.1:7002", keyHashSlot("foo"))
+	if reply := nodes[0].redirect([]string{"GET", "foo"}, false); reply != moved {
+		t.Fatalf("Expected %q, Got: %q", moved, reply)
+	}
+	if reply := nodes[2].redirect([]string{"SET", "foo", "v"}, false); reply != "" {
+		t.Fatalf("Expected the node serving the slot to run the command, Got: %q", reply)
+	}
+	if reply := nodes[0].redirect([]string{"MGET", "foo", "bar"}, false); reply != "CROSSSLOT Keys in request don't hash to the same slot" {
+		t.Fatalf("Expected keys of different slots to be refused, Got: %q", reply)
+	}
+	if reply := nodes[0].redirect([]string{"MSET", "{bar}1", "a", "{bar}2", "b"}, false); reply != "" {
+		t.Fatalf("Expected keys with the same hashtag to run together, Got: %q", reply)
+	}
+	if reply := nodes[0].redirect([]string{"PING"}, false); reply != "" {
+		t.Fatalf("Expected commands without keys to run anywhere, Got: %q", reply)
+	}
+
+	slots := nodes[1].command([]string{"CLUSTER", "SLOTS"})
+	expected := fmt.Sprintf("0 5460 127.0.0.1 7000 %s\n5461 10922 127.0.0.1 7001 %s\n10923 16383 127.0.0.1 7002 %s",
+		nodes[0].myself.id, nodes[1].myself.id, nodes[2].myself.id)
+	if slots != expected {
+		t.Fatalf("Expected %q, Got: %q", expected, slots)
+	}
+}
+
+func TestClusterResharding(t *testing.T) {
+	nodes := startTestCluster(t, 2*time.Second)
+	source, target, other := nodes[2], nodes[0], nodes[1]
+	slot := fmt.Sprint(keyHashSlot("foo"))
+	source.kv.executeCommand([]string{"SET", "foo", "v"})
+
+	if reply := target.command([]string{"CLUSTER", "SETSLOT", slot, "IMPORTING", source.myself.id}); reply != "OK" {
+		t.Fatalf("Expected the slot to be imported, Got: %q", reply)
+	}
+	if reply := source.command([]string{"CLUSTER", "SETSLOT", slot, "MIGRATING", target.myself.id}); reply != "OK" {
+		t.Fatalf("Expected the slot to be migrated, Got: %q", reply)
+	}
+	if reply := source.redirect([]string{"GET", "foo"}, false); reply != "" {
+		t.Fatalf("Expected a key not moved yet to be served, Got: %q", reply)
+	}
+	ask := fmt.Sprintf("ASK %s 127.0.0.1:7000", slot)
+	if reply := source.redirect([]string{"GET", "{foo}x"}, false); reply != ask {
+		t.Fatalf("Expected %q for a key that may have moved, Got: %q", ask, reply)
+	}
+	if reply := target.redirect([]string{"GET", "foo"}, false); !strings.HasPrefix(reply, "MOVED ") {
+		t.Fatalf("Expected the importing node to redirect without ASKING, Got: %q", reply)
+	}
+	if reply := target.redirect([]string{"GET", "foo"}, true); reply != "" {
+		t.Fatalf("Expected the importing node to serve after ASKING, Got: %q", reply)
+	}
+	if reply := source.command([]string{"CLUSTER", "SETSLOT", slot, "NODE", target.myself.id}); !strings.HasPrefix(reply, "ERR Can't assign hashslot") {
+		t.Fatalf("Expected the slot not to be given away with keys left, Got: %q", reply)
+	}
+
+	// Move the key, like MIGRATE does
+	source.kv.executeCommand([]string{"DEL", "foo"})
+	target.kv.executeCommand([]string{"SET", "foo", "v"})
+	if reply := source.redirect([]string{"GET", "foo"}, false); reply != ask {
+		t.Fatalf("Expected %q for a moved key, Got: %q", ask, reply)
+	}
+	for _, node := range []*testClusterNode{target, source} {
+		if reply := node.command([]string{"CLUSTER", "SETSLOT", slot, "NODE", target.myself.id}); reply != "OK" {
+			t.Fatalf("Expected the slot to be given to its new node, Got: %q", reply)
+		}
+	}
+	waitUntil(t, "the other node to learn where the slot went", func() bool {
+		return other.redirect([]string{"GET", "foo"}, false) == fmt.Sprintf("MOVED %s 127.0.0.1:7000", slot)
+	})
+	if reply := target.command([]string{"CLUSTER", "COUNTKEYSINSLOT", slot}); reply != "(integer) 1" {
+		t.Fatalf("Expected one key in the slot, Got: %q", reply)
+	}
+	if reply := target.command([]string{"CLUSTER", "GETKEYSINSLOT", slot, "10"}); reply != "foo" {
+		t.Fatalf("Expected the key of the slot, Got: %q", reply)
+	}
+}
+
+func TestClusterFailureDetection(t *testing.T) {
+	nodes := startTestCluster(t, 300*time.Millisecond)
+	failed := nodes[2].myself.id
+	nodes[2].kill()
+
+	for _, node := range nodes[:2] {
+		waitUntil(t, "the node to be failed", func() bool {
+			return strings.Contains(node.command([]string{"CLUSTER", "INFO"}), "cluster_state:fail\r\n")
+		})
+		if reply := node.redirect([]string{"GET", "bar"}, false); reply != "CLUSTERDOWN The cluster is down" {
+			t.Fatalf("Expected the cluster to be down, Got: %q", reply)
+		}
+		if nodesReply := node.command([]string{"CLUSTER", "NODES"}); !strings.Contains(nodesReply, failed+" 127.0.0.1:7002@") || !strings.Contains(nodesReply, "master,fail ") {
+			t.Fatalf("Expected the node to be listed as failing, Got: %q", nodesReply)
+		}
+	}
+}
+
+func TestClusterConfigFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "nodes.conf")
+	nodes := startTestCluster(t, 2*time.Second)
+	node := startTestClusterNode(t, 7003, 2*time.Second, file)
+	node.command([]string{"CLUSTER", "MEET", "127.0.0.1", "7000", fmt.Sprint(nodes[0].myself.busPort)})
+	waitUntil(t, "the node to learn about the cluster", func() bool {
+		info := node.command([]string{"CLUSTER", "INFO"})
+		return strings.Contains(info, "cluster_state:ok\r\n") && strings.Contains(info, "cluster_known_nodes:4\r\n")
+	})
+	if reply := node.command([]string{"CLUSTER", "SETSLOT", "0", "IMPORTING", nodes[0].myself.id}); reply != "OK" {
+		t.Fatalf("Expected the slot to be imported, Got: %q", reply)
+	}
+	before := node.command([]string{"CLUSTER", "NODES"})
+	node.kill()
+
+	restarted := startTestClusterNode(t, 7003, 2*time.Second, file)
+	if restarted.myself.id != node.myself.id {
+		t.Fatalf("Expected the node to keep its id %s, Got: %s", node.myself.id, restarted.myself.id)
+	}
+	if reply := restarted.command([]string{"CLUSTER", "SLOTS"}); reply != nodes[0].command([]string{"CLUSTER", "SLOTS"}) {
+		t.Fatalf("Expected the slots to be loaded, Got: %q", reply)
+	}
+	if after := restarted.command([]string{"CLUSTER", "NODES"}); !strings.Contains(after, fmt.Sprintf("[0-<-%s]", nodes[0].myself.id)) || strings.Count(after, "\n") != strings.Count(before, "\n") {
+		t.Fatalf("Expected the nodes and the imported slot to be loaded, Got: %q", after)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/dhravya/radish/internal/rdb"
+)
+
+// Append-only files hold write commands as RESP arrays of bulk strings,
+// possibly after an RDB preamble holding the dataset as of the last
+// rewrite. See aof.go of the server.
+
+// maxBulkLen is the longest argument the server accepts.
+const maxBulkLen = 512 << 20
+
+var errBadAOF = errors.New("bad append only file format")
+
+// commandReader reads commands, counting the bytes read so far.
+type commandReader struct {
+	r      *bufio.Reader
+	offset int64
+}
+
+// readLine reads a line ending in CRLF and returns it without the CRLF.
+func (cr *commandReader) readLine() (string, error) {
+	line, err := cr.r.ReadString('\n')
+	cr.offset += int64(len(line))
+	if err != nil {
+		return "", io.ErrUnexpectedEOF
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		return "", fmt.Errorf("%w: line without CRLF", errBadAOF)
+	}
+	return line[:len(line)-2], nil
+}
+
+// readLength reads a line made of prefix and a length of at most limit.
+func (cr *commandReader) readLength(prefix byte, limit int) (int, error) {
+	line, err := cr.readLine()
+	if err != nil {
+		return 0, err
+	}
+	if len(line) < 2 || line[0] != prefix {
+		return 0, fmt.Errorf("%w: expected '%c'", errBadAOF, prefix)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > limit {
+		return 0, fmt.Errorf("%w: invalid length %q", errBadAOF, line[1:])
+	}
+	return n, nil
+}
+
+// readCommand reads a command. It returns io.EOF when there is none left,
+// and io.ErrUnexpectedEOF when the file ends in the middle of one.
+func (cr *commandReader) readCommand() ([]string, error) {
+	if _, err := cr.r.Peek(1); err == io.EOF {
+		return nil, io.EOF
+	}
+	n, err := cr.readLength('*', 1<<20)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("%w: empty command", errBadAOF)
+	}
+	args := make([]string, n)
+	for i := range args {
+		size, err := cr.readLength('$', maxBulkLen)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		read, err := io.ReadFull(cr.r, buf)
+		cr.offset += int64(read)
+		if err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if string(buf[size:]) != "\r\n" {
+			return nil, fmt.Errorf("%w: argument without CRLF", errBadAOF)
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// aofDamage is returned when an append-only file is damaged after its last
+// complete command, which ends at valid.
+type aofDamage struct {
+	valid int64
+	err   error
+}
+
+func (d *aofDamage) Error() string {
+	if errors.Is(d.err, io.ErrUnexpectedEOF) {
+		return fmt.Sprintf("the file ends in the middle of a command after offset %d", d.valid)
+	}
+	return fmt.Sprintf("%v after offset %d", d.err, d.valid)
+}
+
+func (d *aofDamage) Unwrap() error {
+	return d.err
+}
+
+// readAppendOnlyFile reads an RDB file, or an append-only file with or
+// without an RDB preamble, from r and adds what it holds to rep. It reports
+// whether any commands followed the RDB. Damage past the preamble is
+// returned as an *aofDamage.
+func readAppendOnlyFile(r io.Reader, rep *report) (bool, error) {
+	br := bufio.NewReader(r)
+	var preamble int64
+	if magic, _ := br.Peek(len(rdb.Magic)); string(magic) == rdb.Magic {
+		rd := rdb.NewReader(br)
+		if err := readRDB(rd, rep); err != nil {
+			return false, err
+		}
+		preamble = rd.Offset()
+	}
+
+	cr := &commandReader{r: br, offset: preamble}
+	db := 0
+	for {
+		valid := cr.offset
+		args, err := cr.readCommand()
+		if err == io.EOF {
+			return cr.offset > preamble, nil
+		}
+		if err != nil {
+			return cr.offset > preamble, &aofDamage{valid: valid, err: err}
+		}
+		if strings.EqualFold(args[0], "SELECT") && len(args) == 2 {
+			index, err := strconv.Atoi(args[1])
+			if err != nil || index < 0 {
+				return true, &aofDamage{valid: valid, err: fmt.Errorf("%w: invalid SELECT", errBadAOF)}
+			}
+			db = index
+			continue
+		}
+		if err := rep.addCommand(db, args); err != nil {
+			return true, err
+		}
+	}
+}
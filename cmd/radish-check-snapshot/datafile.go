@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/dhravya/radish/internal/datafile"
+)
+
+// Data files written by the server hold a header, the gob-encoded databases
+// and a trailing checksum, see package datafile. Gob matches fields by name,
+// so the types below decode the same streams as the ones of the server.
+
+type persistedDatabases struct {
+	Databases []*storedDatabase
+}
+
+type storedDatabase struct {
+	Strings              map[string]string
+	Lists                map[string][]string
+	Hashes               map[string]map[string]string
+	Sets                 map[string]map[string]struct{}
+	SortedSets           map[string]*storedSortedSet
+	Expirations          map[string]time.Time
+	HashFieldExpirations map[string]map[string]time.Time
+}
+
+// storedSortedSet decodes what SortedSet.GobEncode writes, its members in
+// rank order.
+type storedSortedSet struct {
+	members []zsetMember
+}
+
+type storedSortedSetMember struct {
+	Member string
+	Score  float64
+}
+
+func (z *storedSortedSet) GobDecode(data []byte) error {
+	var members []storedSortedSetMember
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&members); err != nil {
+		return err
+	}
+	for _, m := range members {
+		z.members = append(z.members, zsetMember{m.Member, m.Score})
+	}
+	return nil
+}
+
+// readDataFile reads a data file with a header and adds its keys to rep.
+func readDataFile(r io.Reader, rep *report) error {
+	var persisted persistedDatabases
+	header, err := datafile.Read(r, func(r io.Reader, version int) error {
+		return gob.NewDecoder(r).Decode(&persisted)
+	})
+	if !header.Created.IsZero() {
+		rep.format = fmt.Sprintf("data file version %d", header.Version)
+		rep.created = header.Created
+	}
+	if err != nil {
+		return err
+	}
+	rep.checksummed = true
+	return addStoredDatabases(persisted.Databases, rep)
+}
+
+// readUnversionedDataFile reads a data file written before there was a
+// header, in either of the layouts used back then.
+func readUnversionedDataFile(file *os.File, rep *report) error {
+	rep.format = "data file version 0"
+	var persisted persistedDatabases
+	if err := gob.NewDecoder(file).Decode(&persisted); err == nil {
+		return addStoredDatabases(persisted.Databases, rep)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var single storedDatabase
+	if err := gob.NewDecoder(file).Decode(&single); err != nil {
+		return fmt.Errorf("%w: %v", datafile.ErrBadFormat, err)
+	}
+	return addStoredDatabases([]*storedDatabase{&single}, rep)
+}
+
+func addStoredDatabases(dbs []*storedDatabase, rep *report) error {
+	for i, db := range dbs {
+		var entries []entry
+		for key, value := range db.Strings {
+			entries = append(entries, entry{Type: "string", Key: key, Value: value})
+		}
+		for key, value := range db.Lists {
+			entries = append(entries, entry{Type: "list", Key: key, Value: value})
+		}
+		for key, value := range db.Hashes {
+			entries = append(entries, entry{Type: "hash", Key: key, Value: value})
+		}
+		for key, value := range db.Sets {
+			members := make([]string, 0, len(value))
+			for member := range value {
+				members = append(members, member)
+			}
+			entries = append(entries, entry{Type: "set", Key: key, Value: sortedStrings(members)})
+		}
+		for key, value := range db.SortedSets {
+			entries = append(entries, entry{Type: "zset", Key: key, Value: value.members})
+		}
+		sort.Slice(entries, func(a, b int) bool { return entries[a].Key < entries[b].Key })
+
+		for _, e := range entries {
+			e.DB = i
+			if expiration, ok := db.Expirations[e.Key]; ok {
+				e.ExpireAt = expiration.UnixMilli()
+			}
+			for field, expiration := range db.HashFieldExpirations[e.Key] {
+				e.setFieldTTL(field, expiration.UnixMilli())
+			}
+			if err := rep.add(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+// radish-check-snapshot checks a file written by radish without starting a
+// server: a data file, an RDB file or an append-only file. It verifies that
+// the file is intact, reports the keys it holds by type along with their
+// sizes and TTLs, and can dump them as JSON lines. A damaged append-only
+// file can be truncated back to its last complete command.
+//
+// Usage:
+//
+//	radish-check-snapshot [-dump] [-fix] <file>
+//
+// It exits with status 0 when the file is intact or was repaired, 1 when it
+// is damaged and 2 when it could not be read at all.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/dhravya/radish/internal/datafile"
+	"github.com/dhravya/radish/internal/rdb"
+)
+
+func main() {
+	dump := flag.Bool("dump", false, "Write every key, and every command of an append only file, to stdout as JSON lines")
+	fix := flag.Bool("fix", false, "Truncate a damaged append only file after its last complete command")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: radish-check-snapshot [-dump] [-fix] <file>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	os.Exit(run(flag.Arg(0), *dump, *fix, os.Stdout, os.Stderr))
+}
+
+// run checks the file at path and returns the exit status. The report goes
+// to stdout, or to stderr when the keys are dumped to stdout.
+func run(path string, dump, fix bool, stdout, stderr io.Writer) int {
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	defer file.Close()
+
+	out := stdout
+	var dumpTo io.Writer
+	if dump {
+		out, dumpTo = stderr, stdout
+	}
+	rep := newReport(time.Now(), dumpTo)
+
+	magic := make([]byte, len(datafile.Magic))
+	n, _ := io.ReadFull(file, magic)
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	switch {
+	case n == 0:
+		err = errors.New("the file is empty")
+	case string(magic[:n]) == datafile.Magic:
+		err = readDataFile(file, rep)
+	case string(magic[:min(n, len(rdb.Magic))]) == rdb.Magic || magic[0] == '*':
+		var commands bool
+		commands, err = readAppendOnlyFile(file, rep)
+		if commands || magic[0] == '*' {
+			rep.format = appendOnlyFormat(rep.format)
+		}
+	default:
+		err = readUnversionedDataFile(file, rep)
+	}
+	rep.print(out)
+	if err == nil {
+		fmt.Fprintln(out, "The file is intact")
+		return 0
+	}
+
+	fmt.Fprintf(out, "The file is damaged: %v\n", err)
+	var damage *aofDamage
+	if !errors.As(err, &damage) {
+		return 1
+	}
+	info, statErr := file.Stat()
+	if statErr != nil {
+		fmt.Fprintln(stderr, statErr)
+		return 2
+	}
+	discarded := info.Size() - damage.valid
+	if !fix {
+		fmt.Fprintf(out, "Run with -fix to truncate it after its last complete command, discarding the last %d bytes\n", discarded)
+		return 1
+	}
+	if err := os.Truncate(path, damage.valid); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	fmt.Fprintf(out, "Truncated the file to %d bytes, discarding the last %d bytes\n", damage.valid, discarded)
+	return 0
+}
+
+// appendOnlyFormat describes an append-only file whose RDB preamble, if
+// any, is in format.
+func appendOnlyFormat(format string) string {
+	if format == "" {
+		return "append only file"
+	}
+	return "append only file with an " + format + " preamble"
+}
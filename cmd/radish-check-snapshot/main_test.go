@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dhravya/radish/internal/datafile"
+	"github.com/dhravya/radish/internal/rdb"
+)
+
+// GobEncode writes a sorted set the way the server does, for the fixtures.
+func (z *storedSortedSet) GobEncode() ([]byte, error) {
+	members := make([]storedSortedSetMember, len(z.members))
+	for i, m := range z.members {
+		members[i] = storedSortedSetMember{m.member, m.score}
+	}
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(members)
+	return buf.Bytes(), err
+}
+
+func writeDataFile(t *testing.T, dbs []*storedDatabase) string {
+	t.Helper()
+	var buf bytes.Buffer
+	err := datafile.Write(&buf, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(persistedDatabases{Databases: dbs})
+	})
+	if err != nil {
+		t.Fatalf("Expected the fixture to encode, Got: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "data.gob")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Expected the fixture to be written, Got: %v", err)
+	}
+	return path
+}
+
+func TestCheckDataFile(t *testing.T) {
+	now := time.Now()
+	path := writeDataFile(t, []*storedDatabase{
+		{
+			Strings:     map[string]string{"a": "1", "gone": "x", "soon": "value"},
+			Hashes:      map[string]map[string]string{"h": {"f": "v"}},
+			SortedSets:  map[string]*storedSortedSet{"z": {members: []zsetMember{{"m", 1.5}}}},
+			Expirations: map[string]time.Time{"gone": now.Add(-time.Second), "soon": now.Add(30 * time.Second)},
+			HashFieldExpirations: map[string]map[string]time.Time{
+				"h": {"f": now.Add(time.Hour)},
+			},
+		},
+		{Lists: map[string][]string{"l": {"x", "y"}}},
+	})
+
+	var stdout, stderr bytes.Buffer
+	if code := run(path, true, false, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit status 0, Got: %d\n%s", code, stderr.String())
+	}
+	report := stderr.String()
+	for _, expected := range []string{
+		"Format: data file version 1",
+		"Checksum: OK",
+		"Keys: 6 (db0=5 db1=1)",
+		"TTLs: none=4 expired=1 < 1m=1 < 1h=0",
+		"Hash fields with a TTL: 1",
+		"The file is intact",
+	} {
+		if !strings.Contains(report, expected) {
+			t.Fatalf("Expected the report to contain %q, Got:\n%s", expected, report)
+		}
+	}
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("Expected 6 keys to be dumped, Got: %d", len(lines))
+	}
+	if expected := `{"db":0,"key":"z","type":"zset","value":[{"member":"m","score":"1.5"}]}`; lines[4] != expected {
+		t.Fatalf("Expected %s, Got: %s", expected, lines[4])
+	}
+	if expected := `{"db":1,"key":"l","type":"list","value":["x","y"]}`; lines[5] != expected {
+		t.Fatalf("Expected %s, Got: %s", expected, lines[5])
+	}
+
+	contents, _ := os.ReadFile(path)
+	contents[len(contents)-1] ^= 0xff
+	os.WriteFile(path, contents, 0644)
+	stdout.Reset()
+	if code := run(path, false, false, &stdout, &stderr); code != 1 {
+		t.Fatalf("Expected exit status 1 for a wrong checksum, Got: %d", code)
+	}
+	if !strings.Contains(stdout.String(), "wrong checksum") {
+		t.Fatalf("Expected the wrong checksum to be reported, Got:\n%s", stdout.String())
+	}
+}
+
+func TestFixTruncatedAppendOnlyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	complete := "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n*2\r\n$6\r\nSELECT\r\n$1\r\n1\r\n*2\r\n$3\r\nDEL\r\n$1\r\nb\r\n"
+	os.WriteFile(path, []byte(complete+"*3\r\n$3\r\nSET\r\n$1\r\nc"), 0644)
+
+	var stdout, stderr bytes.Buffer
+	if code := run(path, false, false, &stdout, &stderr); code != 1 {
+		t.Fatalf("Expected exit status 1, Got: %d", code)
+	}
+	if !strings.Contains(stdout.String(), "discarding the last 18 bytes") {
+		t.Fatalf("Expected the damage to be reported, Got:\n%s", stdout.String())
+	}
+	if code := run(path, false, true, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit status 0 after the fix, Got: %d\n%s", code, stderr.String())
+	}
+	if contents, _ := os.ReadFile(path); string(contents) != complete {
+		t.Fatalf("Expected the file to end after its last complete command, Got: %q", contents)
+	}
+
+	stdout.Reset()
+	if code := run(path, true, false, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected the fixed file to be intact, Got: %d", code)
+	}
+	if expected := `{"db":1,"command":["DEL","b"]}`; !strings.Contains(stdout.String(), expected) {
+		t.Fatalf("Expected %s to be dumped, Got:\n%s", expected, stdout.String())
+	}
+}
+
+func TestCheckRDBFile(t *testing.T) {
+	rdbString := func(s string) []byte { return append([]byte{byte(len(s))}, s...) }
+	// A listpack of the field "f" and the value 7
+	listpack := []byte{0, 0, 0, 0, 2, 0, 0x81, 'f', 2, 7, 1, 0xff}
+	binary.LittleEndian.PutUint32(listpack, uint32(len(listpack)))
+
+	var buf bytes.Buffer
+	buf.WriteString("REDIS0012")
+	buf.WriteByte(rdb.OpcodeAux)
+	buf.Write(rdbString("ctime"))
+	buf.Write(rdbString("1700000000"))
+	buf.Write([]byte{rdb.OpcodeSelectDB, 2})
+	buf.WriteByte(rdb.OpcodeExpireTimeMS)
+	binary.Write(&buf, binary.LittleEndian, uint64(time.Now().Add(2*time.Hour).UnixMilli()))
+	buf.WriteByte(rdb.TypeString)
+	buf.Write(rdbString("k"))
+	buf.Write([]byte{0xc0, 42})
+	buf.WriteByte(rdb.TypeHashListpack)
+	buf.Write(rdbString("h"))
+	buf.Write(rdbString(string(listpack)))
+	buf.WriteByte(rdb.OpcodeEOF)
+	binary.Write(&buf, binary.LittleEndian, rdb.CRC64(0, buf.Bytes()))
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	os.WriteFile(path, buf.Bytes(), 0644)
+
+	var stdout, stderr bytes.Buffer
+	if code := run(path, true, false, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit status 0, Got: %d\n%s", code, stderr.String())
+	}
+	for _, expected := range []string{"Format: RDB version 12, written 2023-11-14", "Keys: 2 (db2=2)", "< 1d=1"} {
+		if !strings.Contains(stderr.String(), expected) {
+			t.Fatalf("Expected the report to contain %q, Got:\n%s", expected, stderr.String())
+		}
+	}
+	if dumped := stdout.String(); !strings.HasPrefix(dumped, `{"db":2,"key":"k","type":"string","value":"42","expire_at":`) || !strings.HasSuffix(dumped, `{"db":2,"key":"h","type":"hash","value":{"f":"7"}}`+"\n") {
+		t.Fatalf("Expected both keys to be dumped, Got:\n%s", dumped)
+	}
+
+	contents := buf.Bytes()
+	contents[bytes.Index(contents, []byte{0x81, 'f'})+1] = 'g'
+	os.WriteFile(path, contents, 0644)
+	stdout.Reset()
+	if code := run(path, false, false, &stdout, &stderr); code != 1 {
+		t.Fatalf("Expected exit status 1 for a wrong checksum, Got: %d", code)
+	}
+	if !strings.Contains(stdout.String(), "wrong checksum") {
+		t.Fatalf("Expected the wrong checksum to be reported, Got:\n%s", stdout.String())
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/dhravya/radish/internal/rdb"
+)
+
+// readRDB reads an RDB file, or the preamble of an append-only file, from
+// r up to and including its checksum, and adds its keys to rep.
+func readRDB(r *rdb.Reader, rep *report) error {
+	file, err := r.ReadFile(rdb.Handler{
+		Aux: func(field, value string) {
+			if field == "ctime" {
+				if ctime, err := strconv.ParseInt(value, 10, 64); err == nil {
+					rep.created = time.Unix(ctime, 0)
+				}
+			}
+		},
+		Key: func(k rdb.Key) error {
+			return rep.add(entryFromRDB(k))
+		},
+	})
+	if file.Version != 0 {
+		rep.format = fmt.Sprintf("RDB version %d", file.Version)
+	}
+	rep.checksummed = file.Checksummed
+	return err
+}
+
+// entryFromRDB converts a key read from RDB data, sorting the members of
+// sets and sorted sets.
+func entryFromRDB(k rdb.Key) entry {
+	e := entry{DB: k.DB, Key: k.Key, Type: k.Value.Type, ExpireAt: k.ExpireAt}
+	switch k.Value.Type {
+	case "string":
+		e.Value = k.Value.String
+	case "list":
+		e.Value = k.Value.Elements
+	case "set":
+		e.Value = sortedStrings(k.Value.Elements)
+	case "zset":
+		members := make([]zsetMember, len(k.Value.Members))
+		for i, m := range k.Value.Members {
+			members[i] = zsetMember{m.Member, m.Score}
+		}
+		e.Value = sortedMembers(members)
+	case "hash":
+		hash := make(map[string]string, len(k.Value.Fields))
+		for _, f := range k.Value.Fields {
+			hash[f.Field] = f.Value
+		}
+		e.Value = hash
+		for field, deadline := range k.Value.FieldTTLs {
+			e.setFieldTTL(field, deadline)
+		}
+	}
+	return e
+}
+
+func sortedStrings(s []string) []string {
+	sort.Strings(s)
+	return s
+}
+
+func sortedMembers(members []zsetMember) []zsetMember {
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].score != members[j].score {
+			return members[i].score < members[j].score
+		}
+		return members[i].member < members[j].member
+	})
+	return members
+}
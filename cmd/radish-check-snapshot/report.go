@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// entry is a key found in a snapshot, as dumped in JSON. Times are Unix
+// milliseconds.
+type entry struct {
+	DB            int              `json:"db"`
+	Key           string           `json:"key"`
+	Type          string           `json:"type"`
+	Value         any              `json:"value,omitempty"`
+	ExpireAt      int64            `json:"expire_at,omitempty"`
+	FieldExpireAt map[string]int64 `json:"field_expire_at,omitempty"`
+}
+
+func (e *entry) setFieldTTL(field string, deadline int64) {
+	if e.FieldExpireAt == nil {
+		e.FieldExpireAt = make(map[string]int64)
+	}
+	e.FieldExpireAt[field] = deadline
+}
+
+// size returns the bytes of the key and its value, without any overhead.
+// Scores count for 8 bytes.
+func (e entry) size() int64 {
+	size := int64(len(e.Key))
+	switch v := e.Value.(type) {
+	case string:
+		size += int64(len(v))
+	case []string:
+		for _, s := range v {
+			size += int64(len(s))
+		}
+	case map[string]string:
+		for field, value := range v {
+			size += int64(len(field) + len(value))
+		}
+	case []zsetMember:
+		for _, m := range v {
+			size += int64(len(m.member)) + 8
+		}
+	}
+	return size
+}
+
+type zsetMember struct {
+	member string
+	score  float64
+}
+
+// MarshalJSON writes the score as a string, like Redis replies with it, so
+// that infinite scores can be written too.
+func (m zsetMember) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Member string `json:"member"`
+		Score  string `json:"score"`
+	}{m.member, strconv.FormatFloat(m.score, 'g', -1, 64)})
+}
+
+var keyTypes = []string{"string", "list", "hash", "set", "zset", "stream"}
+
+// ttlBuckets are the ranges the remaining TTLs are counted in.
+var ttlBuckets = []struct {
+	name  string
+	below time.Duration
+}{
+	{"< 1m", time.Minute},
+	{"< 1h", time.Hour},
+	{"< 1d", 24 * time.Hour},
+	{"< 1w", 7 * 24 * time.Hour},
+	{">= 1w", math.MaxInt64},
+}
+
+type typeStats struct {
+	keys, bytes int64
+	largest     entry
+	largestSize int64
+}
+
+// report gathers what a snapshot holds, and dumps its keys as they are
+// added when dump is set.
+type report struct {
+	format      string
+	created     time.Time
+	checksummed bool
+	now         time.Time
+
+	types     map[string]*typeStats
+	databases map[int]int64
+	noTTL     int64
+	expired   int64
+	ttls      []int64
+	fieldTTLs int64
+
+	// commands counts the commands of an append-only file by name
+	commands      map[string]int64
+	totalCommands int64
+
+	dump *json.Encoder
+}
+
+func newReport(now time.Time, dump io.Writer) *report {
+	r := &report{
+		now:       now,
+		types:     make(map[string]*typeStats),
+		databases: make(map[int]int64),
+		ttls:      make([]int64, len(ttlBuckets)),
+		commands:  make(map[string]int64),
+	}
+	if dump != nil {
+		r.dump = json.NewEncoder(dump)
+	}
+	return r
+}
+
+func (r *report) add(e entry) error {
+	stats, ok := r.types[e.Type]
+	if !ok {
+		stats = &typeStats{}
+		r.types[e.Type] = stats
+	}
+	size := e.size()
+	stats.keys++
+	stats.bytes += size
+	if size > stats.largestSize || stats.keys == 1 {
+		stats.largest, stats.largestSize = entry{DB: e.DB, Key: e.Key}, size
+	}
+	r.databases[e.DB]++
+	r.fieldTTLs += int64(len(e.FieldExpireAt))
+
+	switch ttl := time.UnixMilli(e.ExpireAt).Sub(r.now); {
+	case e.ExpireAt == 0:
+		r.noTTL++
+	case ttl <= 0:
+		r.expired++
+	default:
+		for i, bucket := range ttlBuckets {
+			if ttl < bucket.below {
+				r.ttls[i]++
+				break
+			}
+		}
+	}
+
+	if r.dump == nil {
+		return nil
+	}
+	return r.dump.Encode(e)
+}
+
+// addCommand counts a command of an append-only file, run in database db.
+func (r *report) addCommand(db int, args []string) error {
+	r.commands[strings.ToUpper(args[0])]++
+	r.totalCommands++
+	if r.dump == nil {
+		return nil
+	}
+	return r.dump.Encode(struct {
+		DB      int      `json:"db"`
+		Command []string `json:"command"`
+	}{db, args})
+}
+
+func (r *report) print(w io.Writer) {
+	fmt.Fprintf(w, "Format: %s", r.format)
+	if !r.created.IsZero() {
+		fmt.Fprintf(w, ", written %s", r.created.Format(time.RFC3339))
+	}
+	fmt.Fprintln(w)
+	if r.checksummed {
+		fmt.Fprintln(w, "Checksum: OK")
+	} else {
+		fmt.Fprintln(w, "Checksum: none")
+	}
+
+	total := int64(0)
+	dbs := make([]int, 0, len(r.databases))
+	for db, keys := range r.databases {
+		total += keys
+		dbs = append(dbs, db)
+	}
+	sort.Ints(dbs)
+	perDB := make([]string, len(dbs))
+	for i, db := range dbs {
+		perDB[i] = fmt.Sprintf("db%d=%d", db, r.databases[db])
+	}
+	fmt.Fprintf(w, "Keys: %d (%s)\n", total, strings.Join(perDB, " "))
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "Type\tKeys\tBytes\tLargest key")
+	for _, typ := range keyTypes {
+		if stats, ok := r.types[typ]; ok {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%q in db%d (%d bytes)\n", typ, stats.keys, stats.bytes, stats.largest.Key, stats.largest.DB, stats.largestSize)
+		}
+	}
+	tw.Flush()
+
+	ttls := []string{fmt.Sprintf("none=%d", r.noTTL), fmt.Sprintf("expired=%d", r.expired)}
+	for i, bucket := range ttlBuckets {
+		ttls = append(ttls, fmt.Sprintf("%s=%d", bucket.name, r.ttls[i]))
+	}
+	fmt.Fprintf(w, "TTLs: %s\n", strings.Join(ttls, " "))
+	if r.fieldTTLs > 0 {
+		fmt.Fprintf(w, "Hash fields with a TTL: %d\n", r.fieldTTLs)
+	}
+
+	if r.totalCommands > 0 {
+		names := make([]string, 0, len(r.commands))
+		for name := range r.commands {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool {
+			if r.commands[names[i]] != r.commands[names[j]] {
+				return r.commands[names[i]] > r.commands[names[j]]
+			}
+			return names[i] < names[j]
+		})
+		counts := make([]string, len(names))
+		for i, name := range names {
+			counts[i] = fmt.Sprintf("%s=%d", name, r.commands[name])
+		}
+		fmt.Fprintf(w, "Commands: %d %s\n", r.totalCommands, strings.Join(counts, " "))
+	}
+}
@@ -0,0 +1,244 @@
+// radish-jsonl exports the keys of a radish server as JSON lines, and
+// imports them back, through the EXPORT and IMPORT commands. Every line
+// holds one key:
+//
+//	{"key":"user:1","type":"hash","ttl":5000,"value":{"name":"Ada"}}
+//
+// Usage:
+//
+//	radish-jsonl export [-addr host:port] [-db n] [-match pattern] [-type type] [file]
+//	radish-jsonl import [-addr host:port] [-db n] [-replace] [file]
+//
+// The file defaults to stdout for export and stdin for import. Import merges
+// the keys into the database, leaving the ones that already exist alone,
+// unless -replace is given.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commander runs a command on the server.
+type commander interface {
+	Do(args ...string) (string, error)
+}
+
+type connectOptions struct {
+	addr     string
+	db       int
+	password string
+	timeout  time.Duration
+}
+
+func (o *connectOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.addr, "addr", "localhost:6379", "Address of the server")
+	flags.IntVar(&o.db, "db", 0, "Database to export from or import into")
+	flags.StringVar(&o.password, "password", "", "Password to AUTH with, if any")
+	flags.DurationVar(&o.timeout, "timeout", 10*time.Second, "Timeout for connecting")
+}
+
+func (o *connectOptions) connect() (*client, error) {
+	c, err := dial(o.addr, o.timeout)
+	if err != nil {
+		return nil, err
+	}
+	if o.password != "" {
+		if err := expectOK(c, "AUTH", o.password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if o.db != 0 {
+		if err := expectOK(c, "SELECT", strconv.Itoa(o.db)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: radish-jsonl export|import [options] [file]")
+	fmt.Fprintln(os.Stderr, "Run radish-jsonl export -h or radish-jsonl import -h for the options")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	var conn connectOptions
+	flags := flag.NewFlagSet("radish-jsonl "+os.Args[1], flag.ExitOnError)
+	conn.register(flags)
+
+	var err error
+	switch os.Args[1] {
+	case "export":
+		match := flags.String("match", "", "Only export the keys matching this glob-style pattern")
+		typ := flags.String("type", "", "Only export the keys of this type")
+		count := flags.Int("count", 100, "Keys the server looks at for each EXPORT")
+		flags.Parse(os.Args[2:])
+		err = withFile(flags, os.Stdout, func(file *os.File) error {
+			c, err := conn.connect()
+			if err != nil {
+				return err
+			}
+			defer c.Close()
+			w := bufio.NewWriter(file)
+			n, err := export(c, w, *match, *typ, *count)
+			if err == nil {
+				err = w.Flush()
+			}
+			fmt.Fprintf(os.Stderr, "Exported %d keys\n", n)
+			return err
+		})
+	case "import":
+		replace := flags.Bool("replace", false, "Overwrite the keys that already exist instead of leaving them alone")
+		batch := flags.Int("batch", 100, "Lines sent with each IMPORT")
+		flags.Parse(os.Args[2:])
+		err = withFile(flags, os.Stdin, func(file *os.File) error {
+			c, err := conn.connect()
+			if err != nil {
+				return err
+			}
+			defer c.Close()
+			imported, skipped, err := importLines(c, bufio.NewReader(file), *replace, *batch)
+			fmt.Fprintf(os.Stderr, "Imported %d keys, skipped %d that already existed\n", imported, skipped)
+			return err
+		})
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// withFile calls fn with the file named by the argument of flags, or with
+// std when there is none or it is "-".
+func withFile(flags *flag.FlagSet, std *os.File, fn func(*os.File) error) error {
+	if flags.NArg() > 1 {
+		return errors.New("too many arguments")
+	}
+	if flags.NArg() == 0 || flags.Arg(0) == "-" {
+		return fn(std)
+	}
+	var file *os.File
+	var err error
+	if std == os.Stdin {
+		file, err = os.Open(flags.Arg(0))
+	} else {
+		file, err = os.Create(flags.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+	if err := fn(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// export writes the keys matching pattern and typ, any when empty, to w and
+// returns how many there were.
+func export(c commander, w io.Writer, pattern, typ string, count int) (int, error) {
+	args := []string{"COUNT", strconv.Itoa(count)}
+	if pattern != "" {
+		args = append(args, "MATCH", pattern)
+	}
+	if typ != "" {
+		args = append(args, "TYPE", typ)
+	}
+	exported := 0
+	cursor := "0"
+	for {
+		reply, err := c.Do(append([]string{"EXPORT", cursor}, args...)...)
+		if err != nil {
+			return exported, err
+		}
+		next, lines, _ := strings.Cut(reply, "\n")
+		if _, err := strconv.ParseUint(next, 10, 64); err != nil {
+			return exported, errors.New(reply)
+		}
+		if lines != "" {
+			if _, err := io.WriteString(w, lines+"\n"); err != nil {
+				return exported, err
+			}
+			exported += strings.Count(lines, "\n") + 1
+		}
+		if cursor = next; cursor == "0" {
+			return exported, nil
+		}
+	}
+}
+
+// importLines sends the lines read from r with IMPORT, batch lines at a
+// time, and returns how many keys were imported and how many were skipped
+// because they existed. Blank lines are ignored.
+func importLines(c commander, r *bufio.Reader, replace bool, batch int) (imported, skipped int, err error) {
+	mode := "MERGE"
+	if replace {
+		mode = "REPLACE"
+	}
+	var lines []string
+	// numbers holds the line number in r of each of lines
+	var numbers []int
+	send := func() error {
+		if len(lines) == 0 {
+			return nil
+		}
+		reply, err := c.Do(append([]string{"IMPORT", mode}, lines...)...)
+		if err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(reply, "(integer) "))
+		if err != nil {
+			return importError(reply, numbers)
+		}
+		imported += n
+		skipped += len(lines) - n
+		lines, numbers = lines[:0], numbers[:0]
+		return nil
+	}
+
+	for number := 1; ; number++ {
+		line, readErr := r.ReadString('\n')
+		if line = strings.TrimRight(line, "\r\n"); strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+			numbers = append(numbers, number)
+			if len(lines) >= batch {
+				if err := send(); err != nil {
+					return imported, skipped, err
+				}
+			}
+		}
+		if readErr == io.EOF {
+			return imported, skipped, send()
+		}
+		if readErr != nil {
+			return imported, skipped, readErr
+		}
+	}
+}
+
+// importError turns an error reply of IMPORT about one of its lines into
+// one about the line of the file it was read from.
+func importError(reply string, numbers []int) error {
+	rest, ok := strings.CutPrefix(reply, "ERR invalid line ")
+	index, message, found := strings.Cut(rest, ": ")
+	if n, err := strconv.Atoi(index); ok && found && err == nil && n >= 1 && n <= len(numbers) {
+		return fmt.Errorf("line %d: %s", numbers[n-1], message)
+	}
+	return errors.New(reply)
+}
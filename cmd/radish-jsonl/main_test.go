@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// fakeServer replies to the commands it is sent in order, and records them.
+type fakeServer struct {
+	replies  []string
+	commands [][]string
+}
+
+func (f *fakeServer) Do(args ...string) (string, error) {
+	f.commands = append(f.commands, args)
+	reply := f.replies[0]
+	f.replies = f.replies[1:]
+	return reply, nil
+}
+
+func TestExportFollowsTheCursor(t *testing.T) {
+	server := &fakeServer{replies: []string{
+		"17\n{\"key\":\"a\"}\n{\"key\":\"b\"}",
+		"42",
+		"0\n{\"key\":\"c\"}",
+	}}
+	var out bytes.Buffer
+	n, err := export(server, &out, "user:*", "", 10)
+	if err != nil || n != 3 {
+		t.Fatalf("Expected 3 keys to be exported, Got: %d, %v", n, err)
+	}
+	if expected := "{\"key\":\"a\"}\n{\"key\":\"b\"}\n{\"key\":\"c\"}\n"; out.String() != expected {
+		t.Fatalf("Expected %q, Got: %q", expected, out.String())
+	}
+	if got := strings.Join(server.commands[1], " "); got != "EXPORT 17 COUNT 10 MATCH user:*" {
+		t.Fatalf("Expected the cursor to be passed on, Got: %s", got)
+	}
+
+	server = &fakeServer{replies: []string{"NOAUTH Authentication required."}}
+	if _, err := export(server, &out, "", "", 10); err == nil || err.Error() != "NOAUTH Authentication required." {
+		t.Fatalf("Expected the error reply to be returned, Got: %v", err)
+	}
+}
+
+func TestImportBatchesLines(t *testing.T) {
+	input := "{\"key\":\"a\"}\n\n{\"key\":\"b\"}\r\n{\"key\":\"c\"}"
+	server := &fakeServer{replies: []string{"(integer) 1", "(integer) 1"}}
+	imported, skipped, err := importLines(server, bufio.NewReader(strings.NewReader(input)), false, 2)
+	if err != nil || imported != 2 || skipped != 1 {
+		t.Fatalf("Expected 2 keys imported and 1 skipped, Got: %d, %d, %v", imported, skipped, err)
+	}
+	if len(server.commands) != 2 || strings.Join(server.commands[1], " ") != "IMPORT MERGE {\"key\":\"c\"}" {
+		t.Fatalf("Expected two batches, Got: %q", server.commands)
+	}
+
+	server = &fakeServer{replies: []string{"ERR invalid line 2: missing value"}}
+	_, _, err = importLines(server, bufio.NewReader(strings.NewReader(input)), true, 10)
+	if err == nil || err.Error() != "line 3: missing value" {
+		t.Fatalf("Expected the error to name line 3 of the input, Got: %v", err)
+	}
+	if server.commands[0][1] != "REPLACE" {
+		t.Fatalf("Expected REPLACE to be sent, Got: %q", server.commands[0])
+	}
+}
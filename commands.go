@@ -0,0 +1,272 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// commandSpec describes a command the way Redis' command table does: what it
+// may do to the dataset and where its key arguments are. Handlers don't need
+// it; it is for code that has to reason about commands generically, such as
+// recording key accesses.
+
+type commandFlags int
+
+const (
+	flagWrite commandFlags = 1 << iota
+	flagReadOnly
+	// flagDenyOOM marks commands that may grow the dataset
+	flagDenyOOM
+	// flagNoTouch marks commands that inspect keys without counting as an access
+	flagNoTouch
+)
+
+// Key positions follow Redis: lastKey -1 is the last argument, -2 the one
+// before it. A positive numKeys is the position of a "numkeys" argument that
+// is followed by the keys, and extra keys at firstKey..lastKey may be given
+// alongside it.
+type commandSpec struct {
+	flags    commandFlags
+	firstKey int
+	lastKey  int
+	step     int
+	numKeys  int
+}
+
+func readKey() commandSpec  { return commandSpec{flagReadOnly, 1, 1, 1, 0} }
+func writeKey() commandSpec { return commandSpec{flagWrite, 1, 1, 1, 0} }
+func growKey() commandSpec  { return commandSpec{flagWrite | flagDenyOOM, 1, 1, 1, 0} }
+
+var commandTable = map[string]commandSpec{
+	"INFO":         {},
+	"PING":         {},
+	"SHUTDOWN":     {},
+	"SAVE":         {},
+	"BGSAVE":       {},
+	"LASTSAVE":     {},
+	"BGREWRITEAOF": {},
+	"FLUSHALL":     {flags: flagWrite},
+	"FLUSHDB":      {flags: flagWrite},
+	"SWAPDB":       {flags: flagWrite},
+	"SELECT":       {},
+	"AUTH":         {},
+	"MULTI":        {},
+	"EXEC":         {},
+	"DISCARD":      {},
+	"SUBSCRIBE":    {},
+	"PUBLISH":      {},
+	"UNSUBSCRIBE":  {},
+	"REPLICAOF":    {},
+	"SLAVEOF":      {},
+	"ROLE":         {},
+	"REPLCONF":     {},
+	"PSYNC":        {},
+	"WAIT":         {},
+	"WAITAOF":      {},
+	"RAFT":         {},
+	"CLUSTER":      {},
+	"ASKING":       {},
+
+	"DEL":       {flagWrite, 1, -1, 1, 0},
+	"UNLINK":    {flagWrite, 1, -1, 1, 0},
+	"EXISTS":    {flagReadOnly, 1, -1, 1, 0},
+	"TOUCH":     {flagReadOnly, 1, -1, 1, 0},
+	"KEYS":      {flags: flagReadOnly},
+	"SCAN":      {flags: flagReadOnly},
+	"RANDOMKEY": {flags: flagReadOnly},
+	"DBSIZE":    {flags: flagReadOnly},
+	"TYPE":      readKey(),
+	"EXPIRE":    writeKey(),
+	"PEXPIREAT": writeKey(),
+	"TTL":       readKey(),
+	"RENAME":    {flagWrite, 1, 2, 1, 0},
+	"RENAMENX":  {flagWrite, 1, 2, 1, 0},
+	"COPY":      {flagWrite | flagDenyOOM, 1, 2, 1, 0},
+	"MOVE":      writeKey(),
+	"OBJECT":    {flagReadOnly | flagNoTouch, 2, 2, 1, 0},
+	"MEMORY":    {flagReadOnly | flagNoTouch, 2, 2, 1, 0},
+	"DUMP":      readKey(),
+	"RESTORE":   {flagWrite | flagDenyOOM | flagNoTouch, 1, 1, 1, 0},
+	// The keys of MIGRATE are found by migrateKeys
+	"MIGRATE": {flags: flagWrite},
+	"EXPORT":  {flags: flagReadOnly},
+	// IMPORT preserves the keys of its lines for snapshots itself
+	"IMPORT": {flags: flagWrite | flagDenyOOM},
+
+	"SET":    growKey(),
+	"GET":    readKey(),
+	"APPEND": growKey(),
+	"INCR":   growKey(),
+	"INCRBY": growKey(),
+	"DECR":   growKey(),
+	"DECRBY": growKey(),
+	"MSET":   {flagWrite | flagDenyOOM, 1, -1, 2, 0},
+	"MGET":   {flagReadOnly, 1, -1, 1, 0},
+
+	"LPUSH":  growKey(),
+	"RPUSH":  growKey(),
+	"LPOP":   writeKey(),
+	"RPOP":   writeKey(),
+	"LRANGE": readKey(),
+	"LLEN":   readKey(),
+
+	"HSET":         growKey(),
+	"HSETNX":       growKey(),
+	"HMSET":        growKey(),
+	"HINCRBY":      growKey(),
+	"HINCRBYFLOAT": growKey(),
+	"HSETEX":       growKey(),
+	"HGET":         readKey(),
+	"HMGET":        readKey(),
+	"HGETALL":      readKey(),
+	"HEXISTS":      readKey(),
+	"HLEN":         readKey(),
+	"HKEYS":        readKey(),
+	"HVALS":        readKey(),
+	"HSTRLEN":      readKey(),
+	"HRANDFIELD":   readKey(),
+	"HSCAN":        readKey(),
+	"HTTL":         readKey(),
+	"HPTTL":        readKey(),
+	"HEXPIRETIME":  readKey(),
+	"HPEXPIRETIME": readKey(),
+	"HDEL":         writeKey(),
+	"HEXPIRE":      writeKey(),
+	"HPEXPIRE":     writeKey(),
+	"HEXPIREAT":    writeKey(),
+	"HPEXPIREAT":   writeKey(),
+	"HPERSIST":     writeKey(),
+	"HGETEX":       writeKey(),
+	"HGETDEL":      writeKey(),
+
+	"SADD":        growKey(),
+	"SREM":        writeKey(),
+	"SPOP":        writeKey(),
+	"SMOVE":       {flagWrite, 1, 2, 1, 0},
+	"SMEMBERS":    readKey(),
+	"SISMEMBER":   readKey(),
+	"SMISMEMBER":  readKey(),
+	"SCARD":       readKey(),
+	"SRANDMEMBER": readKey(),
+	"SSCAN":       readKey(),
+	"SUNION":      {flagReadOnly, 1, -1, 1, 0},
+	"SINTER":      {flagReadOnly, 1, -1, 1, 0},
+	"SDIFF":       {flagReadOnly, 1, -1, 1, 0},
+	"SUNIONSTORE": {flagWrite | flagDenyOOM, 1, -1, 1, 0},
+	"SINTERSTORE": {flagWrite | flagDenyOOM, 1, -1, 1, 0},
+	"SDIFFSTORE":  {flagWrite | flagDenyOOM, 1, -1, 1, 0},
+	"SINTERCARD":  {flags: flagReadOnly, numKeys: 1},
+
+	"ZADD":             growKey(),
+	"ZINCRBY":          growKey(),
+	"ZREM":             writeKey(),
+	"ZREMRANGEBYRANK":  writeKey(),
+	"ZREMRANGEBYSCORE": writeKey(),
+	"ZREMRANGEBYLEX":   writeKey(),
+	"ZPOPMIN":          writeKey(),
+	"ZPOPMAX":          writeKey(),
+	"BZPOPMIN":         {flagWrite, 1, -2, 1, 0},
+	"BZPOPMAX":         {flagWrite, 1, -2, 1, 0},
+	"ZMPOP":            {flags: flagWrite, numKeys: 1},
+	"BZMPOP":           {flags: flagWrite, numKeys: 2},
+	"ZSCORE":           readKey(),
+	"ZMSCORE":          readKey(),
+	"ZCARD":            readKey(),
+	"ZCOUNT":           readKey(),
+	"ZLEXCOUNT":        readKey(),
+	"ZRANK":            readKey(),
+	"ZREVRANK":         readKey(),
+	"ZRANGE":           readKey(),
+	"ZREVRANGE":        readKey(),
+	"ZRANGEBYSCORE":    readKey(),
+	"ZREVRANGEBYSCORE": readKey(),
+	"ZRANGEBYLEX":      readKey(),
+	"ZREVRANGEBYLEX":   readKey(),
+	"ZRANDMEMBER":      readKey(),
+	"ZSCAN":            readKey(),
+	"ZRANGESTORE":      {flagWrite | flagDenyOOM, 1, 2, 1, 0},
+	"ZUNION":           {flags: flagReadOnly, numKeys: 1},
+	"ZINTER":           {flags: flagReadOnly, numKeys: 1},
+	"ZDIFF":            {flags: flagReadOnly, numKeys: 1},
+	"ZUNIONSTORE":      {flagWrite | flagDenyOOM, 1, 1, 1, 2},
+	"ZINTERSTORE":      {flagWrite | flagDenyOOM, 1, 1, 1, 2},
+	"ZDIFFSTORE":       {flagWrite | flagDenyOOM, 1, 1, 1, 2},
+
+	"GEOADD":               growKey(),
+	"GEOPOS":               readKey(),
+	"GEODIST":              readKey(),
+	"GEOHASH":              readKey(),
+	"GEOSEARCH":            readKey(),
+	"GEORADIUS_RO":         readKey(),
+	"GEORADIUSBYMEMBER_RO": readKey(),
+	"GEOSEARCHSTORE":       {flagWrite | flagDenyOOM, 1, 2, 1, 0},
+	// The STORE destination of these is found by geoRadiusStoreKeys
+	"GEORADIUS":         growKey(),
+	"GEORADIUSBYMEMBER": growKey(),
+}
+
+// commandKeys returns the key arguments of the command in parts.
+func commandKeys(parts []string) []string {
+	spec, ok := commandTable[parts[0]]
+	if !ok {
+		return nil
+	}
+	keys := make([]string, 0)
+	if spec.firstKey > 0 {
+		last := spec.lastKey
+		if last < 0 {
+			last += len(parts)
+		}
+		for i := spec.firstKey; i <= last && i < len(parts); i += spec.step {
+			keys = append(keys, parts[i])
+		}
+	}
+	if spec.numKeys > 0 && spec.numKeys < len(parts) {
+		n, err := strconv.Atoi(parts[spec.numKeys])
+		if err == nil && n > 0 && spec.numKeys+n < len(parts) {
+			keys = append(keys, parts[spec.numKeys+1:spec.numKeys+1+n]...)
+		}
+	}
+	switch parts[0] {
+	case "GEORADIUS", "GEORADIUSBYMEMBER":
+		keys = append(keys, geoRadiusStoreKeys(parts)...)
+	case "MIGRATE":
+		keys = append(keys, migrateKeys(parts)...)
+	}
+	return keys
+}
+
+// geoRadiusStoreKeys returns the STORE and STOREDIST destinations of a
+// GEORADIUS or GEORADIUSBYMEMBER command.
+func geoRadiusStoreKeys(parts []string) []string {
+	keys := make([]string, 0)
+	for i := 2; i < len(parts)-1; i++ {
+		if option := strings.ToUpper(parts[i]); option == "STORE" || option == "STOREDIST" {
+			keys = append(keys, parts[i+1])
+			i++
+		}
+	}
+	return keys
+}
+
+// migrateKeys returns the key argument of MIGRATE, or the keys following its
+// KEYS option when the key argument is empty.
+func migrateKeys(parts []string) []string {
+	if len(parts) < 6 {
+		return nil
+	}
+	if parts[3] != "" {
+		return []string{parts[3]}
+	}
+	for i := 6; i < len(parts); i++ {
+		switch strings.ToUpper(parts[i]) {
+		case "KEYS":
+			return parts[i+1:]
+		case "AUTH":
+			i++
+		case "AUTH2":
+			i += 2
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import "strings"
+
+// crc16 is the CRC-16/XMODEM variant Redis Cluster hashes keys to slots
+// with: polynomial 0x1021, no reflection, no initial or final XOR.
+
+const crc16XModem = 0x1021
+
+var crc16Table = func() *[256]uint16 {
+	table := new([256]uint16)
+	for i := range table {
+		crc := uint16(i) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ crc16XModem
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+func crc16(s string) uint16 {
+	crc := uint16(0)
+	for i := 0; i < len(s); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^s[i]]
+	}
+	return crc
+}
+
+// keyHashSlot returns the cluster slot of key. When the key has a non-empty
+// {hashtag}, only the part between the first { and the } after it is
+// hashed, so keys that share it are in the same slot.
+func keyHashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) & (clusterSlots - 1)
+}
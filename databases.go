@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The server holds a fixed number of numbered databases, each one a separate
+// KeyValueStore with its own lock. Connections start on database 0 and switch
+// with SELECT. Commands that span two databases lock them in index order.
+
+const defaultDatabases = 16
+
+var databases []*KeyValueStore
+
+func newDatabases(n int) []*KeyValueStore {
+	dbs := make([]*KeyValueStore, n)
+	for i := range dbs {
+		dbs[i] = NewKeyValueStore()
+		dbs[i].index = i
+	}
+	return dbs
+}
+
+// servedDatabases returns every database, or just kv when it is used on its
+// own, as in tests.
+func (kv *KeyValueStore) servedDatabases() []*KeyValueStore {
+	if len(databases) == 0 {
+		return []*KeyValueStore{kv}
+	}
+	return databases
+}
+
+// parseDBIndex parses a database number and checks it exists.
+func parseDBIndex(s string) (int, string) {
+	index, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, "ERR value is not an integer or out of range"
+	}
+	if index < 0 || index >= len(databases) {
+		return 0, "ERR DB index is out of range"
+	}
+	return index, ""
+}
+
+// lockPair write-locks two different databases in index order and returns
+// the function that unlocks them.
+func lockPair(a, b *KeyValueStore) func() {
+	if a.index > b.index {
+		a, b = b, a
+	}
+	a.mu.Lock()
+	b.mu.Lock()
+	return func() {
+		b.mu.Unlock()
+		a.mu.Unlock()
+	}
+}
+
+// selectCommand implements SELECT index for a connection on database db,
+// returning the reply and the database the connection is on afterwards.
+func selectCommand(parts []string, db int) (string, int) {
+	if len(parts) != 2 {
+		return "ERR SELECT requires 1 argument", db
+	}
+	index, errMsg := parseDBIndex(parts[1])
+	if errMsg != "" {
+		return errMsg, db
+	}
+	if cluster != nil && index != 0 {
+		return "ERR SELECT is not allowed in cluster mode", db
+	}
+	// Transactions belong to a database, they can't follow the connection
+	if databases[db].CurrentTx != nil {
+		return "ERR SELECT is not allowed while a transaction is open", db
+	}
+	return "OK", index
+}
+
+// flush empties the database. The caller must hold the write lock.
+func (kv *KeyValueStore) flush() {
+	kv.Strings = make(map[string]string)
+	kv.Lists = make(map[string]*List)
+	kv.Hashes = make(map[string]*Hash)
+	kv.Sets = make(map[string]*Set)
+	kv.SortedSets = make(map[string]*SortedSet)
+	kv.Expirations = make(map[string]time.Time)
+	kv.HashFieldExpirations = make(map[string]map[string]time.Time)
+	kv.accessMu.Lock()
+	kv.access = make(map[string]*keyAccess)
+	kv.accessMu.Unlock()
+	kv.dropKeyIndex()
+}
+
+// parseFlushMode accepts the optional ASYNC or SYNC argument of FLUSHDB and
+// FLUSHALL. Dropped maps are reclaimed by the garbage collector either way.
+func parseFlushMode(parts []string) string {
+	if len(parts) > 2 {
+		return fmt.Sprintf("ERR %s requires at most 1 argument", parts[0])
+	}
+	if len(parts) == 2 {
+		if mode := strings.ToUpper(parts[1]); mode != "ASYNC" && mode != "SYNC" {
+			return "ERR syntax error"
+		}
+	}
+	return ""
+}
+
+func (kv *KeyValueStore) FlushDBCommand(parts []string) string {
+	if errMsg := parseFlushMode(parts); errMsg != "" {
+		return errMsg
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.preserveAll()
+	kv.flush()
+	return "OK"
+}
+
+// FlushAllCommand empties every database, one at a time.
+func (kv *KeyValueStore) FlushAllCommand(parts []string) string {
+	if errMsg := parseFlushMode(parts); errMsg != "" {
+		return errMsg
+	}
+	for _, db := range kv.servedDatabases() {
+		db.mu.Lock()
+		db.preserveAll()
+		db.flush()
+		db.mu.Unlock()
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.CurrentTx = nil
+	return "OK"
+}
+
+// SwapDBCommand implements SWAPDB index1 index2. The data is swapped, while
+// connections stay on the database number they selected.
+func (kv *KeyValueStore) SwapDBCommand(parts []string) string {
+	if len(parts) != 3 {
+		return "ERR SWAPDB requires 2 arguments"
+	}
+	first, errMsg := parseDBIndex(parts[1])
+	if errMsg != "" {
+		return "ERR invalid first DB index"
+	}
+	second, errMsg := parseDBIndex(parts[2])
+	if errMsg != "" {
+		return "ERR invalid second DB index"
+	}
+	if first == second {
+		return "OK"
+	}
+	a, b := databases[first], databases[second]
+	unlock := lockPair(a, b)
+	defer unlock()
+	a.preserveAll()
+	b.preserveAll()
+	a.Strings, b.Strings = b.Strings, a.Strings
+	a.Lists, b.Lists = b.Lists, a.Lists
+	a.Hashes, b.Hashes = b.Hashes, a.Hashes
+	a.Sets, b.Sets = b.Sets, a.Sets
+	a.SortedSets, b.SortedSets = b.SortedSets, a.SortedSets
+	a.Expirations, b.Expirations = b.Expirations, a.Expirations
+	a.HashFieldExpirations, b.HashFieldExpirations = b.HashFieldExpirations, a.HashFieldExpirations
+	a.keys, b.keys = b.keys, a.keys
+	a.volatileKeys, b.volatileKeys = b.volatileKeys, a.volatileKeys
+	a.keySizes, b.keySizes = b.keySizes, a.keySizes
+	a.usedBytes, b.usedBytes = b.usedBytes, a.usedBytes
+	a.accessMu.Lock()
+	b.accessMu.Lock()
+	a.access, b.access = b.access, a.access
+	b.accessMu.Unlock()
+	a.accessMu.Unlock()
+
+	// Clients blocked in either database may find their keys now
+	for _, db := range []*KeyValueStore{a, b} {
+		for key := range db.blocked {
+			db.signalKeyReady(key)
+		}
+	}
+	return "OK"
+}
+
+// MoveCommand implements MOVE key db. Nothing happens if the key is missing
+// or already exists in the target database.
+func (kv *KeyValueStore) MoveCommand(parts []string) string {
+	if len(parts) != 3 {
+		return "ERR MOVE requires 2 arguments"
+	}
+	index, errMsg := parseDBIndex(parts[2])
+	if errMsg != "" {
+		return errMsg
+	}
+	if index == kv.index {
+		return "ERR source and destination objects are the same"
+	}
+	target := databases[index]
+	unlock := lockPair(kv, target)
+	defer unlock()
+	key := parts[1]
+	kv.expireHashFields(key)
+	value, exists := kv.getKeyValue(key)
+	if !exists || target.keyExists(key) {
+		return "(integer) 0"
+	}
+	target.preserveKeys(key)
+	target.deleteKey(key)
+	target.setKeyValue(key, value)
+	// The value now belongs to target, so only drop the references here
+	kv.deleteKey(key)
+	return "(integer) 1"
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestMoveSwapAndCopyAcrossDatabases(t *testing.T) {
+	databases = newDatabases(3)
+	defer func() { databases = nil }()
+	db0, db1 := databases[0], databases[1]
+
+	db0.executeCommand([]string{"SET", "a", "1"})
+	db1.executeCommand([]string{"SET", "b", "2"})
+	if got := db0.executeCommand([]string{"MOVE", "a", "1"}); got != "(integer) 1" {
+		t.Fatalf("Expected MOVE to succeed, Got: %q", got)
+	}
+	if got := db0.executeCommand([]string{"MOVE", "a", "1"}); got != "(integer) 0" {
+		t.Fatalf("Expected MOVE of a missing key to fail, Got: %q", got)
+	}
+	if got := db1.executeCommand([]string{"MOVE", "a", "1"}); got != "ERR source and destination objects are the same" {
+		t.Fatalf("Expected a same database error, Got: %q", got)
+	}
+
+	if got := db0.executeCommand([]string{"SWAPDB", "0", "1"}); got != "OK" {
+		t.Fatalf("Expected SWAPDB to succeed, Got: %q", got)
+	}
+	if got := db0.executeCommand([]string{"KEYS", "*"}); got != "a b" {
+		t.Fatalf("Expected database 0 to hold a and b, Got: %q", got)
+	}
+	if got := db1.executeCommand([]string{"DBSIZE"}); got != "(integer) 0" {
+		t.Fatalf("Expected database 1 to be empty, Got: %q", got)
+	}
+
+	if got := db0.executeCommand([]string{"COPY", "a", "a", "DB", "2"}); got != "(integer) 1" {
+		t.Fatalf("Expected COPY to database 2 to succeed, Got: %q", got)
+	}
+	if got := databases[2].executeCommand([]string{"GET", "a"}); got != "1" {
+		t.Fatalf("Expected the copy in database 2, Got: %q", got)
+	}
+	if got := db0.executeCommand([]string{"FLUSHDB"}); got != "OK" || db0.keyExists("a") || !databases[2].keyExists("a") {
+		t.Fatalf("Expected FLUSHDB to only empty database 0, Got: %q", got)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/dhravya/radish/internal/datafile"
+)
+
+// Data files are framed by package datafile: a header, the gob-encoded
+// persistedDatabases and a checksum. Files written before there was a
+// header are version 0. Older versions are migrated to the current layout
+// when loaded, and written in the current version on the next save.
+
+// loadCorruptedData lets the server start empty when the data file can't be
+// loaded, instead of refusing to.
+var loadCorruptedData = false
+
+// writeDataFile writes databases to w in the current data file format.
+func writeDataFile(w io.Writer, databases []*KeyValueStore) error {
+	persisted := persistedDatabases{Databases: make([]*storedDatabase, len(databases))}
+	for i, kv := range databases {
+		persisted.Databases[i] = kv.store()
+	}
+	return datafile.Write(w, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(persisted)
+	})
+}
+
+// readDataFile loads a data file with a header from r into databases. It
+// refuses files with a wrong checksum, so nothing is loaded from them.
+func readDataFile(r io.Reader, databases []*KeyValueStore) error {
+	var persisted *persistedDatabases
+	header, err := datafile.Read(r, func(r io.Reader, version int) error {
+		var err error
+		persisted, err = decodeDataFile(r, version)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	adoptDatabases(persisted, databases)
+	log.Printf("Loaded a version %d data file written at %s", header.Version, header.Created.Format(time.RFC3339))
+	return nil
+}
+
+// decodeDataFile decodes the body of a data file of the given version and
+// migrates it to the current layout. A new version adds a case decoding the
+// layout it replaces and converting it.
+func decodeDataFile(r io.Reader, version int) (*persistedDatabases, error) {
+	switch version {
+	case 1:
+		var persisted persistedDatabases
+		if err := gob.NewDecoder(r).Decode(&persisted); err != nil {
+			return nil, err
+		}
+		return &persisted, nil
+	}
+	return nil, fmt.Errorf("no loader for version %d", version)
+}
+
+// adoptDatabases moves the databases of persisted into databases.
+func adoptDatabases(persisted *persistedDatabases, databases []*KeyValueStore) {
+	for i, loaded := range persisted.Databases {
+		if i >= len(databases) {
+			log.Printf("Data file holds %d databases, only the first %d were loaded", len(persisted.Databases), len(databases))
+			break
+		}
+		databases[i].adopt(loaded)
+	}
+}
+
+// dropExpired deletes the keys and hash fields whose TTL passed while the
+// dataset was on disk. The caller must hold the write lock.
+func (kv *KeyValueStore) dropExpired() int {
+	dropped := 0
+	for key := range kv.Expirations {
+		if !kv.keyExpired(key) {
+			continue
+		}
+		if kv.keyStored(key) {
+			dropped++
+		}
+		kv.deleteKey(key)
+	}
+	for key := range kv.HashFieldExpirations {
+		kv.expireHashFields(key)
+	}
+	return dropped
+}
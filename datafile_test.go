@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/gob"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dhravya/radish/internal/datafile"
+)
+
+func TestDataFileRoundTripDropsExpiredKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.gob")
+	dbs := newDatabases(2)
+	dbs[0].executeCommand([]string{"SET", "kept", "v"})
+	dbs[0].executeCommand([]string{"SET", "ttl", "v"})
+	dbs[0].executeCommand([]string{"EXPIRE", "ttl", "100"})
+	dbs[0].executeCommand([]string{"SET", "expired", "v"})
+	dbs[0].executeCommand([]string{"HSET", "hash", "f1", "v1", "f2", "v2"})
+	dbs[1].executeCommand([]string{"RPUSH", "list", "a", "b"})
+	if err := newPersistence(dbs, path).saveData(); err != nil {
+		t.Fatalf("Expected the data file to be saved, Got: %v", err)
+	}
+	contents, _ := os.ReadFile(path)
+	if string(contents[:len(datafile.Magic)]) != datafile.Magic {
+		t.Fatalf("Expected the data file to start with its header")
+	}
+
+	// Expire a key and a field as if the server had been down for a while
+	loaded := newDatabases(2)
+	p := newPersistence(loaded, path)
+	if err := readDataFile(mustOpen(t, path), loaded); err != nil {
+		t.Fatalf("Expected the data file to load, Got: %v", err)
+	}
+	loaded[0].Expirations["expired"] = time.Now().Add(-time.Second)
+	loaded[0].HashFieldExpirations["hash"] = map[string]time.Time{"f1": time.Now().Add(-time.Second)}
+	if err := p.saveData(); err != nil {
+		t.Fatalf("Expected the data file to be saved, Got: %v", err)
+	}
+	loaded = newDatabases(2)
+	if _, err := NewPersistence(loaded, path); err != nil {
+		t.Fatalf("Expected the data file to load, Got: %v", err)
+	}
+	for _, check := range []struct {
+		db       int
+		command  []string
+		expected string
+	}{
+		{0, []string{"GET", "kept"}, "v"},
+		{0, []string{"GET", "expired"}, "(nil)"},
+		{0, []string{"HGETALL", "hash"}, multiBulkReply([]string{"f2", "v2"})},
+		{1, []string{"LRANGE", "list", "0", "-1"}, "a b"},
+	} {
+		if got := loaded[check.db].executeCommand(check.command); got != check.expected {
+			t.Fatalf("%v: expected %q, Got: %q", check.command, check.expected, got)
+		}
+	}
+	if _, stored := loaded[0].Strings["expired"]; stored {
+		t.Fatalf("Expected the expired key to be dropped on load")
+	}
+	if time.Until(loaded[0].Expirations["ttl"]) < 99*time.Second {
+		t.Fatalf("Expected the TTL to survive the restart")
+	}
+}
+
+func mustOpen(t *testing.T, path string) *os.File {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Expected %s to open, Got: %v", path, err)
+	}
+	t.Cleanup(func() { file.Close() })
+	return file
+}
+
+func TestCorruptedDataFileIsRefused(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.gob")
+	dbs := newDatabases(1)
+	for _, key := range []string{"a", "b", "c"} {
+		dbs[0].executeCommand([]string{"SET", key, "value"})
+	}
+	if err := newPersistence(dbs, path).saveData(); err != nil {
+		t.Fatalf("Expected the data file to be saved, Got: %v", err)
+	}
+	contents, _ := os.ReadFile(path)
+
+	flipped := append([]byte(nil), contents...)
+	flipped[len(flipped)-12] ^= 0xff
+	newer := append([]byte(nil), contents...)
+	newer[len(datafile.Magic)+1] = datafile.Version + 1
+	for name, corrupted := range map[string][]byte{
+		"flipped byte":  flipped,
+		"truncated":     contents[:len(contents)-5],
+		"trailing data": append(append([]byte(nil), contents...), 0),
+		"newer version": newer,
+	} {
+		os.WriteFile(path, corrupted, 0644)
+		loaded := newDatabases(1)
+		_, err := NewPersistence(loaded, path)
+		if !errors.Is(err, datafile.ErrBadFormat) {
+			t.Fatalf("%s: expected the data file to be refused, Got: %v", name, err)
+		}
+		if got := loaded[0].executeCommand([]string{"DBSIZE"}); got != "(integer) 0" {
+			t.Fatalf("%s: expected nothing to be loaded, Got: %q", name, got)
+		}
+	}
+
+	loadCorruptedData = true
+	defer func() { loadCorruptedData = false }()
+	if _, err := NewPersistence(newDatabases(1), path); err != nil {
+		t.Fatalf("Expected the override to start empty, Got: %v", err)
+	}
+	if _, err := os.Stat(path + ".corrupted"); err != nil {
+		t.Fatalf("Expected the corrupted file to be kept aside, Got: %v", err)
+	}
+}
+
+func TestUnversionedDataFileIsMigrated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.gob")
+	file, _ := os.Create(path)
+	gob.NewEncoder(file).Encode(persistedDatabases{Databases: []*storedDatabase{{
+		Strings:     map[string]string{"old": "value", "gone": "value"},
+		Expirations: map[string]time.Time{"gone": time.Now().Add(-time.Hour)},
+	}}})
+	file.Close()
+
+	loaded := newDatabases(1)
+	p, err := NewPersistence(loaded, path)
+	if err != nil {
+		t.Fatalf("Expected the version 0 file to load, Got: %v", err)
+	}
+	if got := loaded[0].executeCommand([]string{"GET", "old"}); got != "value" {
+		t.Fatalf("Expected the version 0 data to be migrated, Got: %q", got)
+	}
+	if _, stored := loaded[0].Strings["gone"]; stored {
+		t.Fatalf("Expected the expired key to be dropped on load")
+	}
+	p.saveData()
+	if err := readDataFile(mustOpen(t, path), newDatabases(1)); err != nil {
+		t.Fatalf("Expected the next save to write the current version, Got: %v", err)
+	}
+}
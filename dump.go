@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dhravya/radish/internal/rdb"
+)
+
+// A DUMP payload is a single RDB encoded value followed by the two byte RDB
+// version that wrote it and a CRC-64 of everything before the checksum, both
+// little endian, exactly like in Redis.
+
+func createDumpPayload(v keyValue) []byte {
+	payload := appendRDBValue(nil, v)
+	payload = binary.LittleEndian.AppendUint16(payload, rdb.Version)
+	return binary.LittleEndian.AppendUint64(payload, rdb.CRC64(0, payload))
+}
+
+// parseDumpPayload verifies the footer of payload and decodes its value.
+func parseDumpPayload(payload []byte) (keyValue, string) {
+	if len(payload) < 10 {
+		return keyValue{}, "ERR DUMP payload version or checksum are wrong"
+	}
+	footer := payload[len(payload)-10:]
+	version := binary.LittleEndian.Uint16(footer)
+	checksum := binary.LittleEndian.Uint64(footer[2:])
+	if version > rdb.Version || rdb.CRC64(0, payload[:len(payload)-8]) != checksum {
+		return keyValue{}, "ERR DUMP payload version or checksum are wrong"
+	}
+	r := rdb.NewReader(bytes.NewReader(payload[:len(payload)-10]))
+	typ, err := r.ReadByte()
+	if err != nil {
+		return keyValue{}, "ERR Bad data format"
+	}
+	value, err := r.ReadValue(typ)
+	if err != nil {
+		return keyValue{}, "ERR Bad data format"
+	}
+	v, err := keyValueFromRDB(value)
+	if err != nil {
+		return keyValue{}, "ERR Bad data format"
+	}
+	if _, err := r.ReadByte(); err == nil {
+		return keyValue{}, "ERR Bad data format"
+	}
+	return v, ""
+}
+
+func (kv *KeyValueStore) DumpCommand(parts []string) string {
+	if len(parts) != 2 {
+		return "ERR DUMP requires 1 argument"
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	key := parts[1]
+	kv.expireHashFields(key)
+	v, exists := kv.getKeyValue(key)
+	if !exists {
+		return "(nil)"
+	}
+	return string(createDumpPayload(v))
+}
+
+// RestoreCommand implements
+// RESTORE key ttl serialized-value [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency]
+func (kv *KeyValueStore) RestoreCommand(parts []string) string {
+	if len(parts) < 4 {
+		return "ERR RESTORE requires at least 3 arguments"
+	}
+	var replace, absTTL bool
+	idleTime, freq := int64(-1), int64(-1)
+	for i := 4; i < len(parts); i++ {
+		switch strings.ToUpper(parts[i]) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absTTL = true
+		case "IDLETIME":
+			if i+1 >= len(parts) {
+				return "ERR syntax error"
+			}
+			n, err := strconv.ParseInt(parts[i+1], 10, 64)
+			if err != nil || n < 0 {
+				return "ERR Invalid IDLETIME value, must be >= 0"
+			}
+			idleTime = n
+			i++
+		case "FREQ":
+			if i+1 >= len(parts) {
+				return "ERR syntax error"
+			}
+			n, err := strconv.ParseInt(parts[i+1], 10, 64)
+			if err != nil || n < 0 || n > lfuMaxCounter {
+				return "ERR Invalid FREQ value, must be >= 0 and <= 255"
+			}
+			freq = n
+			i++
+		default:
+			return "ERR syntax error"
+		}
+	}
+	ttl, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return "ERR value is not an integer or out of range"
+	}
+	if ttl < 0 {
+		return "ERR Invalid TTL value, must be >= 0"
+	}
+	v, errMsg := parseDumpPayload([]byte(parts[3]))
+	if errMsg != "" {
+		return errMsg
+	}
+	if ttl > 0 {
+		if absTTL {
+			v.expireAt = time.UnixMilli(ttl)
+		} else {
+			v.expireAt = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+		}
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	key := parts[1]
+	if kv.keyExists(key) && !replace {
+		return "BUSYKEY Target key name already exists."
+	}
+	kv.deleteKey(key)
+	// A deadline in the past means the key would be gone already
+	if !v.expireAt.IsZero() && !time.Now().Before(v.expireAt) {
+		return "OK"
+	}
+	kv.setKeyValue(key, v)
+	kv.expireHashFields(key)
+	if idleTime >= 0 || freq >= 0 {
+		kv.setKeyAccess(key, idleTime, freq)
+	}
+	return "OK"
+}
+
+// MigrateCommand implements
+// MIGRATE host port <key | ""> destination-db timeout [COPY] [REPLACE]
+// [AUTH password | AUTH2 username password] [KEYS key [key ...]]
+// The lock is held for the whole transfer, so the keys move atomically.
+func (kv *KeyValueStore) MigrateCommand(parts []string) string {
+	if len(parts) < 6 {
+		return "ERR MIGRATE requires at least 5 arguments"
+	}
+	var copyKeys, replace bool
+	var auth []string
+	keys := []string{parts[3]}
+	for i := 6; i < len(parts); i++ {
+		switch strings.ToUpper(parts[i]) {
+		case "COPY":
+			copyKeys = true
+		case "REPLACE":
+			replace = true
+		case "AUTH":
+			if i+1 >= len(parts) {
+				return "ERR syntax error"
+			}
+			auth = []string{"AUTH", parts[i+1]}
+			i++
+		case "AUTH2":
+			if i+2 >= len(parts) {
+				return "ERR syntax error"
+			}
+			auth = []string{"AUTH", parts[i+1], parts[i+2]}
+			i += 2
+		case "KEYS":
+			if parts[3] != "" {
+				return "ERR When using MIGRATE KEYS option, the key argument must be set to the empty string"
+			}
+			keys = parts[i+1:]
+			i = len(parts)
+		default:
+			return "ERR syntax error"
+		}
+	}
+	db, err := strconv.Atoi(parts[4])
+	if err != nil {
+		return "ERR value is not an integer or out of range"
+	}
+	timeout, err := strconv.ParseInt(parts[5], 10, 64)
+	if err != nil {
+		return "ERR value is not an integer or out of range"
+	}
+	if timeout <= 0 {
+		timeout = 1000
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	// Locally MIGRATE only deletes the keys it moved, if any
+	var moved []string
+	defer func() {
+		if len(moved) > 0 {
+			propagateInstead(append([]string{"DEL"}, moved...))
+		} else {
+			propagateInstead()
+		}
+	}()
+	type dumped struct {
+		key     string
+		ttl     int64
+		payload string
+	}
+	batch := make([]dumped, 0, len(keys))
+	for _, key := range keys {
+		kv.expireHashFields(key)
+		v, exists := kv.getKeyValue(key)
+		if !exists {
+			continue
+		}
+		ttl := int64(0)
+		if !v.expireAt.IsZero() {
+			ttl = max(time.Until(v.expireAt).Milliseconds(), 1)
+		}
+		batch = append(batch, dumped{key, ttl, string(createDumpPayload(v))})
+	}
+	if len(batch) == 0 {
+		return "NOKEY"
+	}
+
+	client, err := dialRedis(net.JoinHostPort(parts[1], parts[2]), time.Duration(timeout)*time.Millisecond)
+	if err != nil {
+		return "IOERR error or timeout connecting to the client"
+	}
+	defer client.Close()
+	if auth != nil {
+		if err := client.expectOK(auth...); err != nil {
+			return migrateError(err)
+		}
+	}
+	if db != 0 {
+		if err := client.expectOK("SELECT", strconv.Itoa(db)); err != nil {
+			return migrateError(err)
+		}
+	}
+	for _, d := range batch {
+		// A cluster node importing the slot only takes the keys when asked
+		if cluster != nil {
+			if err := client.expectOK("ASKING"); err != nil {
+				return migrateError(err)
+			}
+		}
+		restore := []string{"RESTORE", d.key, strconv.FormatInt(d.ttl, 10), d.payload}
+		if replace {
+			restore = append(restore, "REPLACE")
+		}
+		if err := client.expectOK(restore...); err != nil {
+			return migrateError(err)
+		}
+		if !copyKeys {
+			kv.deleteKey(d.key)
+			moved = append(moved, d.key)
+		}
+	}
+	return "OK"
+}
+
+func migrateError(err error) string {
+	if reply, ok := err.(redisError); ok {
+		return fmt.Sprintf("ERR Target instance replied with error: %s", string(reply))
+	}
+	return "IOERR error or timeout reading to target instance"
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDumpPayloadCompatibleWithRedis(t *testing.T) {
+	// DUMP of the string "12345" as written by Redis 7.4
+	expected := "\x00\xc1\x39\x30\x0c\x00"
+	payload := string(createDumpPayload(keyValue{typ: "string", str: "12345"}))
+	if !strings.HasPrefix(payload, expected) || len(payload) != len(expected)+8 {
+		t.Fatalf("Expected %q followed by the checksum, Got: %q", expected, payload)
+	}
+}
+
+func TestDumpRestoreRoundTrip(t *testing.T) {
+	kv := NewKeyValueStore()
+	kv.executeCommand([]string{"SET", "string", "binary\x00\r\nvalue"})
+	kv.executeCommand([]string{"SET", "int", "-70000"})
+	kv.executeCommand([]string{"RPUSH", "list", "a", "1", strings.Repeat("x", 20000)})
+	kv.executeCommand([]string{"HSET", "hash", "f1", "v1", "f2", "v2"})
+	kv.executeCommand([]string{"HEXPIRE", "hash", "100", "FIELDS", "1", "f1"})
+	kv.executeCommand([]string{"SADD", "set", "a", "b"})
+	kv.executeCommand([]string{"ZADD", "zset", "1.5", "a", "-inf", "b"})
+
+	for _, key := range []string{"string", "int", "list", "hash", "set", "zset"} {
+		payload := kv.executeCommand([]string{"DUMP", key})
+		if got := kv.executeCommand([]string{"RESTORE", key + ":copy", "0", payload}); got != "OK" {
+			t.Fatalf("RESTORE of %s: expected OK, Got: %q", key, got)
+		}
+		original, _ := kv.getKeyValue(key)
+		restored, _ := kv.getKeyValue(key + ":copy")
+		if string(createDumpPayload(original)) != string(createDumpPayload(restored)) && key != "hash" && key != "set" {
+			t.Fatalf("Expected %s to survive a round trip", key)
+		}
+	}
+	if got := kv.executeCommand([]string{"HGETALL", "hash:copy"}); got != multiBulkReply([]string{"f1", "v1", "f2", "v2"}) && got != multiBulkReply([]string{"f2", "v2", "f1", "v1"}) {
+		t.Fatalf("Expected both hash fields, Got: %q", got)
+	}
+	deadline := kv.HashFieldExpirations["hash:copy"]["f1"]
+	if time.Until(deadline) < 99*time.Second {
+		t.Fatalf("Expected the field TTL to survive, Got: %v", deadline)
+	}
+	if got := kv.executeCommand([]string{"SMEMBERS", "set:copy"}); got != "a b" && got != "b a" {
+		t.Fatalf("Expected both set members, Got: %q", got)
+	}
+
+	payload := kv.executeCommand([]string{"DUMP", "string"})
+	corrupted := payload[:2] + "X" + payload[3:]
+	if got := kv.executeCommand([]string{"RESTORE", "bad", "0", corrupted}); got != "ERR DUMP payload version or checksum are wrong" {
+		t.Fatalf("Expected a checksum error, Got: %q", got)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// When maxmemory is set, commands that may grow the dataset first evict keys
+// until the used memory is back under the limit, like Redis does. Candidates
+// are picked the way Redis picks them: a few keys are sampled from every
+// database, and the best ones are kept in a small pool across evictions, so
+// LRU, LFU and TTL ordering are approximated without tracking every key.
+
+type evictionPolicy int
+
+const (
+	policyNoEviction evictionPolicy = iota
+	policyAllKeysLRU
+	policyAllKeysLFU
+	policyAllKeysRandom
+	policyVolatileLRU
+	policyVolatileLFU
+	policyVolatileRandom
+	policyVolatileTTL
+)
+
+var evictionPolicyNames = []string{
+	"noeviction",
+	"allkeys-lru",
+	"allkeys-lfu",
+	"allkeys-random",
+	"volatile-lru",
+	"volatile-lfu",
+	"volatile-random",
+	"volatile-ttl",
+}
+
+func (p evictionPolicy) String() string {
+	return evictionPolicyNames[p]
+}
+
+// volatile reports whether the policy only evicts keys with a TTL.
+func (p evictionPolicy) volatile() bool {
+	return p >= policyVolatileLRU
+}
+
+// lfu reports whether the policy evicts the least frequently used keys.
+func (p evictionPolicy) lfu() bool {
+	return p == policyAllKeysLFU || p == policyVolatileLFU
+}
+
+func parseEvictionPolicy(s string) (evictionPolicy, bool) {
+	for i, name := range evictionPolicyNames {
+		if strings.EqualFold(s, name) {
+			return evictionPolicy(i), true
+		}
+	}
+	return policyNoEviction, false
+}
+
+// parseMemorySize parses sizes like 100mb, 1gb or 4096, with the units Redis
+// accepts in its configuration.
+func parseMemorySize(s string) (int64, bool) {
+	units := []struct {
+		suffix string
+		factor int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+	s = strings.ToLower(s)
+	factor := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(s, unit.suffix) {
+			s, factor = strings.TrimSuffix(s, unit.suffix), unit.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/factor {
+		return 0, false
+	}
+	return n * factor, true
+}
+
+const evictionPoolSize = 16
+
+// oomReply refuses a command that would add to the dataset over maxmemory.
+const oomReply = "OOM command not allowed when used memory > 'maxmemory'."
+
+var (
+	// maxMemory is the limit in bytes, 0 means no limit
+	maxMemory        int64
+	maxMemoryPolicy  = policyNoEviction
+	maxMemorySamples = 5
+
+	evictedKeys atomic.Int64
+)
+
+type evictionCandidate struct {
+	db    *KeyValueStore
+	key   string
+	score int64
+}
+
+// evictor holds the candidate pool, ordered from the worst to the best
+// candidate, and the database random eviction goes to next.
+var evictor struct {
+	mu     sync.Mutex
+	pool   []evictionCandidate
+	nextDB int
+}
+
+// freeMemoryIfNeeded evicts keys from all databases until the used memory is
+// under maxmemory. It reports false if that could not be done, in which case
+// the command must be refused. No database lock may be held by the caller.
+func (kv *KeyValueStore) freeMemoryIfNeeded() bool {
+	if maxMemory <= 0 {
+		return true
+	}
+	evictor.mu.Lock()
+	defer evictor.mu.Unlock()
+	for kv.usedMemory() > maxMemory {
+		if maxMemoryPolicy == policyNoEviction || !kv.evictKey() {
+			return false
+		}
+	}
+	return true
+}
+
+// evictKey evicts a single key according to maxMemoryPolicy. It reports
+// false when there is no key the policy allows to evict.
+func (kv *KeyValueStore) evictKey() bool {
+	dbs := kv.servedDatabases()
+	if maxMemoryPolicy == policyAllKeysRandom || maxMemoryPolicy == policyVolatileRandom {
+		// Go through the databases in turn, so they are all evicted from
+		for range dbs {
+			db := dbs[evictor.nextDB%len(dbs)]
+			evictor.nextDB++
+			if evictKeyFrom(db, maxMemoryPolicy.volatile(), nil) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Candidates may have been deleted since they were pooled, in which case
+	// the pool is drained and filled again
+	for attempt := 0; attempt < evictionPoolSize; attempt++ {
+		for _, db := range dbs {
+			db.fillEvictionPool()
+		}
+		if len(evictor.pool) == 0 {
+			return false
+		}
+		for len(evictor.pool) > 0 {
+			best := evictor.pool[len(evictor.pool)-1]
+			evictor.pool = evictor.pool[:len(evictor.pool)-1]
+			if evictKeyFrom(best.db, maxMemoryPolicy.volatile(), &best.key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// evictKeyFrom deletes key from db, or a random key when key is nil. With
+// volatile set, only a key with a TTL may go.
+func evictKeyFrom(db *KeyValueStore, volatile bool, key *string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if key == nil {
+		sample := db.sampleKeys(1, volatile)
+		if len(sample) == 0 {
+			return false
+		}
+		key = &sample[0]
+	}
+	if _, hasTTL := db.Expirations[*key]; !db.keyStored(*key) || volatile && !hasTTL {
+		return false
+	}
+	db.preserveKeys(*key)
+	// Expired keys still take memory, they just don't count as evicted
+	if db.deleteKey(*key) {
+		evictedKeys.Add(1)
+	}
+	propagate(db.index, []string{"DEL", *key})
+	return true
+}
+
+// fillEvictionPool samples keys of the database and adds those that are
+// better candidates than the ones already pooled.
+func (kv *KeyValueStore) fillEvictionPool() {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	now := time.Now()
+	for _, key := range kv.sampleKeys(maxMemorySamples, maxMemoryPolicy.volatile()) {
+		candidate := evictionCandidate{db: kv, key: key, score: kv.evictionScore(key, now)}
+		i := sort.Search(len(evictor.pool), func(i int) bool {
+			return evictor.pool[i].score > candidate.score
+		})
+		pooled := false
+		for _, c := range evictor.pool {
+			if c.db == kv && c.key == key {
+				pooled = true
+				break
+			}
+		}
+		if pooled || (i == 0 && len(evictor.pool) == evictionPoolSize) {
+			continue
+		}
+		evictor.pool = append(evictor.pool, evictionCandidate{})
+		copy(evictor.pool[i+1:], evictor.pool[i:])
+		evictor.pool[i] = candidate
+		if len(evictor.pool) > evictionPoolSize {
+			evictor.pool = evictor.pool[1:]
+		}
+	}
+}
+
+// evictionScore rates key for the current policy, higher scores are evicted
+// first. Keys never accessed since startup count as idle since then. The
+// caller must hold the read lock.
+func (kv *KeyValueStore) evictionScore(key string, now time.Time) int64 {
+	switch maxMemoryPolicy {
+	case policyVolatileTTL:
+		return math.MaxInt64 - kv.Expirations[key].UnixNano()
+	case policyAllKeysLFU, policyVolatileLFU:
+		kv.accessMu.Lock()
+		defer kv.accessMu.Unlock()
+		if access, exists := kv.access[key]; exists {
+			return lfuMaxCounter - int64(access.decayedCounter(now))
+		}
+		return lfuMaxCounter - lfuInitValue
+	default:
+		kv.accessMu.Lock()
+		defer kv.accessMu.Unlock()
+		if access, exists := kv.access[key]; exists {
+			return int64(now.Sub(access.lastAccess))
+		}
+		return int64(now.Sub(serverStartTime))
+	}
+}
+
+// sampleKeys returns up to n distinct keys of the database, each as likely
+// to be picked as any other. Map iteration order isn't uniform, so the keys
+// are picked at random from the key index. The caller must hold the lock.
+func (kv *KeyValueStore) sampleKeys(n int, volatile bool) []string {
+	return kv.keyIndex(volatile).sample(n)
+}
+
+// keyStored reports whether key holds a value, even an expired one.
+func (kv *KeyValueStore) keyStored(key string) bool {
+	_, isString := kv.Strings[key]
+	_, isList := kv.Lists[key]
+	_, isHash := kv.Hashes[key]
+	_, isSet := kv.Sets[key]
+	_, isSortedSet := kv.SortedSets[key]
+	return isString || isList || isHash || isSet || isSortedSet
+}
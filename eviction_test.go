@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func setEvictionPolicy(t *testing.T, limit int64, policy evictionPolicy) {
+	t.Helper()
+	maxMemory, maxMemoryPolicy, maxMemorySamples = limit, policy, 10
+	evictor.pool = nil
+	t.Cleanup(func() {
+		maxMemory, maxMemoryPolicy, maxMemorySamples = 0, policyNoEviction, 5
+		evictor.pool = nil
+	})
+}
+
+func TestParseMemorySize(t *testing.T) {
+	cases := map[string]int64{"0": 0, "4096": 4096, "100mb": 100 << 20, "2GB": 2 << 30, "1k": 1000}
+	for input, expected := range cases {
+		if got, ok := parseMemorySize(input); !ok || got != expected {
+			t.Fatalf("parseMemorySize(%q): expected %d, Got: %d", input, expected, got)
+		}
+	}
+	if _, ok := parseMemorySize("lots"); ok {
+		t.Fatalf("Expected an invalid size to be rejected")
+	}
+}
+
+func TestNoEvictionRefusesWrites(t *testing.T) {
+	kv := NewKeyValueStore()
+	kv.executeCommand([]string{"SET", "a", "1"})
+	setEvictionPolicy(t, 1, policyNoEviction)
+
+	if got := kv.executeCommand([]string{"SET", "b", "2"}); got != "OOM command not allowed when used memory > 'maxmemory'." {
+		t.Fatalf("Expected an OOM error, Got: %q", got)
+	}
+	if got := kv.executeCommand([]string{"GET", "a"}); got != "1" {
+		t.Fatalf("Expected reads to keep working, Got: %q", got)
+	}
+	if got := kv.executeCommand([]string{"DEL", "a"}); got != "(integer) 1" {
+		t.Fatalf("Expected deletes to keep working, Got: %q", got)
+	}
+}
+
+func TestEvictionPicksTheBestCandidate(t *testing.T) {
+	kv := NewKeyValueStore()
+	for _, key := range []string{"soon", "later", "never"} {
+		kv.executeCommand([]string{"SET", key, "v"})
+	}
+	kv.executeCommand([]string{"EXPIRE", "soon", "10"})
+	kv.executeCommand([]string{"EXPIRE", "later", "1000"})
+
+	evictedBefore := evictedKeys.Load()
+	// Without a limit nothing is evicted on writes, only explicitly here
+	setEvictionPolicy(t, 0, policyVolatileTTL)
+	if !kv.evictKey() || kv.keyExists("soon") || !kv.keyExists("later") {
+		t.Fatalf("Expected volatile-ttl to evict the key closest to expiring")
+	}
+	if !kv.evictKey() || kv.keyExists("later") {
+		t.Fatalf("Expected volatile-ttl to evict the remaining volatile key")
+	}
+	if kv.evictKey() || !kv.keyExists("never") {
+		t.Fatalf("Expected volatile-ttl to leave keys without a TTL alone")
+	}
+
+	setEvictionPolicy(t, 0, policyAllKeysLRU)
+	kv.executeCommand([]string{"SET", "recent", "v"})
+	kv.access["never"].lastAccess = time.Now().Add(-time.Hour)
+	if !kv.evictKey() || kv.keyExists("never") || !kv.keyExists("recent") {
+		t.Fatalf("Expected allkeys-lru to evict the idlest key")
+	}
+	if got := evictedKeys.Load() - evictedBefore; got != 3 {
+		t.Fatalf("Expected 3 evicted keys, Got: %d", got)
+	}
+}
+
+func TestSampleKeysIsUniform(t *testing.T) {
+	kv := NewKeyValueStore()
+	for i := 0; i < 100; i++ {
+		kv.executeCommand([]string{"SET", fmt.Sprintf("k%d", i), "v"})
+	}
+	const draws = 100000
+	picked := make(map[string]int)
+	for i := 0; i < draws; i++ {
+		picked[kv.sampleKeys(1, false)[0]]++
+	}
+	// Each key is expected 1000 times, where map iteration starts favours
+	// some keys over others
+	for key, count := range picked {
+		if count < 850 || count > 1150 {
+			t.Fatalf("Expected %s to be sampled about 1000 times, Got: %d", key, count)
+		}
+	}
+	if len(picked) != 100 {
+		t.Fatalf("Expected every key to be sampled, Got: %v", picked)
+	}
+}
+
+func TestEvictionKeepsEstimateUnderMaxMemory(t *testing.T) {
+	kv := NewKeyValueStore()
+	kv.executeCommand([]string{"SET", "k0", "v"})
+	perKey := kv.usedMemory()
+	setEvictionPolicy(t, 10*perKey, policyAllKeysRandom)
+	for i := 1; i < 100; i++ {
+		if got := kv.executeCommand([]string{"SET", fmt.Sprintf("k%d", i), "v"}); got != "OK" {
+			t.Fatalf("Expected writes to evict keys, Got: %q", got)
+		}
+	}
+	// The limit is checked before each write, so the last one may exceed it
+	if used := kv.usedMemory(); used > 11*perKey {
+		t.Fatalf("Expected at most %d bytes to be used, Got: %d", 11*perKey, used)
+	}
+	if got := kv.executeCommand([]string{"DBSIZE"}); got != "(integer) 11" {
+		t.Fatalf("Expected 11 keys to be left, Got: %q", got)
+	}
+}
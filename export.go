@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// EXPORT and IMPORT move keys around as JSON lines, one object per key, so
+// that a dataset can be read and edited by hand:
+//
+//	{"key":"user:1","type":"hash","ttl":5000,"value":{"name":"Ada"}}
+//
+// ttl is the remaining time to live in milliseconds, left out when the key
+// has none, and field_ttl holds the same for the fields of a hash. Strings
+// are written as JSON strings, lists and sets as arrays of them, hashes as
+// objects and sorted sets as arrays of {"member","score"} in rank order,
+// with the score formatted like in replies so that infinities fit. JSON only
+// holds UTF-8 text, so when any string of the value isn't, the record has
+// "base64":true and all of them, hash fields included, are base64 encoded.
+// A key that isn't is encoded on its own and flagged with "key_base64".
+
+type exportRecord struct {
+	Key       string           `json:"key"`
+	KeyBase64 bool             `json:"key_base64,omitempty"`
+	Type      string           `json:"type"`
+	TTL       int64            `json:"ttl,omitempty"`
+	FieldTTL  map[string]int64 `json:"field_ttl,omitempty"`
+	Base64    bool             `json:"base64,omitempty"`
+	Value     json.RawMessage  `json:"value"`
+}
+
+type exportMember struct {
+	Member string      `json:"member"`
+	Score  exportScore `json:"score"`
+}
+
+// exportScore is written as a string, and read from either a string or a
+// number.
+type exportScore float64
+
+func (s exportScore) MarshalJSON() ([]byte, error) {
+	return json.Marshal(formatScore(float64(s)))
+}
+
+func (s *exportScore) UnmarshalJSON(data []byte) error {
+	text := string(data)
+	if unquoted, err := strconv.Unquote(text); err == nil {
+		text = unquoted
+	}
+	score, err := parseFloatArg(text)
+	if err != nil {
+		return fmt.Errorf("invalid score %s", data)
+	}
+	*s = exportScore(score)
+	return nil
+}
+
+// remainingMillis returns the time left until deadline in milliseconds, at
+// least 1 so that it still reads as a TTL.
+func remainingMillis(deadline, now time.Time) int64 {
+	return max(deadline.Sub(now).Milliseconds(), 1)
+}
+
+// exportKeyValue returns the JSON line for v stored at key.
+func exportKeyValue(key string, v keyValue, now time.Time) ([]byte, error) {
+	var strs []string
+	var members []sortedSetMember
+	switch v.typ {
+	case "string":
+		strs = []string{v.str}
+	case "list":
+		strs = v.list.Elements()
+	case "hash":
+		v.hash.Range(func(field, value string) bool {
+			strs = append(strs, field, value)
+			return true
+		})
+	case "set":
+		strs = v.set.Members()
+		sort.Strings(strs)
+	case "zset":
+		members = v.zset.RangeByRank(0, v.zset.Len()-1, false)
+		for _, m := range members {
+			strs = append(strs, m.Member)
+		}
+	}
+
+	record := exportRecord{Key: key, Type: v.typ}
+	if !utf8.ValidString(key) {
+		record.Key, record.KeyBase64 = base64.StdEncoding.EncodeToString([]byte(key)), true
+	}
+	for _, s := range strs {
+		if !utf8.ValidString(s) {
+			record.Base64 = true
+			break
+		}
+	}
+	encode := func(s string) string {
+		if record.Base64 {
+			return base64.StdEncoding.EncodeToString([]byte(s))
+		}
+		return s
+	}
+	for i, s := range strs {
+		strs[i] = encode(s)
+	}
+
+	var value any
+	switch v.typ {
+	case "string":
+		value = strs[0]
+	case "list", "set":
+		value = strs
+	case "hash":
+		fields := make(map[string]string, len(strs)/2)
+		for i := 0; i < len(strs); i += 2 {
+			fields[strs[i]] = strs[i+1]
+		}
+		value = fields
+	case "zset":
+		exported := make([]exportMember, len(members))
+		for i, m := range members {
+			exported[i] = exportMember{strs[i], exportScore(m.Score)}
+		}
+		value = exported
+	}
+	var err error
+	if record.Value, err = json.Marshal(value); err != nil {
+		return nil, err
+	}
+
+	if !v.expireAt.IsZero() {
+		record.TTL = remainingMillis(v.expireAt, now)
+	}
+	for field, expiration := range v.fieldTTLs {
+		if record.FieldTTL == nil {
+			record.FieldTTL = make(map[string]int64, len(v.fieldTTLs))
+		}
+		record.FieldTTL[encode(field)] = remainingMillis(expiration, now)
+	}
+	return json.Marshal(record)
+}
+
+// importKeyValue parses a JSON line written by exportKeyValue, or by hand,
+// into the key and value it holds.
+func importKeyValue(line string, now time.Time) (string, keyValue, error) {
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.DisallowUnknownFields()
+	var record exportRecord
+	if err := decoder.Decode(&record); err != nil {
+		return "", keyValue{}, err
+	}
+	if decoder.More() {
+		return "", keyValue{}, fmt.Errorf("more than one JSON value")
+	}
+	var decodeErr error
+	decodeBase64 := func(s string) string {
+		decoded, err := base64.StdEncoding.DecodeString(s)
+		if err != nil && decodeErr == nil {
+			decodeErr = fmt.Errorf("invalid base64 %q", s)
+		}
+		return string(decoded)
+	}
+	decode := func(s string) string {
+		if record.Base64 {
+			return decodeBase64(s)
+		}
+		return s
+	}
+	key := record.Key
+	if record.KeyBase64 {
+		key = decodeBase64(key)
+	}
+	if record.Value == nil {
+		return "", keyValue{}, fmt.Errorf("missing value")
+	}
+
+	v := keyValue{typ: record.Type}
+	var err error
+	switch record.Type {
+	case "string":
+		var s string
+		err = json.Unmarshal(record.Value, &s)
+		v.str = decode(s)
+	case "list", "set":
+		var elements []string
+		if err = json.Unmarshal(record.Value, &elements); err == nil && len(elements) == 0 {
+			err = fmt.Errorf("empty %s", record.Type)
+		}
+		for i := range elements {
+			elements[i] = decode(elements[i])
+		}
+		if record.Type == "list" {
+			v.list = listFromSlice(elements)
+		} else {
+			members := make(map[string]struct{}, len(elements))
+			for _, member := range elements {
+				members[member] = struct{}{}
+			}
+			v.set = setFromMap(members)
+		}
+	case "hash":
+		var fields map[string]string
+		if err = json.Unmarshal(record.Value, &fields); err == nil && len(fields) == 0 {
+			err = fmt.Errorf("empty hash")
+		}
+		decoded := make(map[string]string, len(fields))
+		for field, value := range fields {
+			decoded[decode(field)] = decode(value)
+		}
+		v.hash = hashFromMap(decoded)
+	case "zset":
+		var members []exportMember
+		if err = json.Unmarshal(record.Value, &members); err == nil && len(members) == 0 {
+			err = fmt.Errorf("empty zset")
+		}
+		v.zset = NewSortedSet()
+		for _, m := range members {
+			v.zset.Add(decode(m.Member), float64(m.Score))
+		}
+	default:
+		err = fmt.Errorf("unknown type %q", record.Type)
+	}
+	if err != nil {
+		return "", keyValue{}, err
+	}
+
+	if record.TTL < 0 {
+		return "", keyValue{}, fmt.Errorf("invalid ttl %d", record.TTL)
+	}
+	if record.TTL > 0 {
+		v.expireAt = now.Add(time.Duration(record.TTL) * time.Millisecond)
+	}
+	if len(record.FieldTTL) > 0 && v.typ != "hash" {
+		return "", keyValue{}, fmt.Errorf("field_ttl on a %s", v.typ)
+	}
+	for field, ttl := range record.FieldTTL {
+		field = decode(field)
+		if ttl <= 0 || !v.hash.Has(field) {
+			return "", keyValue{}, fmt.Errorf("invalid field_ttl for %q", field)
+		}
+		if v.fieldTTLs == nil {
+			v.fieldTTLs = make(map[string]time.Time, len(record.FieldTTL))
+		}
+		v.fieldTTLs[field] = now.Add(time.Duration(ttl) * time.Millisecond)
+	}
+	return key, v, decodeErr
+}
+
+// ExportCommand implements EXPORT cursor [MATCH pattern] [COUNT count]
+// [TYPE type]. It walks the keys like SCAN does, and replies with the next
+// cursor followed by the JSON line of every key, one per line.
+func (kv *KeyValueStore) ExportCommand(parts []string) string {
+	opts, errMsg := parseScanArgs(parts, 1, true, false)
+	if errMsg != "" {
+		return errMsg
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	keys, next := kv.keyIndex(false).batch(opts.cursor, opts.count)
+	keys = filterMatch(keys, opts.match)
+	lines := []string{strconv.FormatUint(next, 10)}
+	now := time.Now()
+	for _, key := range keys {
+		kv.expireHashFields(key)
+		v, exists := kv.getKeyValue(key)
+		if !exists || (opts.typ != "" && v.typ != opts.typ) {
+			continue
+		}
+		line, err := exportKeyValue(key, v, now)
+		if err != nil {
+			return "ERR " + err.Error()
+		}
+		lines = append(lines, string(line))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ImportCommand implements IMPORT [MERGE | REPLACE] line [line ...] and
+// replies with the number of keys written. MERGE, the default, leaves the
+// keys that already exist alone, REPLACE overwrites them. Every line is
+// checked before any key is written, so a bad line imports nothing.
+func (kv *KeyValueStore) ImportCommand(parts []string) string {
+	lines := parts[1:]
+	replace := false
+	if len(lines) > 0 {
+		switch strings.ToUpper(lines[0]) {
+		case "MERGE":
+			lines = lines[1:]
+		case "REPLACE":
+			replace, lines = true, lines[1:]
+		}
+	}
+	if len(lines) == 0 {
+		return "ERR IMPORT requires at least 1 line"
+	}
+	now := time.Now()
+	keys := make([]string, len(lines))
+	values := make([]keyValue, len(lines))
+	for i, line := range lines {
+		var err error
+		if keys[i], values[i], err = importKeyValue(line, now); err != nil {
+			return fmt.Sprintf("ERR invalid line %d: %v", i+1, err)
+		}
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	// Each key is logged as the RESTORE that recreates it, with absolute TTLs
+	restores := make([][]string, 0, len(keys))
+	defer func() { propagateInstead(restores...) }()
+	for i, key := range keys {
+		v := values[i]
+		if kv.keyExists(key) && !replace {
+			continue
+		}
+		kv.preserveKeys(key)
+		kv.deleteKey(key)
+		kv.setKeyValue(key, v)
+		ttl := int64(0)
+		if !v.expireAt.IsZero() {
+			ttl = v.expireAt.UnixMilli()
+		}
+		payload := string(createDumpPayload(v))
+		restores = append(restores, []string{"RESTORE", key, strconv.FormatInt(ttl, 10), payload, "REPLACE", "ABSTTL"})
+	}
+	return fmt.Sprintf("(integer) %d", len(restores))
+}
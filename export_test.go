@@ -0,0 +1,168 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exportAll runs EXPORT until the cursor comes back to 0 and returns the
+// lines of every key.
+func exportAll(t *testing.T, kv *KeyValueStore, options ...string) []string {
+	t.Helper()
+	var lines []string
+	cursor := "0"
+	for {
+		reply := kv.executeCommand(append([]string{"EXPORT", cursor}, options...))
+		next, rest, _ := strings.Cut(reply, "\n")
+		if _, err := strconv.ParseUint(next, 10, 64); err != nil {
+			t.Fatalf("Expected EXPORT to reply with a cursor, Got: %q", reply)
+		}
+		if rest != "" {
+			lines = append(lines, strings.Split(rest, "\n")...)
+		}
+		if cursor = next; cursor == "0" {
+			return lines
+		}
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	kv := NewKeyValueStore()
+	kv.executeCommand([]string{"SET", "string", "text"})
+	kv.executeCommand([]string{"SET", "binary", "\xff\x00bytes"})
+	kv.executeCommand([]string{"SET", "ttl", "v"})
+	kv.executeCommand([]string{"EXPIRE", "ttl", "100"})
+	kv.executeCommand([]string{"RPUSH", "list", "a", "b", "a"})
+	kv.executeCommand([]string{"HSET", "hash", "f1", "v1", "f2", "v2"})
+	kv.executeCommand([]string{"HEXPIRE", "hash", "100", "FIELDS", "1", "f1"})
+	kv.executeCommand([]string{"SADD", "set", "x", "1"})
+	kv.executeCommand([]string{"ZADD", "zset", "1.5", "a", "-inf", "b"})
+
+	lines := exportAll(t, kv, "COUNT", "3")
+	if len(lines) != 7 {
+		t.Fatalf("Expected 7 keys to be exported, Got: %d", len(lines))
+	}
+	for _, expected := range []string{
+		`{"key":"string","type":"string","value":"text"}`,
+		`{"key":"binary","type":"string","base64":true,"value":"/wBieXRlcw=="}`,
+		`{"key":"list","type":"list","value":["a","b","a"]}`,
+		`{"key":"set","type":"set","value":["1","x"]}`,
+		`{"key":"zset","type":"zset","value":[{"member":"b","score":"-inf"},{"member":"a","score":"1.5"}]}`,
+	} {
+		if !strings.Contains(strings.Join(lines, "\n"), expected) {
+			t.Fatalf("Expected %s to be exported, Got:\n%s", expected, strings.Join(lines, "\n"))
+		}
+	}
+
+	imported := NewKeyValueStore()
+	if got := imported.executeCommand(append([]string{"IMPORT"}, lines...)); got != "(integer) 7" {
+		t.Fatalf("Expected 7 keys to be imported, Got: %q", got)
+	}
+	for _, command := range [][]string{
+		{"GET", "string"},
+		{"GET", "binary"},
+		{"LRANGE", "list", "0", "-1"},
+		{"HMGET", "hash", "f1", "f2"},
+		{"SMEMBERS", "set"},
+		{"ZRANGE", "zset", "0", "-1", "WITHSCORES"},
+	} {
+		expected := kv.executeCommand(command)
+		if got := imported.executeCommand(command); got != expected {
+			t.Fatalf("%v: expected %q, Got: %q", command, expected, got)
+		}
+	}
+	if ttl := imported.executeCommand([]string{"TTL", "ttl"}); ttl != "(integer) 99" {
+		t.Fatalf("Expected the TTL to be imported, Got: %s", ttl)
+	}
+	if fields := imported.HashFieldExpirations["hash"]; len(fields) != 1 || time.Until(fields["f1"]) < 99*time.Second {
+		t.Fatalf("Expected the field TTL to be imported, Got: %v", fields)
+	}
+}
+
+func TestExportMatchAndType(t *testing.T) {
+	kv := NewKeyValueStore()
+	kv.executeCommand([]string{"SET", "user:1", "a"})
+	kv.executeCommand([]string{"RPUSH", "user:2", "b"})
+	kv.executeCommand([]string{"SET", "other", "c"})
+
+	lines := exportAll(t, kv, "MATCH", "user:*", "TYPE", "string")
+	if len(lines) != 1 || lines[0] != `{"key":"user:1","type":"string","value":"a"}` {
+		t.Fatalf("Expected only user:1 to be exported, Got: %q", lines)
+	}
+}
+
+func TestImportMergeAndReplace(t *testing.T) {
+	kv := NewKeyValueStore()
+	kv.executeCommand([]string{"SET", "existing", "old"})
+	lines := []string{
+		`{"key":"existing","type":"string","value":"new"}`,
+		`{"key":"added","type":"zset","ttl":60000,"value":[{"member":"m","score":2}]}`,
+	}
+
+	if got := kv.executeCommand(append([]string{"IMPORT", "MERGE"}, lines...)); got != "(integer) 1" {
+		t.Fatalf("Expected 1 key to be imported, Got: %q", got)
+	}
+	if got := kv.executeCommand([]string{"GET", "existing"}); got != "old" {
+		t.Fatalf("Expected MERGE to keep the existing key, Got: %q", got)
+	}
+	if got := kv.executeCommand([]string{"ZSCORE", "added", "m"}); got != "2" {
+		t.Fatalf("Expected a numeric score to be accepted, Got: %q", got)
+	}
+
+	if got := kv.executeCommand(append([]string{"IMPORT", "REPLACE"}, lines...)); got != "(integer) 2" {
+		t.Fatalf("Expected 2 keys to be imported, Got: %q", got)
+	}
+	if got := kv.executeCommand([]string{"GET", "existing"}); got != "new" {
+		t.Fatalf("Expected REPLACE to overwrite the existing key, Got: %q", got)
+	}
+}
+
+func TestImportRejectsBadLines(t *testing.T) {
+	kv := NewKeyValueStore()
+	for _, line := range []string{
+		`not json`,
+		`{"key":"k","type":"string"}`,
+		`{"key":"k","type":"stream","value":[]}`,
+		`{"key":"k","type":"list","value":[]}`,
+		`{"key":"k","type":"string","value":"v","ttl":-1}`,
+		`{"key":"k","type":"string","value":"v","extra":1}`,
+		`{"key":"k","type":"string","value":"!","base64":true}`,
+		`{"key":"k","type":"hash","value":{"f":"v"},"field_ttl":{"g":10}}`,
+		`{"key":"k","type":"zset","value":[{"member":"m","score":"nan"}]}`,
+	} {
+		got := kv.executeCommand([]string{"IMPORT", `{"key":"good","type":"string","value":"v"}`, line})
+		if !strings.HasPrefix(got, "ERR invalid line 2: ") {
+			t.Fatalf("%s: expected an error about line 2, Got: %q", line, got)
+		}
+	}
+	if got := kv.executeCommand([]string{"DBSIZE"}); got != "(integer) 0" {
+		t.Fatalf("Expected nothing to be imported, Got: %s", got)
+	}
+}
+
+func TestImportIsLoggedAsRestore(t *testing.T) {
+	dbs := newDatabases(1)
+	path := startTestAppendOnly(t, dbs)
+	line := `{"key":"k","type":"hash","ttl":100000,"value":{"f":"v"},"field_ttl":{"f":50000}}`
+	if got := dbs[0].executeCommand([]string{"IMPORT", line}); got != "(integer) 1" {
+		t.Fatalf("Expected 1 key to be imported, Got: %q", got)
+	}
+	contents, _ := os.ReadFile(path)
+	if !strings.Contains(string(contents), "RESTORE") || strings.Contains(string(contents), "IMPORT") {
+		t.Fatalf("Expected IMPORT to be logged as RESTORE, Got: %q", contents)
+	}
+
+	replayed := replayAppendOnly(t, path, 1)
+	if got := replayed[0].executeCommand([]string{"HGET", "k", "f"}); got != "v" {
+		t.Fatalf("Expected the key to be replayed, Got: %q", got)
+	}
+	if deadline := replayed[0].Expirations["k"]; time.Until(deadline) < 99*time.Second {
+		t.Fatalf("Expected the TTL to be replayed, Got: %v", deadline)
+	}
+	if deadline := replayed[0].HashFieldExpirations["k"]["f"]; time.Until(deadline) < 49*time.Second {
+		t.Fatalf("Expected the field TTL to be replayed, Got: %v", deadline)
+	}
+}
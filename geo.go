@@ -0,0 +1,807 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Geospatial indexes are plain sorted sets whose scores are 52-bit
+// interleaved geohashes, exactly like in Redis, so GEOADD'ed keys can also be
+// read with ZRANGE and friends. The math below follows Redis' geohash.c and
+// geohash_helper.c so that distances and search results match.
+
+const (
+	geoStepMax        = 26 // 26 * 2 = 52 bits
+	geoLatMin         = -85.05112878
+	geoLatMax         = 85.05112878
+	geoLongMin        = -180.0
+	geoLongMax        = 180.0
+	earthRadiusMeters = 6372797.560856
+	mercatorMax       = 20037726.37
+	geoHashAlphabet   = "0123456789bcdefghjkmnpqrstuvwxyz"
+	geoStandardLatMin = -90.0
+	geoStandardLatMax = 90.0
+)
+
+type geoHashBits struct {
+	bits uint64
+	step uint
+}
+
+type geoHashRange struct {
+	min, max float64
+}
+
+type geoHashArea struct {
+	hash      geoHashBits
+	longitude geoHashRange
+	latitude  geoHashRange
+}
+
+type geoPoint struct {
+	longitude, latitude float64
+}
+
+func degRad(ang float64) float64 { return ang * (math.Pi / 180.0) }
+func radDeg(ang float64) float64 { return ang / (math.Pi / 180.0) }
+
+// interleave64 spreads the bits of x over the even positions and the bits of
+// y over the odd positions of the result.
+func interleave64(x, y uint32) uint64 {
+	spread := func(v uint64) uint64 {
+		v = (v | (v << 16)) & 0x0000FFFF0000FFFF
+		v = (v | (v << 8)) & 0x00FF00FF00FF00FF
+		v = (v | (v << 4)) & 0x0F0F0F0F0F0F0F0F
+		v = (v | (v << 2)) & 0x3333333333333333
+		v = (v | (v << 1)) & 0x5555555555555555
+		return v
+	}
+	return spread(uint64(x)) | (spread(uint64(y)) << 1)
+}
+
+// deinterleave64 is the inverse of interleave64, returning x and y.
+func deinterleave64(interleaved uint64) (uint32, uint32) {
+	squash := func(v uint64) uint64 {
+		v &= 0x5555555555555555
+		v = (v | (v >> 1)) & 0x3333333333333333
+		v = (v | (v >> 2)) & 0x0F0F0F0F0F0F0F0F
+		v = (v | (v >> 4)) & 0x00FF00FF00FF00FF
+		v = (v | (v >> 8)) & 0x0000FFFF0000FFFF
+		v = (v | (v >> 16)) & 0x00000000FFFFFFFF
+		return v
+	}
+	return uint32(squash(interleaved)), uint32(squash(interleaved >> 1))
+}
+
+func geohashEncode(longRange, latRange geoHashRange, longitude, latitude float64, step uint) (geoHashBits, bool) {
+	if longitude > geoLongMax || longitude < geoLongMin || latitude > geoLatMax || latitude < geoLatMin {
+		return geoHashBits{}, false
+	}
+	if latitude < latRange.min || latitude > latRange.max || longitude < longRange.min || longitude > longRange.max {
+		return geoHashBits{}, false
+	}
+	latOffset := (latitude - latRange.min) / (latRange.max - latRange.min)
+	longOffset := (longitude - longRange.min) / (longRange.max - longRange.min)
+	latOffset *= float64(uint64(1) << step)
+	longOffset *= float64(uint64(1) << step)
+	return geoHashBits{bits: interleave64(uint32(latOffset), uint32(longOffset)), step: step}, true
+}
+
+func geohashEncodeWGS84(longitude, latitude float64, step uint) (geoHashBits, bool) {
+	return geohashEncode(geoHashRange{geoLongMin, geoLongMax}, geoHashRange{geoLatMin, geoLatMax}, longitude, latitude, step)
+}
+
+func geohashDecode(longRange, latRange geoHashRange, hash geoHashBits) geoHashArea {
+	area := geoHashArea{hash: hash}
+	ilato, ilono := deinterleave64(hash.bits)
+	latScale := latRange.max - latRange.min
+	longScale := longRange.max - longRange.min
+	cells := float64(uint64(1) << hash.step)
+	area.latitude.min = latRange.min + (float64(ilato)/cells)*latScale
+	area.latitude.max = latRange.min + ((float64(ilato)+1)/cells)*latScale
+	area.longitude.min = longRange.min + (float64(ilono)/cells)*longScale
+	area.longitude.max = longRange.min + ((float64(ilono)+1)/cells)*longScale
+	return area
+}
+
+func geohashDecodeWGS84(hash geoHashBits) geoHashArea {
+	return geohashDecode(geoHashRange{geoLongMin, geoLongMax}, geoHashRange{geoLatMin, geoLatMax}, hash)
+}
+
+func geohashAreaCenter(area geoHashArea) geoPoint {
+	point := geoPoint{
+		longitude: (area.longitude.min + area.longitude.max) / 2,
+		latitude:  (area.latitude.min + area.latitude.max) / 2,
+	}
+	point.longitude = math.Max(geoLongMin, math.Min(geoLongMax, point.longitude))
+	point.latitude = math.Max(geoLatMin, math.Min(geoLatMax, point.latitude))
+	return point
+}
+
+// decodeGeoScore turns a sorted set score back into coordinates.
+func decodeGeoScore(score float64) geoPoint {
+	return geohashAreaCenter(geohashDecodeWGS84(geoHashBits{bits: uint64(score), step: geoStepMax}))
+}
+
+func geohashMoveX(hash *geoHashBits, d int) {
+	if d == 0 {
+		return
+	}
+	x := hash.bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.bits & 0x5555555555555555
+	zz := uint64(0x5555555555555555) >> (64 - hash.step*2)
+	if d > 0 {
+		x = x + (zz + 1)
+	} else {
+		x = x | zz
+		x = x - (zz + 1)
+	}
+	x &= uint64(0xaaaaaaaaaaaaaaaa) >> (64 - hash.step*2)
+	hash.bits = x | y
+}
+
+func geohashMoveY(hash *geoHashBits, d int) {
+	if d == 0 {
+		return
+	}
+	x := hash.bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.bits & 0x5555555555555555
+	zz := uint64(0xaaaaaaaaaaaaaaaa) >> (64 - hash.step*2)
+	if d > 0 {
+		y = y + (zz + 1)
+	} else {
+		y = y | zz
+		y = y - (zz + 1)
+	}
+	y &= uint64(0x5555555555555555) >> (64 - hash.step*2)
+	hash.bits = x | y
+}
+
+// geohashNeighbors returns the eight cells around hash, in the order
+// north, south, east, west, north-east, south-east, north-west, south-west.
+func geohashNeighbors(hash geoHashBits) [8]geoHashBits {
+	moves := [8][2]int{{0, 1}, {0, -1}, {1, 0}, {-1, 0}, {1, 1}, {1, -1}, {-1, 1}, {-1, -1}}
+	var neighbors [8]geoHashBits
+	for i, move := range moves {
+		neighbors[i] = hash
+		geohashMoveX(&neighbors[i], move[0])
+		geohashMoveY(&neighbors[i], move[1])
+	}
+	return neighbors
+}
+
+// geohashEstimateStepsByRadius picks the precision at which a cell is about
+// as large as the search radius.
+func geohashEstimateStepsByRadius(rangeMeters, latitude float64) uint {
+	if rangeMeters == 0 {
+		return geoStepMax
+	}
+	step := 1
+	for rangeMeters < mercatorMax {
+		rangeMeters *= 2
+		step++
+	}
+	step -= 2 // Make sure range is included in most of the base cases
+
+	// Cells are narrower near the poles
+	if latitude > 66 || latitude < -66 {
+		step--
+		if latitude > 80 || latitude < -80 {
+			step--
+		}
+	}
+	if step < 1 {
+		step = 1
+	}
+	if step > geoStepMax {
+		step = geoStepMax
+	}
+	return uint(step)
+}
+
+func geohashLatDistance(lat1d, lat2d float64) float64 {
+	return earthRadiusMeters * math.Abs(degRad(lat2d)-degRad(lat1d))
+}
+
+// geohashDistance is the haversine distance in meters between two points.
+func geohashDistance(lon1d, lat1d, lon2d, lat2d float64) float64 {
+	lat1r, lon1r := degRad(lat1d), degRad(lon1d)
+	lat2r, lon2r := degRad(lat2d), degRad(lon2d)
+	v := math.Sin((lon2r - lon1r) / 2)
+	// Avoid the expensive math when the longitudes are practically the same
+	if v == 0 {
+		return geohashLatDistance(lat1d, lat2d)
+	}
+	u := math.Sin((lat2r - lat1r) / 2)
+	a := u*u + math.Cos(lat1r)*math.Cos(lat2r)*v*v
+	return 2.0 * earthRadiusMeters * math.Asin(math.Sqrt(a))
+}
+
+// geoShape is the area searched by GEOSEARCH: a circle or a width by height
+// box centered on a point. Sizes are in the unit the client asked for, and
+// conversion is the number of meters in that unit.
+type geoShape struct {
+	center        geoPoint
+	byBox         bool
+	radius        float64
+	width, height float64
+	conversion    float64
+}
+
+// contains reports whether point is inside the shape, and its distance from
+// the center in meters.
+func (s *geoShape) contains(point geoPoint) (float64, bool) {
+	if !s.byBox {
+		distance := geohashDistance(s.center.longitude, s.center.latitude, point.longitude, point.latitude)
+		return distance, distance <= s.radius*s.conversion
+	}
+	// Latitude distance is cheaper to compute, so rule points out with it first
+	if geohashLatDistance(point.latitude, s.center.latitude) > s.height*s.conversion/2 {
+		return 0, false
+	}
+	if geohashDistance(point.longitude, point.latitude, s.center.longitude, point.latitude) > s.width*s.conversion/2 {
+		return 0, false
+	}
+	return geohashDistance(s.center.longitude, s.center.latitude, point.longitude, point.latitude), true
+}
+
+func (s *geoShape) boundingBox() (minLon, minLat, maxLon, maxLat float64) {
+	height, width := s.radius*s.conversion, s.radius*s.conversion
+	if s.byBox {
+		height, width = s.height*s.conversion/2, s.width*s.conversion/2
+	}
+	latDelta := radDeg(height / earthRadiusMeters)
+	longDeltaTop := radDeg(width / earthRadiusMeters / math.Cos(degRad(s.center.latitude+latDelta)))
+	longDeltaBottom := radDeg(width / earthRadiusMeters / math.Cos(degRad(s.center.latitude-latDelta)))
+	// The hemispheres widen in opposite directions
+	longDelta := longDeltaTop
+	if s.center.latitude < 0 {
+		longDelta = longDeltaBottom
+	}
+	return s.center.longitude - longDelta, s.center.latitude - latDelta,
+		s.center.longitude + longDelta, s.center.latitude + latDelta
+}
+
+// searchAreas returns the cell containing the center and its neighbors at a
+// precision where together they cover the whole shape. Cells that cannot
+// intersect the shape are dropped.
+func (s *geoShape) searchAreas() []geoHashBits {
+	minLon, minLat, maxLon, maxLat := s.boundingBox()
+	radiusMeters := s.radius * s.conversion
+	if s.byBox {
+		radiusMeters = math.Sqrt(math.Pow(s.width*s.conversion/2, 2) + math.Pow(s.height*s.conversion/2, 2))
+	}
+	steps := geohashEstimateStepsByRadius(radiusMeters, s.center.latitude)
+
+	hash, _ := geohashEncodeWGS84(s.center.longitude, s.center.latitude, steps)
+	neighbors := geohashNeighbors(hash)
+	area := geohashDecodeWGS84(hash)
+
+	// The estimate can be too precise when the center sits close to the edge
+	// of its cell, check the cells around it really cover the bounding box.
+	north := geohashDecodeWGS84(neighbors[0])
+	south := geohashDecodeWGS84(neighbors[1])
+	east := geohashDecodeWGS84(neighbors[2])
+	west := geohashDecodeWGS84(neighbors[3])
+	if steps > 1 && (north.latitude.max < maxLat || south.latitude.min > minLat ||
+		east.longitude.max < maxLon || west.longitude.min > minLon) {
+		steps--
+		hash, _ = geohashEncodeWGS84(s.center.longitude, s.center.latitude, steps)
+		neighbors = geohashNeighbors(hash)
+		area = geohashDecodeWGS84(hash)
+	}
+
+	skip := make([]bool, 8)
+	if steps >= 2 {
+		if area.latitude.min < minLat {
+			skip[1], skip[5], skip[7] = true, true, true // south
+		}
+		if area.latitude.max > maxLat {
+			skip[0], skip[4], skip[6] = true, true, true // north
+		}
+		if area.longitude.min < minLon {
+			skip[3], skip[6], skip[7] = true, true, true // west
+		}
+		if area.longitude.max > maxLon {
+			skip[2], skip[4], skip[5] = true, true, true // east
+		}
+	}
+
+	areas := []geoHashBits{hash}
+	seen := map[uint64]bool{hash.bits: true}
+	for i, neighbor := range neighbors {
+		if skip[i] || seen[neighbor.bits] {
+			continue
+		}
+		seen[neighbor.bits] = true
+		areas = append(areas, neighbor)
+	}
+	return areas
+}
+
+type geoResult struct {
+	member   string
+	distance float64
+	score    float64
+	point    geoPoint
+}
+
+// search returns the members of sortedSet inside the shape, stopping early
+// after limit matches when limit is positive.
+func (s *geoShape) search(sortedSet *SortedSet, limit int) []geoResult {
+	results := make([]geoResult, 0)
+	for _, area := range s.searchAreas() {
+		shift := 52 - area.step*2
+		spec := scoreRange{
+			min:          float64(area.bits << shift),
+			max:          float64((area.bits + 1) << shift),
+			maxExclusive: true,
+		}
+		for _, m := range sortedSet.Range(spec, false, 0, -1) {
+			point := decodeGeoScore(m.Score)
+			distance, ok := s.contains(point)
+			if !ok {
+				continue
+			}
+			results = append(results, geoResult{member: m.Member, distance: distance, score: m.Score, point: point})
+			if limit > 0 && len(results) == limit {
+				return results
+			}
+		}
+	}
+	return results
+}
+
+// geoUnitConversion returns how many meters make one unit.
+func geoUnitConversion(unit string) (float64, bool) {
+	switch strings.ToLower(unit) {
+	case "m":
+		return 1, true
+	case "km":
+		return 1000, true
+	case "ft":
+		return 0.3048, true
+	case "mi":
+		return 1609.34, true
+	}
+	return 0, false
+}
+
+// formatCoordinate formats a coordinate with the precision Redis uses.
+func formatCoordinate(f float64) string {
+	s := strconv.FormatFloat(f, 'f', 17, 64)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+func parseGeoPoint(lon, lat string) (geoPoint, string) {
+	longitude, err1 := parseFloatArg(lon)
+	latitude, err2 := parseFloatArg(lat)
+	if err1 != nil || err2 != nil {
+		return geoPoint{}, "ERR value is not a valid float"
+	}
+	if longitude < geoLongMin || longitude > geoLongMax || latitude < geoLatMin || latitude > geoLatMax {
+		return geoPoint{}, fmt.Sprintf("ERR invalid longitude,latitude pair %f,%f", longitude, latitude)
+	}
+	return geoPoint{longitude, latitude}, ""
+}
+
+// GeoAddCommand implements
+// GEOADD key [NX | XX] [CH] longitude latitude member [longitude latitude member ...]
+// on top of ZADD.
+func (kv *KeyValueStore) GeoAddCommand(parts []string) string {
+	if len(parts) < 5 {
+		return "ERR GEOADD requires at least 4 arguments"
+	}
+	zadd := []string{"ZADD", parts[1]}
+	i := 2
+options:
+	for ; i < len(parts); i++ {
+		switch option := strings.ToUpper(parts[i]); option {
+		case "NX", "XX", "CH":
+			zadd = append(zadd, option)
+		default:
+			break options
+		}
+	}
+	triples := parts[i:]
+	if len(triples) == 0 || len(triples)%3 != 0 {
+		return "ERR syntax error. Try GEOADD key [x1] [y1] [name1] [x2] [y2] [name2] ... "
+	}
+	for j := 0; j < len(triples); j += 3 {
+		point, errMsg := parseGeoPoint(triples[j], triples[j+1])
+		if errMsg != "" {
+			return errMsg
+		}
+		hash, _ := geohashEncodeWGS84(point.longitude, point.latitude, geoStepMax)
+		zadd = append(zadd, strconv.FormatUint(hash.bits, 10), triples[j+2])
+	}
+	return kv.ZAddCommand(zadd)
+}
+
+func (kv *KeyValueStore) GeoPosCommand(parts []string) string {
+	if len(parts) < 2 {
+		return "ERR GEOPOS requires at least 1 argument"
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	sortedSet := kv.SortedSets[parts[1]]
+	result := make([]string, 0, len(parts)-2)
+	for _, member := range parts[2:] {
+		if sortedSet != nil {
+			if score, ok := sortedSet.Score(member); ok {
+				point := decodeGeoScore(score)
+				result = append(result, formatCoordinate(point.longitude), formatCoordinate(point.latitude))
+				continue
+			}
+		}
+		result = append(result, "(nil)")
+	}
+	return strings.Join(result, " ")
+}
+
+// GeoDistCommand implements GEODIST key member1 member2 [M | KM | FT | MI].
+func (kv *KeyValueStore) GeoDistCommand(parts []string) string {
+	if len(parts) != 4 && len(parts) != 5 {
+		return "ERR GEODIST requires 3 or 4 arguments"
+	}
+	conversion := 1.0
+	if len(parts) == 5 {
+		var ok bool
+		if conversion, ok = geoUnitConversion(parts[4]); !ok {
+			return "ERR unsupported unit provided. please use M, KM, FT, MI"
+		}
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	sortedSet, exists := kv.SortedSets[parts[1]]
+	if !exists {
+		return "(nil)"
+	}
+	score1, ok1 := sortedSet.Score(parts[2])
+	score2, ok2 := sortedSet.Score(parts[3])
+	if !ok1 || !ok2 {
+		return "(nil)"
+	}
+	p1, p2 := decodeGeoScore(score1), decodeGeoScore(score2)
+	distance := geohashDistance(p1.longitude, p1.latitude, p2.longitude, p2.latitude)
+	return fmt.Sprintf("%.4f", distance/conversion)
+}
+
+// GeoHashCommand returns standard 11 character geohash strings. Radish stores
+// hashes over the Mercator latitude range, so they are re-encoded over the
+// standard [-90, 90] range first.
+func (kv *KeyValueStore) GeoHashCommand(parts []string) string {
+	if len(parts) < 2 {
+		return "ERR GEOHASH requires at least 1 argument"
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	sortedSet := kv.SortedSets[parts[1]]
+	result := make([]string, 0, len(parts)-2)
+	for _, member := range parts[2:] {
+		score, ok := 0.0, false
+		if sortedSet != nil {
+			score, ok = sortedSet.Score(member)
+		}
+		if !ok {
+			result = append(result, "(nil)")
+			continue
+		}
+		point := decodeGeoScore(score)
+		hash, _ := geohashEncode(geoHashRange{-180, 180}, geoHashRange{geoStandardLatMin, geoStandardLatMax}, point.longitude, point.latitude, geoStepMax)
+		buf := make([]byte, 11)
+		for i := range buf {
+			idx := 0
+			if i < 10 {
+				idx = int((hash.bits >> (52 - uint((i+1)*5))) & 0x1f)
+			}
+			buf[i] = geoHashAlphabet[idx]
+		}
+		result = append(result, string(buf))
+	}
+	return strings.Join(result, " ")
+}
+
+// geoSearchRequest holds the options shared by GEOSEARCH, GEOSEARCHSTORE and
+// the legacy GEORADIUS commands.
+type geoSearchRequest struct {
+	key        string
+	fromMember string
+	hasFrom    bool
+	shape      geoShape
+	hasShape   bool
+	sort       int // 0 unsorted, 1 ascending, -1 descending
+	count      int
+	any        bool
+	withCoord  bool
+	withDist   bool
+	withHash   bool
+	store      string
+	storeDist  bool
+}
+
+// parseGeoSearchOptions parses the GEOSEARCH style options in args. The
+// legacy form already has its center and radius filled in and additionally
+// takes STORE and STOREDIST.
+func parseGeoSearchOptions(req *geoSearchRequest, args []string, legacy, storing bool) string {
+	for i := 0; i < len(args); i++ {
+		remaining := len(args) - i - 1
+		switch option := strings.ToUpper(args[i]); option {
+		case "FROMMEMBER":
+			if legacy || req.hasFrom || remaining < 1 {
+				return "ERR syntax error"
+			}
+			req.fromMember, req.hasFrom = args[i+1], true
+			i++
+		case "FROMLONLAT":
+			if legacy || req.hasFrom || remaining < 2 {
+				return "ERR syntax error"
+			}
+			point, errMsg := parseGeoPoint(args[i+1], args[i+2])
+			if errMsg != "" {
+				return errMsg
+			}
+			req.shape.center, req.hasFrom = point, true
+			i += 2
+		case "BYRADIUS":
+			if legacy || req.hasShape || remaining < 2 {
+				return "ERR syntax error"
+			}
+			radius, err := parseFloatArg(args[i+1])
+			if err != nil || radius < 0 {
+				return "ERR need numeric radius"
+			}
+			conversion, ok := geoUnitConversion(args[i+2])
+			if !ok {
+				return "ERR unsupported unit provided. please use M, KM, FT, MI"
+			}
+			req.shape.radius, req.shape.conversion, req.hasShape = radius, conversion, true
+			i += 2
+		case "BYBOX":
+			if legacy || req.hasShape || remaining < 3 {
+				return "ERR syntax error"
+			}
+			width, err1 := parseFloatArg(args[i+1])
+			height, err2 := parseFloatArg(args[i+2])
+			if err1 != nil || err2 != nil || width < 0 || height < 0 {
+				return "ERR need numeric width and height"
+			}
+			conversion, ok := geoUnitConversion(args[i+3])
+			if !ok {
+				return "ERR unsupported unit provided. please use M, KM, FT, MI"
+			}
+			req.shape.byBox, req.shape.width, req.shape.height = true, width, height
+			req.shape.conversion, req.hasShape = conversion, true
+			i += 3
+		case "ASC":
+			req.sort = 1
+		case "DESC":
+			req.sort = -1
+		case "COUNT":
+			if remaining < 1 {
+				return "ERR syntax error"
+			}
+			count, err := strconv.Atoi(args[i+1])
+			if err != nil || count <= 0 {
+				return "ERR COUNT must be > 0"
+			}
+			req.count = count
+			i++
+			if i+1 < len(args) && strings.ToUpper(args[i+1]) == "ANY" {
+				req.any = true
+				i++
+			}
+		case "WITHCOORD":
+			req.withCoord = true
+		case "WITHDIST":
+			req.withDist = true
+		case "WITHHASH":
+			req.withHash = true
+		case "STOREDIST":
+			if !storing && !legacy {
+				return "ERR syntax error"
+			}
+			req.storeDist = true
+			if legacy {
+				if remaining < 1 {
+					return "ERR syntax error"
+				}
+				req.store = args[i+1]
+				i++
+			}
+		case "STORE":
+			if !legacy || remaining < 1 {
+				return "ERR syntax error"
+			}
+			req.store, req.storeDist = args[i+1], false
+			i++
+		default:
+			return "ERR syntax error"
+		}
+	}
+	if !req.hasFrom {
+		return "ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for GEOSEARCH"
+	}
+	if !req.hasShape {
+		return "ERR exactly one of BYRADIUS and BYBOX can be specified for GEOSEARCH"
+	}
+	if req.any && req.count == 0 {
+		return "ERR the ANY argument requires COUNT argument"
+	}
+	if (storing || req.store != "") && (req.withCoord || req.withDist || req.withHash) {
+		return "ERR STORE option in GEORADIUS is not compatible with WITHDIST, WITHHASH and WITHCOORD options"
+	}
+	return ""
+}
+
+// geoSearch runs a parsed search. The caller must hold the lock.
+func (kv *KeyValueStore) geoSearch(req *geoSearchRequest) ([]geoResult, string) {
+	sortedSet, exists := kv.SortedSets[req.key]
+	if req.fromMember != "" {
+		if !exists {
+			return nil, "ERR could not decode requested zset member"
+		}
+		score, ok := sortedSet.Score(req.fromMember)
+		if !ok {
+			return nil, "ERR could not decode requested zset member"
+		}
+		req.shape.center = decodeGeoScore(score)
+	}
+	if !exists {
+		return nil, ""
+	}
+
+	limit := 0
+	if req.any {
+		limit = req.count
+	}
+	results := req.shape.search(sortedSet, limit)
+	if req.count > 0 && req.sort == 0 && !req.any {
+		// COUNT without ANY returns the closest matches
+		req.sort = 1
+	}
+	switch req.sort {
+	case 1:
+		sort.SliceStable(results, func(i, j int) bool { return results[i].distance < results[j].distance })
+	case -1:
+		sort.SliceStable(results, func(i, j int) bool { return results[i].distance > results[j].distance })
+	}
+	if req.count > 0 && len(results) > req.count {
+		results = results[:req.count]
+	}
+	return results, ""
+}
+
+func formatGeoResults(req *geoSearchRequest, results []geoResult) string {
+	if len(results) == 0 {
+		return "(empty array)"
+	}
+	reply := make([]string, 0, len(results))
+	for _, r := range results {
+		reply = append(reply, r.member)
+		if req.withDist {
+			reply = append(reply, fmt.Sprintf("%.4f", r.distance/req.shape.conversion))
+		}
+		if req.withHash {
+			reply = append(reply, strconv.FormatUint(uint64(r.score), 10))
+		}
+		if req.withCoord {
+			reply = append(reply, formatCoordinate(r.point.longitude), formatCoordinate(r.point.latitude))
+		}
+	}
+	return strings.Join(reply, " ")
+}
+
+// storeGeoResults writes results to the sorted set at key, scored by geohash
+// or, with STOREDIST, by distance. The caller must hold the write lock.
+func (kv *KeyValueStore) storeGeoResults(req *geoSearchRequest, results []geoResult) string {
+	members := make([]sortedSetMember, 0, len(results))
+	for _, r := range results {
+		score := r.score
+		if req.storeDist {
+			score = r.distance / req.shape.conversion
+		}
+		members = append(members, sortedSetMember{Member: r.member, Score: score})
+	}
+	return fmt.Sprintf("(integer) %d", kv.storeSortedSet(req.store, members))
+}
+
+// GeoSearchCommand implements
+// GEOSEARCH key <FROMMEMBER member | FROMLONLAT longitude latitude>
+// <BYRADIUS radius <M | KM | FT | MI> | BYBOX width height <M | KM | FT | MI>>
+// [ASC | DESC] [COUNT count [ANY]] [WITHCOORD] [WITHDIST] [WITHHASH]
+func (kv *KeyValueStore) GeoSearchCommand(parts []string) string {
+	if len(parts) < 6 {
+		return "ERR GEOSEARCH requires at least 5 arguments"
+	}
+	req := &geoSearchRequest{key: parts[1]}
+	if errMsg := parseGeoSearchOptions(req, parts[2:], false, false); errMsg != "" {
+		return errMsg
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	results, errMsg := kv.geoSearch(req)
+	if errMsg != "" {
+		return errMsg
+	}
+	return formatGeoResults(req, results)
+}
+
+// GeoSearchStoreCommand implements GEOSEARCHSTORE destination source followed
+// by the GEOSEARCH options and an optional STOREDIST.
+func (kv *KeyValueStore) GeoSearchStoreCommand(parts []string) string {
+	if len(parts) < 7 {
+		return "ERR GEOSEARCHSTORE requires at least 6 arguments"
+	}
+	req := &geoSearchRequest{key: parts[2], store: parts[1]}
+	if errMsg := parseGeoSearchOptions(req, parts[3:], false, true); errMsg != "" {
+		return errMsg
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	results, errMsg := kv.geoSearch(req)
+	if errMsg != "" {
+		return errMsg
+	}
+	return kv.storeGeoResults(req, results)
+}
+
+// GeoRadiusCommand implements GEORADIUS and GEORADIUSBYMEMBER, plus their
+// read-only _RO variants:
+// GEORADIUS key longitude latitude radius <M | KM | FT | MI> [options]
+// GEORADIUSBYMEMBER key member radius <M | KM | FT | MI> [options]
+func (kv *KeyValueStore) GeoRadiusCommand(parts []string, byMember, readOnly bool) string {
+	argc := 6
+	if byMember {
+		argc = 5
+	}
+	if len(parts) < argc {
+		return fmt.Sprintf("ERR %s requires at least %d arguments", parts[0], argc-1)
+	}
+	req := &geoSearchRequest{key: parts[1], hasFrom: true, hasShape: true}
+	if byMember {
+		req.fromMember = parts[2]
+	} else {
+		point, errMsg := parseGeoPoint(parts[2], parts[3])
+		if errMsg != "" {
+			return errMsg
+		}
+		req.shape.center = point
+	}
+	radius, err := parseFloatArg(parts[argc-2])
+	if err != nil || radius < 0 {
+		return "ERR need numeric radius"
+	}
+	conversion, ok := geoUnitConversion(parts[argc-1])
+	if !ok {
+		return "ERR unsupported unit provided. please use M, KM, FT, MI"
+	}
+	req.shape.radius, req.shape.conversion = radius, conversion
+	if errMsg := parseGeoSearchOptions(req, parts[argc:], true, false); errMsg != "" {
+		return errMsg
+	}
+	if readOnly && req.store != "" {
+		return "ERR syntax error"
+	}
+
+	if req.store == "" {
+		kv.mu.RLock()
+		defer kv.mu.RUnlock()
+		results, errMsg := kv.geoSearch(req)
+		if errMsg != "" {
+			return errMsg
+		}
+		return formatGeoResults(req, results)
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	results, errMsg := kv.geoSearch(req)
+	if errMsg != "" {
+		return errMsg
+	}
+	return kv.storeGeoResults(req, results)
+}
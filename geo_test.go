@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestGeohashEncodeDecode(t *testing.T) {
+	hash, ok := geohashEncodeWGS84(13.361389, 38.115556, geoStepMax)
+	if !ok {
+		t.Fatal("Expected Palermo to encode")
+	}
+	// The score Redis stores for the GEOADD example in its documentation
+	if hash.bits != 3479099956230698 {
+		t.Fatalf("Expected score 3479099956230698, Got: %d", hash.bits)
+	}
+	point := decodeGeoScore(float64(hash.bits))
+	if math.Abs(point.longitude-13.361389) > 1e-5 || math.Abs(point.latitude-38.115556) > 1e-5 {
+		t.Fatalf("Expected 13.361389,38.115556, Got: %v,%v", point.longitude, point.latitude)
+	}
+
+	if _, ok := geohashEncodeWGS84(0, 86, geoStepMax); ok {
+		t.Fatal("Expected latitudes outside the Mercator range to be rejected")
+	}
+}
+
+func TestGeohashDistance(t *testing.T) {
+	distance := geohashDistance(13.361389, 38.115556, 15.087269, 37.502669)
+	if math.Abs(distance-166274.15) > 1 {
+		t.Fatalf("Expected about 166274 meters, Got: %f", distance)
+	}
+}
+
+// TestGeoSearch compares searches against a linear scan over random points.
+func TestGeoSearch(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for round := 0; round < 50; round++ {
+		center := geoPoint{rng.Float64()*360 - 180, rng.Float64()*160 - 80}
+		sortedSet := NewSortedSet()
+		points := make(map[string]geoPoint)
+		for i := 0; i < 500; i++ {
+			// Scatter points within a few degrees so some of them match
+			lon := math.Max(geoLongMin, math.Min(geoLongMax, center.longitude+rng.Float64()*6-3))
+			lat := math.Max(-85, math.Min(85, center.latitude+rng.Float64()*6-3))
+			hash, _ := geohashEncodeWGS84(lon, lat, geoStepMax)
+			member := strconv.Itoa(i)
+			sortedSet.Add(member, float64(hash.bits))
+			points[member] = decodeGeoScore(float64(hash.bits))
+		}
+
+		shapes := []geoShape{
+			{center: center, radius: rng.Float64() * 300, conversion: 1000},
+			{center: center, byBox: true, width: rng.Float64() * 600, height: rng.Float64() * 600, conversion: 1000},
+		}
+		for _, shape := range shapes {
+			expected := make([]string, 0)
+			for member, point := range points {
+				if _, ok := shape.contains(point); ok {
+					expected = append(expected, member)
+				}
+			}
+			got := make([]string, 0)
+			for _, r := range shape.search(sortedSet, 0) {
+				got = append(got, r.member)
+			}
+			sort.Strings(expected)
+			sort.Strings(got)
+			if len(got) != len(expected) {
+				t.Fatalf("Round %d, shape %+v: expected %d matches, Got: %d", round, shape, len(expected), len(got))
+			}
+			for i := range got {
+				if got[i] != expected[i] {
+					t.Fatalf("Round %d: expected %v, Got: %v", round, expected, got)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+// stringMatch reports whether s matches the glob-style pattern, using the same
+// rules as Redis: '*' matches any sequence, '?' matches one character,
+// "[abc]", "[a-z]" and "[^x]" match character classes and '\' escapes the
+// next character.
+//
+// A mismatch only ever makes the last '*' seen take one more byte: whatever
+// an earlier '*' would take instead, the last one can take too. Matching
+// thus takes at most len(s) passes over the pattern, never backtracking
+// further than that.
+func stringMatch(pattern, s string, nocase bool) bool {
+	p, i := 0, 0
+	// star is the position of the last '*' in pattern, -1 before there is
+	// one, and starEnd where the bytes it takes in s end
+	star, starEnd := -1, 0
+	for i < len(s) {
+		if p < len(pattern) && pattern[p] == '*' {
+			star, starEnd = p, i
+			p++
+			continue
+		}
+		if p < len(pattern) {
+			if width, ok := matchByte(pattern[p:], s[i], nocase); ok {
+				p += width
+				i++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		starEnd++
+		p, i = star+1, starEnd
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchByte reports whether c matches the element at the start of pattern,
+// anything but '*', along with the number of bytes the element spans.
+func matchByte(pattern string, c byte, nocase bool) (int, bool) {
+	switch pattern[0] {
+	case '?':
+		return 1, true
+	case '[':
+		i := 1
+		not := i < len(pattern) && pattern[i] == '^'
+		if not {
+			i++
+		}
+		match := false
+		// An unterminated class ends with the pattern
+		for ; i < len(pattern) && pattern[i] != ']'; i++ {
+			if pattern[i] == '\\' && i+1 < len(pattern) {
+				i++
+				if pattern[i] == c {
+					match = true
+				}
+			} else if i+2 < len(pattern) && pattern[i+1] == '-' {
+				start, end, b := pattern[i], pattern[i+2], c
+				if start > end {
+					start, end = end, start
+				}
+				if nocase {
+					start, end, b = toLower(start), toLower(end), toLower(b)
+				}
+				if b >= start && b <= end {
+					match = true
+				}
+				i += 2
+			} else if equalByte(pattern[i], c, nocase) {
+				match = true
+			}
+		}
+		if i < len(pattern) {
+			i++
+		}
+		return i, match != not
+	case '\\':
+		if len(pattern) >= 2 {
+			return 2, equalByte(pattern[1], c, nocase)
+		}
+	}
+	return 1, equalByte(pattern[0], c, nocase)
+}
+
+func equalByte(a, b byte, nocase bool) bool {
+	if nocase {
+		return toLower(a) == toLower(b)
+	}
+	return a == b
+}
+
+func toLower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + ('a' - 'A')
+	}
+	return c
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStringMatch(t *testing.T) {
+	cases := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"user:*", "user:1000", true},
+		{"user:*", "session:1", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{"h[b-a]llo", "hallo", true},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{`[\]]`, "]", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{"[abc", "a", true},
+		{"[abc", "ab", false},
+		{"*[abc", "xa", true},
+		{"a*a", "aa", true},
+		{"a*a", "a", false},
+		{"*a*b", "aab", true},
+		{"*?", "", false},
+		{"**", "", true},
+		{"a*b*c*", "abbbcbc", true},
+		{`a\`, `a\`, true},
+		// Backtracking over every star would take forever on these
+		{strings.Repeat("a*", 30) + "b", strings.Repeat("a", 100), false},
+		{strings.Repeat("*a", 30), strings.Repeat("a", 100), true},
+	}
+	for _, c := range cases {
+		if got := stringMatch(c.pattern, c.s, false); got != c.want {
+			t.Errorf("stringMatch(%q, %q) = %v, want %v", c.pattern, c.s, got, c.want)
+		}
+	}
+}
+
+func TestStringMatchNoCase(t *testing.T) {
+	if !stringMatch("USER:[a-z]*", "user:Bob", true) {
+		t.Error("Expected case insensitive match")
+	}
+	if stringMatch("USER:*", "user:bob", false) {
+		t.Error("Expected case sensitive mismatch")
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+// Hash is the value type behind hashes. Like in Redis, a small hash is kept
+// as a listpack of alternating fields and values, in insertion order, and is
+// converted to a map once it has more than hash-max-listpack-entries fields
+// or a field or value longer than hash-max-listpack-value. A nil *Hash
+// behaves as an empty hash.
+type Hash struct {
+	lp   listpack
+	dict map[string]string
+	// scan indexes the fields of dict once HSCAN needed it
+	scan *scanIndex
+}
+
+func NewHash() *Hash {
+	return &Hash{lp: newListpack()}
+}
+
+// hashFromMap builds a hash holding the pairs of m, in the encoding their
+// number and size call for.
+func hashFromMap(m map[string]string) *Hash {
+	h := NewHash()
+	if len(m) > hashMaxListpackEntries {
+		h.convert(len(m))
+	}
+	for field, value := range m {
+		h.Set(field, value)
+	}
+	return h
+}
+
+// Encoding names the representation of the hash the way OBJECT ENCODING does.
+func (h *Hash) Encoding() string {
+	if h.dict != nil {
+		return "hashtable"
+	}
+	return "listpack"
+}
+
+func (h *Hash) Len() int {
+	if h == nil {
+		return 0
+	}
+	if h.dict != nil {
+		return len(h.dict)
+	}
+	return h.lp.Len() / 2
+}
+
+// find returns the position of the listpack entry holding field, or -1.
+func (h *Hash) find(field string) int {
+	for pos := h.lp.first(); !h.lp.atEnd(pos); {
+		e, next := h.lp.next(pos)
+		if e.equals(field) {
+			return pos
+		}
+		pos = h.lp.skip(next)
+	}
+	return -1
+}
+
+func (h *Hash) Get(field string) (string, bool) {
+	if h == nil {
+		return "", false
+	}
+	if h.dict != nil {
+		value, ok := h.dict[field]
+		return value, ok
+	}
+	pos := h.find(field)
+	if pos < 0 {
+		return "", false
+	}
+	e, _ := h.lp.next(h.lp.skip(pos))
+	return e.String(), true
+}
+
+func (h *Hash) Has(field string) bool {
+	_, ok := h.Get(field)
+	return ok
+}
+
+// Set sets field to value and reports whether the field is new.
+func (h *Hash) Set(field, value string) bool {
+	if h.dict == nil && (len(field) > hashMaxListpackValue || len(value) > hashMaxListpackValue) {
+		h.convert(h.Len() + 1)
+	}
+	if h.dict != nil {
+		_, exists := h.dict[field]
+		h.dict[field] = value
+		if !exists && h.scan != nil {
+			h.scan.add(field)
+		}
+		return !exists
+	}
+	if pos := h.find(field); pos >= 0 {
+		valuePos := h.lp.skip(pos)
+		h.lp = h.lp.replace(valuePos, h.lp.skip(valuePos), 1, value)
+		return false
+	}
+	h.lp = h.lp.append(field, value)
+	if h.Len() > hashMaxListpackEntries {
+		h.convert(h.Len())
+	}
+	return true
+}
+
+// Delete removes field and reports whether it was there.
+func (h *Hash) Delete(field string) bool {
+	if h == nil {
+		return false
+	}
+	if h.dict != nil {
+		_, exists := h.dict[field]
+		delete(h.dict, field)
+		if exists && h.scan != nil {
+			h.scan.remove(field)
+		}
+		return exists
+	}
+	pos := h.find(field)
+	if pos < 0 {
+		return false
+	}
+	h.lp = h.lp.remove(pos, 2)
+	return true
+}
+
+// Range calls fn for every field and value until it returns false.
+func (h *Hash) Range(fn func(field, value string) bool) {
+	if h == nil {
+		return
+	}
+	if h.dict != nil {
+		for field, value := range h.dict {
+			if !fn(field, value) {
+				return
+			}
+		}
+		return
+	}
+	for pos := h.lp.first(); !h.lp.atEnd(pos); {
+		var field, value lpEntry
+		field, pos = h.lp.next(pos)
+		value, pos = h.lp.next(pos)
+		if !fn(field.String(), value.String()) {
+			return
+		}
+	}
+}
+
+// Scan returns up to about count fields for HSCAN, like scanBatch does.
+func (h *Hash) Scan(cursor uint64, count int) ([]string, uint64) {
+	if h == nil || h.dict == nil {
+		return scanBatch(cursor, count, func(yield func(string)) {
+			h.Range(func(field, _ string) bool {
+				yield(field)
+				return true
+			})
+		})
+	}
+	scanIndexMu.Lock()
+	if h.scan == nil {
+		h.scan = buildScanIndex(func(yield func(string)) {
+			for field := range h.dict {
+				yield(field)
+			}
+		})
+	}
+	scanIndexMu.Unlock()
+	return h.scan.batch(cursor, count)
+}
+
+// Fields returns every field, in no particular order for a hashtable.
+func (h *Hash) Fields() []string {
+	fields := make([]string, 0, h.Len())
+	h.Range(func(field, _ string) bool {
+		fields = append(fields, field)
+		return true
+	})
+	return fields
+}
+
+// Map returns a copy of the hash as a map.
+func (h *Hash) Map() map[string]string {
+	m := make(map[string]string, h.Len())
+	h.Range(func(field, value string) bool {
+		m[field] = value
+		return true
+	})
+	return m
+}
+
+func (h *Hash) clone() *Hash {
+	if h.dict != nil {
+		return &Hash{dict: h.Map()}
+	}
+	return &Hash{lp: append(listpack(nil), h.lp...)}
+}
+
+// convert switches the hash to a map sized for size fields.
+func (h *Hash) convert(size int) {
+	dict := make(map[string]string, size)
+	h.Range(func(field, value string) bool {
+		dict[field] = value
+		return true
+	})
+	h.dict, h.lp = dict, nil
+}
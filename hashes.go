@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+func (kv *KeyValueStore) HSetNXCommand(parts []string) string {
+	if len(parts) != 4 {
+		return "ERR HSETNX requires 3 arguments"
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.expireHashFields(parts[1])
+	key, field, value := parts[1], parts[2], parts[3]
+	hash, exists := kv.Hashes[key]
+	if !exists {
+		hash = NewHash()
+		kv.Hashes[key] = hash
+	}
+	if hash.Has(field) {
+		return "(integer) 0"
+	}
+	hash.Set(field, value)
+	return "(integer) 1"
+}
+
+func (kv *KeyValueStore) HExistsCommand(parts []string) string {
+	if len(parts) != 3 {
+		return "ERR HEXISTS requires 2 arguments"
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	if kv.liveHash(parts[1]).Has(parts[2]) {
+		return "(integer) 1"
+	}
+	return "(integer) 0"
+}
+
+func (kv *KeyValueStore) HLenCommand(parts []string) string {
+	if len(parts) != 2 {
+		return "ERR HLEN requires 1 argument"
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	return fmt.Sprintf("(integer) %d", kv.liveHash(parts[1]).Len())
+}
+
+func (kv *KeyValueStore) HKeysCommand(parts []string) string {
+	if len(parts) != 2 {
+		return "ERR HKEYS requires 1 argument"
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	hash := kv.liveHash(parts[1])
+	if hash.Len() == 0 {
+		return "(empty hash)"
+	}
+	return strings.Join(hash.Fields(), " ")
+}
+
+func (kv *KeyValueStore) HValsCommand(parts []string) string {
+	if len(parts) != 2 {
+		return "ERR HVALS requires 1 argument"
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	hash := kv.liveHash(parts[1])
+	if hash.Len() == 0 {
+		return "(empty hash)"
+	}
+	values := make([]string, 0, hash.Len())
+	hash.Range(func(_, value string) bool {
+		values = append(values, value)
+		return true
+	})
+	return strings.Join(values, " ")
+}
+
+func (kv *KeyValueStore) HStrLenCommand(parts []string) string {
+	if len(parts) != 3 {
+		return "ERR HSTRLEN requires 2 arguments"
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	value, _ := kv.liveHash(parts[1]).Get(parts[2])
+	return fmt.Sprintf("(integer) %d", len(value))
+}
+
+func (kv *KeyValueStore) HIncrByCommand(parts []string) string {
+	if len(parts) != 4 {
+		return "ERR HINCRBY requires 3 arguments"
+	}
+	increment, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		return "ERR value is not an integer or out of range"
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.expireHashFields(parts[1])
+	key, field := parts[1], parts[2]
+	hash, exists := kv.Hashes[key]
+	if !exists {
+		hash = NewHash()
+		kv.Hashes[key] = hash
+	}
+	var current int64
+	if value, ok := hash.Get(field); ok {
+		current, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "ERR hash value is not an integer"
+		}
+	}
+	if (increment > 0 && current > math.MaxInt64-increment) || (increment < 0 && current < math.MinInt64-increment) {
+		return "ERR increment or decrement would overflow"
+	}
+	current += increment
+	hash.Set(field, strconv.FormatInt(current, 10))
+	return fmt.Sprintf("(integer) %d", current)
+}
+
+func (kv *KeyValueStore) HIncrByFloatCommand(parts []string) string {
+	if len(parts) != 4 {
+		return "ERR HINCRBYFLOAT requires 3 arguments"
+	}
+	increment, err := parseFloatArg(parts[3])
+	if err != nil {
+		return "ERR value is not a valid float"
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.expireHashFields(parts[1])
+	key, field := parts[1], parts[2]
+	hash, exists := kv.Hashes[key]
+	if !exists {
+		hash = NewHash()
+		kv.Hashes[key] = hash
+	}
+	var current float64
+	if value, ok := hash.Get(field); ok {
+		current, err = parseFloatArg(value)
+		if err != nil {
+			return "ERR hash value is not a float"
+		}
+	}
+	current += increment
+	if math.IsNaN(current) || math.IsInf(current, 0) {
+		return "ERR increment would produce NaN or Infinity"
+	}
+	value := strconv.FormatFloat(current, 'f', -1, 64)
+	hash.Set(field, value)
+	return value
+}
+
+// HRandFieldCommand implements HRANDFIELD key [count [WITHVALUES]]. A negative
+// count may return the same field more than once.
+func (kv *KeyValueStore) HRandFieldCommand(parts []string) string {
+	if len(parts) < 2 || len(parts) > 4 {
+		return "ERR HRANDFIELD requires 1 to 3 arguments"
+	}
+	withValues := false
+	if len(parts) == 4 {
+		if strings.ToUpper(parts[3]) != "WITHVALUES" {
+			return "ERR syntax error"
+		}
+		withValues = true
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	hash := kv.liveHash(parts[1])
+
+	if len(parts) == 2 {
+		if hash.Len() == 0 {
+			return "(nil)"
+		}
+		fields := hash.Fields()
+		return fields[rand.Intn(len(fields))]
+	}
+
+	count, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return "ERR value is not an integer or out of range"
+	}
+	if hash.Len() == 0 || count == 0 {
+		return "(empty array)"
+	}
+	fields := hash.Fields()
+
+	var picked []string
+	if count < 0 {
+		picked = make([]string, -count)
+		for i := range picked {
+			picked[i] = fields[rand.Intn(len(fields))]
+		}
+	} else {
+		rand.Shuffle(len(fields), func(i, j int) { fields[i], fields[j] = fields[j], fields[i] })
+		if count < len(fields) {
+			fields = fields[:count]
+		}
+		picked = fields
+	}
+
+	if !withValues {
+		return strings.Join(picked, " ")
+	}
+	result := make([]string, 0, len(picked)*2)
+	for _, field := range picked {
+		value, _ := hash.Get(field)
+		result = append(result, field, value)
+	}
+	return strings.Join(result, " ")
+}
+
+// HScanCommand implements HSCAN key cursor [MATCH pattern] [COUNT count] [NOVALUES].
+// The reply is the next cursor followed by the field/value pairs.
+func (kv *KeyValueStore) HScanCommand(parts []string) string {
+	if len(parts) < 3 {
+		return "ERR HSCAN requires at least 2 arguments"
+	}
+	opts, errMsg := parseScanArgs(parts, 2, false, true)
+	if errMsg != "" {
+		return errMsg
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	hash := kv.liveHash(parts[1])
+	fields, next := hash.Scan(opts.cursor, opts.count)
+	fields = filterMatch(fields, opts.match)
+
+	result := []string{strconv.FormatUint(next, 10)}
+	for _, field := range fields {
+		result = append(result, field)
+		if !opts.noValues {
+			value, _ := hash.Get(field)
+			result = append(result, value)
+		}
+	}
+	return strings.Join(result, " ")
+}
+
+// parseFloatArg parses a float the way Redis does, accepting "inf" and
+// "-inf" but rejecting NaN.
+func parseFloatArg(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(f) {
+		return 0, strconv.ErrSyntax
+	}
+	return f, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/dhravya/radish/redisproto"
+)
+
+// commandCase is a command and the reply it is expected to get, run in turn
+// against the same database.
+type commandCase struct {
+	command  []string
+	expected string
+}
+
+func checkCommands(t *testing.T, kv *KeyValueStore, cases []commandCase) {
+	t.Helper()
+	for _, c := range cases {
+		if got := kv.executeCommand(c.command); got != c.expected {
+			t.Fatalf("%s: expected %q, Got: %q", strings.Join(c.command, " "), c.expected, got)
+		}
+	}
+}
+
+func TestHashCommands(t *testing.T) {
+	kv := NewKeyValueStore()
+	checkCommands(t, kv, []commandCase{
+		{[]string{"HSET", "h", "a", "1", "b", "2"}, "(integer) 2"},
+		{[]string{"HSET", "h", "a", "10", "c", "3"}, "(integer) 1"},
+		{[]string{"HSET", "h", "a"}, "ERR HSET requires an even number of arguments >= 4"},
+		{[]string{"HGET", "h", "a"}, "10"},
+		{[]string{"HGET", "h", "missing"}, "(nil)"},
+		{[]string{"HSETNX", "h", "a", "100"}, "(integer) 0"},
+		{[]string{"HSETNX", "h", "d", "4"}, "(integer) 1"},
+		{[]string{"HSETNX", "new", "f", "v"}, "(integer) 1"},
+		{[]string{"HGET", "h", "a"}, "10"},
+		{[]string{"HMSET", "h", "e", "5"}, "OK"},
+		{[]string{"HMGET", "h", "a", "missing", "e"}, "10 (nil) 5"},
+		{[]string{"HLEN", "h"}, "(integer) 5"},
+		{[]string{"HLEN", "missing"}, "(integer) 0"},
+		{[]string{"HEXISTS", "h", "b"}, "(integer) 1"},
+		{[]string{"HEXISTS", "h", "z"}, "(integer) 0"},
+		{[]string{"HSTRLEN", "h", "a"}, "(integer) 2"},
+		{[]string{"HSTRLEN", "h", "z"}, "(integer) 0"},
+		{[]string{"HDEL", "h", "d", "e", "z"}, "(integer) 2"},
+		{[]string{"HKEYS", "missing"}, "(empty hash)"},
+		{[]string{"HDEL", "new", "f"}, "(integer) 1"},
+		{[]string{"EXISTS", "new"}, "(integer) 0"},
+	})
+
+	for _, command := range [][]string{{"HKEYS", "h"}, {"HVALS", "h"}} {
+		got := strings.Fields(kv.executeCommand(command))
+		sort.Strings(got)
+		expected := map[string]string{
+			"HKEYS": "a b c",
+			"HVALS": "10 2 3",
+		}[command[0]]
+		if strings.Join(got, " ") != expected {
+			t.Fatalf("%s: expected %q in any order, Got: %q", command[0], expected, got)
+		}
+	}
+
+	// HGETALL replies with an array, so values may hold spaces
+	checkCommands(t, kv, []commandCase{
+		{[]string{"HSET", "h", "b", "two words"}, "(integer) 0"},
+		{[]string{"HGETALL", "h"}, multiBulkReply([]string{"a", "10", "b", "two words", "c", "3"})},
+		{[]string{"HGETALL", "missing"}, multiBulkReply(nil)},
+	})
+}
+
+func TestEmptiedHashLosesItsTTL(t *testing.T) {
+	kv := NewKeyValueStore()
+	for _, empty := range [][]string{
+		{"HDEL", "h", "f"},
+		{"HGETDEL", "h", "FIELDS", "1", "f"},
+	} {
+		kv.executeCommand([]string{"HSET", "h", "f", "v"})
+		kv.executeCommand([]string{"EXPIRE", "h", "100"})
+		kv.executeCommand(empty)
+		checkCommands(t, kv, []commandCase{
+			{[]string{"EXISTS", "h"}, "(integer) 0"},
+			{[]string{"HSET", "h", "f", "v"}, "(integer) 1"},
+			{[]string{"TTL", "h"}, "(integer) -1"},
+		})
+		kv.executeCommand([]string{"DEL", "h"})
+	}
+}
+
+func TestWriteMultiBulkReply(t *testing.T) {
+	var b strings.Builder
+	w := redisproto.NewWriter(&b)
+	writeReply(w, multiBulkReply([]string{"f", "a b"}))
+	writeReply(w, "a b")
+	if got := b.String(); got != "*2\r\n$1\r\nf\r\n$3\r\na b\r\n$3\r\na b\r\n" {
+		t.Fatalf("Expected an array and then a bulk string, Got: %q", got)
+	}
+}
+
+func TestHashIncrements(t *testing.T) {
+	kv := NewKeyValueStore()
+	checkCommands(t, kv, []commandCase{
+		{[]string{"HINCRBY", "h", "n", "5"}, "(integer) 5"},
+		{[]string{"HINCRBY", "h", "n", "-7"}, "(integer) -2"},
+		{[]string{"HINCRBY", "h", "n", "x"}, "ERR value is not an integer or out of range"},
+		{[]string{"HSET", "h", "max", "9223372036854775806"}, "(integer) 1"},
+		{[]string{"HINCRBY", "h", "max", "1"}, "(integer) 9223372036854775807"},
+		{[]string{"HINCRBY", "h", "max", "1"}, "ERR increment or decrement would overflow"},
+		{[]string{"HSET", "h", "min", "-9223372036854775808"}, "(integer) 1"},
+		{[]string{"HINCRBY", "h", "min", "-1"}, "ERR increment or decrement would overflow"},
+		{[]string{"HSET", "h", "s", "abc"}, "(integer) 1"},
+		{[]string{"HINCRBY", "h", "s", "1"}, "ERR hash value is not an integer"},
+		{[]string{"HINCRBYFLOAT", "h", "f", "10.5"}, "10.5"},
+		{[]string{"HINCRBYFLOAT", "h", "f", "0.1"}, "10.6"},
+		{[]string{"HINCRBYFLOAT", "h", "f", "-5e1"}, "-39.4"},
+		{[]string{"HINCRBYFLOAT", "h", "n", "0.5"}, "-1.5"},
+		{[]string{"HINCRBYFLOAT", "h", "f", "nan"}, "ERR value is not a valid float"},
+		{[]string{"HINCRBYFLOAT", "h", "f", "inf"}, "ERR increment would produce NaN or Infinity"},
+		{[]string{"HINCRBYFLOAT", "h", "s", "1"}, "ERR hash value is not a float"},
+		{[]string{"HGET", "h", "f"}, "-39.4"},
+	})
+}
+
+func TestHashRandomFieldsAndScan(t *testing.T) {
+	kv := NewKeyValueStore()
+	kv.executeCommand([]string{"HSET", "h", "a", "1", "b", "2", "c", "3"})
+	checkCommands(t, kv, []commandCase{
+		{[]string{"HRANDFIELD", "missing"}, "(nil)"},
+		{[]string{"HRANDFIELD", "missing", "3"}, "(empty array)"},
+		{[]string{"HRANDFIELD", "h", "0"}, "(empty array)"},
+		{[]string{"HRANDFIELD", "h", "1", "VALUES"}, "ERR syntax error"},
+	})
+
+	if got := strings.Fields(kv.executeCommand([]string{"HRANDFIELD", "h", "10"})); len(got) != 3 {
+		t.Fatalf("Expected a positive count to return distinct fields at most once, Got: %q", got)
+	}
+	got := strings.Fields(kv.executeCommand([]string{"HRANDFIELD", "h", "-10", "WITHVALUES"}))
+	if len(got) != 20 {
+		t.Fatalf("Expected a negative count to return exactly that many fields, Got: %q", got)
+	}
+	for i := 0; i < len(got); i += 2 {
+		if value, _ := kv.Hashes["h"].Get(got[i]); value != got[i+1] {
+			t.Fatalf("Expected %s to come with its value, Got: %q", got[i], got[i+1])
+		}
+	}
+
+	reply := strings.Fields(kv.executeCommand([]string{"HSCAN", "h", "0", "MATCH", "[ab]", "COUNT", "100"}))
+	if reply[0] != "0" || len(reply) != 5 {
+		t.Fatalf("Expected a and b with their values in one call, Got: %q", reply)
+	}
+	reply = strings.Fields(kv.executeCommand([]string{"HSCAN", "h", "0", "NOVALUES"}))
+	sort.Strings(reply[1:])
+	if strings.Join(reply, " ") != "0 a b c" {
+		t.Fatalf("Expected only the fields, Got: %q", reply)
+	}
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Hash fields can carry their own TTL. The deadlines live in
+// kv.HashFieldExpirations, keyed by hash key and then by field, so that they
+// are persisted together with the rest of the store. Expired fields are
+// removed lazily by write commands, hidden from read commands by liveHash and
+// reclaimed in the background by activeExpireHashFields.
+
+const (
+	hashExpireCycleInterval = 100 * time.Millisecond
+	hashExpireSampleSize    = 20
+)
+
+// Reply codes used by the HEXPIRE family, matching Redis.
+const (
+	fieldNoSuchField  = -2
+	fieldNoTTL        = -1
+	fieldNotSet       = 0
+	fieldTTLSet       = 1
+	fieldDeletedByTTL = 2
+)
+
+// liveHash returns the hash stored at key without the fields whose TTL has
+// passed. It only copies the hash when something has actually expired, so it
+// is safe to call under the read lock.
+func (kv *KeyValueStore) liveHash(key string) *Hash {
+	hash := kv.Hashes[key]
+	ttls := kv.HashFieldExpirations[key]
+	if len(ttls) == 0 {
+		return hash
+	}
+	now := time.Now()
+	var live *Hash
+	for field, deadline := range ttls {
+		if now.Before(deadline) {
+			continue
+		}
+		if live == nil {
+			live = hash.clone()
+		}
+		live.Delete(field)
+	}
+	if live == nil {
+		return hash
+	}
+	if live.Len() == 0 {
+		return nil
+	}
+	return live
+}
+
+// hashExpired reports whether every field of the hash at key is past its
+// TTL, which leaves the key as good as missing until the fields are removed.
+func (kv *KeyValueStore) hashExpired(key string) bool {
+	ttls := kv.HashFieldExpirations[key]
+	if len(ttls) < kv.Hashes[key].Len() {
+		return false
+	}
+	now := time.Now()
+	for _, deadline := range ttls {
+		if now.Before(deadline) {
+			return false
+		}
+	}
+	return true
+}
+
+// expireHashFields deletes the fields of the hash at key whose TTL has passed,
+// removing the key when it becomes empty, and returns them. The caller must
+// hold the write lock.
+func (kv *KeyValueStore) expireHashFields(key string) []string {
+	ttls := kv.HashFieldExpirations[key]
+	if len(ttls) == 0 {
+		return nil
+	}
+	now := time.Now()
+	var expired []string
+	for field, deadline := range ttls {
+		if now.Before(deadline) {
+			continue
+		}
+		kv.deleteHashField(key, field)
+		expired = append(expired, field)
+	}
+	return expired
+}
+
+// deleteHashField removes field and its TTL from the hash at key, removing
+// the key when it becomes empty. The caller must hold the write lock.
+func (kv *KeyValueStore) deleteHashField(key, field string) bool {
+	hash, exists := kv.Hashes[key]
+	if !exists {
+		return false
+	}
+	existed := hash.Delete(field)
+	kv.persistHashField(key, field)
+	if hash.Len() == 0 {
+		kv.deleteKey(key)
+		return existed
+	}
+	kv.indexKeys(key)
+	return existed
+}
+
+// persistHashField drops the TTL of a single field, if any.
+func (kv *KeyValueStore) persistHashField(key, field string) bool {
+	ttls, exists := kv.HashFieldExpirations[key]
+	if !exists {
+		return false
+	}
+	if _, ok := ttls[field]; !ok {
+		return false
+	}
+	delete(ttls, field)
+	if len(ttls) == 0 {
+		delete(kv.HashFieldExpirations, key)
+	}
+	return true
+}
+
+func (kv *KeyValueStore) setHashFieldTTL(key, field string, deadline time.Time) {
+	ttls, exists := kv.HashFieldExpirations[key]
+	if !exists {
+		ttls = make(map[string]time.Time)
+		kv.HashFieldExpirations[key] = ttls
+	}
+	ttls[field] = deadline
+}
+
+// activeExpireHashFields periodically samples hashes that have field TTLs and
+// reclaims the expired fields, so memory is released even for hashes that are
+// never touched again. Like Redis, it keeps sampling while a large share of
+// the sample turns out to be expired.
+func (kv *KeyValueStore) activeExpireHashFields() {
+	ticker := time.NewTicker(hashExpireCycleInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for kv.expireHashFieldsCycle() {
+		}
+	}
+}
+
+// expireHashFieldsCycle samples hashes that have field TTLs once, deleting
+// their expired fields. The deletions are logged as HDEL, so the append-only
+// file and the replicas drop the fields too. It reports whether enough of the
+// sample had expired to sample again right away.
+func (kv *KeyValueStore) expireHashFieldsCycle() bool {
+	propagateMu.Lock()
+	defer propagateMu.Unlock()
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	sampled, expired := 0, 0
+	for key := range kv.HashFieldExpirations {
+		if sampled == hashExpireSampleSize {
+			break
+		}
+		sampled++
+		if fields := kv.expireHashFields(key); len(fields) > 0 {
+			propagate(kv.index, append([]string{"HDEL", key}, fields...))
+			expired++
+		}
+	}
+	return sampled == hashExpireSampleSize && expired*4 >= sampled
+}
+
+// parseFieldsArg parses "FIELDS numfields field [field ...]" starting at
+// parts[i] and expects it to run to the end of the command.
+func parseFieldsArg(parts []string, i int) ([]string, string) {
+	if i >= len(parts) || strings.ToUpper(parts[i]) != "FIELDS" {
+		return nil, "ERR mandatory argument FIELDS is missing or not at the right position"
+	}
+	if i+1 >= len(parts) {
+		return nil, "ERR syntax error"
+	}
+	numFields, err := strconv.Atoi(parts[i+1])
+	if err != nil || numFields <= 0 {
+		return nil, "ERR Parameter `numFields` should be greater than 0"
+	}
+	fields := parts[i+2:]
+	if len(fields) != numFields {
+		return nil, "ERR The `numfields` parameter must match the number of arguments"
+	}
+	return fields, ""
+}
+
+// parseExpireDeadline turns the time argument of an EXPIRE-style command into
+// an absolute deadline. unit is the duration of one tick of value and absolute
+// tells whether value is a unix timestamp rather than a relative TTL.
+func parseExpireDeadline(value string, unit time.Duration, absolute bool, command string) (time.Time, string) {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, "ERR value is not an integer or out of range"
+	}
+	if n < 0 || n > math.MaxInt64/int64(unit) {
+		return time.Time{}, fmt.Sprintf("ERR invalid expire time in '%s' command", strings.ToLower(command))
+	}
+	if absolute {
+		return time.Unix(0, n*int64(unit)), ""
+	}
+	return time.Now().Add(time.Duration(n) * unit), ""
+}
+
+func joinInts(values []int64) string {
+	result := make([]string, len(values))
+	for i, v := range values {
+		result[i] = strconv.FormatInt(v, 10)
+	}
+	return strings.Join(result, " ")
+}
+
+// HExpireCommand implements HEXPIRE, HPEXPIRE, HEXPIREAT and HPEXPIREAT:
+// key time [NX | XX | GT | LT] FIELDS numfields field [field ...]
+func (kv *KeyValueStore) HExpireCommand(parts []string, unit time.Duration, absolute bool) string {
+	if len(parts) < 6 {
+		return fmt.Sprintf("ERR %s requires at least 5 arguments", parts[0])
+	}
+	key := parts[1]
+	deadline, errMsg := parseExpireDeadline(parts[2], unit, absolute, parts[0])
+	if errMsg != "" {
+		return errMsg
+	}
+	condition := ""
+	fieldsAt := 3
+	switch strings.ToUpper(parts[3]) {
+	case "NX", "XX", "GT", "LT":
+		condition = strings.ToUpper(parts[3])
+		fieldsAt = 4
+	}
+	fields, errMsg := parseFieldsArg(parts, fieldsAt)
+	if errMsg != "" {
+		return errMsg
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.expireHashFields(key)
+	now := time.Now()
+	results := make([]int64, len(fields))
+	for i, field := range fields {
+		hash := kv.Hashes[key]
+		if !hash.Has(field) {
+			results[i] = fieldNoSuchField
+			continue
+		}
+		current, hasTTL := kv.HashFieldExpirations[key][field]
+		switch {
+		case condition == "NX" && hasTTL,
+			condition == "XX" && !hasTTL,
+			condition == "GT" && (!hasTTL || !deadline.After(current)),
+			condition == "LT" && hasTTL && !deadline.Before(current):
+			results[i] = fieldNotSet
+			continue
+		}
+		if !deadline.After(now) {
+			kv.deleteHashField(key, field)
+			results[i] = fieldDeletedByTTL
+			continue
+		}
+		kv.setHashFieldTTL(key, field, deadline)
+		results[i] = fieldTTLSet
+	}
+	return joinInts(results)
+}
+
+// HTTLCommand implements HTTL, HPTTL, HEXPIRETIME and HPEXPIRETIME:
+// key FIELDS numfields field [field ...]
+func (kv *KeyValueStore) HTTLCommand(parts []string, unit time.Duration, absolute bool) string {
+	if len(parts) < 5 {
+		return fmt.Sprintf("ERR %s requires at least 4 arguments", parts[0])
+	}
+	key := parts[1]
+	fields, errMsg := parseFieldsArg(parts, 2)
+	if errMsg != "" {
+		return errMsg
+	}
+
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	hash := kv.liveHash(key)
+	now := time.Now()
+	results := make([]int64, len(fields))
+	for i, field := range fields {
+		if !hash.Has(field) {
+			results[i] = fieldNoSuchField
+			continue
+		}
+		deadline, hasTTL := kv.HashFieldExpirations[key][field]
+		switch {
+		case !hasTTL:
+			results[i] = fieldNoTTL
+		case absolute:
+			results[i] = deadline.UnixNano() / int64(unit)
+		default:
+			remaining := deadline.Sub(now)
+			results[i] = int64((remaining + unit/2) / unit)
+		}
+	}
+	return joinInts(results)
+}
+
+// HPersistCommand implements HPERSIST key FIELDS numfields field [field ...]
+func (kv *KeyValueStore) HPersistCommand(parts []string) string {
+	if len(parts) < 5 {
+		return "ERR HPERSIST requires at least 4 arguments"
+	}
+	key := parts[1]
+	fields, errMsg := parseFieldsArg(parts, 2)
+	if errMsg != "" {
+		return errMsg
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.expireHashFields(key)
+	results := make([]int64, len(fields))
+	for i, field := range fields {
+		if !kv.Hashes[key].Has(field) {
+			results[i] = fieldNoSuchField
+		} else if kv.persistHashField(key, field) {
+			results[i] = fieldTTLSet
+		} else {
+			results[i] = fieldNoTTL
+		}
+	}
+	return joinInts(results)
+}
+
+// HGetExCommand implements
+// HGETEX key [EX seconds | PX milliseconds | EXAT unix-time-seconds |
+// PXAT unix-time-milliseconds | PERSIST] FIELDS numfields field [field ...]
+func (kv *KeyValueStore) HGetExCommand(parts []string) string {
+	if len(parts) < 5 {
+		return "ERR HGETEX requires at least 4 arguments"
+	}
+	key := parts[1]
+	var deadline time.Time
+	setTTL, persist := false, false
+	fieldsAt := 2
+	switch option := strings.ToUpper(parts[2]); option {
+	case "EX", "PX", "EXAT", "PXAT":
+		var errMsg string
+		deadline, errMsg = parseExpireDeadline(parts[3], expireUnit(option), strings.HasSuffix(option, "AT"), parts[0])
+		if errMsg != "" {
+			return errMsg
+		}
+		setTTL = true
+		fieldsAt = 4
+	case "PERSIST":
+		persist = true
+		fieldsAt = 3
+	}
+	fields, errMsg := parseFieldsArg(parts, fieldsAt)
+	if errMsg != "" {
+		return errMsg
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.expireHashFields(key)
+	now := time.Now()
+	results := make([]string, len(fields))
+	for i, field := range fields {
+		value, ok := kv.Hashes[key].Get(field)
+		if !ok {
+			results[i] = "(nil)"
+			continue
+		}
+		results[i] = value
+		switch {
+		case persist:
+			kv.persistHashField(key, field)
+		case setTTL && !deadline.After(now):
+			kv.deleteHashField(key, field)
+		case setTTL:
+			kv.setHashFieldTTL(key, field, deadline)
+		}
+	}
+	return strings.Join(results, " ")
+}
+
+// HSetExCommand implements
+// HSETEX key [FNX | FXX] [EX seconds | PX milliseconds | EXAT unix-time-seconds |
+// PXAT unix-time-milliseconds | KEEPTTL] FIELDS numfields field value [field value ...]
+// It replies 1 when all fields were set and 0 when the FNX/FXX condition
+// prevented any of them from being set.
+func (kv *KeyValueStore) HSetExCommand(parts []string) string {
+	if len(parts) < 6 {
+		return "ERR HSETEX requires at least 5 arguments"
+	}
+	key := parts[1]
+	condition := ""
+	var deadline time.Time
+	setTTL, keepTTL := false, false
+	i := 2
+	for ; i < len(parts) && strings.ToUpper(parts[i]) != "FIELDS"; i++ {
+		switch option := strings.ToUpper(parts[i]); option {
+		case "FNX", "FXX":
+			if condition != "" {
+				return "ERR syntax error"
+			}
+			condition = option
+		case "EX", "PX", "EXAT", "PXAT":
+			if setTTL || keepTTL || i+1 >= len(parts) {
+				return "ERR syntax error"
+			}
+			var errMsg string
+			deadline, errMsg = parseExpireDeadline(parts[i+1], expireUnit(option), strings.HasSuffix(option, "AT"), parts[0])
+			if errMsg != "" {
+				return errMsg
+			}
+			setTTL = true
+			i++
+		case "KEEPTTL":
+			if setTTL {
+				return "ERR syntax error"
+			}
+			keepTTL = true
+		default:
+			return "ERR syntax error"
+		}
+	}
+	if i+1 >= len(parts) {
+		return "ERR mandatory argument FIELDS is missing or not at the right position"
+	}
+	numFields, err := strconv.Atoi(parts[i+1])
+	if err != nil || numFields <= 0 {
+		return "ERR Parameter `numFields` should be greater than 0"
+	}
+	pairs := parts[i+2:]
+	if len(pairs) != numFields*2 {
+		return "ERR wrong number of arguments for 'hsetex' command"
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.expireHashFields(key)
+	hash := kv.Hashes[key]
+	if condition != "" {
+		for j := 0; j < len(pairs); j += 2 {
+			exists := hash.Has(pairs[j])
+			if (condition == "FNX" && exists) || (condition == "FXX" && !exists) {
+				return "(integer) 0"
+			}
+		}
+	}
+	if setTTL && !deadline.After(time.Now()) {
+		// Setting fields that are already expired amounts to deleting them
+		for j := 0; j < len(pairs); j += 2 {
+			kv.deleteHashField(key, pairs[j])
+		}
+		return "(integer) 1"
+	}
+	if hash == nil {
+		hash = NewHash()
+		kv.Hashes[key] = hash
+	}
+	for j := 0; j < len(pairs); j += 2 {
+		field := pairs[j]
+		hash.Set(field, pairs[j+1])
+		switch {
+		case setTTL:
+			kv.setHashFieldTTL(key, field, deadline)
+		case !keepTTL:
+			kv.persistHashField(key, field)
+		}
+	}
+	return "(integer) 1"
+}
+
+// HGetDelCommand implements HGETDEL key FIELDS numfields field [field ...]
+func (kv *KeyValueStore) HGetDelCommand(parts []string) string {
+	if len(parts) < 5 {
+		return "ERR HGETDEL requires at least 4 arguments"
+	}
+	key := parts[1]
+	fields, errMsg := parseFieldsArg(parts, 2)
+	if errMsg != "" {
+		return errMsg
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.expireHashFields(key)
+	results := make([]string, len(fields))
+	for i, field := range fields {
+		value, ok := kv.Hashes[key].Get(field)
+		if !ok {
+			results[i] = "(nil)"
+			continue
+		}
+		results[i] = value
+		kv.deleteHashField(key, field)
+	}
+	return strings.Join(results, " ")
+}
+
+func expireUnit(option string) time.Duration {
+	if strings.HasPrefix(option, "P") {
+		return time.Millisecond
+	}
+	return time.Second
+}
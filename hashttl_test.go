@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashFieldExpireConditions(t *testing.T) {
+	kv := NewKeyValueStore()
+	kv.executeCommand([]string{"HSET", "h", "a", "1", "b", "2", "c", "3"})
+	checkCommands(t, kv, []commandCase{
+		{[]string{"HEXPIRE", "h", "100", "FIELDS", "2", "a", "missing"}, "1 -2"},
+		{[]string{"HEXPIRE", "missing", "100", "FIELDS", "1", "a"}, "-2"},
+		{[]string{"HEXPIRE", "h", "200", "NX", "FIELDS", "2", "a", "b"}, "0 1"},
+		{[]string{"HEXPIRE", "h", "300", "XX", "FIELDS", "2", "a", "c"}, "1 0"},
+		// a has 300s and b 200s left, c has no TTL, which counts as infinite
+		{[]string{"HEXPIRE", "h", "250", "GT", "FIELDS", "3", "a", "b", "c"}, "0 1 0"},
+		{[]string{"HEXPIRE", "h", "100", "LT", "FIELDS", "3", "a", "b", "c"}, "1 1 1"},
+		{[]string{"HTTL", "h", "FIELDS", "3", "a", "b", "missing"}, "100 100 -2"},
+		{[]string{"HPERSIST", "h", "FIELDS", "3", "a", "a", "missing"}, "1 -1 -2"},
+		{[]string{"HTTL", "h", "FIELDS", "1", "a"}, "-1"},
+		{[]string{"HEXPIRE", "h", "0", "FIELDS", "1", "c"}, "2"},
+		{[]string{"HEXISTS", "h", "c"}, "(integer) 0"},
+		{[]string{"HEXPIRE", "h", "-1", "FIELDS", "1", "a"}, "ERR invalid expire time in 'hexpire' command"},
+		{[]string{"HEXPIRE", "h", "10", "FIELDS", "2", "a"}, "ERR The `numfields` parameter must match the number of arguments"},
+		{[]string{"HEXPIRE", "h", "10", "FIELDS", "0", "a"}, "ERR Parameter `numFields` should be greater than 0"},
+		{[]string{"HEXPIRE", "h", "10", "SOON", "FIELDS", "1", "a"}, "ERR mandatory argument FIELDS is missing or not at the right position"},
+	})
+}
+
+func TestHashFieldTTLReplies(t *testing.T) {
+	kv := NewKeyValueStore()
+	kv.executeCommand([]string{"HSET", "h", "a", "1", "b", "2"})
+	deadline := time.Now().Add(time.Hour).UnixMilli()
+	at := strconv.FormatInt(deadline, 10)
+	checkCommands(t, kv, []commandCase{
+		{[]string{"HPEXPIREAT", "h", at, "FIELDS", "1", "a"}, "1"},
+		{[]string{"HPEXPIRETIME", "h", "FIELDS", "2", "a", "b"}, at + " -1"},
+		{[]string{"HEXPIRETIME", "h", "FIELDS", "1", "a"}, strconv.FormatInt(deadline/1000, 10)},
+		{[]string{"HTTL", "h", "FIELDS", "1", "a"}, "3600"},
+		{[]string{"HPEXPIRE", "h", "1500", "FIELDS", "1", "b"}, "1"},
+	})
+	if got, _ := strconv.Atoi(kv.executeCommand([]string{"HPTTL", "h", "FIELDS", "1", "b"})); got <= 1000 || got > 1500 {
+		t.Fatalf("Expected about 1500ms left, Got: %d", got)
+	}
+
+	// Fields past their TTL are gone for every command
+	kv.HashFieldExpirations["h"]["b"] = time.Now().Add(-time.Millisecond)
+	checkCommands(t, kv, []commandCase{
+		{[]string{"HGET", "h", "b"}, "(nil)"},
+		{[]string{"HLEN", "h"}, "(integer) 1"},
+		{[]string{"HTTL", "h", "FIELDS", "1", "b"}, "-2"},
+		{[]string{"HGETALL", "h"}, multiBulkReply([]string{"a", "1"})},
+	})
+	kv.HashFieldExpirations["h"]["a"] = time.Now().Add(-time.Millisecond)
+	checkCommands(t, kv, []commandCase{
+		{[]string{"EXISTS", "h"}, "(integer) 0"},
+		{[]string{"HSET", "h", "c", "3"}, "(integer) 1"},
+		{[]string{"HLEN", "h"}, "(integer) 1"},
+	})
+}
+
+func TestHashGetExSetExAndGetDel(t *testing.T) {
+	kv := NewKeyValueStore()
+	checkCommands(t, kv, []commandCase{
+		{[]string{"HSETEX", "h", "FNX", "EX", "100", "FIELDS", "2", "a", "1", "b", "2"}, "(integer) 1"},
+		{[]string{"HTTL", "h", "FIELDS", "2", "a", "b"}, "100 100"},
+		// FNX and FXX apply to all the fields or none of them
+		{[]string{"HSETEX", "h", "FNX", "FIELDS", "2", "a", "10", "c", "3"}, "(integer) 0"},
+		{[]string{"HEXISTS", "h", "c"}, "(integer) 0"},
+		{[]string{"HSETEX", "h", "FXX", "FIELDS", "2", "a", "10", "c", "3"}, "(integer) 0"},
+		{[]string{"HSETEX", "h", "FXX", "KEEPTTL", "FIELDS", "1", "a", "10"}, "(integer) 1"},
+		{[]string{"HTTL", "h", "FIELDS", "1", "a"}, "100"},
+		{[]string{"HSETEX", "h", "FXX", "FIELDS", "1", "b", "20"}, "(integer) 1"},
+		{[]string{"HTTL", "h", "FIELDS", "1", "b"}, "-1"},
+		{[]string{"HSETEX", "h", "FNX", "FXX", "FIELDS", "1", "z", "0"}, "ERR syntax error"},
+		{[]string{"HSETEX", "h", "EX", "10", "KEEPTTL", "FIELDS", "1", "z", "0"}, "ERR syntax error"},
+		{[]string{"HSETEX", "h", "FIELDS", "2", "z", "0"}, "ERR wrong number of arguments for 'hsetex' command"},
+
+		{[]string{"HGETEX", "h", "EX", "50", "FIELDS", "2", "b", "missing"}, "20 (nil)"},
+		{[]string{"HTTL", "h", "FIELDS", "1", "b"}, "50"},
+		{[]string{"HGETEX", "h", "PERSIST", "FIELDS", "2", "a", "b"}, "10 20"},
+		{[]string{"HTTL", "h", "FIELDS", "2", "a", "b"}, "-1 -1"},
+		{[]string{"HGETEX", "h", "PXAT", "1", "FIELDS", "1", "a"}, "10"},
+		{[]string{"HEXISTS", "h", "a"}, "(integer) 0"},
+
+		{[]string{"HGETDEL", "h", "FIELDS", "2", "b", "missing"}, "20 (nil)"},
+		{[]string{"EXISTS", "h"}, "(integer) 0"},
+	})
+}
+
+func TestActiveHashFieldExpiry(t *testing.T) {
+	kv := NewKeyValueStore()
+	path := startTestAppendOnly(t, []*KeyValueStore{kv})
+	kv.executeCommand([]string{"HSET", "h", "a", "1", "b", "2"})
+	kv.executeCommand([]string{"HPEXPIRE", "h", "1", "FIELDS", "1", "a"})
+	time.Sleep(5 * time.Millisecond)
+
+	// Reads hide expired fields without removing them under the read lock
+	if got := kv.executeCommand([]string{"HKEYS", "h"}); got != "b" {
+		t.Fatalf("Expected only b, Got: %q", got)
+	}
+	if !kv.Hashes["h"].Has("a") {
+		t.Fatal("Expected a read not to remove the field")
+	}
+	if kv.expireHashFieldsCycle() || kv.Hashes["h"].Has("a") || len(kv.HashFieldExpirations) != 0 {
+		t.Fatal("Expected the field and its TTL to be reclaimed in one cycle")
+	}
+	if got := strings.Join(kv.Hashes["h"].Fields(), " "); got != "b" {
+		t.Fatalf("Expected b to stay, Got: %q", got)
+	}
+	// The append-only file and the replicas are told about the deletion
+	contents, _ := os.ReadFile(path)
+	if !strings.HasSuffix(string(contents), string(appendRESPCommand(nil, "HDEL", "h", "a"))) {
+		t.Fatalf("Expected HDEL to be logged, Got: %q", contents)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var infoSections = []string{"server", "clients", "memory", "persistence", "stats", "replication", "raft", "cluster", "keyspace"}
+
+// InfoCommand implements INFO [section ...]. Without a section, or with
+// default, all or everything, every section is included.
+func (kv *KeyValueStore) InfoCommand(parts []string) string {
+	wanted := make(map[string]bool)
+	for _, section := range parts[1:] {
+		switch section = strings.ToLower(section); section {
+		case "default", "all", "everything":
+			for _, s := range infoSections {
+				wanted[s] = true
+			}
+		default:
+			wanted[section] = true
+		}
+	}
+	if len(parts) == 1 {
+		for _, s := range infoSections {
+			wanted[s] = true
+		}
+	}
+
+	var infoBuilder strings.Builder
+	for _, section := range infoSections {
+		if !wanted[section] {
+			continue
+		}
+		if infoBuilder.Len() > 0 {
+			infoBuilder.WriteString("\r\n")
+		}
+		switch section {
+		case "server":
+			infoBuilder.WriteString("# Server\r\n")
+			infoBuilder.WriteString(fmt.Sprintf("uptime_in_seconds:%d\r\n", int(time.Since(serverStartTime).Seconds())))
+		case "clients":
+			infoBuilder.WriteString("# Clients\r\n")
+			infoBuilder.WriteString(fmt.Sprintf("connected_clients:%d\r\n", connectedClients.Load()))
+		case "memory":
+			memoryUsage := readMemStats()
+			infoBuilder.WriteString("# Memory\r\n")
+			infoBuilder.WriteString(fmt.Sprintf("used_memory:%d\r\n", kv.usedMemory()))
+			infoBuilder.WriteString(fmt.Sprintf("used_memory_peak:%d\r\n", peakUsedMemory.Load()))
+			infoBuilder.WriteString(fmt.Sprintf("allocator_allocated:%d\r\n", memoryUsage.Alloc))
+			infoBuilder.WriteString(fmt.Sprintf("allocator_allocated_peak:%d\r\n", peakAllocated.Load()))
+			infoBuilder.WriteString(fmt.Sprintf("allocator_allocated_startup:%d\r\n", startupAllocated))
+			infoBuilder.WriteString(fmt.Sprintf("maxmemory:%d\r\n", maxMemory))
+			infoBuilder.WriteString(fmt.Sprintf("maxmemory_policy:%s\r\n", maxMemoryPolicy))
+		case "persistence":
+			infoBuilder.WriteString("# Persistence\r\n")
+			infoBuilder.WriteString(persistence.info())
+		case "stats":
+			infoBuilder.WriteString("# Stats\r\n")
+			infoBuilder.WriteString(fmt.Sprintf("total_commands_processed:%d\r\n", totalCommandsProcessed.Load()))
+			infoBuilder.WriteString(fmt.Sprintf("evicted_keys:%d\r\n", evictedKeys.Load()))
+		case "replication":
+			infoBuilder.WriteString("# Replication\r\n")
+			infoBuilder.WriteString(replication.info())
+		case "raft":
+			infoBuilder.WriteString("# Raft\r\n")
+			infoBuilder.WriteString(raftInfo())
+		case "cluster":
+			infoBuilder.WriteString("# Cluster\r\n")
+			infoBuilder.WriteString(clusterInfo())
+		case "keyspace":
+			infoBuilder.WriteString("# Keyspace\r\n")
+			for _, db := range kv.servedDatabases() {
+				infoBuilder.WriteString(db.keyspaceInfo())
+			}
+		}
+	}
+	return infoBuilder.String()
+}
+
+// keyspaceInfo returns the INFO keyspace line of the database, or "" when it
+// is empty. avg_ttl is in milliseconds, over the keys that have one.
+func (kv *KeyValueStore) keyspaceInfo() string {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	now := time.Now()
+	keys, expires := 0, 0
+	var totalTTL time.Duration
+	kv.eachKey(func(key string) {
+		keys++
+		if deadline, exists := kv.Expirations[key]; exists {
+			expires++
+			totalTTL += deadline.Sub(now)
+		}
+	})
+	if keys == 0 {
+		return ""
+	}
+	avgTTL := int64(0)
+	if expires > 0 {
+		avgTTL = (totalTTL / time.Duration(expires)).Milliseconds()
+	}
+	return fmt.Sprintf("db%d:keys=%d,expires=%d,avg_ttl=%d\r\n", kv.index, keys, expires, avgTTL)
+}
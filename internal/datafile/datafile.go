@@ -0,0 +1,127 @@
+// Package datafile reads and writes the framing of radish data files, shared
+// by the server and the tools that check its files.
+//
+// Data files start with a header: the magic, the format version as two
+// bytes and the creation time as eight bytes of Unix milliseconds, both big
+// endian. The gob-encoded databases follow, and the file ends with the
+// CRC-64 of everything before it, little endian like in RDB files. Files
+// written before there was a header are version 0. What the body holds is
+// up to the caller, as each program decodes it into its own types.
+package datafile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dhravya/radish/internal/rdb"
+)
+
+const (
+	Magic   = "RADISH"
+	Version = 1
+
+	HeaderLen = len(Magic) + 2 + 8
+)
+
+// ErrBadFormat is wrapped by every error about a malformed data file.
+var ErrBadFormat = errors.New("bad data file format")
+
+// Header is the header of a data file.
+type Header struct {
+	Version int
+	Created time.Time
+}
+
+// checksumReader keeps the CRC-64 of what is read through it. It is an
+// io.ByteReader, so gob reads no further than the end of its stream.
+type checksumReader struct {
+	r   *bufio.Reader
+	crc uint64
+}
+
+func (cr *checksumReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.crc = rdb.CRC64(cr.crc, p[:n])
+	return n, err
+}
+
+func (cr *checksumReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err == nil {
+		cr.crc = rdb.CRC64(cr.crc, []byte{b})
+	}
+	return b, err
+}
+
+// checksumWriter keeps the CRC-64 of what is written through it.
+type checksumWriter struct {
+	w   io.Writer
+	crc uint64
+}
+
+func (cw *checksumWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.crc = rdb.CRC64(cw.crc, p[:n])
+	return n, err
+}
+
+// Write writes a data file of the current version to w, with the body
+// written by encode.
+func Write(w io.Writer, encode func(w io.Writer) error) error {
+	bw := bufio.NewWriter(w)
+	cw := &checksumWriter{w: bw}
+
+	header := make([]byte, 0, HeaderLen)
+	header = append(header, Magic...)
+	header = binary.BigEndian.AppendUint16(header, Version)
+	header = binary.BigEndian.AppendUint64(header, uint64(time.Now().UnixMilli()))
+	if _, err := cw.Write(header); err != nil {
+		return err
+	}
+	if err := encode(cw); err != nil {
+		return err
+	}
+	if _, err := bw.Write(binary.LittleEndian.AppendUint64(nil, cw.crc)); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Read reads a data file with a header from r, handing its body to decode
+// along with its version, and then verifies its checksum. The header is
+// returned as soon as it was read, even along with an error, and is the
+// zero Header when there is none.
+func Read(r io.Reader, decode func(r io.Reader, version int) error) (Header, error) {
+	cr := &checksumReader{r: bufio.NewReader(r)}
+	buf := make([]byte, HeaderLen)
+	if _, err := io.ReadFull(cr, buf); err != nil || string(buf[:len(Magic)]) != Magic {
+		return Header{}, fmt.Errorf("%w: missing header", ErrBadFormat)
+	}
+	header := Header{
+		Version: int(binary.BigEndian.Uint16(buf[len(Magic):])),
+		Created: time.UnixMilli(int64(binary.BigEndian.Uint64(buf[len(Magic)+2:]))),
+	}
+	if header.Version < 1 || header.Version > Version {
+		return header, fmt.Errorf("%w: unsupported version %d", ErrBadFormat, header.Version)
+	}
+
+	if err := decode(cr, header.Version); err != nil {
+		return header, fmt.Errorf("%w: %v", ErrBadFormat, err)
+	}
+	expected := cr.crc
+	footer := make([]byte, 8)
+	if _, err := io.ReadFull(cr.r, footer); err != nil {
+		return header, fmt.Errorf("%w: missing checksum, the file may be truncated", ErrBadFormat)
+	}
+	if binary.LittleEndian.Uint64(footer) != expected {
+		return header, fmt.Errorf("%w: wrong checksum", ErrBadFormat)
+	}
+	if _, err := cr.r.ReadByte(); err != io.EOF {
+		return header, fmt.Errorf("%w: unexpected data after the checksum", ErrBadFormat)
+	}
+	return header, nil
+}
@@ -0,0 +1,31 @@
+package rdb
+
+// CRC-64/Jones is the variant Redis uses to checksum DUMP payloads and RDB
+// files: reflected polynomial 0xad93d23594c935a9, no initial or final XOR.
+// hash/crc64 always inverts the register, so it cannot produce it.
+
+const crc64JonesReflected = 0x95ac9329ac4bc9b5
+
+var crc64Table = func() *[256]uint64 {
+	table := new([256]uint64)
+	for i := range table {
+		crc := uint64(i)
+		for bit := 0; bit < 8; bit++ {
+			if crc&1 == 1 {
+				crc = (crc >> 1) ^ crc64JonesReflected
+			} else {
+				crc >>= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// CRC64 returns crc updated with p.
+func CRC64(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = crc64Table[byte(crc)^b] ^ (crc >> 8)
+	}
+	return crc
+}
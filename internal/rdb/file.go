@@ -0,0 +1,166 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// An RDB file starts with the "REDIS" magic and a four digit version,
+// followed by aux fields describing the server that wrote it. Every
+// database then gets a SELECTDB opcode and a RESIZEDB hint, followed by its
+// keys, each preceded by its expire time and by its idle time or access
+// frequency. An EOF opcode and, since version 5, the CRC-64 of everything
+// before it end the file.
+
+// Key is a key of an RDB file with its value and what the opcodes before
+// it said about it. ExpireAt is in Unix milliseconds, 0 for none, and Idle,
+// in seconds, and Freq are -1 when not given.
+type Key struct {
+	DB       int
+	Key      string
+	Value    Value
+	ExpireAt int64
+	Idle     int64
+	Freq     int64
+}
+
+// Handler is called back by ReadFile with what it finds. Any of its
+// functions may be nil, and an error returned by one stops the reading.
+type Handler struct {
+	Aux      func(field, value string)
+	SelectDB func(db int) error
+	// Function is called for every function library, which is read past
+	Function func()
+	Key      func(k Key) error
+}
+
+// File describes an RDB file read by ReadFile.
+type File struct {
+	Version     int
+	Checksummed bool
+}
+
+// ReadFile reads an RDB file, or the preamble of an append-only file, up to
+// and including its checksum. The version is returned as soon as the header
+// was read, even along with an error.
+func (r *Reader) ReadFile(h Handler) (File, error) {
+	var file File
+	header, err := r.readFull(uint64(len(Magic) + 4))
+	if err != nil || string(header[:len(Magic)]) != Magic {
+		return file, fmt.Errorf("%w: not an RDB file", ErrBadFormat)
+	}
+	version, err := strconv.Atoi(string(header[len(Magic):]))
+	if err != nil || version < 1 || version > Version {
+		return file, fmt.Errorf("%w: unsupported RDB version %s", ErrBadFormat, header[len(Magic):])
+	}
+	file.Version = version
+
+	k := Key{Idle: -1, Freq: -1}
+	for {
+		typ, err := r.ReadByte()
+		if err != nil {
+			return file, err
+		}
+		switch typ {
+		case OpcodeEOF:
+			expected := r.crc
+			if version < 5 {
+				return file, nil
+			}
+			footer, err := r.readFull(8)
+			if err != nil {
+				return file, err
+			}
+			// A checksum of 0 means the writer did not compute one
+			checksum := binary.LittleEndian.Uint64(footer)
+			if checksum != 0 && checksum != expected {
+				return file, fmt.Errorf("%w: wrong checksum", ErrBadFormat)
+			}
+			file.Checksummed = checksum != 0
+			return file, nil
+		case OpcodeSelectDB:
+			index, err := r.readPlainLen()
+			if err != nil {
+				return file, err
+			}
+			if index > 1<<16 {
+				return file, fmt.Errorf("%w: invalid database %d", ErrBadFormat, index)
+			}
+			k.DB = int(index)
+			if h.SelectDB != nil {
+				if err := h.SelectDB(k.DB); err != nil {
+					return file, err
+				}
+			}
+		case OpcodeResizeDB, OpcodeSlotInfo:
+			n := 2
+			if typ == OpcodeSlotInfo {
+				n = 3
+			}
+			for i := 0; i < n; i++ {
+				if _, err := r.readPlainLen(); err != nil {
+					return file, err
+				}
+			}
+		case OpcodeAux:
+			field, err := r.readString()
+			if err != nil {
+				return file, err
+			}
+			value, err := r.readString()
+			if err != nil {
+				return file, err
+			}
+			if h.Aux != nil {
+				h.Aux(field, value)
+			}
+		case OpcodeFunction2:
+			if _, err := r.readString(); err != nil {
+				return file, err
+			}
+			if h.Function != nil {
+				h.Function()
+			}
+		case OpcodeFunctionPreGA, OpcodeModuleAux:
+			return file, fmt.Errorf("%w: unsupported opcode %d", ErrBadFormat, typ)
+		case OpcodeExpireTimeMS:
+			buf, err := r.readFull(8)
+			if err != nil {
+				return file, err
+			}
+			k.ExpireAt = int64(binary.LittleEndian.Uint64(buf))
+		case OpcodeExpireTime:
+			buf, err := r.readFull(4)
+			if err != nil {
+				return file, err
+			}
+			k.ExpireAt = int64(int32(binary.LittleEndian.Uint32(buf))) * 1000
+		case OpcodeIdle:
+			n, err := r.readPlainLen()
+			if err != nil {
+				return file, err
+			}
+			k.Idle = int64(n)
+		case OpcodeFreq:
+			n, err := r.ReadByte()
+			if err != nil {
+				return file, err
+			}
+			k.Freq = int64(n)
+		default:
+			if k.Key, err = r.readString(); err != nil {
+				return file, err
+			}
+			if k.Value, err = r.ReadValue(typ); err != nil {
+				return file, fmt.Errorf("reading key %q: %w", k.Key, err)
+			}
+			if h.Key != nil {
+				if err := h.Key(k); err != nil {
+					return file, err
+				}
+			}
+			k = Key{DB: k.DB, Idle: -1, Freq: -1}
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package rdb
+
+import "errors"
+
+// Redis compresses long strings in RDB files with LZF. A compressed block is
+// a sequence of literal runs, whose control byte below 32 is the run length
+// minus one, and back references, whose control byte holds the length minus
+// two in its top three bits (with an extra length byte when they are all
+// set) and the high bits of the offset minus one, followed by its low byte.
+
+// ErrBadLZF is returned for compressed data that doesn't expand as expected.
+var ErrBadLZF = errors.New("bad LZF data")
+
+// LZFDecompress expands in, which must decompress to exactly size bytes.
+func LZFDecompress(in []byte, size int) ([]byte, error) {
+	out := make([]byte, 0, size)
+	for ip := 0; ip < len(in); {
+		ctrl := int(in[ip])
+		ip++
+		if ctrl < 32 {
+			n := ctrl + 1
+			if ip+n > len(in) || len(out)+n > size {
+				return nil, ErrBadLZF
+			}
+			out = append(out, in[ip:ip+n]...)
+			ip += n
+			continue
+		}
+
+		n := ctrl >> 5
+		if n == 7 {
+			if ip >= len(in) {
+				return nil, ErrBadLZF
+			}
+			n += int(in[ip])
+			ip++
+		}
+		n += 2
+		if ip >= len(in) {
+			return nil, ErrBadLZF
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[ip]) - 1
+		ip++
+		if ref < 0 || len(out)+n > size {
+			return nil, ErrBadLZF
+		}
+		// The reference may overlap what it produces, so copy byte by byte
+		for i := 0; i < n; i++ {
+			out = append(out, out[ref+i])
+		}
+	}
+	if len(out) != size {
+		return nil, ErrBadLZF
+	}
+	return out, nil
+}
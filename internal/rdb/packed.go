@@ -0,0 +1,225 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+)
+
+// Compact values are stored in RDB files as the packed structure they are
+// kept in: a listpack, or a ziplist before Redis 7, and an intset for sets
+// of integers. The decoders below check every length against the data, so
+// a damaged file or RESTORE payload is refused rather than misread.
+
+// ListpackStrings decodes the entries of a listpack, reporting whether it
+// is well formed. A listpack starts with its total size and number of
+// entries, 65535 meaning unknown, and ends with 0xff. Every entry is its
+// encoding and data followed by their size written backwards.
+func ListpackStrings(b []byte) ([]string, bool) {
+	const headerSize = 6
+	if len(b) < headerSize+1 || int(binary.LittleEndian.Uint32(b)) != len(b) || b[len(b)-1] != 0xff {
+		return nil, false
+	}
+	var entries []string
+	end := len(b) - 1
+	for pos := headerSize; pos < end; {
+		first := b[pos]
+		var entry string
+		var size int
+		switch {
+		case first&0x80 == 0x00:
+			entry, size = strconv.Itoa(int(first&0x7f)), 1
+		case first&0xc0 == 0x80:
+			size = 1 + int(first&0x3f)
+			if pos+size <= end {
+				entry = string(b[pos+1 : pos+size])
+			}
+		case first&0xe0 == 0xc0:
+			size = 2
+			if pos+size <= end {
+				u := uint16(first&0x1f)<<8 | uint16(b[pos+1])
+				entry = strconv.Itoa(int(int16(u<<3) >> 3))
+			}
+		case first&0xf0 == 0xe0:
+			if pos+2 > end {
+				return nil, false
+			}
+			size = 2 + (int(first&0x0f)<<8 | int(b[pos+1]))
+			if pos+size <= end {
+				entry = string(b[pos+2 : pos+size])
+			}
+		case first >= 0xf1 && first <= 0xf4:
+			width := [...]int{2, 3, 4, 8}[first-0xf1]
+			size = 1 + width
+			if pos+size <= end {
+				var u uint64
+				for i := width; i > 0; i-- {
+					u = u<<8 | uint64(b[pos+i])
+				}
+				// Sign extend from the width of the integer
+				shift := 64 - 8*width
+				entry = strconv.FormatInt(int64(u<<shift)>>shift, 10)
+			}
+		case first == 0xf0:
+			if pos+5 > end {
+				return nil, false
+			}
+			size = 5 + int(binary.LittleEndian.Uint32(b[pos+1:]))
+			if size >= 5 && pos+size <= end {
+				entry = string(b[pos+5 : pos+size])
+			}
+		default:
+			return nil, false
+		}
+		if size < 1 || pos+size > end {
+			return nil, false
+		}
+		var buf [5]byte
+		backlen := appendBacklen(buf[:0], size)
+		if pos+size+len(backlen) > end || string(b[pos+size:pos+size+len(backlen)]) != string(backlen) {
+			return nil, false
+		}
+		entries = append(entries, entry)
+		pos += size + len(backlen)
+	}
+	if count := binary.LittleEndian.Uint16(b[4:]); count != math.MaxUint16 && int(count) != len(entries) {
+		return nil, false
+	}
+	return entries, true
+}
+
+// appendBacklen writes the size of a listpack entry backwards, seven bits a
+// byte, with the thresholds of Redis.
+func appendBacklen(b []byte, size int) []byte {
+	switch {
+	case size <= 127:
+		return append(b, byte(size))
+	case size < 16383:
+		return append(b, byte(size>>7), byte(size&127)|128)
+	case size < 2097151:
+		return append(b, byte(size>>14), byte(size>>7&127)|128, byte(size&127)|128)
+	case size < 268435455:
+		return append(b, byte(size>>21), byte(size>>14&127)|128, byte(size>>7&127)|128, byte(size&127)|128)
+	}
+	return append(b, byte(size>>28), byte(size>>21&127)|128, byte(size>>14&127)|128, byte(size>>7&127)|128, byte(size&127)|128)
+}
+
+// ZiplistStrings decodes the entries of a ziplist, the packed format Redis
+// used before listpacks, reporting whether it is well formed. Every entry
+// starts with the length of the previous one, in 1 or 5 bytes, then its
+// encoding, which for strings includes their length.
+func ZiplistStrings(b []byte) ([]string, bool) {
+	if len(b) < 11 || int(binary.LittleEndian.Uint32(b)) != len(b) || b[len(b)-1] != 0xff {
+		return nil, false
+	}
+	var entries []string
+	pos, end := 10, len(b)-1
+	for pos < end {
+		if b[pos] == 0xfe {
+			pos += 5
+		} else {
+			pos++
+		}
+		if pos >= end {
+			return nil, false
+		}
+		enc := b[pos]
+		var header, n int
+		switch enc >> 6 {
+		case 0:
+			header, n = 1, int(enc&0x3f)
+		case 1:
+			if pos+2 > end {
+				return nil, false
+			}
+			header, n = 2, int(enc&0x3f)<<8|int(b[pos+1])
+		case 2:
+			if pos+5 > end {
+				return nil, false
+			}
+			header, n = 5, int(binary.BigEndian.Uint32(b[pos+1:]))
+		}
+		if header > 0 {
+			if n > end-pos-header {
+				return nil, false
+			}
+			entries = append(entries, string(b[pos+header:pos+header+n]))
+			pos += header + n
+			continue
+		}
+
+		var value int64
+		switch {
+		case enc == 0xc0 && pos+3 <= end:
+			value, pos = int64(int16(binary.LittleEndian.Uint16(b[pos+1:]))), pos+3
+		case enc == 0xd0 && pos+5 <= end:
+			value, pos = int64(int32(binary.LittleEndian.Uint32(b[pos+1:]))), pos+5
+		case enc == 0xe0 && pos+9 <= end:
+			value, pos = int64(binary.LittleEndian.Uint64(b[pos+1:])), pos+9
+		case enc == 0xf0 && pos+4 <= end:
+			u := uint32(b[pos+1]) | uint32(b[pos+2])<<8 | uint32(b[pos+3])<<16
+			value, pos = int64(int32(u<<8)>>8), pos+4
+		case enc == 0xfe && pos+2 <= end:
+			value, pos = int64(int8(b[pos+1])), pos+2
+		case enc >= 0xf1 && enc <= 0xfd:
+			// Immediate values from 0 to 12
+			value, pos = int64(enc&0x0f)-1, pos+1
+		default:
+			return nil, false
+		}
+		entries = append(entries, strconv.FormatInt(value, 10))
+	}
+	return entries, true
+}
+
+// AppendIntset encodes sorted integers as an intset, using the smallest
+// width that fits all of them.
+func AppendIntset(b []byte, ints []int64) []byte {
+	width := 2
+	for _, n := range ints {
+		switch {
+		case n < math.MinInt32 || n > math.MaxInt32:
+			width = 8
+		case (n < math.MinInt16 || n > math.MaxInt16) && width < 4:
+			width = 4
+		}
+	}
+	b = binary.LittleEndian.AppendUint32(b, uint32(width))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(ints)))
+	for _, n := range ints {
+		switch width {
+		case 2:
+			b = binary.LittleEndian.AppendUint16(b, uint16(n))
+		case 4:
+			b = binary.LittleEndian.AppendUint32(b, uint32(n))
+		default:
+			b = binary.LittleEndian.AppendUint64(b, uint64(n))
+		}
+	}
+	return b
+}
+
+// IntsetValues decodes an intset, reporting whether it is well formed.
+func IntsetValues(b []byte) ([]int64, bool) {
+	if len(b) < 8 {
+		return nil, false
+	}
+	width := int(binary.LittleEndian.Uint32(b))
+	length := int(binary.LittleEndian.Uint32(b[4:]))
+	if (width != 2 && width != 4 && width != 8) || len(b) != 8+width*length {
+		return nil, false
+	}
+	ints := make([]int64, length)
+	for i := range ints {
+		p := b[8+i*width:]
+		switch width {
+		case 2:
+			ints[i] = int64(int16(binary.LittleEndian.Uint16(p)))
+		case 4:
+			ints[i] = int64(int32(binary.LittleEndian.Uint32(p)))
+		default:
+			ints[i] = int64(binary.LittleEndian.Uint64(p))
+		}
+	}
+	return ints, true
+}
@@ -0,0 +1,632 @@
+// Package rdb reads and writes the Redis RDB format, which DUMP hands out,
+// RESTORE takes back and RDB files are made of. It is shared by the server
+// and the tools that check its files.
+//
+// Every value type of Redis 7.4 can be read, including the ziplist based
+// types of older versions and the hashes whose fields carry TTLs of RDB 12.
+// Streams are read past without being decoded.
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+const (
+	Magic   = "REDIS"
+	Version = 12
+
+	TypeString           = 0
+	TypeList             = 1
+	TypeSet              = 2
+	TypeZSet             = 3
+	TypeHash             = 4
+	TypeZSet2            = 5
+	TypeListZiplist      = 10
+	TypeSetIntset        = 11
+	TypeZSetZiplist      = 12
+	TypeHashZiplist      = 13
+	TypeListQuicklist    = 14
+	TypeStreamListpacks  = 15
+	TypeHashListpack     = 16
+	TypeZSetListpack     = 17
+	TypeListQuicklist2   = 18
+	TypeStreamListpacks2 = 19
+	TypeSetListpack      = 20
+	TypeStreamListpacks3 = 21
+	TypeHashMetadata     = 24
+	TypeHashListpackEx   = 25
+
+	QuicklistNodePlain  = 1
+	QuicklistNodePacked = 2
+
+	OpcodeSlotInfo      = 244
+	OpcodeFunction2     = 245
+	OpcodeFunctionPreGA = 246
+	OpcodeModuleAux     = 247
+	OpcodeIdle          = 248
+	OpcodeFreq          = 249
+	OpcodeAux           = 250
+	OpcodeResizeDB      = 251
+	OpcodeExpireTimeMS  = 252
+	OpcodeExpireTime    = 253
+	OpcodeSelectDB      = 254
+	OpcodeEOF           = 255
+
+	// The two most significant bits of a length select its encoding
+	len6Bit  = 0
+	len14Bit = 1
+	len32Bit = 0x80
+	len64Bit = 0x81
+	encVal   = 3
+
+	encInt8  = 0
+	encInt16 = 1
+	encInt32 = 2
+	encLZF   = 3
+)
+
+// ErrBadFormat is wrapped by every error about malformed RDB data.
+var ErrBadFormat = errors.New("bad RDB format")
+
+func AppendLen(b []byte, n uint64) []byte {
+	switch {
+	case n < 1<<6:
+		return append(b, byte(n)|len6Bit<<6)
+	case n < 1<<14:
+		return append(b, byte(n>>8)|len14Bit<<6, byte(n))
+	case n <= math.MaxUint32:
+		b = append(b, len32Bit)
+		return binary.BigEndian.AppendUint32(b, uint32(n))
+	}
+	b = append(b, len64Bit)
+	return binary.BigEndian.AppendUint64(b, n)
+}
+
+// AppendString writes s, using the compact integer encoding when s is the
+// canonical form of a small enough integer.
+func AppendString(b []byte, s string) []byte {
+	if len(s) <= 11 {
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil && strconv.FormatInt(n, 10) == s {
+			switch {
+			case n >= math.MinInt8 && n <= math.MaxInt8:
+				return append(b, encVal<<6|encInt8, byte(n))
+			case n >= math.MinInt16 && n <= math.MaxInt16:
+				b = append(b, encVal<<6|encInt16)
+				return binary.LittleEndian.AppendUint16(b, uint16(n))
+			case n >= math.MinInt32 && n <= math.MaxInt32:
+				b = append(b, encVal<<6|encInt32)
+				return binary.LittleEndian.AppendUint32(b, uint32(n))
+			}
+		}
+	}
+	b = AppendLen(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// AppendBytes writes a binary blob such as a listpack as a plain string.
+func AppendBytes(b []byte, blob []byte) []byte {
+	b = AppendLen(b, uint64(len(blob)))
+	return append(b, blob...)
+}
+
+func AppendDouble(b []byte, f float64) []byte {
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(f))
+}
+
+// Reader decodes RDB data, keeping a running CRC-64 of everything it has
+// read for the checksum at the end of RDB files, and how many bytes that
+// was.
+type Reader struct {
+	r      *bufio.Reader
+	crc    uint64
+	offset int64
+}
+
+// NewReader returns a Reader of r. When r is a *bufio.Reader, it is read
+// from directly, so whatever follows the RDB data can be read from it next.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Offset returns the number of bytes read so far.
+func (r *Reader) Offset() int64 {
+	return r.offset
+}
+
+func (r *Reader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err != nil {
+		return 0, fmt.Errorf("%w: unexpected end of file", ErrBadFormat)
+	}
+	r.crc = CRC64(r.crc, []byte{b})
+	r.offset++
+	return b, nil
+}
+
+func (r *Reader) readFull(n uint64) ([]byte, error) {
+	// Don't trust the length with a huge allocation before seeing the data
+	buf := make([]byte, 0, min(n, 1<<20))
+	for uint64(len(buf)) < n {
+		chunk := make([]byte, min(n-uint64(len(buf)), 1<<20))
+		if _, err := io.ReadFull(r.r, chunk); err != nil {
+			return nil, fmt.Errorf("%w: unexpected end of file", ErrBadFormat)
+		}
+		buf = append(buf, chunk...)
+	}
+	r.crc = CRC64(r.crc, buf)
+	r.offset += int64(n)
+	return buf, nil
+}
+
+// readLen reads a length. encoded is set when the length is really a
+// special string encoding, returned in n.
+func (r *Reader) readLen() (n uint64, encoded bool, err error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch first >> 6 {
+	case len6Bit:
+		return uint64(first & 0x3f), false, nil
+	case len14Bit:
+		second, err := r.ReadByte()
+		return uint64(first&0x3f)<<8 | uint64(second), false, err
+	case encVal:
+		return uint64(first & 0x3f), true, nil
+	}
+	switch first {
+	case len32Bit:
+		buf, err := r.readFull(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(buf)), false, nil
+	case len64Bit:
+		buf, err := r.readFull(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(buf), false, nil
+	}
+	return 0, false, fmt.Errorf("%w: invalid length", ErrBadFormat)
+}
+
+func (r *Reader) readPlainLen() (uint64, error) {
+	n, encoded, err := r.readLen()
+	if err == nil && encoded {
+		err = fmt.Errorf("%w: encoded length", ErrBadFormat)
+	}
+	return n, err
+}
+
+func (r *Reader) readString() (string, error) {
+	n, encoded, err := r.readLen()
+	if err != nil {
+		return "", err
+	}
+	if !encoded {
+		buf, err := r.readFull(n)
+		return string(buf), err
+	}
+	switch n {
+	case encInt8:
+		buf, err := r.readFull(1)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(int64(int8(buf[0])), 10), nil
+	case encInt16:
+		buf, err := r.readFull(2)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(int64(int16(binary.LittleEndian.Uint16(buf))), 10), nil
+	case encInt32:
+		buf, err := r.readFull(4)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(int64(int32(binary.LittleEndian.Uint32(buf))), 10), nil
+	case encLZF:
+		compressed, err := r.readPlainLen()
+		if err != nil {
+			return "", err
+		}
+		size, err := r.readPlainLen()
+		if err != nil {
+			return "", err
+		}
+		buf, err := r.readFull(compressed)
+		if err != nil {
+			return "", err
+		}
+		if size > 512<<20 {
+			return "", fmt.Errorf("%w: compressed string too long", ErrBadFormat)
+		}
+		out, err := LZFDecompress(buf, int(size))
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrBadFormat, err)
+		}
+		return string(out), nil
+	}
+	return "", fmt.Errorf("%w: unknown string encoding %d", ErrBadFormat, n)
+}
+
+// readPacked reads the listpack, or the ziplist for the older types, that
+// holds a compact value of type typ.
+func (r *Reader) readPacked(typ byte) ([]string, error) {
+	s, err := r.readString()
+	if err != nil {
+		return nil, err
+	}
+	switch typ {
+	case TypeListZiplist, TypeZSetZiplist, TypeHashZiplist, TypeListQuicklist:
+		entries, ok := ZiplistStrings([]byte(s))
+		if !ok {
+			return nil, fmt.Errorf("%w: invalid ziplist", ErrBadFormat)
+		}
+		return entries, nil
+	}
+	entries, ok := ListpackStrings([]byte(s))
+	if !ok {
+		return nil, fmt.Errorf("%w: invalid listpack", ErrBadFormat)
+	}
+	return entries, nil
+}
+
+func (r *Reader) readDouble() (float64, error) {
+	buf, err := r.readFull(8)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(buf)), nil
+}
+
+// readASCIIDouble reads the length prefixed textual scores of the original
+// sorted set type, where 253, 254 and 255 stand for NaN, +inf and -inf.
+func (r *Reader) readASCIIDouble() (float64, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	buf, err := r.readFull(uint64(n))
+	if err != nil {
+		return 0, err
+	}
+	f, err := strconv.ParseFloat(string(buf), 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid score", ErrBadFormat)
+	}
+	return f, nil
+}
+
+// Value is a decoded value. Type is "string", "list", "set", "zset", "hash"
+// or "stream", and the field of that type holds its contents in the order
+// they were written, except for streams, which aren't decoded.
+type Value struct {
+	Type     string
+	String   string
+	Elements []string // list elements and set members
+	Members  []Member
+	Fields   []Field
+	// FieldTTLs holds the deadlines of hash fields, in Unix milliseconds
+	FieldTTLs map[string]int64
+}
+
+// Member is a sorted set member and its score.
+type Member struct {
+	Member string
+	Score  float64
+}
+
+// Field is a hash field and its value.
+type Field struct {
+	Field, Value string
+}
+
+func (v *Value) setFieldTTL(field string, deadline int64) {
+	if v.FieldTTLs == nil {
+		v.FieldTTLs = make(map[string]int64)
+	}
+	v.FieldTTLs[field] = deadline
+}
+
+// ReadValue reads a value of the given type.
+func (r *Reader) ReadValue(typ byte) (Value, error) {
+	switch typ {
+	case TypeString:
+		s, err := r.readString()
+		return Value{Type: "string", String: s}, err
+	case TypeList, TypeSet:
+		n, err := r.readPlainLen()
+		if err != nil {
+			return Value{}, err
+		}
+		elements := make([]string, 0, min(n, 1<<16))
+		for i := uint64(0); i < n; i++ {
+			element, err := r.readString()
+			if err != nil {
+				return Value{}, err
+			}
+			elements = append(elements, element)
+		}
+		if typ == TypeSet {
+			return Value{Type: "set", Elements: elements}, nil
+		}
+		return Value{Type: "list", Elements: elements}, nil
+	case TypeZSet, TypeZSet2:
+		n, err := r.readPlainLen()
+		if err != nil {
+			return Value{}, err
+		}
+		members := make([]Member, 0, min(n, 1<<16))
+		for i := uint64(0); i < n; i++ {
+			member, err := r.readString()
+			if err != nil {
+				return Value{}, err
+			}
+			var score float64
+			if typ == TypeZSet {
+				score, err = r.readASCIIDouble()
+			} else {
+				score, err = r.readDouble()
+			}
+			if err != nil {
+				return Value{}, err
+			}
+			if math.IsNaN(score) {
+				return Value{}, fmt.Errorf("%w: NaN score", ErrBadFormat)
+			}
+			members = append(members, Member{member, score})
+		}
+		return Value{Type: "zset", Members: members}, nil
+	case TypeHash, TypeHashMetadata:
+		// Field TTLs are stored relative to the earliest one, 0 meaning none
+		minExpire := int64(0)
+		if typ == TypeHashMetadata {
+			buf, err := r.readFull(8)
+			if err != nil {
+				return Value{}, err
+			}
+			minExpire = int64(binary.LittleEndian.Uint64(buf))
+		}
+		n, err := r.readPlainLen()
+		if err != nil {
+			return Value{}, err
+		}
+		v := Value{Type: "hash", Fields: make([]Field, 0, min(n, 1<<16))}
+		for i := uint64(0); i < n; i++ {
+			ttl := uint64(0)
+			if typ == TypeHashMetadata {
+				if ttl, err = r.readPlainLen(); err != nil {
+					return Value{}, err
+				}
+			}
+			field, err := r.readString()
+			if err != nil {
+				return Value{}, err
+			}
+			value, err := r.readString()
+			if err != nil {
+				return Value{}, err
+			}
+			v.Fields = append(v.Fields, Field{field, value})
+			if ttl != 0 {
+				v.setFieldTTL(field, minExpire+int64(ttl)-1)
+			}
+		}
+		return v, nil
+	case TypeListQuicklist, TypeListQuicklist2:
+		n, err := r.readPlainLen()
+		if err != nil {
+			return Value{}, err
+		}
+		var elements []string
+		for i := uint64(0); i < n; i++ {
+			container := uint64(QuicklistNodePacked)
+			if typ == TypeListQuicklist2 {
+				if container, err = r.readPlainLen(); err != nil {
+					return Value{}, err
+				}
+			}
+			switch container {
+			case QuicklistNodePlain:
+				element, err := r.readString()
+				if err != nil {
+					return Value{}, err
+				}
+				elements = append(elements, element)
+			case QuicklistNodePacked:
+				packed, err := r.readPacked(typ)
+				if err != nil {
+					return Value{}, err
+				}
+				elements = append(elements, packed...)
+			default:
+				return Value{}, fmt.Errorf("%w: unknown quicklist container %d", ErrBadFormat, container)
+			}
+		}
+		return Value{Type: "list", Elements: elements}, nil
+	case TypeListZiplist:
+		elements, err := r.readPacked(typ)
+		return Value{Type: "list", Elements: elements}, err
+	case TypeSetIntset:
+		s, err := r.readString()
+		if err != nil {
+			return Value{}, err
+		}
+		ints, ok := IntsetValues([]byte(s))
+		if !ok {
+			return Value{}, fmt.Errorf("%w: invalid intset", ErrBadFormat)
+		}
+		members := make([]string, len(ints))
+		for i, n := range ints {
+			members[i] = strconv.FormatInt(n, 10)
+		}
+		return Value{Type: "set", Elements: members}, nil
+	case TypeSetListpack:
+		members, err := r.readPacked(typ)
+		return Value{Type: "set", Elements: members}, err
+	case TypeZSetZiplist, TypeZSetListpack:
+		entries, err := r.readPacked(typ)
+		if err != nil {
+			return Value{}, err
+		}
+		if len(entries)%2 != 0 {
+			return Value{}, fmt.Errorf("%w: odd number of sorted set entries", ErrBadFormat)
+		}
+		members := make([]Member, 0, len(entries)/2)
+		for i := 0; i < len(entries); i += 2 {
+			score, err := strconv.ParseFloat(entries[i+1], 64)
+			if err != nil || math.IsNaN(score) {
+				return Value{}, fmt.Errorf("%w: invalid score", ErrBadFormat)
+			}
+			members = append(members, Member{entries[i], score})
+		}
+		return Value{Type: "zset", Members: members}, nil
+	case TypeHashZiplist, TypeHashListpack, TypeHashListpackEx:
+		// The earliest TTL comes first, but every field has its own deadline
+		if typ == TypeHashListpackEx {
+			if _, err := r.readFull(8); err != nil {
+				return Value{}, err
+			}
+		}
+		entries, err := r.readPacked(typ)
+		if err != nil {
+			return Value{}, err
+		}
+		step := 2
+		if typ == TypeHashListpackEx {
+			step = 3
+		}
+		if len(entries)%step != 0 {
+			return Value{}, fmt.Errorf("%w: bad number of hash entries", ErrBadFormat)
+		}
+		v := Value{Type: "hash", Fields: make([]Field, 0, len(entries)/step)}
+		for i := 0; i < len(entries); i += step {
+			v.Fields = append(v.Fields, Field{entries[i], entries[i+1]})
+			if step == 3 {
+				deadline, err := strconv.ParseInt(entries[i+2], 10, 64)
+				if err != nil {
+					return Value{}, fmt.Errorf("%w: invalid field TTL", ErrBadFormat)
+				}
+				if deadline != 0 {
+					v.setFieldTTL(entries[i], deadline)
+				}
+			}
+		}
+		return v, nil
+	case TypeStreamListpacks, TypeStreamListpacks2, TypeStreamListpacks3:
+		return Value{Type: "stream"}, r.skipStream(typ)
+	}
+	return Value{}, fmt.Errorf("%w: unsupported value type %d", ErrBadFormat, typ)
+}
+
+// skipStream reads past a stream: its listpacks of entries, its metadata
+// and its consumer groups with their pending entries.
+func (r *Reader) skipStream(typ byte) error {
+	lens := func(n int) error {
+		for i := 0; i < n; i++ {
+			if _, err := r.readPlainLen(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	count := func() (int, error) {
+		n, err := r.readPlainLen()
+		if err == nil && n > math.MaxInt32 {
+			err = fmt.Errorf("%w: invalid stream", ErrBadFormat)
+		}
+		return int(n), err
+	}
+
+	listpacks, err := count()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < 2*listpacks; i++ {
+		// The master entry ID, then the listpack itself
+		if _, err := r.readString(); err != nil {
+			return err
+		}
+	}
+	// Length and last ID, then the first and max deleted IDs and the number
+	// of entries ever added since version 2
+	metadata := 3
+	if typ >= TypeStreamListpacks2 {
+		metadata += 5
+	}
+	if err := lens(metadata); err != nil {
+		return err
+	}
+
+	groups, err := count()
+	if err != nil {
+		return err
+	}
+	for ; groups > 0; groups-- {
+		if _, err := r.readString(); err != nil {
+			return err
+		}
+		groupMetadata := 2
+		if typ >= TypeStreamListpacks2 {
+			groupMetadata++
+		}
+		if err := lens(groupMetadata); err != nil {
+			return err
+		}
+		pending, err := count()
+		if err != nil {
+			return err
+		}
+		for ; pending > 0; pending-- {
+			// A raw ID and the delivery time, then the delivery count
+			if _, err := r.readFull(16 + 8); err != nil {
+				return err
+			}
+			if err := lens(1); err != nil {
+				return err
+			}
+		}
+		consumers, err := count()
+		if err != nil {
+			return err
+		}
+		for ; consumers > 0; consumers-- {
+			if _, err := r.readString(); err != nil {
+				return err
+			}
+			// The seen time, and the active time since version 3
+			times := uint64(8)
+			if typ >= TypeStreamListpacks3 {
+				times += 8
+			}
+			if _, err := r.readFull(times); err != nil {
+				return err
+			}
+			pending, err := count()
+			if err != nil {
+				return err
+			}
+			if _, err := r.readFull(uint64(pending) * 16); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
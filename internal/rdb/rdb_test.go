@@ -0,0 +1,106 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCRC64MatchesRedis(t *testing.T) {
+	if got := CRC64(0, []byte("123456789")); got != 0xe9c6d914c4b8d9ca {
+		t.Fatalf("Expected 0xe9c6d914c4b8d9ca, Got: %#x", got)
+	}
+}
+
+func TestLZFDecompress(t *testing.T) {
+	// A literal run of "abc", then a back reference copying 9 bytes
+	out, err := LZFDecompress([]byte("\x02abc\xe0\x00\x02"), 12)
+	if err != nil || string(out) != "abcabcabcabc" {
+		t.Fatalf("Expected abcabcabcabc, Got: %q, %v", out, err)
+	}
+	if _, err := LZFDecompress([]byte("\x02abc\xe0\x00\x02"), 11); !errors.Is(err, ErrBadLZF) {
+		t.Fatalf("Expected a wrong size to be refused, Got: %v", err)
+	}
+}
+
+func TestPackedStrings(t *testing.T) {
+	// A listpack of "f" and 7, and a ziplist of "ab" and the immediate 5
+	listpack := []byte{0, 0, 0, 0, 2, 0, 0x81, 'f', 2, 7, 1, 0xff}
+	binary.LittleEndian.PutUint32(listpack, uint32(len(listpack)))
+	if entries, ok := ListpackStrings(listpack); !ok || strings.Join(entries, " ") != "f 7" {
+		t.Fatalf("Expected the listpack entries, Got: %q", entries)
+	}
+	damaged := bytes.Clone(listpack)
+	damaged[8] = 3
+	if _, ok := ListpackStrings(damaged); ok {
+		t.Fatalf("Expected a wrong entry size to be refused")
+	}
+
+	entries := []byte{0x00, 0x02, 'a', 'b', 0x04, 0xf6}
+	ziplist := binary.LittleEndian.AppendUint32(nil, uint32(10+len(entries)+1))
+	ziplist = binary.LittleEndian.AppendUint32(ziplist, 14)
+	ziplist = binary.LittleEndian.AppendUint16(ziplist, 2)
+	ziplist = append(append(ziplist, entries...), 0xff)
+	if got, ok := ZiplistStrings(ziplist); !ok || strings.Join(got, " ") != "ab 5" {
+		t.Fatalf("Expected the ziplist entries, Got: %q", got)
+	}
+
+	ints, ok := IntsetValues(AppendIntset(nil, []int64{-1, 70000}))
+	if !ok || len(ints) != 2 || ints[0] != -1 || ints[1] != 70000 {
+		t.Fatalf("Expected the intset to round trip, Got: %v", ints)
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	file := []byte("REDIS0012")
+	file = append(file, OpcodeAux)
+	file = AppendString(file, "ctime")
+	file = AppendString(file, "1700000000")
+	file = append(file, OpcodeSelectDB)
+	file = AppendLen(file, 3)
+	file = append(file, OpcodeExpireTimeMS)
+	file = binary.LittleEndian.AppendUint64(file, 1234)
+	file = append(file, TypeList)
+	file = AppendString(file, "list")
+	file = AppendLen(file, 2)
+	file = AppendString(file, "-300")
+	file = AppendString(file, strings.Repeat("x", 100))
+	file = append(file, OpcodeFreq, 5, TypeZSet2)
+	file = AppendString(file, "zset")
+	file = AppendLen(file, 1)
+	file = AppendString(file, "m")
+	file = AppendDouble(file, 1.5)
+	file = append(file, OpcodeEOF)
+	file = binary.LittleEndian.AppendUint64(file, CRC64(0, file))
+
+	var keys []Key
+	aux := make(map[string]string)
+	r := NewReader(bytes.NewReader(file))
+	info, err := r.ReadFile(Handler{
+		Aux: func(field, value string) { aux[field] = value },
+		Key: func(k Key) error {
+			keys = append(keys, k)
+			return nil
+		},
+	})
+	if err != nil || info.Version != 12 || !info.Checksummed || r.Offset() != int64(len(file)) {
+		t.Fatalf("Expected the file to be read, Got: %+v, %v", info, err)
+	}
+	if aux["ctime"] != "1700000000" || len(keys) != 2 {
+		t.Fatalf("Expected the aux field and 2 keys, Got: %v, %+v", aux, keys)
+	}
+	list, zset := keys[0], keys[1]
+	if list.DB != 3 || list.ExpireAt != 1234 || list.Freq != -1 || list.Value.Type != "list" || list.Value.Elements[0] != "-300" {
+		t.Fatalf("Unexpected list: %+v", list)
+	}
+	if zset.ExpireAt != 0 || zset.Freq != 5 || zset.Value.Members[0] != (Member{"m", 1.5}) {
+		t.Fatalf("Unexpected sorted set: %+v", zset)
+	}
+
+	file[len(file)-20] ^= 0xff
+	if _, err := NewReader(bytes.NewReader(file)).ReadFile(Handler{}); !errors.Is(err, ErrBadFormat) {
+		t.Fatalf("Expected a corrupted file to be refused, Got: %v", err)
+	}
+}
@@ -0,0 +1,624 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every data type lives in its own map, so the helpers below are the single
+// place that knows how to look a key up across all of them.
+
+// keyExpired reports whether key has a TTL in the past. Expired keys are
+// treated as missing even before anything has removed them.
+func (kv *KeyValueStore) keyExpired(key string) bool {
+	expiration, exists := kv.Expirations[key]
+	return exists && !time.Now().Before(expiration)
+}
+
+// expireIfNeeded deletes key if its TTL has passed, and reports whether it
+// did. The caller must hold the write lock.
+func (kv *KeyValueStore) expireIfNeeded(key string) bool {
+	if !kv.keyExpired(key) {
+		return false
+	}
+	kv.preserveKeys(key)
+	kv.deleteKey(key)
+	return true
+}
+
+// keyType returns the Redis type name of the value at key, or "none".
+func (kv *KeyValueStore) keyType(key string) string {
+	if kv.keyExpired(key) {
+		return "none"
+	}
+	if _, ok := kv.Strings[key]; ok {
+		return "string"
+	}
+	if _, ok := kv.Lists[key]; ok {
+		return "list"
+	}
+	if _, ok := kv.Hashes[key]; ok {
+		if kv.hashExpired(key) {
+			return "none"
+		}
+		return "hash"
+	}
+	if _, ok := kv.Sets[key]; ok {
+		return "set"
+	}
+	if _, ok := kv.SortedSets[key]; ok {
+		return "zset"
+	}
+	return "none"
+}
+
+func (kv *KeyValueStore) keyExists(key string) bool {
+	return kv.keyType(key) != "none"
+}
+
+// deleteKey removes key whatever its type, along with its TTLs. It reports
+// whether a live key was removed. The caller must hold the write lock.
+func (kv *KeyValueStore) deleteKey(key string) bool {
+	existed := kv.keyExists(key)
+	delete(kv.Strings, key)
+	delete(kv.Lists, key)
+	delete(kv.Hashes, key)
+	delete(kv.Sets, key)
+	delete(kv.SortedSets, key)
+	delete(kv.Expirations, key)
+	delete(kv.HashFieldExpirations, key)
+	kv.accessMu.Lock()
+	delete(kv.access, key)
+	kv.accessMu.Unlock()
+	kv.indexKeys(key)
+	return existed
+}
+
+// eachKey calls yield once for every live key of every type.
+func (kv *KeyValueStore) eachKey(yield func(key string)) {
+	visit := func(key string) {
+		if !kv.keyExpired(key) {
+			yield(key)
+		}
+	}
+	for key := range kv.Strings {
+		visit(key)
+	}
+	for key := range kv.Lists {
+		visit(key)
+	}
+	for key := range kv.Hashes {
+		visit(key)
+	}
+	for key := range kv.Sets {
+		visit(key)
+	}
+	for key := range kv.SortedSets {
+		visit(key)
+	}
+}
+
+// keyIndex returns the index of the stored keys, or of the ones with a TTL
+// when volatile is set, building both the first time. The caller must hold
+// the read lock.
+func (kv *KeyValueStore) keyIndex(volatile bool) *scanIndex {
+	scanIndexMu.Lock()
+	defer scanIndexMu.Unlock()
+	if kv.keys == nil {
+		kv.keys = buildScanIndex(func(yield func(string)) {
+			for key := range kv.Strings {
+				yield(key)
+			}
+			for key := range kv.Lists {
+				yield(key)
+			}
+			for key := range kv.Hashes {
+				yield(key)
+			}
+			for key := range kv.Sets {
+				yield(key)
+			}
+			for key := range kv.SortedSets {
+				yield(key)
+			}
+		})
+		kv.volatileKeys = buildScanIndex(func(yield func(string)) {
+			for key := range kv.Expirations {
+				yield(key)
+			}
+		})
+	}
+	if volatile {
+		return kv.volatileKeys
+	}
+	return kv.keys
+}
+
+// indexKeys updates the key indexes and memory estimates, if built, for keys
+// that may have been added, removed, changed or had their TTL changed. The
+// caller must hold the write lock.
+func (kv *KeyValueStore) indexKeys(keys ...string) {
+	kv.accountKeys(keys...)
+	if kv.keys == nil {
+		return
+	}
+	for _, key := range keys {
+		if kv.keyStored(key) {
+			kv.keys.add(key)
+		} else {
+			kv.keys.remove(key)
+		}
+		if _, hasTTL := kv.Expirations[key]; hasTTL {
+			kv.volatileKeys.add(key)
+		} else {
+			kv.volatileKeys.remove(key)
+		}
+	}
+}
+
+// indexCommandKeys updates the key indexes and memory estimates for the keys the write command
+// in parts may have changed.
+func (kv *KeyValueStore) indexCommandKeys(parts []string) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.indexKeys(commandKeys(parts)...)
+}
+
+// dropKeyIndex forgets the key indexes and memory estimates when the whole
+// database changes at once. They are built again when next needed. The
+// caller must hold the write lock.
+func (kv *KeyValueStore) dropKeyIndex() {
+	kv.keys, kv.volatileKeys = nil, nil
+	kv.keySizes, kv.usedBytes = nil, 0
+}
+
+// KeysCommand implements KEYS pattern. It walks the whole keyspace while
+// holding the lock, so scripts should prefer SCAN.
+func (kv *KeyValueStore) KeysCommand(parts []string) string {
+	if len(parts) != 2 {
+		return "ERROR: KEYS requires 1 argument"
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	pattern := parts[1]
+	matchedKeys := make([]string, 0)
+	kv.eachKey(func(key string) {
+		if stringMatch(pattern, key, false) {
+			matchedKeys = append(matchedKeys, key)
+		}
+	})
+	if len(matchedKeys) == 0 {
+		return "(empty array)"
+	}
+	sort.Strings(matchedKeys)
+	return strings.Join(matchedKeys, " ")
+}
+
+// ScanCommand implements SCAN cursor [MATCH pattern] [COUNT count] [TYPE type].
+func (kv *KeyValueStore) ScanCommand(parts []string) string {
+	opts, errMsg := parseScanArgs(parts, 1, true, false)
+	if errMsg != "" {
+		return errMsg
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	keys, next := kv.keyIndex(false).batch(opts.cursor, opts.count)
+	keys = filterMatch(keys, opts.match)
+	filtered := keys[:0]
+	for _, key := range keys {
+		if typ := kv.keyType(key); typ != "none" && (opts.typ == "" || typ == opts.typ) {
+			filtered = append(filtered, key)
+		}
+	}
+	keys = filtered
+	return strings.Join(append([]string{strconv.FormatUint(next, 10)}, keys...), " ")
+}
+
+func (kv *KeyValueStore) TypeCommand(parts []string) string {
+	if len(parts) != 2 {
+		return "ERR TYPE requires 1 argument"
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	return kv.keyType(parts[1])
+}
+
+// DelCommand implements DEL and UNLINK. Values are freed by the garbage
+// collector either way, so UNLINK has nothing extra to do in the background.
+func (kv *KeyValueStore) DelCommand(parts []string) string {
+	if len(parts) < 2 {
+		return fmt.Sprintf("ERROR: %s requires at least 1 argument", parts[0])
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	count := 0
+	for _, key := range parts[1:] {
+		if kv.deleteKey(key) {
+			count++
+		}
+	}
+	return fmt.Sprintf("(integer) %d", count)
+}
+
+// ExistsCommand implements EXISTS key [key ...] and TOUCH, which only differs
+// in that it counts as an access. Keys named more than once are counted more
+// than once, like in Redis.
+func (kv *KeyValueStore) ExistsCommand(parts []string) string {
+	if len(parts) < 2 {
+		return fmt.Sprintf("ERROR: %s requires at least 1 argument", parts[0])
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	count := 0
+	for _, key := range parts[1:] {
+		if kv.keyExists(key) {
+			count++
+		}
+	}
+	return fmt.Sprintf("(integer) %d", count)
+}
+
+// PExpireAtCommand implements PEXPIREAT key unix-time-milliseconds, which is
+// also how EXPIRE is written to the append-only file. A time in the past
+// deletes the key.
+func (kv *KeyValueStore) PExpireAtCommand(parts []string) string {
+	if len(parts) != 3 {
+		return "ERR PEXPIREAT requires 2 arguments"
+	}
+	ms, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return "ERR value is not an integer or out of range"
+	}
+	return kv.expireAt(parts[1], time.UnixMilli(ms))
+}
+
+// ExpireCommand implements EXPIRE key seconds. It behaves like the
+// PEXPIREAT it is logged as, so a TTL that isn't positive deletes the key.
+func (kv *KeyValueStore) ExpireCommand(parts []string) string {
+	if len(parts) != 3 {
+		return "ERR EXPIRE requires 2 arguments"
+	}
+	seconds, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return "ERR value is not an integer or out of range"
+	}
+	if seconds > math.MaxInt64/int64(time.Second) || seconds < math.MinInt64/int64(time.Second) {
+		return "ERR invalid expire time in 'expire' command"
+	}
+	return kv.expireAt(parts[1], time.Now().Add(time.Duration(seconds)*time.Second))
+}
+
+// expireAt sets the deadline of key, or deletes it when the deadline has
+// passed.
+func (kv *KeyValueStore) expireAt(key string, deadline time.Time) string {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if !kv.keyExists(key) {
+		return "(integer) 0"
+	}
+	if !time.Now().Before(deadline) {
+		kv.deleteKey(key)
+	} else {
+		kv.Expirations[key] = deadline
+	}
+	return "(integer) 1"
+}
+
+// moveKey moves the value and TTLs of src over to dst, which must not exist.
+// The caller must hold the write lock.
+func (kv *KeyValueStore) moveKey(src, dst string) {
+	if value, ok := kv.Strings[src]; ok {
+		kv.Strings[dst] = value
+		delete(kv.Strings, src)
+	}
+	if value, ok := kv.Lists[src]; ok {
+		kv.Lists[dst] = value
+		delete(kv.Lists, src)
+	}
+	if value, ok := kv.Hashes[src]; ok {
+		kv.Hashes[dst] = value
+		delete(kv.Hashes, src)
+	}
+	if value, ok := kv.Sets[src]; ok {
+		kv.Sets[dst] = value
+		delete(kv.Sets, src)
+	}
+	if value, ok := kv.SortedSets[src]; ok {
+		kv.SortedSets[dst] = value
+		delete(kv.SortedSets, src)
+	}
+	if expiration, ok := kv.Expirations[src]; ok {
+		kv.Expirations[dst] = expiration
+		delete(kv.Expirations, src)
+	}
+	if fields, ok := kv.HashFieldExpirations[src]; ok {
+		kv.HashFieldExpirations[dst] = fields
+		delete(kv.HashFieldExpirations, src)
+	}
+}
+
+// keyValue holds everything stored under one key, whatever its type, so
+// that values can be moved around and serialized generically. expireAt is
+// the zero time when the key has no TTL.
+type keyValue struct {
+	typ       string
+	str       string
+	list      *List
+	hash      *Hash
+	fieldTTLs map[string]time.Time
+	set       *Set
+	zset      *SortedSet
+	expireAt  time.Time
+}
+
+// getKeyValue returns the value at key without copying it. The caller must
+// hold the lock.
+func (kv *KeyValueStore) getKeyValue(key string) (keyValue, bool) {
+	v := keyValue{typ: kv.keyType(key)}
+	switch v.typ {
+	case "none":
+		return v, false
+	case "string":
+		v.str = kv.Strings[key]
+	case "list":
+		v.list = kv.Lists[key]
+	case "hash":
+		v.hash = kv.Hashes[key]
+		v.fieldTTLs = kv.HashFieldExpirations[key]
+	case "set":
+		v.set = kv.Sets[key]
+	case "zset":
+		v.zset = kv.SortedSets[key]
+	}
+	v.expireAt = kv.Expirations[key]
+	return v, true
+}
+
+// setKeyValue stores v at key, which must not exist. The caller must hold
+// the write lock.
+func (kv *KeyValueStore) setKeyValue(key string, v keyValue) {
+	switch v.typ {
+	case "string":
+		kv.Strings[key] = v.str
+	case "list":
+		kv.Lists[key] = v.list
+	case "hash":
+		kv.Hashes[key] = v.hash
+		if len(v.fieldTTLs) > 0 {
+			kv.HashFieldExpirations[key] = v.fieldTTLs
+		}
+	case "set":
+		kv.Sets[key] = v.set
+	case "zset":
+		kv.SortedSets[key] = v.zset
+	}
+	if !v.expireAt.IsZero() {
+		kv.Expirations[key] = v.expireAt
+	}
+	kv.indexKeys(key)
+	kv.signalKeyReady(key)
+}
+
+// clone returns a deep copy of v.
+func (v keyValue) clone() keyValue {
+	c := v
+	if v.list != nil {
+		c.list = v.list.clone()
+	}
+	if v.hash != nil {
+		c.hash = v.hash.clone()
+	}
+	if v.fieldTTLs != nil {
+		c.fieldTTLs = make(map[string]time.Time, len(v.fieldTTLs))
+		for field, expiration := range v.fieldTTLs {
+			c.fieldTTLs[field] = expiration
+		}
+	}
+	if v.set != nil {
+		c.set = v.set.clone()
+	}
+	if v.zset != nil {
+		c.zset = v.zset.clone()
+	}
+	return c
+}
+
+// RenameCommand implements RENAME and, when nx is set, RENAMENX. The TTL of
+// the source moves along with its value.
+func (kv *KeyValueStore) RenameCommand(parts []string, nx bool) string {
+	if len(parts) != 3 {
+		return fmt.Sprintf("ERR %s requires 2 arguments", parts[0])
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	src, dst := parts[1], parts[2]
+	if !kv.keyExists(src) {
+		return "ERR no such key"
+	}
+	if src == dst {
+		if nx {
+			return "(integer) 0"
+		}
+		return "OK"
+	}
+	if nx && kv.keyExists(dst) {
+		return "(integer) 0"
+	}
+	kv.deleteKey(dst)
+	kv.moveKey(src, dst)
+	kv.moveKeyAccess(src, dst)
+	kv.signalKeyReady(dst)
+	if nx {
+		return "(integer) 1"
+	}
+	return "OK"
+}
+
+// CopyCommand implements COPY source destination [DB destination-db] [REPLACE].
+func (kv *KeyValueStore) CopyCommand(parts []string) string {
+	if len(parts) < 3 {
+		return "ERR COPY requires at least 2 arguments"
+	}
+	replace := false
+	target := kv
+	for i := 3; i < len(parts); i++ {
+		switch strings.ToUpper(parts[i]) {
+		case "REPLACE":
+			replace = true
+		case "DB":
+			if i+1 >= len(parts) {
+				return "ERR syntax error"
+			}
+			index, errMsg := parseDBIndex(parts[i+1])
+			if errMsg != "" {
+				return errMsg
+			}
+			target = databases[index]
+			i++
+		default:
+			return "ERR syntax error"
+		}
+	}
+	src, dst := parts[1], parts[2]
+	if src == dst && target == kv {
+		return "ERR source and destination objects are the same"
+	}
+	if target == kv {
+		kv.mu.Lock()
+		defer kv.mu.Unlock()
+	} else {
+		unlock := lockPair(kv, target)
+		defer unlock()
+	}
+	if !kv.keyExists(src) {
+		return "(integer) 0"
+	}
+	if target.keyExists(dst) && !replace {
+		return "(integer) 0"
+	}
+	value, _ := kv.getKeyValue(src)
+	target.preserveKeys(dst)
+	target.deleteKey(dst)
+	target.setKeyValue(dst, value.clone())
+	return "(integer) 1"
+}
+
+func (kv *KeyValueStore) RandomKeyCommand(parts []string) string {
+	if len(parts) != 1 {
+		return "ERR RANDOMKEY requires no arguments"
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	// Reservoir sampling, so every key is equally likely
+	picked, seen := "", 0
+	kv.eachKey(func(key string) {
+		seen++
+		if rand.Intn(seen) == 0 {
+			picked = key
+		}
+	})
+	if seen == 0 {
+		return "(nil)"
+	}
+	return picked
+}
+
+func (kv *KeyValueStore) DBSizeCommand(parts []string) string {
+	if len(parts) != 1 {
+		return "ERR DBSIZE requires no arguments"
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	count := 0
+	kv.eachKey(func(string) { count++ })
+	return fmt.Sprintf("(integer) %d", count)
+}
+
+// objectEncoding names the internal representation of the value at key the
+// way Redis does.
+func (kv *KeyValueStore) objectEncoding(key string) string {
+	switch kv.keyType(key) {
+	case "string":
+		value := kv.Strings[key]
+		if _, err := strconv.ParseInt(value, 10, 64); err == nil && len(value) <= 20 {
+			return "int"
+		}
+		if len(value) <= 44 {
+			return "embstr"
+		}
+		return "raw"
+	case "list":
+		return kv.Lists[key].Encoding()
+	case "hash":
+		return kv.Hashes[key].Encoding()
+	case "set":
+		return kv.Sets[key].Encoding()
+	case "zset":
+		return kv.SortedSets[key].Encoding()
+	}
+	return "hashtable"
+}
+
+var objectHelp = []string{
+	"OBJECT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"ENCODING <key>",
+	"    Return the kind of internal representation used in order to store the value",
+	"    associated with a <key>.",
+	"FREQ <key>",
+	"    Return the access frequency index of the <key>. The returned integer is",
+	"    proportional to the logarithm of the recent access frequency of the key.",
+	"IDLETIME <key>",
+	"    Return the idle time of the <key>, that is the approximated number of",
+	"    seconds elapsed since the last access to the key.",
+	"REFCOUNT <key>",
+	"    Return the number of references of the value associated with the specified",
+	"    <key>.",
+	"HELP",
+	"    Print this help.",
+}
+
+// ObjectCommand implements OBJECT ENCODING|FREQ|IDLETIME|REFCOUNT key and
+// OBJECT HELP. Inspecting a key this way does not count as accessing it.
+func (kv *KeyValueStore) ObjectCommand(parts []string) string {
+	if len(parts) < 2 {
+		return "ERR OBJECT requires at least 1 argument"
+	}
+	subcommand := strings.ToUpper(parts[1])
+	if subcommand == "HELP" && len(parts) == 2 {
+		return strings.Join(objectHelp, "\n")
+	}
+	switch subcommand {
+	case "ENCODING", "FREQ", "IDLETIME", "REFCOUNT":
+		if len(parts) != 3 {
+			return fmt.Sprintf("ERR OBJECT %s requires 1 argument", subcommand)
+		}
+	default:
+		return fmt.Sprintf("ERR unknown subcommand '%s'. Try OBJECT HELP.", parts[1])
+	}
+
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	key := parts[2]
+	if !kv.keyExists(key) {
+		return "(nil)"
+	}
+	switch subcommand {
+	case "ENCODING":
+		return kv.objectEncoding(key)
+	case "FREQ":
+		if !maxMemoryPolicy.lfu() {
+			return "ERR An LFU maxmemory policy is not selected, access frequency not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust."
+		}
+		access := kv.keyAccessOf(key)
+		return fmt.Sprintf("(integer) %d", access.decayedCounter(time.Now()))
+	case "IDLETIME":
+		access := kv.keyAccessOf(key)
+		return fmt.Sprintf("(integer) %d", int64(time.Since(access.lastAccess).Seconds()))
+	}
+	return "(integer) 1"
+}
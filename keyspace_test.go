@@ -0,0 +1,139 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeysAndScanAcrossTypes(t *testing.T) {
+	kv := NewKeyValueStore()
+	kv.executeCommand([]string{"SET", "user:1", "a"})
+	kv.executeCommand([]string{"LPUSH", "user:2", "a"})
+	kv.executeCommand([]string{"HSET", "user:3", "f", "v"})
+	kv.executeCommand([]string{"SADD", "other", "m"})
+	kv.executeCommand([]string{"ZADD", "user:4", "1", "m"})
+	kv.executeCommand([]string{"SET", "gone", "a"})
+	kv.Expirations["gone"] = time.Now().Add(-time.Second)
+
+	if got := kv.executeCommand([]string{"KEYS", "user:*"}); got != "user:1 user:2 user:3 user:4" {
+		t.Fatalf("Expected all user keys, Got: %q", got)
+	}
+	if got := kv.executeCommand([]string{"KEYS", "user:[^13]"}); got != "user:2 user:4" {
+		t.Fatalf("Expected user:2 and user:4, Got: %q", got)
+	}
+
+	seen := make(map[string]int)
+	cursor := "0"
+	for {
+		reply := strings.Fields(kv.executeCommand([]string{"SCAN", cursor, "COUNT", "2"}))
+		for _, key := range reply[1:] {
+			seen[key]++
+		}
+		if cursor = reply[0]; cursor == "0" {
+			break
+		}
+	}
+	if len(seen) != 5 || seen["gone"] != 0 {
+		t.Fatalf("Expected the 5 live keys once each, Got: %v", seen)
+	}
+
+	reply := kv.executeCommand([]string{"SCAN", "0", "COUNT", "100", "TYPE", "zset"})
+	if reply != "0 user:4" {
+		t.Fatalf("Expected only the sorted set, Got: %q", reply)
+	}
+	if got := kv.executeCommand([]string{"DEL", "user:3", "user:4", "gone"}); got != "(integer) 2" {
+		t.Fatalf("Expected 2 deleted keys, Got: %q", got)
+	}
+}
+
+func TestRenameCarriesTTL(t *testing.T) {
+	kv := NewKeyValueStore()
+	kv.executeCommand([]string{"SET", "old", "v"})
+	kv.executeCommand([]string{"EXPIRE", "old", "100"})
+	kv.executeCommand([]string{"SET", "new", "stale"})
+	if got := kv.executeCommand([]string{"RENAME", "old", "new"}); got != "OK" {
+		t.Fatalf("Expected OK, Got: %q", got)
+	}
+	if got := kv.executeCommand([]string{"GET", "new"}); got != "v" {
+		t.Fatalf("Expected the renamed value, Got: %q", got)
+	}
+	if _, exists := kv.Expirations["new"]; !exists {
+		t.Fatal("Expected the TTL to move along with the key")
+	}
+	if got := kv.executeCommand([]string{"EXISTS", "old"}); got != "(integer) 0" {
+		t.Fatalf("Expected the old key to be gone, Got: %q", got)
+	}
+}
+
+func TestObjectFreqNeedsLFUPolicy(t *testing.T) {
+	kv := NewKeyValueStore()
+	kv.executeCommand([]string{"SET", "k", "v"})
+	checkCommands(t, kv, []commandCase{
+		{[]string{"OBJECT", "FREQ", "missing"}, "(nil)"},
+		{[]string{"OBJECT", "FREQ", "k"}, "ERR An LFU maxmemory policy is not selected, access frequency not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust."},
+	})
+	setEvictionPolicy(t, 0, policyVolatileLFU)
+	if got := kv.executeCommand([]string{"OBJECT", "FREQ", "k"}); !strings.HasPrefix(got, "(integer) ") {
+		t.Fatalf("Expected the access frequency, Got: %q", got)
+	}
+}
+
+func TestExpireMatchesPExpireAt(t *testing.T) {
+	kv := NewKeyValueStore()
+	kv.executeCommand([]string{"SET", "k", "v"})
+	kv.executeCommand([]string{"SET", "gone", "v"})
+	checkCommands(t, kv, []commandCase{
+		{[]string{"EXPIRE", "missing", "100"}, "(integer) 0"},
+		{[]string{"EXISTS", "missing"}, "(integer) 0"},
+		{[]string{"EXPIRE", "k", "100"}, "(integer) 1"},
+		{[]string{"TTL", "gone"}, "(integer) -1"},
+		{[]string{"EXPIRE", "gone", "0"}, "(integer) 1"},
+		{[]string{"EXISTS", "gone"}, "(integer) 0"},
+		{[]string{"EXPIRE", "k", "ten"}, "ERR value is not an integer or out of range"},
+		{[]string{"EXPIRE", "k", "9223372036854775807"}, "ERR invalid expire time in 'expire' command"},
+		{[]string{"EXPIRE", "k", "-1"}, "(integer) 1"},
+		{[]string{"EXISTS", "k"}, "(integer) 0"},
+	})
+	if _, exists := kv.Expirations["missing"]; exists {
+		t.Fatal("Expected no TTL to be set on a missing key")
+	}
+}
+
+func TestTTLReclaimsExpiredKeys(t *testing.T) {
+	kv := NewKeyValueStore()
+	kv.executeCommand([]string{"SADD", "s", "a"})
+	kv.executeCommand([]string{"EXPIRE", "s", "100"})
+	kv.Expirations["s"] = time.Now().Add(-time.Millisecond)
+	if got := kv.executeCommand([]string{"TTL", "s"}); got != "(integer) -2" {
+		t.Fatalf("Expected the key to be expired, Got: %q", got)
+	}
+	if _, exists := kv.Sets["s"]; exists || kv.usedMemory() != 0 {
+		t.Fatalf("Expected the set and its memory to be reclaimed, Got: %d bytes", kv.usedMemory())
+	}
+	checkCommands(t, kv, []commandCase{
+		{[]string{"SADD", "s", "a"}, "(integer) 1"},
+		{[]string{"TTL", "s"}, "(integer) -1"},
+	})
+}
+
+func TestCommandKeys(t *testing.T) {
+	cases := []struct {
+		parts []string
+		keys  []string
+	}{
+		{[]string{"GET", "a"}, []string{"a"}},
+		{[]string{"MSET", "a", "1", "b", "2"}, []string{"a", "b"}},
+		{[]string{"BZPOPMIN", "a", "b", "0"}, []string{"a", "b"}},
+		{[]string{"ZUNIONSTORE", "d", "2", "a", "b", "WEIGHTS", "1", "2"}, []string{"d", "a", "b"}},
+		{[]string{"ZMPOP", "1", "a", "MIN"}, []string{"a"}},
+		{[]string{"GEORADIUS", "g", "1", "2", "3", "km", "STORE", "d"}, []string{"g", "d"}},
+		{[]string{"PING"}, []string{}},
+	}
+	for _, c := range cases {
+		got := commandKeys(c.parts)
+		if strings.Join(got, " ") != strings.Join(c.keys, " ") {
+			t.Errorf("%v: expected keys %v, Got: %v", c.parts, c.keys, got)
+		}
+	}
+}
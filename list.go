@@ -0,0 +1,178 @@
+package main
+
+// List is the value type behind lists. Like in Redis, a small list is kept
+// as a single listpack and is converted to a plain slice, reported as a
+// quicklist, once it outgrows list-max-listpack-size. A nil *List behaves as
+// an empty list.
+type List struct {
+	lp    listpack
+	items []string
+}
+
+func NewList() *List {
+	return &List{lp: newListpack()}
+}
+
+// listFromSlice builds a list holding values, in the encoding their number
+// and size call for.
+func listFromSlice(values []string) *List {
+	l := NewList()
+	l.PushRight(values...)
+	return l
+}
+
+// Encoding names the representation of the list the way OBJECT ENCODING does.
+func (l *List) Encoding() string {
+	if l.lp == nil {
+		return "quicklist"
+	}
+	return "listpack"
+}
+
+func (l *List) Len() int {
+	if l == nil {
+		return 0
+	}
+	if l.lp == nil {
+		return len(l.items)
+	}
+	return l.lp.Len()
+}
+
+// PushLeft adds values at the head one after the other, so the last of them
+// ends up first, like LPUSH does.
+func (l *List) PushLeft(values ...string) {
+	if l.lp == nil {
+		items := make([]string, 0, len(values)+len(l.items))
+		for i := len(values) - 1; i >= 0; i-- {
+			items = append(items, values[i])
+		}
+		l.items = append(items, l.items...)
+		return
+	}
+	reversed := make([]string, len(values))
+	for i, value := range values {
+		reversed[len(values)-1-i] = value
+	}
+	l.lp = l.lp.insert(l.lp.first(), reversed...)
+	l.convertIfNeeded()
+}
+
+func (l *List) PushRight(values ...string) {
+	if l.lp == nil {
+		l.items = append(l.items, values...)
+		return
+	}
+	l.lp = l.lp.append(values...)
+	l.convertIfNeeded()
+}
+
+func (l *List) PopLeft() (string, bool) {
+	if l.Len() == 0 {
+		return "", false
+	}
+	if l.lp == nil {
+		value := l.items[0]
+		l.items = l.items[1:]
+		return value, true
+	}
+	e, _ := l.lp.next(l.lp.first())
+	value := e.String()
+	l.lp = l.lp.remove(l.lp.first(), 1)
+	return value, true
+}
+
+func (l *List) PopRight() (string, bool) {
+	if l.Len() == 0 {
+		return "", false
+	}
+	if l.lp == nil {
+		value := l.items[len(l.items)-1]
+		l.items = l.items[:len(l.items)-1]
+		return value, true
+	}
+	last := l.lp.prev(len(l.lp) - 1)
+	e, _ := l.lp.next(last)
+	value := e.String()
+	l.lp = l.lp.remove(last, 1)
+	return value, true
+}
+
+// Range returns the elements between the 0-based indexes start and stop,
+// both inclusive, with stop already clamped to the list.
+func (l *List) Range(start, stop int) []string {
+	start = max(start, 0)
+	if start > stop {
+		return nil
+	}
+	if l.lp == nil {
+		return l.items[start : stop+1]
+	}
+	values := make([]string, 0, stop-start+1)
+	pos := l.lp.first()
+	for i := 0; i <= stop && !l.lp.atEnd(pos); i++ {
+		var e lpEntry
+		e, pos = l.lp.next(pos)
+		if i >= start {
+			values = append(values, e.String())
+		}
+	}
+	return values
+}
+
+// Elements returns every element from head to tail.
+func (l *List) Elements() []string {
+	if l == nil {
+		return nil
+	}
+	if l.lp == nil {
+		return append([]string(nil), l.items...)
+	}
+	return l.lp.strings()
+}
+
+func (l *List) clone() *List {
+	if l.lp == nil {
+		return &List{items: l.Elements()}
+	}
+	return &List{lp: append(listpack(nil), l.lp...)}
+}
+
+// listpackFits reports whether a listpack with that many entries and bytes
+// is within the entry count, or the byte size for a negative
+// list-max-listpack-size.
+func listpackFits(entries, size int) bool {
+	if listMaxListpackSize > 0 {
+		return entries <= listMaxListpackSize
+	}
+	return size <= 4096<<(max(min(-listMaxListpackSize, 5), 1)-1)
+}
+
+// convertIfNeeded switches the list to a slice once the listpack is too big.
+func (l *List) convertIfNeeded() {
+	if !listpackFits(l.lp.Len(), len(l.lp)) {
+		l.items, l.lp = l.lp.strings(), nil
+	}
+}
+
+// packedNodes splits the list into listpacks of the size a listpack list
+// may have, the way Redis lays out the nodes of a quicklist.
+func (l *List) packedNodes() []listpack {
+	if l.lp != nil {
+		return []listpack{l.lp}
+	}
+	var nodes []listpack
+	node := newListpack()
+	for _, item := range l.items {
+		size := len(node) + len(appendLPEntry(nil, item))
+		if node.Len() > 0 && !listpackFits(node.Len()+1, size) {
+			nodes = append(nodes, node)
+			node = newListpack()
+		}
+		node = node.append(item)
+	}
+	if node.Len() > 0 {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+)
+
+// Small hashes, lists, sets and sorted sets are stored as a listpack, the
+// packed format Redis uses for them: a header with the total size and the
+// number of entries, then the entries back to back, then an end marker.
+// Every entry holds its encoding and data followed by its own length written
+// backwards, so the listpack can be walked in both directions. Strings that
+// are canonical integers are stored as integers.
+//
+// The layout is the one of Redis byte for byte, so a listpack can be written
+// to and read from RDB files as is.
+
+const (
+	lpHeaderSize = 6
+	lpEOF        = 0xff
+	// lpUnknownCount in the header means the entries have to be counted
+	lpUnknownCount = math.MaxUint16
+
+	lpEncoding7BitUint = 0x00
+	lpEncoding6BitStr  = 0x80
+	lpEncoding13BitInt = 0xc0
+	lpEncoding12BitStr = 0xe0
+	lpEncoding16BitInt = 0xf1
+	lpEncoding24BitInt = 0xf2
+	lpEncoding32BitInt = 0xf3
+	lpEncoding64BitInt = 0xf4
+	lpEncoding32BitStr = 0xf0
+)
+
+// Thresholds past which the compact encodings are converted to the regular
+// ones, with the defaults of Redis. A negative listMaxListpackSize limits the
+// size of a list listpack to 4KB for -1, 8KB for -2, and up to 64KB for -5.
+var (
+	hashMaxListpackEntries = 128
+	hashMaxListpackValue   = 64
+	listMaxListpackSize    = -2
+	setMaxIntsetEntries    = 512
+	setMaxListpackEntries  = 128
+	setMaxListpackValue    = 64
+	zsetMaxListpackEntries = 128
+	zsetMaxListpackValue   = 64
+)
+
+type listpack []byte
+
+func newListpack() listpack {
+	lp := make(listpack, lpHeaderSize, lpHeaderSize+1)
+	lp = append(lp, lpEOF)
+	lp.setHeader(0)
+	return lp
+}
+
+func (lp listpack) setHeader(count int) {
+	binary.LittleEndian.PutUint32(lp, uint32(len(lp)))
+	binary.LittleEndian.PutUint16(lp[4:], uint16(min(count, lpUnknownCount)))
+}
+
+// Len returns the number of entries.
+func (lp listpack) Len() int {
+	if count := binary.LittleEndian.Uint16(lp[4:]); count != lpUnknownCount {
+		return int(count)
+	}
+	count := 0
+	for pos := lp.first(); !lp.atEnd(pos); pos = lp.skip(pos) {
+		count++
+	}
+	return count
+}
+
+// first returns the position of the first entry, or of the end marker.
+func (lp listpack) first() int {
+	return lpHeaderSize
+}
+
+func (lp listpack) atEnd(pos int) bool {
+	return lp[pos] == lpEOF
+}
+
+// lpEntry is a decoded entry, either a string pointing into the listpack or
+// an integer.
+type lpEntry struct {
+	str   []byte
+	num   int64
+	isInt bool
+}
+
+func (e lpEntry) String() string {
+	if e.isInt {
+		return strconv.FormatInt(e.num, 10)
+	}
+	return string(e.str)
+}
+
+// equals compares the entry to s without allocating.
+func (e lpEntry) equals(s string) bool {
+	if !e.isInt {
+		return string(e.str) == s
+	}
+	var buf [20]byte
+	return string(strconv.AppendInt(buf[:0], e.num, 10)) == s
+}
+
+// next decodes the entry at pos and returns it along with the position of
+// the following entry.
+func (lp listpack) next(pos int) (lpEntry, int) {
+	e, size := lp.decode(pos)
+	return e, pos + size + lpBacklenSize(size)
+}
+
+// skip returns the position of the entry after the one at pos.
+func (lp listpack) skip(pos int) int {
+	_, next := lp.next(pos)
+	return next
+}
+
+// prev returns the position of the entry before the one at pos, which may
+// be the end marker, or -1 when pos is the first entry.
+func (lp listpack) prev(pos int) int {
+	if pos <= lpHeaderSize {
+		return -1
+	}
+	// The backlen is read from its last byte, seven bits at a time
+	p := pos - 1
+	size, shift := 0, 0
+	for {
+		size |= int(lp[p]&127) << shift
+		if lp[p]&128 == 0 {
+			break
+		}
+		shift += 7
+		p--
+	}
+	return p - size
+}
+
+// decode returns the entry at pos and the size of its encoding and data.
+func (lp listpack) decode(pos int) (lpEntry, int) {
+	b := lp[pos]
+	switch {
+	case b&0x80 == lpEncoding7BitUint:
+		return lpEntry{num: int64(b & 0x7f), isInt: true}, 1
+	case b&0xc0 == lpEncoding6BitStr:
+		n := int(b & 0x3f)
+		return lpEntry{str: lp[pos+1 : pos+1+n]}, 1 + n
+	case b&0xe0 == lpEncoding13BitInt:
+		u := uint16(b&0x1f)<<8 | uint16(lp[pos+1])
+		// Sign extend from 13 bits
+		return lpEntry{num: int64(int16(u<<3) >> 3), isInt: true}, 2
+	case b&0xf0 == lpEncoding12BitStr:
+		n := int(b&0x0f)<<8 | int(lp[pos+1])
+		return lpEntry{str: lp[pos+2 : pos+2+n]}, 2 + n
+	}
+	switch b {
+	case lpEncoding16BitInt:
+		return lpEntry{num: int64(int16(binary.LittleEndian.Uint16(lp[pos+1:]))), isInt: true}, 3
+	case lpEncoding24BitInt:
+		u := uint32(lp[pos+1]) | uint32(lp[pos+2])<<8 | uint32(lp[pos+3])<<16
+		return lpEntry{num: int64(int32(u<<8) >> 8), isInt: true}, 4
+	case lpEncoding32BitInt:
+		return lpEntry{num: int64(int32(binary.LittleEndian.Uint32(lp[pos+1:]))), isInt: true}, 5
+	case lpEncoding64BitInt:
+		return lpEntry{num: int64(binary.LittleEndian.Uint64(lp[pos+1:])), isInt: true}, 9
+	}
+	// lpEncoding32BitStr
+	n := int(binary.LittleEndian.Uint32(lp[pos+1:]))
+	return lpEntry{str: lp[pos+5 : pos+5+n]}, 5 + n
+}
+
+// lpBacklenSize returns how many bytes the backlen of an entry of size takes.
+func lpBacklenSize(size int) int {
+	switch {
+	case size <= 127:
+		return 1
+	case size < 16383:
+		return 2
+	case size < 2097151:
+		return 3
+	case size < 268435455:
+		return 4
+	}
+	return 5
+}
+
+// lpInt reports whether s is stored as an integer, which is only the case
+// for the canonical form of a 64-bit integer.
+func lpInt(s string) (int64, bool) {
+	if len(s) == 0 || len(s) > 20 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || strconv.FormatInt(n, 10) != s {
+		return 0, false
+	}
+	return n, true
+}
+
+// appendLPEntry encodes s as an entry at the end of b.
+func appendLPEntry(b []byte, s string) []byte {
+	start := len(b)
+	if n, ok := lpInt(s); ok {
+		switch {
+		case n >= 0 && n <= 127:
+			b = append(b, byte(n))
+		case n >= -4096 && n <= 4095:
+			u := uint16(n) & 0x1fff
+			b = append(b, lpEncoding13BitInt|byte(u>>8), byte(u))
+		case n >= math.MinInt16 && n <= math.MaxInt16:
+			b = append(b, lpEncoding16BitInt)
+			b = binary.LittleEndian.AppendUint16(b, uint16(n))
+		case n >= -1<<23 && n < 1<<23:
+			b = append(b, lpEncoding24BitInt, byte(n), byte(n>>8), byte(n>>16))
+		case n >= math.MinInt32 && n <= math.MaxInt32:
+			b = append(b, lpEncoding32BitInt)
+			b = binary.LittleEndian.AppendUint32(b, uint32(n))
+		default:
+			b = append(b, lpEncoding64BitInt)
+			b = binary.LittleEndian.AppendUint64(b, uint64(n))
+		}
+	} else {
+		switch n := len(s); {
+		case n < 64:
+			b = append(b, lpEncoding6BitStr|byte(n))
+		case n < 4096:
+			b = append(b, lpEncoding12BitStr|byte(n>>8), byte(n))
+		default:
+			b = append(b, lpEncoding32BitStr)
+			b = binary.LittleEndian.AppendUint32(b, uint32(n))
+		}
+		b = append(b, s...)
+	}
+
+	return appendLPBacklen(b, len(b)-start)
+}
+
+// appendLPBacklen writes the size of an entry backwards, seven bits a byte.
+func appendLPBacklen(b []byte, size int) []byte {
+	switch lpBacklenSize(size) {
+	case 1:
+		return append(b, byte(size))
+	case 2:
+		return append(b, byte(size>>7), byte(size&127)|128)
+	case 3:
+		return append(b, byte(size>>14), byte(size>>7&127)|128, byte(size&127)|128)
+	case 4:
+		return append(b, byte(size>>21), byte(size>>14&127)|128, byte(size>>7&127)|128, byte(size&127)|128)
+	}
+	return append(b, byte(size>>28), byte(size>>21&127)|128, byte(size>>14&127)|128, byte(size>>7&127)|128, byte(size&127)|128)
+}
+
+// replace swaps the removed entries between the positions from and to for
+// values, and returns the updated listpack.
+func (lp listpack) replace(from, to, removed int, values ...string) listpack {
+	count := lp.Len() - removed + len(values)
+	var encoded []byte
+	for _, value := range values {
+		encoded = appendLPEntry(encoded, value)
+	}
+	grown := len(encoded) - (to - from)
+	if grown > 0 {
+		lp = append(lp, make([]byte, grown)...)
+	}
+	copy(lp[from+len(encoded):], lp[to:len(lp)-max(grown, 0)])
+	copy(lp[from:], encoded)
+	if grown < 0 {
+		lp = lp[:len(lp)+grown]
+	}
+	lp.setHeader(count)
+	return lp
+}
+
+// insert adds values before the entry at pos.
+func (lp listpack) insert(pos int, values ...string) listpack {
+	return lp.replace(pos, pos, 0, values...)
+}
+
+func (lp listpack) append(values ...string) listpack {
+	return lp.insert(len(lp)-1, values...)
+}
+
+// remove deletes count entries starting with the one at pos.
+func (lp listpack) remove(pos, count int) listpack {
+	end := pos
+	for i := 0; i < count; i++ {
+		end = lp.skip(end)
+	}
+	return lp.replace(pos, end, count)
+}
+
+// strings decodes every entry.
+func (lp listpack) strings() []string {
+	values := make([]string, 0, lp.Len())
+	for pos := lp.first(); !lp.atEnd(pos); {
+		var e lpEntry
+		e, pos = lp.next(pos)
+		values = append(values, e.String())
+	}
+	return values
+}
+
+func listpackOf(values ...string) listpack {
+	return newListpack().append(values...)
+}
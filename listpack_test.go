@@ -0,0 +1,131 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestListpackEntries(t *testing.T) {
+	values := []string{"0", "127", "128", "-1", "4095", "-4096", "4096", "32767", "-32768",
+		"8388607", "-8388608", "2147483647", strconv.FormatInt(math.MaxInt64, 10),
+		strconv.FormatInt(math.MinInt64, 10), "007", "-0", "", "a",
+		strings.Repeat("x", 63), strings.Repeat("y", 200), strings.Repeat("z", 5000)}
+	lp := listpackOf(values...)
+	if lp.Len() != len(values) {
+		t.Fatalf("Expected %d entries, Got: %d", len(values), lp.Len())
+	}
+	if got := lp.strings(); !slices.Equal(got, values) {
+		t.Fatalf("Expected %q, Got: %q", values, got)
+	}
+
+	// Walk backwards from the end marker
+	var backwards []string
+	for pos := lp.prev(len(lp) - 1); pos >= 0; pos = lp.prev(pos) {
+		e, _ := lp.next(pos)
+		backwards = append(backwards, e.String())
+	}
+	slices.Reverse(backwards)
+	if !slices.Equal(backwards, values) {
+		t.Fatalf("Expected %q walking backwards, Got: %q", values, backwards)
+	}
+
+	lp = lp.remove(lp.skip(lp.first()), 2)
+	lp = lp.insert(lp.first(), "head")
+	expected := append([]string{"head", "0"}, values[3:]...)
+	if got := lp.strings(); !slices.Equal(got, expected) {
+		t.Fatalf("Expected %q, Got: %q", expected, got)
+	}
+}
+
+func TestCompactEncodingConversions(t *testing.T) {
+	kv := NewKeyValueStore()
+	expectEncoding := func(key, expected string) {
+		t.Helper()
+		if got := kv.objectEncoding(key); got != expected {
+			t.Fatalf("Expected %s to be encoded as %s, Got: %s", key, expected, got)
+		}
+	}
+
+	for i := 0; i < hashMaxListpackEntries; i++ {
+		kv.executeCommand([]string{"HSET", "hash", "f" + strconv.Itoa(i), strconv.Itoa(i)})
+	}
+	expectEncoding("hash", "listpack")
+	kv.executeCommand([]string{"HSET", "hash", "one-more", "v"})
+	expectEncoding("hash", "hashtable")
+	kv.executeCommand([]string{"HSET", "long", "f", strings.Repeat("v", hashMaxListpackValue+1)})
+	expectEncoding("long", "hashtable")
+	if got := kv.executeCommand([]string{"HGET", "hash", "f42"}); got != "42" {
+		t.Fatalf("Expected fields to survive the conversion, Got: %q", got)
+	}
+
+	kv.executeCommand([]string{"SADD", "ints", "3", "1", "2"})
+	expectEncoding("ints", "intset")
+	kv.executeCommand([]string{"SADD", "ints", "a"})
+	expectEncoding("ints", "listpack")
+	kv.executeCommand([]string{"SADD", "ints", strings.Repeat("m", setMaxListpackValue+1)})
+	expectEncoding("ints", "hashtable")
+	if got := kv.executeCommand([]string{"SISMEMBER", "ints", "2"}); got != "(integer) 1" {
+		t.Fatalf("Expected members to survive the conversion, Got: %q", got)
+	}
+	for i := 0; i <= setMaxIntsetEntries; i++ {
+		kv.executeCommand([]string{"SADD", "many", strconv.Itoa(i)})
+	}
+	expectEncoding("many", "hashtable")
+
+	kv.executeCommand([]string{"RPUSH", "list", "b", "c"})
+	kv.executeCommand([]string{"LPUSH", "list", "a"})
+	expectEncoding("list", "listpack")
+	kv.executeCommand([]string{"RPUSH", "list", strings.Repeat("x", 9000)})
+	expectEncoding("list", "quicklist")
+	if got := kv.executeCommand([]string{"LRANGE", "list", "0", "2"}); got != "a b c" {
+		t.Fatalf("Expected elements to survive the conversion, Got: %q", got)
+	}
+
+	for i := 0; i < zsetMaxListpackEntries; i++ {
+		kv.executeCommand([]string{"ZADD", "zset", strconv.Itoa(i % 10), "m" + strconv.Itoa(i)})
+	}
+	expectEncoding("zset", "listpack")
+	before := kv.executeCommand([]string{"ZRANGE", "zset", "0", "-1", "WITHSCORES"})
+	kv.executeCommand([]string{"ZADD", "zset", "100", "last"})
+	expectEncoding("zset", "skiplist")
+	after := kv.executeCommand([]string{"ZRANGE", "zset", "0", "-1", "WITHSCORES"})
+	if after != before+" last 100" {
+		t.Fatalf("Expected the order to survive the conversion, Got: %q", after)
+	}
+}
+
+func TestListpackSortedSetMatchesSkiplist(t *testing.T) {
+	compact, regular := NewSortedSet(), NewSortedSet()
+	regular.convert()
+	for i, score := range []float64{3, 1.5, -2, 1.5, math.Inf(1), 0, 1e20, -0.25} {
+		member := "m" + strconv.Itoa(i%7)
+		compact.Add(member, score)
+		regular.Add(member, score)
+	}
+	compact.Remove("m2")
+	regular.Remove("m2")
+	if compact.Encoding() != "listpack" || regular.Encoding() != "skiplist" {
+		t.Fatalf("Expected one set of each encoding")
+	}
+
+	if got, expected := compact.Members(), regular.Members(); !slices.Equal(got, expected) {
+		t.Fatalf("Expected %v, Got: %v", expected, got)
+	}
+	spec, _ := parseScoreRange("(0", "+inf")
+	if got, expected := compact.Range(spec, true, 1, 2), regular.Range(spec, true, 1, 2); !slices.Equal(got, expected) {
+		t.Fatalf("Expected %v, Got: %v", expected, got)
+	}
+	if got, expected := compact.Count(spec), regular.Count(spec); got != expected {
+		t.Fatalf("Expected a count of %d, Got: %d", expected, got)
+	}
+	for _, member := range []string{"m0", "m3", "m6", "missing"} {
+		gotRank, gotOK := compact.Rank(member, true)
+		rank, ok := regular.Rank(member, true)
+		if gotRank != rank || gotOK != ok {
+			t.Fatalf("Expected the rank of %s to be %d, Got: %d", member, rank, gotRank)
+		}
+	}
+}
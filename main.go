@@ -6,11 +6,11 @@ import (
 	"flag"
 	"fmt"
 	"net"
-	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dhravya/radish/redisproto"
@@ -28,46 +28,67 @@ const (
 
 type sortedSetMember struct {
 	Member string
-	score  float64
+	Score  float64
 }
 
 type KeyValueStore struct {
-	Strings                map[string]string
-	Lists                  map[string][]string
-	Hashes                 map[string]map[string]string
-	Sets                   map[string]map[string]struct{}
-	SortedSets             map[string][]sortedSetMember
-	Expirations            map[string]time.Time
-	mu                     sync.RWMutex
-	CurrentTx              *Transaction
-	totalCommandsProcessed int
-	connectedClients       map[string]net.Conn
+	Strings              map[string]string
+	Lists                map[string]*List
+	Hashes               map[string]*Hash
+	Sets                 map[string]*Set
+	SortedSets           map[string]*SortedSet
+	Expirations          map[string]time.Time
+	HashFieldExpirations map[string]map[string]time.Time
+	mu                   sync.RWMutex
+	CurrentTx            *Transaction
+	index                int
+	blocked              map[string][]chan struct{}
+	access               map[string]*keyAccess
+	accessMu             sync.Mutex
+	snapshots            []*dbSnapshot
+	// keys and volatileKeys index every stored key and the ones with a
+	// TTL, for SCAN and eviction, once either needed them
+	keys         *scanIndex
+	volatileKeys *scanIndex
+	// keySizes holds the memory estimate of every key, and usedBytes their
+	// sum, once maxmemory or INFO needed them
+	keySizes  map[string]int64
+	usedBytes int64
 }
 
 var pubsub = NewPubSub()
 var persistence *Persistence
 var serverStartTime = time.Now()
 
+// Server wide statistics, shared by every database
+var totalCommandsProcessed atomic.Int64
+var connectedClients atomic.Int64
+
+// requirePass is the password clients must AUTH with, if any
+var requirePass string
+
 func init() {
 	gob.Register(map[string]string{})
 	gob.Register(map[string][]string{})
 	gob.Register(map[string]map[string]string{})
 	gob.Register(map[string]map[string]struct{}{})
-	gob.Register(map[string][]sortedSetMember{})
+	gob.Register(map[string]*SortedSet{})
 	gob.Register(map[string]time.Time{})
+	gob.Register(map[string]map[string]time.Time{})
 	gob.Register(sortedSetMember{})
 }
 
 func NewKeyValueStore() *KeyValueStore {
 	return &KeyValueStore{
-		Strings:                make(map[string]string),
-		Lists:                  make(map[string][]string),
-		Hashes:                 make(map[string]map[string]string),
-		Sets:                   make(map[string]map[string]struct{}),
-		SortedSets:             make(map[string][]sortedSetMember),
-		Expirations:            make(map[string]time.Time),
-		totalCommandsProcessed: 0,
-		connectedClients:       make(map[string]net.Conn),
+		Strings:              make(map[string]string),
+		Lists:                make(map[string]*List),
+		Hashes:               make(map[string]*Hash),
+		Sets:                 make(map[string]*Set),
+		SortedSets:           make(map[string]*SortedSet),
+		Expirations:          make(map[string]time.Time),
+		HashFieldExpirations: make(map[string]map[string]time.Time),
+		blocked:              make(map[string][]chan struct{}),
+		access:               make(map[string]*keyAccess),
 	}
 }
 
@@ -86,6 +107,10 @@ func (kv *KeyValueStore) CommandHandler(command *redisproto.Command) string {
 		return kv.CurrentTx.DiscardCommand()
 	}
 
+	if replicaMode.Load() && commandTable[parts[0]].flags&flagWrite != 0 {
+		return "READONLY You can't write against a read only replica."
+	}
+
 	// Otherwise, add the command to the transaction queue
 	if kv.CurrentTx != nil {
 		kv.CurrentTx.Commands = append(kv.CurrentTx.Commands, command)
@@ -96,34 +121,40 @@ func (kv *KeyValueStore) CommandHandler(command *redisproto.Command) string {
 }
 
 func (kv *KeyValueStore) executeCommand(parts []string) string {
+	if commandTable[parts[0]].flags&flagWrite != 0 {
+		propagateMu.Lock()
+		defer propagateMu.Unlock()
+	}
+	return kv.runCommand(parts)
+}
 
-	kv.totalCommandsProcessed++
+// runCommand runs the command in parts. The caller must hold propagateMu if
+// it is a write command. Replicas leave maxmemory to their master, like
+// commands replayed while loading.
+func (kv *KeyValueStore) runCommand(parts []string) string {
+	totalCommandsProcessed.Add(1)
+	if commandTable[parts[0]].flags&flagDenyOOM != 0 && !loadingData.Load() && !replicaMode.Load() && !kv.freeMemoryIfNeeded() {
+		return oomReply
+	}
+	return kv.dispatchCommand(parts)
+}
+
+// dispatchCommand runs the command in parts without checking maxmemory. The
+// caller must hold propagateMu if it is a write command.
+func (kv *KeyValueStore) dispatchCommand(parts []string) string {
+	write := commandTable[parts[0]].flags&flagWrite != 0
+	defer kv.recordAccess(parts)
+	if write {
+		kv.preserveCommandKeys(parts)
+		defer kv.propagateCommand(parts)
+		defer kv.indexCommandKeys(parts)
+	}
 
 	fmt.Println("Command:", parts[0])
 	switch parts[0] {
 
 	case "INFO":
-		kv.mu.Lock()
-		defer kv.mu.Unlock()
-
-		// Calculate server uptime
-		uptimeSeconds := int(time.Since(serverStartTime).Seconds())
-
-		// Assuming you have variables tracking these metrics
-		totalCommandsProcessed := kv.totalCommandsProcessed
-		memoryUsage := runtime.MemStats{}
-		runtime.ReadMemStats(&memoryUsage)
-		connectedClients := len(kv.connectedClients) // Example of how you might track connected clients
-
-		// Building the INFO response
-		var infoBuilder strings.Builder
-		infoBuilder.WriteString("# Server\r\n")
-		infoBuilder.WriteString(fmt.Sprintf("uptime_in_seconds:%d\r\n", uptimeSeconds))
-		infoBuilder.WriteString(fmt.Sprintf("total_commands_processed:%d\r\n", totalCommandsProcessed))
-		infoBuilder.WriteString(fmt.Sprintf("used_memory:%d\r\n", memoryUsage.Alloc)) // Using Alloc as an example of memory usage
-		infoBuilder.WriteString(fmt.Sprintf("connected_clients:%d\r\n", connectedClients))
-
-		return infoBuilder.String()
+		return kv.InfoCommand(parts)
 	case "LPUSH":
 		if len(parts) < 3 {
 			return "ERROR: LPUSH requires at least 2 arguments"
@@ -134,12 +165,10 @@ func (kv *KeyValueStore) executeCommand(parts []string) string {
 		values := parts[2:]
 
 		if _, exists := kv.Lists[key]; !exists {
-			kv.Lists[key] = make([]string, 0)
-		}
-		for i := len(values) - 1; i >= 0; i-- {
-			kv.Lists[key] = append([]string{values[i]}, kv.Lists[key]...)
+			kv.Lists[key] = NewList()
 		}
-		return fmt.Sprintf("(integer) %d", len(kv.Lists[key]))
+		kv.Lists[key].PushLeft(values...)
+		return fmt.Sprintf("(integer) %d", kv.Lists[key].Len())
 	case "LPOP":
 		if len(parts) != 2 {
 			return "ERROR: LPOP requires 1 argument"
@@ -147,10 +176,7 @@ func (kv *KeyValueStore) executeCommand(parts []string) string {
 		kv.mu.Lock()
 		defer kv.mu.Unlock()
 		key := parts[1]
-		if list, exists := kv.Lists[key]; exists && len(list) > 0 {
-			// Pop the first element
-			value := list[0]
-			kv.Lists[key] = list[1:]
+		if value, ok := kv.Lists[key].PopLeft(); ok {
 			return value
 		}
 		return "(nil)"
@@ -164,11 +190,11 @@ func (kv *KeyValueStore) executeCommand(parts []string) string {
 		values := parts[2:]
 
 		if _, exists := kv.Lists[key]; !exists {
-			kv.Lists[key] = make([]string, 0)
+			kv.Lists[key] = NewList()
 		}
 
-		kv.Lists[key] = append(kv.Lists[key], values...)
-		return fmt.Sprintf("(integer) %d", len(kv.Lists[key]))
+		kv.Lists[key].PushRight(values...)
+		return fmt.Sprintf("(integer) %d", kv.Lists[key].Len())
 	case "RPOP":
 		if len(parts) != 2 {
 			return "ERR RPOP requires 1 argument"
@@ -176,9 +202,7 @@ func (kv *KeyValueStore) executeCommand(parts []string) string {
 		kv.mu.Lock()
 		defer kv.mu.Unlock()
 		key := parts[1]
-		if list, exists := kv.Lists[key]; exists && len(list) > 0 {
-			value := list[len(list)-1]
-			kv.Lists[key] = list[:len(list)-1]
+		if value, ok := kv.Lists[key].PopRight(); ok {
 			return value
 		}
 		return "(nil)"
@@ -198,24 +222,25 @@ func (kv *KeyValueStore) executeCommand(parts []string) string {
 			return "ERROR: LRANGE end index must be an integer"
 		}
 
-		if _, exists := kv.Lists[key]; !exists {
+		list, exists := kv.Lists[key]
+		if !exists {
 			return "ERROR: no such key"
 		}
 
 		if start < 0 {
-			start = len(kv.Lists[key]) + start
+			start = list.Len() + start
 		}
 		if end < 0 {
-			end = len(kv.Lists[key]) + end
+			end = list.Len() + end
 		}
-		if start > end || start >= len(kv.Lists[key]) {
+		if start > end || start >= list.Len() {
 			return ""
 		}
-		if end >= len(kv.Lists[key]) {
-			end = len(kv.Lists[key]) - 1
+		if end >= list.Len() {
+			end = list.Len() - 1
 		}
 
-		return fmt.Sprintf("%v", strings.Join(kv.Lists[key][start:end+1], " "))
+		return fmt.Sprintf("%v", strings.Join(list.Range(start, end), " "))
 	case "LLEN":
 		if len(parts) != 2 {
 			return "ERR LLEN requires 1 argument"
@@ -224,28 +249,80 @@ func (kv *KeyValueStore) executeCommand(parts []string) string {
 		defer kv.mu.RUnlock()
 		key := parts[1]
 		if list, exists := kv.Lists[key]; exists {
-			return fmt.Sprintf("(integer) %d", len(list))
+			return fmt.Sprintf("(integer) %d", list.Len())
 		}
 		return "(integer) 0"
 	case "HSET":
-		if len(parts) != 4 {
-			return "ERROR: HSET requires 3 arguments"
+		if len(parts) < 4 || len(parts)%2 != 0 {
+			return "ERR HSET requires an even number of arguments >= 4"
 		}
 		kv.mu.Lock()
 		defer kv.mu.Unlock()
-		if _, exists := kv.Hashes[parts[1]]; !exists {
-			kv.Hashes[parts[1]] = make(map[string]string)
+		key := parts[1]
+		kv.expireHashFields(key)
+		if _, exists := kv.Hashes[key]; !exists {
+			kv.Hashes[key] = NewHash()
 		}
-		kv.Hashes[parts[1]][parts[2]] = parts[3]
-		return "OK"
+		added := 0
+		for i := 2; i < len(parts); i += 2 {
+			if kv.Hashes[key].Set(parts[i], parts[i+1]) {
+				added++
+			}
+			kv.persistHashField(key, parts[i])
+		}
+		return fmt.Sprintf("(integer) %d", added)
+	case "HSETNX":
+		return kv.HSetNXCommand(parts)
+	case "HEXISTS":
+		return kv.HExistsCommand(parts)
+	case "HLEN":
+		return kv.HLenCommand(parts)
+	case "HKEYS":
+		return kv.HKeysCommand(parts)
+	case "HVALS":
+		return kv.HValsCommand(parts)
+	case "HSTRLEN":
+		return kv.HStrLenCommand(parts)
+	case "HINCRBY":
+		return kv.HIncrByCommand(parts)
+	case "HINCRBYFLOAT":
+		return kv.HIncrByFloatCommand(parts)
+	case "HRANDFIELD":
+		return kv.HRandFieldCommand(parts)
+	case "HSCAN":
+		return kv.HScanCommand(parts)
+	case "HEXPIRE":
+		return kv.HExpireCommand(parts, time.Second, false)
+	case "HPEXPIRE":
+		return kv.HExpireCommand(parts, time.Millisecond, false)
+	case "HEXPIREAT":
+		return kv.HExpireCommand(parts, time.Second, true)
+	case "HPEXPIREAT":
+		return kv.HExpireCommand(parts, time.Millisecond, true)
+	case "HTTL":
+		return kv.HTTLCommand(parts, time.Second, false)
+	case "HPTTL":
+		return kv.HTTLCommand(parts, time.Millisecond, false)
+	case "HEXPIRETIME":
+		return kv.HTTLCommand(parts, time.Second, true)
+	case "HPEXPIRETIME":
+		return kv.HTTLCommand(parts, time.Millisecond, true)
+	case "HPERSIST":
+		return kv.HPersistCommand(parts)
+	case "HGETEX":
+		return kv.HGetExCommand(parts)
+	case "HSETEX":
+		return kv.HSetExCommand(parts)
+	case "HGETDEL":
+		return kv.HGetDelCommand(parts)
 	case "HGET":
 		if len(parts) != 3 {
 			return "ERROR: HGET requires 2 arguments"
 		}
 		kv.mu.RLock()
 		defer kv.mu.RUnlock()
-		if hashSet, exists := kv.Hashes[parts[1]]; exists {
-			if value, exists := hashSet[parts[2]]; exists {
+		if hashSet := kv.liveHash(parts[1]); hashSet != nil {
+			if value, exists := hashSet.Get(parts[2]); exists {
 				return value
 			}
 			return "(nil)"
@@ -258,11 +335,13 @@ func (kv *KeyValueStore) executeCommand(parts []string) string {
 		kv.mu.Lock()
 		defer kv.mu.Unlock()
 		key := parts[1]
+		kv.expireHashFields(key)
 		if _, exists := kv.Hashes[key]; !exists {
-			kv.Hashes[key] = make(map[string]string)
+			kv.Hashes[key] = NewHash()
 		}
 		for i := 2; i < len(parts); i += 2 {
-			kv.Hashes[key][parts[i]] = parts[i+1]
+			kv.Hashes[key].Set(parts[i], parts[i+1])
+			kv.persistHashField(key, parts[i])
 		}
 		return "OK"
 	case "HMGET":
@@ -272,10 +351,10 @@ func (kv *KeyValueStore) executeCommand(parts []string) string {
 		kv.mu.RLock()
 		defer kv.mu.RUnlock()
 		key := parts[1]
-		if hash, exists := kv.Hashes[key]; exists {
+		if hash := kv.liveHash(key); hash != nil {
 			result := make([]string, 0)
 			for i := 2; i < len(parts); i++ {
-				if value, ok := hash[parts[i]]; ok {
+				if value, ok := hash.Get(parts[i]); ok {
 					result = append(result, value)
 				} else {
 					result = append(result, "(nil)")
@@ -288,35 +367,33 @@ func (kv *KeyValueStore) executeCommand(parts []string) string {
 		if len(parts) != 2 {
 			return "ERR HGETALL requires 1 argument"
 		}
-		kv.mu.Lock()
-		defer kv.mu.Unlock()
+		kv.mu.RLock()
+		defer kv.mu.RUnlock()
 		key := parts[1]
-		if hash, exists := kv.Hashes[key]; exists {
-			result := make([]string, 0, len(hash)*2)
-			for field, value := range hash {
+		if hash := kv.liveHash(key); hash != nil {
+			result := make([]string, 0, hash.Len()*2)
+			hash.Range(func(field, value string) bool {
 				result = append(result, field, value)
-			}
-			return strings.Join(result, " ")
+				return true
+			})
+			return multiBulkReply(result)
 		}
-		return "(empty hash)"
+		return multiBulkReply(nil)
 	case "HDEL":
-		if len(parts) < 2 {
-			return "ERR HDEL requires at least 1 argument"
+		if len(parts) < 3 {
+			return "ERR HDEL requires at least 2 arguments"
 		}
 		kv.mu.Lock()
 		defer kv.mu.Unlock()
 		key := parts[1]
-		if hash, exists := kv.Hashes[key]; exists {
-			count := 0
-			for i := 2; i < len(parts); i++ {
-				if _, ok := hash[parts[i]]; ok {
-					delete(hash, parts[i])
-					count++
-				}
+		kv.expireHashFields(key)
+		count := 0
+		for i := 2; i < len(parts); i++ {
+			if kv.deleteHashField(key, parts[i]) {
+				count++
 			}
-			return fmt.Sprintf("(integer) %d", count)
 		}
-		return "(integer) 0"
+		return fmt.Sprintf("(integer) %d", count)
 	case "SET":
 		kv.mu.Lock()
 		defer kv.mu.Unlock()
@@ -351,88 +428,60 @@ func (kv *KeyValueStore) executeCommand(parts []string) string {
 		}
 		return "OK"
 	case "DEL":
-		if len(parts) < 2 {
-			return "ERROR: DEL requires at least 1 argument"
-		}
-		kv.mu.Lock()
-		defer kv.mu.Unlock()
-		count := 0
-		for _, key := range parts[1:] {
-			if _, exists := kv.Strings[key]; exists {
-				delete(kv.Strings, key)
-				count++
-			}
-			// Also, attempt to delete from other data structures
-			if _, exists := kv.Lists[key]; exists {
-				delete(kv.Lists, key)
-				count++
-			}
-			if _, exists := kv.Hashes[key]; exists {
-				delete(kv.Hashes, key)
-				count++
-			}
-		}
-		return fmt.Sprintf("(integer) %d", count)
+		return kv.DelCommand(parts)
 	case "EXISTS":
-		if len(parts) != 2 {
-			return "ERROR: EXISTS requires 1 argument"
-		}
-		kv.mu.RLock()
-		defer kv.mu.RUnlock()
-		key := parts[1]
-		_, existsInStrings := kv.Strings[key]
-		_, existsInLists := kv.Lists[key]
-		_, existsInHashes := kv.Hashes[key]
-		exists := existsInStrings || existsInLists || existsInHashes
-		if exists {
-			return "(integer) 1"
-		}
-		return "(integer) 0"
+		return kv.ExistsCommand(parts)
 	case "KEYS":
-		if len(parts) != 2 {
-			return "ERROR: KEYS requires 1 argument"
-		}
-		kv.mu.RLock()
-		defer kv.mu.RUnlock()
-		pattern := parts[1]
-		matchedKeys := ""
-		for key := range kv.Strings {
-			if strings.Contains(key, pattern) {
-				matchedKeys += key + " "
-			}
-		}
-		// Optionally, search in other data structures
-		return strings.TrimSpace(matchedKeys)
+		return kv.KeysCommand(parts)
+	case "SCAN":
+		return kv.ScanCommand(parts)
+	case "TYPE":
+		return kv.TypeCommand(parts)
+	case "RENAME":
+		return kv.RenameCommand(parts, false)
+	case "RENAMENX":
+		return kv.RenameCommand(parts, true)
+	case "COPY":
+		return kv.CopyCommand(parts)
+	case "RANDOMKEY":
+		return kv.RandomKeyCommand(parts)
+	case "DBSIZE":
+		return kv.DBSizeCommand(parts)
+	case "UNLINK":
+		return kv.DelCommand(parts)
+	case "TOUCH":
+		return kv.ExistsCommand(parts)
+	case "OBJECT":
+		return kv.ObjectCommand(parts)
+	case "MEMORY":
+		return kv.MemoryCommand(parts)
+	case "DUMP":
+		return kv.DumpCommand(parts)
+	case "RESTORE":
+		return kv.RestoreCommand(parts)
+	case "MIGRATE":
+		return kv.MigrateCommand(parts)
+	case "EXPORT":
+		return kv.ExportCommand(parts)
+	case "IMPORT":
+		return kv.ImportCommand(parts)
 	case "EXPIRE":
-		if len(parts) != 3 {
-			return "ERROR: EXPIRE requires 2 arguments"
-		}
-		kv.mu.RLock()
-		defer kv.mu.RUnlock()
-		key := parts[1]
-		seconds, err := strconv.Atoi(parts[2])
-		if err != nil {
-			return "ERROR: Invalid TTL value"
-		}
-		expirationTime := time.Now().Add(time.Duration(seconds) * time.Second)
-		kv.Expirations[key] = expirationTime
-		return "OK"
+		return kv.ExpireCommand(parts)
+	case "PEXPIREAT":
+		return kv.PExpireAtCommand(parts)
 	case "TTL":
 		if len(parts) != 2 {
 			return "ERROR: TTL requires 1 argument"
 		}
-		kv.mu.RLock()
-		defer kv.mu.RUnlock()
+		kv.mu.Lock()
+		defer kv.mu.Unlock()
 		key := parts[1]
+		if kv.expireIfNeeded(key) {
+			return "(integer) -2" // Indicate the key does not exist (expired)
+		}
 		if expiration, exists := kv.Expirations[key]; exists {
-			if time.Now().Before(expiration) {
-				ttl := time.Until(expiration).Seconds()
-				return fmt.Sprintf("(integer) %d", int(ttl))
-			}
-			// Key expired, clean up
-			delete(kv.Expirations, key)
-			delete(kv.Strings, key) // Also consider cleaning up from other data structures
-			return "(integer) -2"   // Indicate the key does not exist (expired)
+			ttl := time.Until(expiration).Seconds()
+			return fmt.Sprintf("(integer) %d", int(ttl))
 		}
 		return "(integer) -1"
 	case "SADD":
@@ -443,12 +492,11 @@ func (kv *KeyValueStore) executeCommand(parts []string) string {
 		defer kv.mu.Unlock()
 		key := parts[1]
 		if _, exists := kv.Sets[key]; !exists {
-			kv.Sets[key] = make(map[string]struct{})
+			kv.Sets[key] = NewSet()
 		}
 		count := 0
 		for i := 2; i < len(parts); i++ {
-			if _, ok := kv.Sets[key][parts[i]]; !ok {
-				kv.Sets[key][parts[i]] = struct{}{}
+			if kv.Sets[key].Add(parts[i]) {
 				count++
 			}
 		}
@@ -461,10 +509,7 @@ func (kv *KeyValueStore) executeCommand(parts []string) string {
 		defer kv.mu.Unlock()
 		key := parts[1]
 		if set, exists := kv.Sets[key]; exists {
-			members := make([]string, 0, len(set))
-			for member := range set {
-				members = append(members, member)
-			}
+			members := set.Members()
 			sort.Strings(members) // Sort the slice
 			return strings.Join(members, " ")
 		}
@@ -478,7 +523,7 @@ func (kv *KeyValueStore) executeCommand(parts []string) string {
 		key := parts[1]
 		member := parts[2]
 		if set, exists := kv.Sets[key]; exists {
-			if _, ok := set[member]; ok {
+			if set.Contains(member) {
 				return "(integer) 1"
 			}
 		}
@@ -493,81 +538,128 @@ func (kv *KeyValueStore) executeCommand(parts []string) string {
 		if set, exists := kv.Sets[key]; exists {
 			count := 0
 			for i := 2; i < len(parts); i++ {
-				if _, ok := set[parts[i]]; ok {
-					delete(set, parts[i])
+				if set.Remove(parts[i]) {
 					count++
 				}
 			}
+			if set.Len() == 0 {
+				kv.deleteKey(key)
+			}
 			return fmt.Sprintf("(integer) %d", count)
 		}
 		return "(integer) 0"
+	case "SCARD":
+		return kv.SCardCommand(parts)
+	case "SUNION":
+		return kv.SetAlgebraCommand(parts, setUnion)
+	case "SINTER":
+		return kv.SetAlgebraCommand(parts, setInter)
+	case "SDIFF":
+		return kv.SetAlgebraCommand(parts, setDiff)
+	case "SUNIONSTORE":
+		return kv.SetAlgebraStoreCommand(parts, setUnion)
+	case "SINTERSTORE":
+		return kv.SetAlgebraStoreCommand(parts, setInter)
+	case "SDIFFSTORE":
+		return kv.SetAlgebraStoreCommand(parts, setDiff)
+	case "SINTERCARD":
+		return kv.SInterCardCommand(parts)
+	case "SMISMEMBER":
+		return kv.SMIsMemberCommand(parts)
+	case "SMOVE":
+		return kv.SMoveCommand(parts)
+	case "SPOP":
+		return kv.SPopCommand(parts)
+	case "SRANDMEMBER":
+		return kv.SRandMemberCommand(parts)
+	case "SSCAN":
+		return kv.SScanCommand(parts)
 	case "ZADD":
-		kv.mu.Lock()
-		defer kv.mu.Unlock()
-		key := parts[1]
-		if len(parts[2:])%2 != 0 {
-			return "ERR ZADD requires an even number of arguments"
-		}
-		newElements := 0
-		for i := 2; i < len(parts); i += 2 {
-			score, err := strconv.Atoi(parts[i])
-			if err != nil {
-				return "ERR ZADD invalid score"
-			}
-			member := parts[i+1]
-			exists := false
-			for _, existingMember := range kv.SortedSets[key] {
-				if existingMember.Member == member {
-					existingMember.score = float64(score)
-					exists = true
-					break
-				}
-			}
-			if !exists {
-				kv.SortedSets[key] = append(kv.SortedSets[key], sortedSetMember{member, float64(score)}) // Convert score to float64
-				newElements++
-			}
-		}
-		return fmt.Sprintf("(integer) %d", newElements)
+		return kv.ZAddCommand(parts)
+	case "ZINCRBY":
+		return kv.ZIncrByCommand(parts)
+	case "ZSCORE":
+		return kv.ZScoreCommand(parts)
+	case "ZMSCORE":
+		return kv.ZMScoreCommand(parts)
+	case "ZCARD":
+		return kv.ZCardCommand(parts)
+	case "ZCOUNT":
+		return kv.ZCountCommand(parts, false)
+	case "ZLEXCOUNT":
+		return kv.ZCountCommand(parts, true)
+	case "ZRANK":
+		return kv.ZRankCommand(parts, false)
+	case "ZREVRANK":
+		return kv.ZRankCommand(parts, true)
 	case "ZRANGE":
-		if len(parts) != 4 {
-			return "ERR ZRANGE requires 3 arguments"
-		}
-		kv.mu.Lock()
-		defer kv.mu.Unlock()
-		key := parts[1]
-		start, err := strconv.Atoi(parts[2])
-		if err != nil {
-			return "ERR ZRANGE invalid start index"
-		}
-		stop, err := strconv.Atoi(parts[3])
-		if err != nil {
-			return "ERR ZRANGE invalid stop index"
-		}
-
-		if sortedSet, exists := kv.SortedSets[key]; exists {
-			// Adjusting start and stop for negative values
-			if start < 0 {
-				start = len(sortedSet) + start
-			}
-			if stop < 0 {
-				stop = len(sortedSet) + stop
-			}
-			// Ensuring start and stop are within bounds
-			if start < 0 {
-				start = 0
-			}
-			if stop >= len(sortedSet) {
-				stop = len(sortedSet) - 1
-			}
-
-			result := make([]string, 0)
-			for i := start; i <= stop && i < len(sortedSet); i++ {
-				result = append(result, sortedSet[i].Member)
-			}
-			return strings.Join(result, " ")
-		}
-		return "(empty sorted set)"
+		return kv.ZRangeCommand(parts)
+	case "ZRANGESTORE":
+		return kv.ZRangeStoreCommand(parts)
+	case "ZREVRANGE":
+		return kv.ZLegacyRangeCommand(parts, false, false, true)
+	case "ZRANGEBYSCORE":
+		return kv.ZLegacyRangeCommand(parts, true, false, false)
+	case "ZREVRANGEBYSCORE":
+		return kv.ZLegacyRangeCommand(parts, true, false, true)
+	case "ZRANGEBYLEX":
+		return kv.ZLegacyRangeCommand(parts, false, true, false)
+	case "ZREVRANGEBYLEX":
+		return kv.ZLegacyRangeCommand(parts, false, true, true)
+	case "ZREMRANGEBYRANK":
+		return kv.ZRemRangeCommand(parts, false, false)
+	case "ZREMRANGEBYSCORE":
+		return kv.ZRemRangeCommand(parts, true, false)
+	case "ZREMRANGEBYLEX":
+		return kv.ZRemRangeCommand(parts, false, true)
+	case "ZPOPMIN":
+		return kv.ZPopCommand(parts, false)
+	case "ZPOPMAX":
+		return kv.ZPopCommand(parts, true)
+	case "BZPOPMIN":
+		return kv.BZPopCommand(parts, false)
+	case "BZPOPMAX":
+		return kv.BZPopCommand(parts, true)
+	case "ZMPOP":
+		return kv.ZMPopCommand(parts)
+	case "BZMPOP":
+		return kv.BZMPopCommand(parts)
+	case "ZUNION":
+		return kv.ZSetAlgebraCommand(parts, zsetUnion)
+	case "ZINTER":
+		return kv.ZSetAlgebraCommand(parts, zsetInter)
+	case "ZDIFF":
+		return kv.ZSetAlgebraCommand(parts, zsetDiff)
+	case "ZUNIONSTORE":
+		return kv.ZSetAlgebraStoreCommand(parts, zsetUnion)
+	case "ZINTERSTORE":
+		return kv.ZSetAlgebraStoreCommand(parts, zsetInter)
+	case "ZDIFFSTORE":
+		return kv.ZSetAlgebraStoreCommand(parts, zsetDiff)
+	case "ZRANDMEMBER":
+		return kv.ZRandMemberCommand(parts)
+	case "ZSCAN":
+		return kv.ZScanCommand(parts)
+	case "GEOADD":
+		return kv.GeoAddCommand(parts)
+	case "GEOPOS":
+		return kv.GeoPosCommand(parts)
+	case "GEODIST":
+		return kv.GeoDistCommand(parts)
+	case "GEOHASH":
+		return kv.GeoHashCommand(parts)
+	case "GEOSEARCH":
+		return kv.GeoSearchCommand(parts)
+	case "GEOSEARCHSTORE":
+		return kv.GeoSearchStoreCommand(parts)
+	case "GEORADIUS":
+		return kv.GeoRadiusCommand(parts, false, false)
+	case "GEORADIUS_RO":
+		return kv.GeoRadiusCommand(parts, false, true)
+	case "GEORADIUSBYMEMBER":
+		return kv.GeoRadiusCommand(parts, true, false)
+	case "GEORADIUSBYMEMBER_RO":
+		return kv.GeoRadiusCommand(parts, true, true)
 	case "ZREM":
 		if len(parts) < 3 {
 			return "ERR ZREM requires at least 2 arguments"
@@ -577,19 +669,14 @@ func (kv *KeyValueStore) executeCommand(parts []string) string {
 		key := parts[1]
 		removed := 0
 		if sortedSet, exists := kv.SortedSets[key]; exists {
-			for i := 2; i < len(parts); i++ {
-				member := parts[i]
-				for j := 0; j < len(sortedSet); {
-					if sortedSet[j].Member == member {
-						// Remove by appending slices before and after the current index
-						sortedSet = append(sortedSet[:j], sortedSet[j+1:]...)
-						removed++
-						continue // Skip the increment step to stay at the same index
-					}
-					j++
+			for _, member := range parts[2:] {
+				if sortedSet.Remove(member) {
+					removed++
 				}
 			}
-			kv.SortedSets[key] = sortedSet // Important to assign the modified slice back
+			if sortedSet.Len() == 0 {
+				kv.deleteKey(key)
+			}
 			return fmt.Sprintf("(integer) %d", removed)
 		}
 		return "(integer) 0"
@@ -651,18 +738,17 @@ func (kv *KeyValueStore) executeCommand(parts []string) string {
 
 		return "OK"
 	case "SAVE":
-		kv.mu.Lock()
-		defer kv.mu.Unlock()
-		err := persistence.saveData()
-		if err != nil {
-			return "ERR " + err.Error()
-		}
-		return "OK"
+		return persistence.SaveCommand()
+	case "LASTSAVE":
+		return persistence.LastSaveCommand()
+	case "BGREWRITEAOF":
+		return BgRewriteAOFCommand()
+	case "REPLICAOF", "SLAVEOF":
+		return ReplicaOfCommand(parts)
+	case "ROLE":
+		return RoleCommand()
 	case "BGSAVE":
-		kv.mu.Lock()
-		defer kv.mu.Unlock()
-		persistence.shouldSave = true
-		return "Background saving started"
+		return persistence.BgSaveCommand(parts)
 	case "INCR":
 		if len(parts) != 2 {
 			return "ERR INCR requires 1 argument"
@@ -775,30 +861,81 @@ func (kv *KeyValueStore) executeCommand(parts []string) string {
 		}
 		return strings.Join(result, " ")
 	case "FLUSHALL":
-		kv.mu.Lock()
-		defer kv.mu.Unlock()
-		kv.Strings = make(map[string]string)
-		kv.Lists = make(map[string][]string)
-		kv.Hashes = make(map[string]map[string]string)
-		kv.Sets = make(map[string]map[string]struct{})
-		kv.SortedSets = make(map[string][]sortedSetMember)
-		kv.Expirations = make(map[string]time.Time)
-		kv.CurrentTx = nil
-		return "OK"
+		return kv.FlushAllCommand(parts)
+	case "FLUSHDB":
+		return kv.FlushDBCommand(parts)
+	case "SWAPDB":
+		return kv.SwapDBCommand(parts)
+	case "MOVE":
+		return kv.MoveCommand(parts)
 	default:
 		return "ERR unknown command"
 	}
 }
 
-func handleConnection(conn net.Conn, kv *KeyValueStore) {
+// authCommand implements AUTH [username] password for a connection whose
+// current state is authenticated, returning the reply and the new state.
+func authCommand(command *redisproto.Command, authenticated bool) (string, bool) {
+	var username, password string
+	switch command.ArgCount() {
+	case 2:
+		username, password = "default", string(command.Get(1))
+	case 3:
+		username, password = string(command.Get(1)), string(command.Get(2))
+	default:
+		return "ERR AUTH requires 1 or 2 arguments", authenticated
+	}
+	if requirePass == "" {
+		return "ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?", authenticated
+	}
+	if username != "default" || password != requirePass {
+		return "WRONGPASS invalid username-password pair or user is disabled.", authenticated
+	}
+	return "OK", true
+}
+
+// Like Redis, clients that have yet to AUTH may only send small commands, so
+// they can't make the server buffer large requests.
+const (
+	unauthenticatedMaxNumArg   = 10
+	unauthenticatedMaxBulkSize = 16 * 1024
+)
+
+// limitParser sets how large the commands parser reads for a client may be.
+func limitParser(parser *redisproto.Parser, authenticated bool) {
+	if authenticated {
+		parser.SetLimits(redisproto.MaxNumArg, redisproto.MaxBulkSize)
+	} else {
+		parser.SetLimits(unauthenticatedMaxNumArg, unauthenticatedMaxBulkSize)
+	}
+}
+
+// commandParts returns the arguments of command as strings.
+func commandParts(command *redisproto.Command) []string {
+	parts := make([]string, command.ArgCount())
+	for i := range parts {
+		parts[i] = string(command.Get(i))
+	}
+	return parts
+}
+
+func handleConnection(conn net.Conn) {
 	defer conn.Close()
 
-	kv.mu.Lock()
-	kv.connectedClients[conn.RemoteAddr().String()] = conn
-	kv.mu.Unlock()
+	connectedClients.Add(1)
+	defer connectedClients.Add(-1)
 
 	parser := redisproto.NewParser(conn)
 	writer := redisproto.NewWriter(bufio.NewWriter(conn))
+	authenticated := requirePass == ""
+	limitParser(parser, authenticated)
+	db := 0
+	// listeningPort is the port a replica said it listens on
+	listeningPort := 0
+	// lastWrite is the replication offset after the last write, for WAIT
+	lastWrite := int64(0)
+	// asking is set by ASKING for the next command only
+	asking := false
 
 	for {
 		command, err := parser.ReadCommand()
@@ -815,9 +952,45 @@ func handleConnection(conn net.Conn, kv *KeyValueStore) {
 				break
 			}
 		} else {
-			response := kv.CommandHandler(command)
+			var response string
+			wasAsking := asking
+			asking = false
+			if strings.EqualFold(string(command.Get(0)), "AUTH") {
+				response, authenticated = authCommand(command, authenticated)
+				limitParser(parser, authenticated)
+			} else if !authenticated {
+				response = "NOAUTH Authentication required."
+			} else if strings.EqualFold(string(command.Get(0)), "SELECT") {
+				response, db = selectCommand(commandParts(command), db)
+			} else if strings.EqualFold(string(command.Get(0)), "REPLCONF") {
+				response = replconfCommand(commandParts(command), &listeningPort)
+			} else if strings.EqualFold(string(command.Get(0)), "PSYNC") {
+				// The connection becomes the one of a replica
+				writer.Flush()
+				serveReplica(conn, parser, commandParts(command), listeningPort)
+				return
+			} else if strings.EqualFold(string(command.Get(0)), "WAIT") {
+				response = waitCommand(commandParts(command), lastWrite)
+			} else if strings.EqualFold(string(command.Get(0)), "WAITAOF") {
+				response = waitAOFCommand(commandParts(command), lastWrite)
+			} else if strings.EqualFold(string(command.Get(0)), "CLUSTER") {
+				response = ClusterCommand(commandParts(command))
+			} else if strings.EqualFold(string(command.Get(0)), "ASKING") {
+				response, asking = askingCommand(commandParts(command))
+			} else if reply := clusterRedirect(commandParts(command), wasAsking); reply != "" {
+				response = reply
+			} else if strings.EqualFold(string(command.Get(0)), "RAFT") {
+				response = RaftCommand(commandParts(command))
+			} else if reply, handled := raftClientCommand(db, commandParts(command)); handled {
+				response = reply
+			} else {
+				response = databases[db].CommandHandler(command)
+				if name := strings.ToUpper(string(command.Get(0))); name == "EXEC" || commandTable[name].flags&flagWrite != 0 {
+					lastWrite = replication.currentOffset()
+				}
+			}
 			if response != "" {
-				ew := writer.WriteBulkString(response)
+				ew := writeReply(writer, response)
 				if ew != nil {
 					fmt.Println("Error writing response:", ew)
 					break
@@ -833,23 +1006,190 @@ func handleConnection(conn net.Conn, kv *KeyValueStore) {
 
 func main() {
 	dataFile := flag.String("dataFile", "data.gob", "Path where the 'data.gob'-file is located/created")
+	port := flag.Int("port", 6379, "Port to listen on")
+	flag.StringVar(&requirePass, "requirepass", "", "Password clients must AUTH with")
+	numDatabases := flag.Int("databases", defaultDatabases, "Number of logical databases")
+	maxMemoryFlag := flag.String("maxmemory", "0", "Memory limit for the dataset, like 100mb or 2gb, 0 for none")
+	policyFlag := flag.String("maxmemory-policy", "noeviction", "Which keys to evict when maxmemory is reached")
+	flag.IntVar(&maxMemorySamples, "maxmemory-samples", maxMemorySamples, "Keys sampled per database to pick one to evict")
+	flag.IntVar(&hashMaxListpackEntries, "hash-max-listpack-entries", hashMaxListpackEntries, "Fields a hash can have before it stops being a listpack")
+	flag.IntVar(&hashMaxListpackValue, "hash-max-listpack-value", hashMaxListpackValue, "Longest field or value, in bytes, a listpack hash can hold")
+	flag.IntVar(&listMaxListpackSize, "list-max-listpack-size", listMaxListpackSize, "Elements a listpack list can hold, or -1 to -5 for a 4KB to 64KB size limit")
+	flag.IntVar(&setMaxIntsetEntries, "set-max-intset-entries", setMaxIntsetEntries, "Members an integer-only set can have before it stops being an intset")
+	flag.IntVar(&setMaxListpackEntries, "set-max-listpack-entries", setMaxListpackEntries, "Members a set can have before it stops being a listpack")
+	flag.IntVar(&setMaxListpackValue, "set-max-listpack-value", setMaxListpackValue, "Longest member, in bytes, a listpack set can hold")
+	flag.IntVar(&zsetMaxListpackEntries, "zset-max-listpack-entries", zsetMaxListpackEntries, "Members a sorted set can have before it stops being a listpack")
+	flag.IntVar(&zsetMaxListpackValue, "zset-max-listpack-value", zsetMaxListpackValue, "Longest member, in bytes, a listpack sorted set can hold")
+	flag.BoolVar(&loadCorruptedData, "load-corrupted-data", loadCorruptedData, "Start empty when the data file is corrupted, instead of refusing to start")
+	saveFlag := flag.String("save", "3600 1 300 100 60 10000", "Save points as pairs of seconds and changes, empty to only save on SAVE and BGSAVE")
+	appendOnlyFlag := flag.Bool("appendonly", false, "Log every write command to the append only file, which is loaded instead of the data file")
+	appendFilename := flag.String("appendfilename", "appendonly.aof", "Path of the append only file")
+	fsyncFlag := flag.String("appendfsync", "everysec", "When to fsync the append only file: always, everysec or no")
+	flag.BoolVar(&aofLoadTruncated, "aof-load-truncated", aofLoadTruncated, "Load an append only file that ends in the middle of a command by truncating it")
+	replicaOfFlag := flag.String("replicaof", "", "Host and port of a master to replicate, like \"127.0.0.1 6379\"")
+	flag.StringVar(&masterAuth, "masterauth", "", "Password to AUTH with on the master")
+	backlogFlag := flag.String("repl-backlog-size", "1mb", "How much of the replication stream is kept for replicas to partially resync with")
+	sentinelFlag := flag.Bool("sentinel", false, "Run as a sentinel that monitors masters and fails them over, instead of serving data")
+	var sentinelMonitors stringListFlag
+	flag.Var(&sentinelMonitors, "sentinel-monitor", "Master for a sentinel to monitor, like \"mymaster 127.0.0.1 6379 2\" for a name, host, port and quorum; can be repeated")
+	sentinelPeers := flag.String("sentinel-peers", "", "Addresses of other sentinels, like \"127.0.0.1:26380 127.0.0.1:26381\"")
+	announceIP := flag.String("sentinel-announce-ip", "", "IP other sentinels reach this one at, by default the one they see it connect from")
+	downAfter := flag.Int("down-after-milliseconds", 30000, "How long an instance may not reply before a sentinel considers it down")
+	failoverTimeout := flag.Int("failover-timeout", 180000, "How long a sentinel waits for a failover step, in milliseconds, and twice that before trying again")
+	raftID := flag.String("raft-id", "", "Id of this node in a raft cluster, which enables raft mode")
+	raftCluster := flag.String("raft-cluster", "", "Members a raft cluster starts with, like \"a=127.0.0.1:7000 b=127.0.0.1:7001 c=127.0.0.1:7002\"")
+	raftDir := flag.String("raft-dir", "raft", "Directory where a raft node keeps its log and snapshot")
+	raftElectionTimeout := flag.Int("raft-election-timeout", 1000, "How long a raft node waits to hear from the leader before starting an election, in milliseconds")
+	raftSnapshotEntries := flag.Int64("raft-snapshot-entries", 10000, "How many applied entries the raft log may hold before it is compacted into a snapshot")
+	clusterEnabled := flag.Bool("cluster-enabled", false, "Run as a node of a cluster that shards the keys over hash slots")
+	clusterConfigFile := flag.String("cluster-config-file", "nodes.conf", "Where a cluster node keeps its view of the cluster")
+	clusterNodeTimeout := flag.Int("cluster-node-timeout", 15000, "How long a cluster node may not answer pings before it is considered failing, in milliseconds")
+	clusterPort := flag.Int("cluster-port", 0, "Port of the cluster bus, by default the port + 10000")
+	clusterAnnounceIP := flag.String("cluster-announce-ip", "", "IP other nodes and clients reach this node at, by default the one the first node to meet it used")
 	flag.Parse()
 
-	listener, err := net.Listen("tcp", ":6379")
-	kv := NewKeyValueStore()
+	if *sentinelFlag {
+		portGiven := false
+		flag.Visit(func(f *flag.Flag) { portGiven = portGiven || f.Name == "port" })
+		if !portGiven {
+			*port = defaultSentinelPort
+		}
+		if *downAfter < 1 || *failoverTimeout < 1 {
+			fmt.Println("down-after-milliseconds and failover-timeout must be at least 1")
+			return
+		}
+		runSentinel(*port, sentinelMonitors, *sentinelPeers, *announceIP,
+			time.Duration(*downAfter)*time.Millisecond, time.Duration(*failoverTimeout)*time.Millisecond)
+		return
+	}
+
+	if *numDatabases < 1 {
+		fmt.Println("databases must be at least 1")
+		return
+	}
+	var ok bool
+	if maxMemory, ok = parseMemorySize(*maxMemoryFlag); !ok {
+		fmt.Println("Invalid maxmemory:", *maxMemoryFlag)
+		return
+	}
+	if maxMemoryPolicy, ok = parseEvictionPolicy(*policyFlag); !ok {
+		fmt.Println("Invalid maxmemory-policy:", *policyFlag)
+		return
+	}
+	if maxMemorySamples < 1 {
+		fmt.Println("maxmemory-samples must be at least 1")
+		return
+	}
+	if listMaxListpackSize == 0 || listMaxListpackSize < -5 {
+		fmt.Println("list-max-listpack-size must be positive or between -1 and -5")
+		return
+	}
+	if savePoints, ok = parseSavePoints(*saveFlag); !ok {
+		fmt.Println("Invalid save points:", *saveFlag)
+		return
+	}
+	if appendFsync, ok = parseFsyncPolicy(*fsyncFlag); !ok {
+		fmt.Println("Invalid appendfsync:", *fsyncFlag)
+		return
+	}
+	if replBacklogSize, ok = parseMemorySize(*backlogFlag); !ok || replBacklogSize < 1 {
+		fmt.Println("Invalid repl-backlog-size:", *backlogFlag)
+		return
+	}
+	master := strings.Fields(*replicaOfFlag)
+	if *replicaOfFlag != "" && len(master) != 2 {
+		fmt.Println("Invalid replicaof, expected a host and a port:", *replicaOfFlag)
+		return
+	}
+	raftMembers, err := parseRaftMembers(*raftCluster)
+	if err != nil {
+		fmt.Println("Invalid raft-cluster:", err)
+		return
+	}
+	if *raftID != "" {
+		switch {
+		case *appendOnlyFlag || len(master) > 0:
+			fmt.Println("raft mode can't be combined with appendonly or replicaof")
+			return
+		case maxMemory > 0 && maxMemoryPolicy != policyNoEviction:
+			fmt.Println("raft mode only takes maxmemory with the noeviction policy, as evictions would differ between nodes")
+			return
+		case *raftElectionTimeout < 1 || *raftSnapshotEntries < 1:
+			fmt.Println("raft-election-timeout and raft-snapshot-entries must be at least 1")
+			return
+		}
+	}
+	if *clusterEnabled {
+		switch {
+		case *raftID != "" || len(master) > 0:
+			fmt.Println("cluster mode can't be combined with raft mode or replicaof")
+			return
+		case *clusterNodeTimeout < 1:
+			fmt.Println("cluster-node-timeout must be at least 1")
+			return
+		}
+		if *clusterPort == 0 {
+			*clusterPort = *port + clusterBusPortOffset
+		}
+	}
+	serverPort = *port
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
+	databases = newDatabases(*numDatabases)
 
 	if err != nil {
 		fmt.Println("Error listening:", err.Error())
 		return
 	}
 	defer listener.Close()
-	fmt.Println("Listening on :6379")
+	fmt.Printf("Listening on :%d\n", *port)
 
-	persistence = NewPersistence(kv, *dataFile)
-
-	kv = persistence.kv
+	if *raftID != "" {
+		// The raft log and snapshot take the place of the data file
+		persistence = newPersistence(databases, *dataFile)
+		if raft, err = newRaftNode(*raftID, databases, *raftDir, raftMembers,
+			time.Duration(*raftElectionTimeout)*time.Millisecond, *raftSnapshotEntries); err != nil {
+			fmt.Println("Error loading raft data:", err)
+			return
+		}
+	} else if *appendOnlyFlag {
+		persistence = newPersistence(databases, *dataFile)
+		if err := startAppendOnly(*appendFilename, persistence); err != nil {
+			fmt.Println("Error loading data:", err)
+			return
+		}
+	} else if persistence, err = NewPersistence(databases, *dataFile); err != nil {
+		fmt.Println("Error loading data:", err)
+		return
+	}
 
-	go persistence.backgroundSave()
+	if raft == nil {
+		go persistence.backgroundSave()
+	}
+	if *clusterEnabled {
+		if cluster, err = newClusterState(databases[0], *clusterAnnounceIP, *port, *clusterPort,
+			time.Duration(*clusterNodeTimeout)*time.Millisecond, *clusterConfigFile); err != nil {
+			fmt.Println("Error loading the cluster config:", err)
+			return
+		}
+		bus, err := net.Listen("tcp", fmt.Sprintf(":%d", *clusterPort))
+		if err != nil {
+			fmt.Println("Error listening on the cluster bus:", err.Error())
+			return
+		}
+		defer bus.Close()
+		go cluster.serveBus(bus)
+		go cluster.run()
+	}
+	go replication.pingReplicas()
+	if len(master) == 2 {
+		if reply := ReplicaOfCommand(append([]string{"REPLICAOF"}, master...)); reply != "OK" {
+			fmt.Println("Invalid replicaof:", reply)
+			return
+		}
+	}
+	for _, kv := range databases {
+		go kv.activeExpireHashFields()
+	}
 
 	for {
 		conn, err := listener.Accept()
@@ -857,6 +1197,6 @@ func main() {
 			fmt.Println("Error accepting: ", err.Error())
 			return
 		}
-		go handleConnection(conn, kv)
+		go handleConnection(conn)
 	}
 }
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnauthenticatedClientsSendSmallCommands(t *testing.T) {
+	requirePass, databases = "secret", newDatabases(1)
+	t.Cleanup(func() { requirePass, databases = "", nil })
+	addr := listenTest(t, handleConnection).Addr().String()
+	large := strings.Repeat("x", unauthenticatedMaxBulkSize+1)
+
+	client, err := dialRedis(addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Expected to connect, Got: %v", err)
+	}
+	defer client.Close()
+	if _, err := client.Do("SET", "k", large); err == nil {
+		t.Fatal("Expected the connection to be closed over a large command before AUTH")
+	}
+
+	client, err = dialRedis(addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Expected to connect, Got: %v", err)
+	}
+	defer client.Close()
+	if reply, err := client.Do("AUTH", "secret"); reply != "OK" {
+		t.Fatalf("Expected AUTH to succeed, Got: %q, %v", reply, err)
+	}
+	if reply, err := client.Do("SET", "k", large); reply != "OK" {
+		t.Fatalf("Expected a large command once authenticated, Got: %q, %v", reply, err)
+	}
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Go does not say how much memory a value holds, so it is estimated from the
+// layout of the maps, slices and strings behind each type on a 64-bit
+// platform. Like MEMORY USAGE in Redis, collections are measured on a few
+// elements and the result is scaled to their size.
+
+const (
+	pointerSize      = 8
+	stringHeaderSize = 16
+	sliceHeaderSize  = 24
+	timeSize         = 24
+	mapHeaderSize    = 48
+	// skiplistNodeSize covers member, score, backward and the level slice
+	// header, the levels themselves average 1/(1-p) = 4/3 per node
+	skiplistNodeSize  = stringHeaderSize + 8 + pointerSize + sliceHeaderSize
+	skiplistLevelSize = pointerSize + 8
+
+	// memorySamples is the number of elements MEMORY USAGE looks at by default
+	memorySamples = 5
+)
+
+var (
+	peakAllocated    atomic.Int64
+	startupAllocated = readMemStats().HeapAlloc
+	peakUsedMemory   atomic.Int64
+)
+
+// readMemStats reads the runtime statistics and records the peak allocation.
+func readMemStats() runtime.MemStats {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	for {
+		peak := peakAllocated.Load()
+		if int64(stats.HeapAlloc) <= peak || peakAllocated.CompareAndSwap(peak, int64(stats.HeapAlloc)) {
+			return stats
+		}
+	}
+}
+
+// allocSize rounds n up to the size of the allocation holding it.
+func allocSize(n int) int64 {
+	if n == 0 {
+		return 0
+	}
+	if n <= 128 {
+		return int64((n + 7) &^ 7)
+	}
+	return int64((n + 15) &^ 15)
+}
+
+// mapEntrySize is the share of a map taken by one entry whose key and value
+// use slotSize bytes. Every slot also has a control byte, and tables are at
+// most 7/8 full.
+func mapEntrySize(slotSize int) int64 {
+	return int64((slotSize + 1) * 8 / 7)
+}
+
+// scaleSample extrapolates the size of n sampled elements to count elements.
+func scaleSample(size int64, n, count int) int64 {
+	if n == 0 {
+		return 0
+	}
+	return size * int64(count) / int64(n)
+}
+
+// keyOverhead estimates the bookkeeping of key: its entry in the map of its
+// type, its TTL and its access clocks. Every key is counted with clocks,
+// which it gets once first accessed, so that reads don't change the estimate
+// used for maxmemory. The caller must hold the lock.
+func (kv *KeyValueStore) keyOverhead(key string) int64 {
+	valueSlot := pointerSize
+	switch kv.keyType(key) {
+	case "string":
+		valueSlot = stringHeaderSize
+	case "list":
+		valueSlot = sliceHeaderSize
+	}
+	size := mapEntrySize(stringHeaderSize+valueSlot) + allocSize(len(key))
+	if _, exists := kv.Expirations[key]; exists {
+		size += mapEntrySize(stringHeaderSize + timeSize)
+	}
+	return size + mapEntrySize(stringHeaderSize+pointerSize) + allocSize(2*timeSize+1)
+}
+
+// valueSize estimates the bytes held by the value at key, looking at up to
+// samples elements of a collection, or all of them when samples is 0. The
+// caller must hold the lock.
+func (kv *KeyValueStore) valueSize(key string, samples int) int64 {
+	switch kv.keyType(key) {
+	case "string":
+		return allocSize(len(kv.Strings[key]))
+	case "list":
+		list := kv.Lists[key]
+		if list.lp != nil {
+			return allocSize(2*sliceHeaderSize) + allocSize(cap(list.lp))
+		}
+		n := len(list.items)
+		if samples > 0 && samples < n {
+			n = samples
+		}
+		var elements int64
+		for _, element := range list.items[:n] {
+			elements += allocSize(len(element))
+		}
+		return allocSize(2*sliceHeaderSize) + allocSize(cap(list.items)*stringHeaderSize) +
+			scaleSample(elements, n, len(list.items))
+	case "hash":
+		hash := kv.Hashes[key]
+		size := allocSize(sliceHeaderSize + pointerSize)
+		if hash.dict == nil {
+			size += allocSize(cap(hash.lp))
+		} else {
+			var elements int64
+			n := 0
+			for field, value := range hash.dict {
+				if n == samples && samples > 0 {
+					break
+				}
+				elements += mapEntrySize(2*stringHeaderSize) + allocSize(len(field)) + allocSize(len(value))
+				n++
+			}
+			size += mapHeaderSize + scaleSample(elements, n, len(hash.dict))
+		}
+		if ttls, exists := kv.HashFieldExpirations[key]; exists {
+			size += mapHeaderSize + int64(len(ttls))*mapEntrySize(stringHeaderSize+timeSize)
+		}
+		return size
+	case "set":
+		set := kv.Sets[key]
+		size := allocSize(2*sliceHeaderSize + 2*pointerSize)
+		switch set.enc {
+		case setEncodingIntset:
+			return size + allocSize(cap(set.ints)*8)
+		case setEncodingListpack:
+			return size + allocSize(cap(set.lp))
+		}
+		var elements int64
+		n := 0
+		for member := range set.dict {
+			if n == samples && samples > 0 {
+				break
+			}
+			elements += mapEntrySize(stringHeaderSize) + allocSize(len(member))
+			n++
+		}
+		return size + mapHeaderSize + scaleSample(elements, n, len(set.dict))
+	case "zset":
+		sortedSet := kv.SortedSets[key]
+		if sortedSet.zsl == nil {
+			return allocSize(sliceHeaderSize+2*pointerSize) + allocSize(cap(sortedSet.lp))
+		}
+		// The skiplist shares the member strings of the dict
+		node := allocSize(skiplistNodeSize) + skiplistLevelSize*4/3
+		var elements int64
+		n := 0
+		for member := range sortedSet.dict {
+			if n == samples && samples > 0 {
+				break
+			}
+			elements += mapEntrySize(stringHeaderSize+8) + allocSize(len(member)) + node
+			n++
+		}
+		header := allocSize(skiplistNodeSize) + allocSize(skiplistMaxLevel*skiplistLevelSize)
+		return allocSize(sliceHeaderSize+2*pointerSize) + mapHeaderSize + allocSize(2*pointerSize+16) + header +
+			scaleSample(elements, n, sortedSet.Len())
+	}
+	return 0
+}
+
+// memoryUsage estimates the bytes held by key and its value, see valueSize.
+func (kv *KeyValueStore) memoryUsage(key string, samples int) int64 {
+	return kv.keyOverhead(key) + kv.valueSize(key, samples)
+}
+
+// accountKeys updates the memory estimates, if computed, of keys that may
+// have changed. The caller must hold the write lock.
+func (kv *KeyValueStore) accountKeys(keys ...string) {
+	if kv.keySizes == nil {
+		return
+	}
+	for _, key := range keys {
+		size := int64(0)
+		if kv.keyStored(key) {
+			size = kv.memoryUsage(key, memorySamples)
+		}
+		kv.usedBytes += size - kv.keySizes[key]
+		if size == 0 {
+			delete(kv.keySizes, key)
+		} else {
+			kv.keySizes[key] = size
+		}
+	}
+}
+
+// datasetMemory returns the estimated bytes held by the keys of the
+// database, estimating every key the first time.
+func (kv *KeyValueStore) datasetMemory() int64 {
+	kv.mu.RLock()
+	if kv.keySizes != nil {
+		defer kv.mu.RUnlock()
+		return kv.usedBytes
+	}
+	kv.mu.RUnlock()
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.keySizes == nil {
+		kv.keySizes = make(map[string]int64)
+		kv.eachKey(func(key string) {
+			kv.accountKeys(key)
+		})
+	}
+	return kv.usedBytes
+}
+
+// usedMemory returns the estimated bytes held by the keys of every database,
+// which is what maxmemory limits. Unlike the heap size, it goes down as soon
+// as a key is deleted rather than at the next garbage collection, and it
+// matches what MEMORY USAGE reports. No database lock may be held by the
+// caller.
+func (kv *KeyValueStore) usedMemory() int64 {
+	used := int64(0)
+	for _, db := range kv.servedDatabases() {
+		used += db.datasetMemory()
+	}
+	for {
+		peak := peakUsedMemory.Load()
+		if used <= peak || peakUsedMemory.CompareAndSwap(peak, used) {
+			return used
+		}
+	}
+}
+
+// datasetStats adds up the estimates for every key of the database.
+type datasetStats struct {
+	keys, expires   int
+	overheadMain    int64
+	overheadExpires int64
+	datasetBytes    int64
+	prefixes        map[string]*prefixStats
+}
+
+type prefixStats struct {
+	keys  int
+	bytes int64
+}
+
+// keyPrefix groups keys by what comes before their first colon, the usual
+// way of namespacing keys.
+func keyPrefix(key string) string {
+	if i := strings.IndexByte(key, ':'); i >= 0 {
+		return key[:i+1] + "*"
+	}
+	return "(no prefix)"
+}
+
+func (kv *KeyValueStore) addDatasetStats(stats *datasetStats) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	kv.eachKey(func(key string) {
+		overhead := kv.keyOverhead(key)
+		value := kv.valueSize(key, memorySamples)
+		stats.keys++
+		if _, exists := kv.Expirations[key]; exists {
+			stats.expires++
+			stats.overheadExpires += mapEntrySize(stringHeaderSize + timeSize)
+			overhead -= mapEntrySize(stringHeaderSize + timeSize)
+		}
+		stats.overheadMain += overhead
+		stats.datasetBytes += value
+		if stats.prefixes != nil {
+			prefix := stats.prefixes[keyPrefix(key)]
+			if prefix == nil {
+				prefix = &prefixStats{}
+				stats.prefixes[keyPrefix(key)] = prefix
+			}
+			prefix.keys++
+			prefix.bytes += overhead + value
+		}
+	})
+}
+
+var memoryHelp = []string{
+	"MEMORY <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"DOCTOR",
+	"    Return memory problems reports.",
+	"MALLOC-STATS",
+	"    Return internal statistics report from the memory allocator.",
+	"STATS",
+	"    Return information about the memory usage of the server.",
+	"USAGE <key> [SAMPLES <count>]",
+	"    Return memory in bytes used by <key> and its value. Nested values are",
+	"    sampled up to <count> times (default: 5, 0 means sample all).",
+	"HELP",
+	"    Print this help.",
+}
+
+// MemoryCommand implements MEMORY USAGE|STATS|DOCTOR|MALLOC-STATS|HELP.
+func (kv *KeyValueStore) MemoryCommand(parts []string) string {
+	if len(parts) < 2 {
+		return "ERR MEMORY requires at least 1 argument"
+	}
+	subcommand := strings.ToUpper(parts[1])
+	if subcommand != "USAGE" && len(parts) != 2 {
+		return fmt.Sprintf("ERR unknown subcommand or wrong number of arguments for '%s'. Try MEMORY HELP.", parts[1])
+	}
+	switch subcommand {
+	case "USAGE":
+		return kv.memoryUsageCommand(parts)
+	case "STATS":
+		return kv.memoryStats()
+	case "DOCTOR":
+		return kv.memoryDoctor()
+	case "MALLOC-STATS":
+		return mallocStats()
+	case "HELP":
+		return strings.Join(memoryHelp, "\n")
+	}
+	return fmt.Sprintf("ERR unknown subcommand '%s'. Try MEMORY HELP.", parts[1])
+}
+
+// memoryUsageCommand implements MEMORY USAGE key [SAMPLES count].
+func (kv *KeyValueStore) memoryUsageCommand(parts []string) string {
+	if len(parts) != 3 && len(parts) != 5 {
+		return "ERR MEMORY USAGE requires 1 or 3 arguments"
+	}
+	samples := memorySamples
+	if len(parts) == 5 {
+		if strings.ToUpper(parts[3]) != "SAMPLES" {
+			return "ERR syntax error"
+		}
+		n, err := strconv.Atoi(parts[4])
+		if err != nil || n < 0 {
+			return "ERR value is not an integer or out of range"
+		}
+		samples = n
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	key := parts[2]
+	if !kv.keyExists(key) {
+		return "(nil)"
+	}
+	return fmt.Sprintf("(integer) %d", kv.memoryUsage(key, samples))
+}
+
+func (kv *KeyValueStore) memoryStats() string {
+	mem := readMemStats()
+	peak := peakAllocated.Load()
+	total := int64(mem.HeapAlloc)
+	reply := []string{
+		"peak.allocated", strconv.FormatInt(peak, 10),
+		"total.allocated", strconv.FormatInt(total, 10),
+		"startup.allocated", strconv.FormatUint(startupAllocated, 10),
+	}
+	var all datasetStats
+	for _, db := range kv.servedDatabases() {
+		var stats datasetStats
+		db.addDatasetStats(&stats)
+		if stats.keys == 0 {
+			continue
+		}
+		reply = append(reply, fmt.Sprintf("db.%d", db.index),
+			"overhead.hashtable.main", strconv.FormatInt(stats.overheadMain, 10),
+			"overhead.hashtable.expires", strconv.FormatInt(stats.overheadExpires, 10))
+		all.keys += stats.keys
+		all.overheadMain += stats.overheadMain
+		all.overheadExpires += stats.overheadExpires
+		all.datasetBytes += stats.datasetBytes
+	}
+	overhead := all.overheadMain + all.overheadExpires
+	bytesPerKey := int64(0)
+	if all.keys > 0 {
+		bytesPerKey = (overhead + all.datasetBytes) / int64(all.keys)
+	}
+	reply = append(reply,
+		"overhead.total", strconv.FormatInt(overhead, 10),
+		"keys.count", strconv.Itoa(all.keys),
+		"keys.bytes-per-key", strconv.FormatInt(bytesPerKey, 10),
+		"dataset.bytes", strconv.FormatInt(all.datasetBytes, 10),
+		"dataset.percentage", fmt.Sprintf("%.2f", percentage(all.datasetBytes, total)),
+		"peak.percentage", fmt.Sprintf("%.2f", percentage(total, peak)),
+		"allocator.allocated", strconv.FormatUint(mem.HeapAlloc, 10),
+		"allocator.active", strconv.FormatUint(mem.HeapInuse, 10),
+		"allocator.resident", strconv.FormatUint(mem.HeapSys-mem.HeapReleased, 10),
+		"allocator-fragmentation.ratio", fmt.Sprintf("%.2f", fragmentation(mem)),
+	)
+	return strings.Join(reply, " ")
+}
+
+func percentage(part, whole int64) float64 {
+	if whole == 0 {
+		return 0
+	}
+	return float64(part) * 100 / float64(whole)
+}
+
+// fragmentation is the ratio between the heap spans in use and the objects
+// in them.
+func fragmentation(mem runtime.MemStats) float64 {
+	if mem.HeapAlloc == 0 {
+		return 1
+	}
+	return float64(mem.HeapInuse) / float64(mem.HeapAlloc)
+}
+
+// memoryDoctor reports memory issues, followed by the key prefixes using the
+// most memory.
+func (kv *KeyValueStore) memoryDoctor() string {
+	mem := readMemStats()
+	all := datasetStats{prefixes: make(map[string]*prefixStats)}
+	for _, db := range kv.servedDatabases() {
+		db.addDatasetStats(&all)
+	}
+	if all.keys == 0 || mem.HeapAlloc < 5<<20 {
+		return "Hi Sam, this instance is empty or is using very little memory, my issues detector can't be used in these conditions. Please, leave for your mission on Earth and fill it with some data. The new Sam and I will be back to our programming as soon as I finished rebooting."
+	}
+
+	var issues []string
+	if peak := peakAllocated.Load(); float64(peak) > float64(mem.HeapAlloc)*1.5 {
+		issues = append(issues, fmt.Sprintf(" * Peak memory: In the past this instance used more than 150%% the memory that is currently using (%d bytes at peak). The allocator is normally not able to release memory after a peak, so you can expect to see a big fragmentation ratio, however this is actually harmless and is only due to the memory peak.", peak))
+	}
+	if ratio := fragmentation(mem); ratio > 1.4 {
+		issues = append(issues, fmt.Sprintf(" * High allocator fragmentation: This instance has an allocator fragmentation greater than 1.4 (%.2f). The heap will shrink as the garbage collector returns memory, and the ratio should improve after a while.", ratio))
+	}
+	if maxMemory > 0 && maxMemoryPolicy == policyNoEviction && float64(kv.usedMemory()) > float64(maxMemory)*0.9 {
+		issues = append(issues, " * Near maxmemory: The dataset is close to maxmemory and the policy is noeviction, so writes will soon be refused with OOM errors. Consider an eviction policy or a higher limit.")
+	}
+
+	var report strings.Builder
+	if len(issues) == 0 {
+		report.WriteString("Hi Sam, I can't find any memory issue in your instance. I can only account for what occurs on this base.\n")
+	} else {
+		report.WriteString("Sam, I detected a few issues in this Radish instance memory implants:\n\n")
+		for _, issue := range issues {
+			report.WriteString(issue + "\n\n")
+		}
+	}
+
+	type prefixUsage struct {
+		prefix string
+		*prefixStats
+	}
+	usage := make([]prefixUsage, 0, len(all.prefixes))
+	for prefix, stats := range all.prefixes {
+		usage = append(usage, prefixUsage{prefix, stats})
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].bytes != usage[j].bytes {
+			return usage[i].bytes > usage[j].bytes
+		}
+		return usage[i].prefix < usage[j].prefix
+	})
+	report.WriteString("\nKey prefixes using the most memory:\n")
+	for _, u := range usage[:min(len(usage), 10)] {
+		report.WriteString(fmt.Sprintf(" * %s: %d keys, %d bytes (%.2f%% of the dataset)\n",
+			u.prefix, u.keys, u.bytes, percentage(u.bytes, all.overheadMain+all.datasetBytes)))
+	}
+	return report.String()
+}
+
+// mallocStats reports the statistics of the Go allocator, where Redis would
+// show those of jemalloc.
+func mallocStats() string {
+	mem := readMemStats()
+	var stats strings.Builder
+	stats.WriteString("___ Begin Go runtime statistics ___\n")
+	for _, stat := range []struct {
+		name  string
+		value uint64
+	}{
+		{"heap_alloc", mem.HeapAlloc},
+		{"heap_inuse", mem.HeapInuse},
+		{"heap_idle", mem.HeapIdle},
+		{"heap_released", mem.HeapReleased},
+		{"heap_sys", mem.HeapSys},
+		{"heap_objects", mem.HeapObjects},
+		{"stack_inuse", mem.StackInuse},
+		{"sys", mem.Sys},
+		{"total_alloc", mem.TotalAlloc},
+		{"mallocs", mem.Mallocs},
+		{"frees", mem.Frees},
+		{"num_gc", uint64(mem.NumGC)},
+		{"next_gc", mem.NextGC},
+	} {
+		stats.WriteString(fmt.Sprintf("%s: %d\n", stat.name, stat.value))
+	}
+	stats.WriteString("___ End Go runtime statistics ___")
+	return stats.String()
+}
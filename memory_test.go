@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func memoryUsageOf(t *testing.T, kv *KeyValueStore, key string, samples string) int64 {
+	t.Helper()
+	var usage int64
+	reply := kv.executeCommand([]string{"MEMORY", "USAGE", key, "SAMPLES", samples})
+	if _, err := fmt.Sscanf(reply, "(integer) %d", &usage); err != nil {
+		t.Fatalf("Expected an integer for %s, Got: %q", key, reply)
+	}
+	return usage
+}
+
+func TestMemoryUsage(t *testing.T) {
+	kv := NewKeyValueStore()
+	kv.executeCommand([]string{"SET", "small", "x"})
+	kv.executeCommand([]string{"SET", "large", strings.Repeat("x", 10000)})
+	if small, large := memoryUsageOf(t, kv, "small", "5"), memoryUsageOf(t, kv, "large", "5"); large-small < 9900 {
+		t.Fatalf("Expected the large string to use about 10000 more bytes, Got: %d and %d", small, large)
+	}
+
+	for i := 0; i < 1000; i++ {
+		kv.executeCommand([]string{"HSET", "hash", fmt.Sprintf("field%03d", i), "value"})
+		kv.executeCommand([]string{"ZADD", "zset", fmt.Sprint(i), fmt.Sprintf("member%03d", i)})
+	}
+	for _, key := range []string{"hash", "zset"} {
+		// Every element has the same size, so sampling estimates them exactly
+		if sampled, full := memoryUsageOf(t, kv, key, "5"), memoryUsageOf(t, kv, key, "0"); sampled != full || full < 1000*16 {
+			t.Fatalf("Expected %s to use the same memory sampled or not, Got: %d and %d", key, sampled, full)
+		}
+	}
+
+	if got := kv.executeCommand([]string{"MEMORY", "USAGE", "missing"}); got != "(nil)" {
+		t.Fatalf("Expected (nil) for a missing key, Got: %q", got)
+	}
+	if got := kv.executeCommand([]string{"MEMORY", "DOCTOR"}); !strings.HasPrefix(got, "Hi Sam") {
+		t.Fatalf("Expected a report, Got: %q", got)
+	}
+	if got := kv.executeCommand([]string{"MEMORY", "STATS"}); !strings.Contains(got, "keys.count 4 ") {
+		t.Fatalf("Expected 4 keys in the stats, Got: %q", got)
+	}
+}
+
+func TestUsedMemoryFollowsKeyEstimates(t *testing.T) {
+	kv := NewKeyValueStore()
+	kv.executeCommand([]string{"SET", "s", "value"})
+	if used := kv.usedMemory(); used != memoryUsageOf(t, kv, "s", "5") {
+		t.Fatalf("Expected the used memory to be the estimate of s, Got: %d", used)
+	}
+
+	for i := 0; i < 200; i++ {
+		kv.executeCommand([]string{"RPUSH", "list", fmt.Sprintf("item%d", i)})
+		kv.executeCommand([]string{"HSET", "hash", fmt.Sprintf("field%d", i), "value"})
+	}
+	kv.executeCommand([]string{"HPEXPIRE", "hash", "1", "FIELDS", "1", "field0"})
+	kv.executeCommand([]string{"LPOP", "list", "50"})
+	time.Sleep(5 * time.Millisecond)
+	kv.executeCommand([]string{"HGET", "hash", "field0"})
+	kv.executeCommand([]string{"MOVE", "s", "1"})
+	expected := int64(0)
+	for _, key := range []string{"s", "list", "hash"} {
+		if kv.keyExists(key) {
+			expected += memoryUsageOf(t, kv, key, "5")
+		}
+	}
+	if used := kv.usedMemory(); used != expected {
+		t.Fatalf("Expected %d bytes to be used, Got: %d", expected, used)
+	}
+	if info := kv.executeCommand([]string{"INFO", "memory"}); !strings.Contains(info, fmt.Sprintf("used_memory:%d\r\n", expected)) {
+		t.Fatalf("Expected INFO to report %d bytes, Got: %q", expected, info)
+	}
+
+	kv.executeCommand([]string{"FLUSHDB"})
+	if used := kv.usedMemory(); used != 0 {
+		t.Fatalf("Expected an empty database to use no memory, Got: %d", used)
+	}
+}
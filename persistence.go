@@ -2,40 +2,176 @@ package main
 
 import (
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dhravya/radish/internal/datafile"
+	"github.com/dhravya/radish/internal/rdb"
 )
 
+// The dataset is saved to the data file by SAVE, by BGSAVE and, like in
+// Redis, whenever one of the save points is reached: a number of seconds
+// since the last save together with a number of changes since then. Every
+// write command counts as a change. Background saves are run one at a time
+// by backgroundSave, which sleeps until a BGSAVE comes in or the next check
+// of the save points is due.
+
+type savePoint struct {
+	seconds int
+	changes int64
+}
+
+// savePoints are the save rules, none means the dataset is only saved on
+// request.
+var savePoints = []savePoint{{3600, 1}, {300, 100}, {60, 10000}}
+
+// parseSavePoints parses save rules the way the Redis save directive takes
+// them, like "3600 1 300 100". An empty string disables saving.
+func parseSavePoints(s string) ([]savePoint, bool) {
+	fields := strings.Fields(s)
+	if len(fields)%2 != 0 {
+		return nil, false
+	}
+	points := make([]savePoint, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.Atoi(fields[i])
+		if err != nil || seconds < 1 {
+			return nil, false
+		}
+		changes, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil || changes < 0 {
+			return nil, false
+		}
+		points = append(points, savePoint{seconds, changes})
+	}
+	return points, true
+}
+
+// bgsaveRetryDelay is how long a failed background save keeps the save
+// points from triggering another one.
+const bgsaveRetryDelay = 5 * time.Second
+
+// changesSinceSave counts the write commands run since the last successful
+// save.
+var changesSinceSave atomic.Int64
+
 type Persistence struct {
-	kv         *KeyValueStore
-	dataFile   string
-	mu         sync.Mutex
-	shouldSave bool
+	databases []*KeyValueStore
+	dataFile  string
+	// mu is held while saving, so only one save runs at a time
+	mu sync.Mutex
+	// bgsaveRequests wakes up backgroundSave for a BGSAVE
+	bgsaveRequests chan struct{}
+	bgsaveRunning  atomic.Bool
+	// Unix times in seconds of the last successful save and of the last
+	// attempted background save, and how the latter went
+	lastSave         atomic.Int64
+	lastBgsaveTry    atomic.Int64
+	lastBgsaveFailed atomic.Bool
+	lastBgsaveTime   atomic.Int64
 }
 
-func NewPersistence(kv *KeyValueStore, dataFile string) *Persistence {
-	p := &Persistence{
-		kv:       kv,
-		dataFile: dataFile,
+// persistedDatabases is the layout of the data file. Files written before
+// there were multiple databases hold a single storedDatabase instead, which
+// is loaded into database 0.
+type persistedDatabases struct {
+	Databases []*storedDatabase
+}
+
+// storedDatabase is how a database is laid out in the data file. Lists,
+// hashes and sets are written as plain slices and maps whatever their
+// encoding, so the file does not depend on it, and get re-encoded on load.
+// The field names match the ones of KeyValueStore, which was encoded as is
+// before there were compact encodings.
+type storedDatabase struct {
+	Strings              map[string]string
+	Lists                map[string][]string
+	Hashes               map[string]map[string]string
+	Sets                 map[string]map[string]struct{}
+	SortedSets           map[string]*SortedSet
+	Expirations          map[string]time.Time
+	HashFieldExpirations map[string]map[string]time.Time
+}
+
+// store converts kv to its stored layout. The caller must hold the lock.
+func (kv *KeyValueStore) store() *storedDatabase {
+	stored := &storedDatabase{
+		Strings:              kv.Strings,
+		Lists:                make(map[string][]string, len(kv.Lists)),
+		Hashes:               make(map[string]map[string]string, len(kv.Hashes)),
+		Sets:                 make(map[string]map[string]struct{}, len(kv.Sets)),
+		SortedSets:           kv.SortedSets,
+		Expirations:          kv.Expirations,
+		HashFieldExpirations: kv.HashFieldExpirations,
+	}
+	for key, list := range kv.Lists {
+		stored.Lists[key] = list.Elements()
+	}
+	for key, hash := range kv.Hashes {
+		stored.Hashes[key] = hash.Map()
+	}
+	for key, set := range kv.Sets {
+		members := make(map[string]struct{}, set.Len())
+		set.Range(func(member string) bool {
+			members[member] = struct{}{}
+			return true
+		})
+		stored.Sets[key] = members
 	}
+	return stored
+}
 
-	err := p.loadData()
-	if err != nil {
-		log.Printf("Error loading data: %v", err)
+// NewPersistence returns the persistence of databases, loaded from
+// dataFile.
+func NewPersistence(databases []*KeyValueStore, dataFile string) (*Persistence, error) {
+	p := newPersistence(databases, dataFile)
+	if err := p.load(); err != nil {
+		return nil, err
 	}
+	return p, nil
+}
 
+// newPersistence returns a Persistence that hasn't loaded anything yet.
+func newPersistence(databases []*KeyValueStore, dataFile string) *Persistence {
+	p := &Persistence{
+		databases:      databases,
+		dataFile:       dataFile,
+		bgsaveRequests: make(chan struct{}, 1),
+	}
+	p.lastSave.Store(time.Now().Unix())
+	p.lastBgsaveTime.Store(-1)
 	return p
 }
 
-// Add a method to set shouldSave to true
-func (p *Persistence) MarkAsDirty() {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
-	p.shouldSave = true
+// load loads the data file at startup, if there is one. When it can't be
+// loaded and loadCorruptedData is set, the server starts empty instead, and
+// the file is moved aside so that the next save doesn't replace it.
+func (p *Persistence) load() error {
+	err := p.loadData()
+	if err == nil || errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	for _, kv := range p.databases {
+		kv.flush()
+	}
+	if !loadCorruptedData {
+		return fmt.Errorf("loading %s: %w", p.dataFile, err)
+	}
+	corrupted := p.dataFile + ".corrupted"
+	log.Printf("Error loading %s, starting empty and moving it to %s: %v", p.dataFile, corrupted, err)
+	return os.Rename(p.dataFile, corrupted)
 }
 
+// loadData loads the data file into the databases, whatever format or
+// version it is in, and drops the keys that expired meanwhile.
 func (p *Persistence) loadData() error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -46,16 +182,155 @@ func (p *Persistence) loadData() error {
 	}
 	defer file.Close()
 
-	dec := gob.NewDecoder(file)
+	magic := make([]byte, max(len(rdb.Magic), len(datafile.Magic)))
+	n, _ := io.ReadFull(file, magic)
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	switch {
+	case strings.HasPrefix(string(magic[:n]), rdb.Magic):
+		err = readRDB(file, p.databases, nil)
+	case strings.HasPrefix(string(magic[:n]), datafile.Magic):
+		err = readDataFile(file, p.databases)
+	default:
+		err = p.loadUnversionedData(file)
+	}
+	if err != nil {
+		return err
+	}
+
+	dropped := 0
+	for _, kv := range p.databases {
+		kv.mu.Lock()
+		dropped += kv.dropExpired()
+		kv.mu.Unlock()
+	}
+	if dropped > 0 {
+		log.Printf("Dropped %d keys that expired while the server was down", dropped)
+	}
+	return nil
+}
+
+// loadUnversionedData loads a data file written before there was a header,
+// in any of the layouts used back then. The caller must hold p.mu.
+func (p *Persistence) loadUnversionedData(file *os.File) error {
+	var persisted persistedDatabases
+	if err := gob.NewDecoder(file).Decode(&persisted); err == nil {
+		adoptDatabases(&persisted, p.databases)
+		log.Printf("Migrated the data file from version 0, it will be written in version %d on the next save", datafile.Version)
+		return nil
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var single storedDatabase
+	err := gob.NewDecoder(file).Decode(&single)
+	if err != nil {
+		if legacyErr := p.loadLegacyData(p.databases[0]); legacyErr != nil {
+			return fmt.Errorf("%w: %v", datafile.ErrBadFormat, err)
+		}
+		return nil
+	}
+	p.databases[0].adopt(&single)
+	log.Printf("Migrated the data file from version 0, it will be written in version %d on the next save", datafile.Version)
+	return nil
+}
+
+// adopt takes over the data of a database decoded from disk, encoding the
+// collections the way their size calls for. Gob leaves empty maps out, so
+// those keep the ones kv was created with.
+func (kv *KeyValueStore) adopt(loaded *storedDatabase) {
+	if loaded.Strings != nil {
+		kv.Strings = loaded.Strings
+	}
+	for key, list := range loaded.Lists {
+		kv.Lists[key] = listFromSlice(list)
+	}
+	for key, hash := range loaded.Hashes {
+		kv.Hashes[key] = hashFromMap(hash)
+	}
+	for key, set := range loaded.Sets {
+		kv.Sets[key] = setFromMap(set)
+	}
+	if loaded.SortedSets != nil {
+		kv.SortedSets = loaded.SortedSets
+	}
+	if loaded.Expirations != nil {
+		kv.Expirations = loaded.Expirations
+	}
+	if loaded.HashFieldExpirations != nil {
+		kv.HashFieldExpirations = loaded.HashFieldExpirations
+	}
+	kv.dropKeyIndex()
+}
+
+type legacySortedSetMember struct {
+	Member string
+}
 
-	err = dec.Decode(p.kv)
+// legacyKeyValueStore is the layout written before sorted sets were backed by
+// SortedSet. Member scores were never persisted back then.
+type legacyKeyValueStore struct {
+	Strings     map[string]string
+	Lists       map[string][]string
+	Hashes      map[string]map[string]string
+	Sets        map[string]map[string]struct{}
+	SortedSets  map[string][]legacySortedSetMember
+	Expirations map[string]time.Time
+}
+
+// loadLegacyData migrates a data file in the legacy layout into kv. Sorted
+// set members are loaded with a score of 0. The caller must hold p.mu.
+func (p *Persistence) loadLegacyData(kv *KeyValueStore) error {
+	file, err := os.Open(p.dataFile)
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 
+	var legacy legacyKeyValueStore
+	if err := gob.NewDecoder(file).Decode(&legacy); err != nil {
+		return err
+	}
+
+	fresh := NewKeyValueStore()
+	kv.Strings = fresh.Strings
+	kv.Lists = fresh.Lists
+	kv.Hashes = fresh.Hashes
+	kv.Sets = fresh.Sets
+	kv.SortedSets = fresh.SortedSets
+	kv.Expirations = fresh.Expirations
+	kv.HashFieldExpirations = fresh.HashFieldExpirations
+	kv.dropKeyIndex()
+	for key, value := range legacy.Strings {
+		kv.Strings[key] = value
+	}
+	for key, value := range legacy.Lists {
+		kv.Lists[key] = listFromSlice(value)
+	}
+	for key, value := range legacy.Hashes {
+		kv.Hashes[key] = hashFromMap(value)
+	}
+	for key, value := range legacy.Sets {
+		kv.Sets[key] = setFromMap(value)
+	}
+	for key, members := range legacy.SortedSets {
+		sortedSet := NewSortedSet()
+		for _, m := range members {
+			sortedSet.Add(m.Member, 0)
+		}
+		kv.SortedSets[key] = sortedSet
+	}
+	for key, value := range legacy.Expirations {
+		kv.Expirations[key] = value
+	}
+	log.Printf("Migrated %d sorted sets from the legacy data layout, their scores were reset to 0", len(legacy.SortedSets))
 	return nil
 }
 
+// saveData writes a snapshot of the dataset to the data file, replacing it
+// only once it has been written in full.
 func (p *Persistence) saveData() error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -66,8 +341,20 @@ func (p *Persistence) saveData() error {
 		return err
 	}
 
-	enc := gob.NewEncoder(file)
-	err = enc.Encode(p.kv)
+	// Clients keep running while the snapshot is copied and encoded
+	propagateMu.Lock()
+	snapshot := startSnapshot(p.databases)
+	changes := changesSinceSave.Load()
+	propagateMu.Unlock()
+	copies := snapshot.finish()
+	if isRDBFile(p.dataFile) {
+		err = writeRDB(file, copies)
+	} else {
+		err = writeDataFile(file, copies)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
 	if err != nil {
 		file.Close()
 		os.Remove(tmpFile)
@@ -81,17 +368,119 @@ func (p *Persistence) saveData() error {
 		return err
 	}
 
+	// Changes made while saving still count toward the next save
+	changesSinceSave.Add(-changes)
+	p.lastSave.Store(time.Now().Unix())
 	return nil
 }
 
+// backgroundSave runs the background saves, for BGSAVE and when a save
+// point is reached. Save points are checked once a second.
 func (p *Persistence) backgroundSave() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 	for {
-		if p.shouldSave {
-			p.shouldSave = false
-			err := p.saveData()
-			if err != nil {
-				log.Printf("Error saving data: %v", err)
+		select {
+		case <-p.bgsaveRequests:
+		case now := <-ticker.C:
+			if !p.savePointReached(now) {
+				continue
 			}
+			log.Printf("%d changes since the last save, saving", changesSinceSave.Load())
+		}
+
+		p.bgsaveRunning.Store(true)
+		start := time.Now()
+		p.lastBgsaveTry.Store(start.Unix())
+		err := p.saveData()
+		p.lastBgsaveFailed.Store(err != nil)
+		p.lastBgsaveTime.Store(int64(time.Since(start).Seconds()))
+		p.bgsaveRunning.Store(false)
+		if err != nil {
+			log.Printf("Error saving data: %v", err)
+		}
+	}
+}
+
+// savePointReached reports whether enough time has passed and enough
+// changes have been made for one of the save points. After a failed save
+// it waits for bgsaveRetryDelay before trying again.
+func (p *Persistence) savePointReached(now time.Time) bool {
+	if p.lastBgsaveFailed.Load() && now.Unix()-p.lastBgsaveTry.Load() < int64(bgsaveRetryDelay/time.Second) {
+		return false
+	}
+	changes := changesSinceSave.Load()
+	elapsed := now.Unix() - p.lastSave.Load()
+	for _, point := range savePoints {
+		if changes >= point.changes && changes > 0 && elapsed >= int64(point.seconds) {
+			return true
+		}
+	}
+	return false
+}
+
+// SaveCommand implements SAVE, which saves in the foreground.
+func (p *Persistence) SaveCommand() string {
+	if p.bgsaveRunning.Load() {
+		return "ERR Background save already in progress"
+	}
+	if err := p.saveData(); err != nil {
+		return "ERR " + err.Error()
+	}
+	return "OK"
+}
+
+// BgSaveCommand implements BGSAVE [SCHEDULE]. With SCHEDULE, a BGSAVE that
+// comes in while another is running runs once it is done instead of failing.
+func (p *Persistence) BgSaveCommand(parts []string) string {
+	schedule := false
+	if len(parts) == 2 && strings.ToUpper(parts[1]) == "SCHEDULE" {
+		schedule = true
+	} else if len(parts) != 1 {
+		return "ERR syntax error"
+	}
+	running := p.bgsaveRunning.Load()
+	if running && !schedule {
+		return "ERR Background save already in progress"
+	}
+	select {
+	case p.bgsaveRequests <- struct{}{}:
+	default:
+		// A request is already pending, which covers this one
+	}
+	if running {
+		return "Background saving scheduled"
+	}
+	return "Background saving started"
+}
+
+// LastSaveCommand implements LASTSAVE.
+func (p *Persistence) LastSaveCommand() string {
+	return fmt.Sprintf("(integer) %d", p.lastSave.Load())
+}
+
+// info returns the lines of the INFO persistence section.
+func (p *Persistence) info() string {
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("loading:%d\r\n", boolToInt(loadingData.Load())))
+	b.WriteString(fmt.Sprintf("rdb_changes_since_last_save:%d\r\n", changesSinceSave.Load()))
+	if p != nil {
+		status := "ok"
+		if p.lastBgsaveFailed.Load() {
+			status = "err"
 		}
+		b.WriteString(fmt.Sprintf("rdb_bgsave_in_progress:%d\r\n", boolToInt(p.bgsaveRunning.Load())))
+		b.WriteString(fmt.Sprintf("rdb_last_save_time:%d\r\n", p.lastSave.Load()))
+		b.WriteString(fmt.Sprintf("rdb_last_bgsave_status:%s\r\n", status))
+		b.WriteString(fmt.Sprintf("rdb_last_bgsave_time_sec:%d\r\n", p.lastBgsaveTime.Load()))
+	}
+	b.WriteString(fmt.Sprintf("aof_enabled:%d\r\n", boolToInt(appendOnly != nil)))
+	rewriting := false
+	if appendOnly != nil {
+		appendOnly.mu.Lock()
+		rewriting = appendOnly.rewriting
+		appendOnly.mu.Unlock()
 	}
+	b.WriteString(fmt.Sprintf("aof_rewrite_in_progress:%d\r\n", boolToInt(rewriting)))
+	return b.String()
 }
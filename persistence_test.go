@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseSavePoints(t *testing.T) {
+	points, ok := parseSavePoints("3600 1 300 100")
+	if !ok || len(points) != 2 || points[1] != (savePoint{300, 100}) {
+		t.Fatalf("Expected two save points, Got: %v", points)
+	}
+	if points, ok := parseSavePoints(""); !ok || len(points) != 0 {
+		t.Fatalf("Expected no save points, Got: %v", points)
+	}
+	for _, invalid := range []string{"3600", "a 1", "60 -1", "-1 10"} {
+		if _, ok := parseSavePoints(invalid); ok {
+			t.Fatalf("Expected %q to be refused", invalid)
+		}
+	}
+}
+
+func TestSavePointsAndBackgroundSave(t *testing.T) {
+	dbs := newDatabases(1)
+	p := newPersistence(dbs, filepath.Join(t.TempDir(), "data.gob"))
+	defer func(saved []savePoint) { savePoints = saved }(savePoints)
+	savePoints = []savePoint{{60, 2}}
+	changesSinceSave.Store(0)
+
+	dbs[0].executeCommand([]string{"SET", "a", "1"})
+	dbs[0].executeCommand([]string{"GET", "a"})
+	if got := changesSinceSave.Load(); got != 1 {
+		t.Fatalf("Expected only the write to count as a change, Got: %d", got)
+	}
+	dbs[0].executeCommand([]string{"SET", "b", "2"})
+	now := time.Now()
+	if p.savePointReached(now) {
+		t.Fatalf("Expected the save point to wait for 60 seconds")
+	}
+	if !p.savePointReached(now.Add(time.Minute)) {
+		t.Fatalf("Expected the save point to be reached after 60 seconds")
+	}
+
+	if got := p.SaveCommand(); got != "OK" {
+		t.Fatalf("Expected SAVE to succeed, Got: %q", got)
+	}
+	if got := changesSinceSave.Load(); got != 0 {
+		t.Fatalf("Expected the changes to be saved, Got: %d", got)
+	}
+	if got := p.LastSaveCommand(); got != fmt.Sprintf("(integer) %d", now.Unix()) && p.lastSave.Load() < now.Unix() {
+		t.Fatalf("Expected LASTSAVE to be updated, Got: %q", got)
+	}
+
+	p.bgsaveRunning.Store(true)
+	if got := p.BgSaveCommand([]string{"BGSAVE"}); got != "ERR Background save already in progress" {
+		t.Fatalf("Expected BGSAVE to be refused while saving, Got: %q", got)
+	}
+	if got := p.BgSaveCommand([]string{"BGSAVE", "SCHEDULE"}); got != "Background saving scheduled" {
+		t.Fatalf("Expected BGSAVE SCHEDULE to be scheduled, Got: %q", got)
+	}
+	if len(p.bgsaveRequests) != 1 {
+		t.Fatalf("Expected a pending background save")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Write commands are fed to the append-only file and to replicas in the
+// order they changed the dataset in. Every write command holds propagateMu
+// from before it runs until it has been propagated, so two commands can
+// never be logged the other way around; blocking commands let go of it while
+// they wait.
+// Commands whose effect depends on when they run or on chance are logged as
+// a deterministic equivalent, like Redis does: relative TTLs become absolute
+// ones, blocking pops their non-blocking variant, and handlers such as SPOP
+// replace themselves with what they actually did.
+
+var propagateMu sync.Mutex
+
+// propagateOverride is what the running write command asked to log instead
+// of itself. It is guarded by propagateMu.
+var propagateOverride struct {
+	set      bool
+	commands [][]string
+}
+
+// propagateInstead makes the running write command log commands instead of
+// itself, nothing at all when there are none.
+func propagateInstead(commands ...[]string) {
+	propagateOverride.set = true
+	propagateOverride.commands = commands
+}
+
+// propagate feeds a command that changed database db to the append-only
+// file and the replication stream. Commands replayed while loading came from
+// there in the first place, and replicas pass on the stream of their master
+// as they got it instead. The caller must hold propagateMu.
+func propagate(db int, parts []string) {
+	if loadingData.Load() {
+		return
+	}
+	appendOnly.feed(db, parts)
+	if !replicaMode.Load() {
+		replication.feed(db, parts)
+	}
+}
+
+// propagateCommand logs the write command in parts once it has run on kv,
+// and counts it as a change toward the save points. The caller must hold
+// propagateMu.
+func (kv *KeyValueStore) propagateCommand(parts []string) {
+	if !loadingData.Load() {
+		changesSinceSave.Add(1)
+	}
+	commands := [][]string{deterministicCommand(parts)}
+	if propagateOverride.set {
+		commands = propagateOverride.commands
+	}
+	propagateOverride.set, propagateOverride.commands = false, nil
+	for _, command := range commands {
+		propagate(kv.index, command)
+	}
+}
+
+// deterministicCommand returns a command with the same effect as parts that
+// does not depend on the time it runs at, nor block. Arguments that don't
+// parse are left alone, the command failed and will fail again.
+func deterministicCommand(parts []string) []string {
+	switch parts[0] {
+	case "EXPIRE":
+		if len(parts) == 3 {
+			if at, ok := absoluteMillis(parts[2], time.Second); ok {
+				return []string{"PEXPIREAT", parts[1], at}
+			}
+		}
+	case "HEXPIRE", "HPEXPIRE":
+		if len(parts) > 2 {
+			if at, ok := absoluteMillis(parts[2], expireUnit(parts[0][1:])); ok {
+				return append([]string{"HPEXPIREAT", parts[1], at}, parts[3:]...)
+			}
+		}
+	case "HGETEX", "HSETEX":
+		// The TTL option comes before FIELDS
+		for i := 2; i+1 < len(parts) && strings.ToUpper(parts[i]) != "FIELDS"; i++ {
+			option := strings.ToUpper(parts[i])
+			if option != "EX" && option != "PX" {
+				continue
+			}
+			if at, ok := absoluteMillis(parts[i+1], expireUnit(option)); ok {
+				rewritten := append([]string(nil), parts...)
+				rewritten[i], rewritten[i+1] = "PXAT", at
+				return rewritten
+			}
+		}
+	case "RESTORE":
+		if len(parts) < 4 {
+			break
+		}
+		for _, option := range parts[4:] {
+			if strings.ToUpper(option) == "ABSTTL" {
+				return parts
+			}
+		}
+		if ttl, err := strconv.ParseInt(parts[2], 10, 64); err == nil && ttl > 0 {
+			rewritten := append([]string(nil), parts...)
+			rewritten[2], _ = absoluteMillis(parts[2], time.Millisecond)
+			return append(rewritten, "ABSTTL")
+		}
+	case "BZPOPMIN", "BZPOPMAX":
+		// A timed out pop found nothing, and so will ZMPOP at that point
+		if _, errMsg := parseBlockingTimeout(parts[len(parts)-1]); len(parts) >= 3 && errMsg == "" {
+			keys := parts[1 : len(parts)-1]
+			rewritten := append([]string{"ZMPOP", strconv.Itoa(len(keys))}, keys...)
+			return append(rewritten, parts[0][len(parts[0])-3:])
+		}
+	case "BZMPOP":
+		if len(parts) < 2 {
+			break
+		}
+		if _, errMsg := parseBlockingTimeout(parts[1]); errMsg == "" {
+			return append([]string{"ZMPOP"}, parts[2:]...)
+		}
+	}
+	return parts
+}
+
+// absoluteMillis turns a relative TTL in unit into a Unix time in
+// milliseconds. Negative TTLs are refused like the commands taking them do.
+func absoluteMillis(ttl string, unit time.Duration) (string, bool) {
+	n, err := strconv.ParseInt(ttl, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/int64(unit) {
+		return "", false
+	}
+	return strconv.FormatInt(time.Now().Add(time.Duration(n)*unit).UnixMilli(), 10), true
+}
@@ -0,0 +1,1062 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Raft mode (-raft-id) makes a group of servers agree on every write command
+// through a Raft log before any of them runs it, so a write acknowledged to
+// a client survives the loss of any minority of them. Only the leader takes
+// writes: it appends them to its log, sends them to the other members and
+// runs them once a majority has them on disk, at which point they are
+// committed and every member runs them in the same order. Reads are served
+// by the leader too, after it checks with a majority that it still is the
+// leader and has applied everything committed before the read (read
+// index), so they never see stale data. Other members redirect clients to
+// the leader with a NOTLEADER error.
+//
+// Commands are logged in their deterministic form, like for the append-only
+// file, so they have the same effect whenever and wherever they run, and
+// those that can't be made deterministic are refused. Members change one at
+// a time with RAFT ADDNODE and RAFT REMOVENODE, and a change takes effect as
+// soon as its entry is in a member's log. Once enough entries were applied,
+// a node writes its dataset to a snapshot and drops the log up to there;
+// members that fall behind the start of the leader's log are sent the
+// snapshot instead.
+
+const (
+	raftFollower  = "follower"
+	raftCandidate = "candidate"
+	raftLeader    = "leader"
+	// raftMaxBatch is how many entries are sent in one AppendEntries
+	raftMaxBatch = 512
+)
+
+// raftRefused are the commands that can't run through the log, with why.
+var raftRefused = map[string]string{
+	"SPOP":      "its result is random",
+	"MIGRATE":   "it talks to another server",
+	"MULTI":     "transactions are not supported",
+	"REPLICAOF": "raft replicates on its own",
+	"SLAVEOF":   "raft replicates on its own",
+}
+
+// raft is the Raft node of this server in raft mode, nil otherwise.
+var raft *raftNode
+
+type raftPeer struct {
+	id   string
+	link *serverLink
+	// nextIndex is the next entry to send, matchIndex the last one known
+	// to be in its log, and ackSent when the last RPC it answered was sent
+	nextIndex  int64
+	matchIndex int64
+	ackSent    time.Time
+	trigger    chan struct{}
+}
+
+// raftWaiter is a client waiting for the entry it proposed to be applied.
+type raftWaiter struct {
+	term  int64
+	done  bool
+	reply string
+}
+
+type raftNode struct {
+	mu      sync.Mutex
+	changed *sync.Cond
+	// applyMu is held while entries or snapshots are applied to dbs
+	applyMu sync.Mutex
+	id      string
+	dbs     []*KeyValueStore
+	storage *raftStorage
+
+	electionTimeout time.Duration
+	heartbeat       time.Duration
+	// snapshotEntries is how many applied entries the log may hold before
+	// it is compacted
+	snapshotEntries int64
+
+	// term, votedFor and the log are kept on disk
+	term     int64
+	votedFor string
+	log      []raftEntry
+	// snapshot is what the log was compacted up to
+	snapshot     raftSnapshotInfo
+	snapshotting bool
+
+	state         string
+	leader        string
+	leaderContact time.Time
+	deadline      time.Time
+	commitIndex   int64
+	lastApplied   int64
+	// members is the configuration in the latest config entry of the log
+	members map[string]string
+	// peers and leaderStart, the index of its first entry, exist on a
+	// leader
+	peers       map[string]*raftPeer
+	leaderStart int64
+	waiters     map[int64]*raftWaiter
+	applyCh     chan struct{}
+	stop        chan struct{}
+	stopped     bool
+}
+
+// newRaftNode starts the node id on dbs from the files in dir. Members are
+// the cluster it starts with when dir holds nothing yet; a node that isn't
+// one of them waits to be added.
+func newRaftNode(id string, dbs []*KeyValueStore, dir string, members map[string]string, electionTimeout time.Duration, snapshotEntries int64) (*raftNode, error) {
+	storage, err := openRaftStorage(dir)
+	if err != nil {
+		return nil, err
+	}
+	n := &raftNode{
+		id:              id,
+		dbs:             dbs,
+		storage:         storage,
+		electionTimeout: electionTimeout,
+		heartbeat:       max(electionTimeout/10, time.Millisecond),
+		snapshotEntries: snapshotEntries,
+		state:           raftFollower,
+		snapshot:        raftSnapshotInfo{members: members},
+		waiters:         make(map[int64]*raftWaiter),
+		applyCh:         make(chan struct{}, 1),
+		stop:            make(chan struct{}),
+	}
+	n.changed = sync.NewCond(&n.mu)
+	if info, ok, err := storage.loadSnapshot(dbs); err != nil {
+		return nil, err
+	} else if ok {
+		n.snapshot = info
+		n.commitIndex, n.lastApplied = info.index, info.index
+	}
+	if n.term, n.votedFor, err = storage.loadState(); err != nil {
+		return nil, err
+	}
+	entries, err := storage.loadLog()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Index > n.snapshot.index {
+			n.log = append(n.log, e)
+		}
+	}
+	if err := storage.openLog(); err != nil {
+		return nil, err
+	}
+	n.members = n.membersAt(n.lastIndex())
+	n.resetDeadline()
+	go n.run()
+	go n.applyLoop()
+	return n, nil
+}
+
+func (n *raftNode) close() {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return
+	}
+	n.stopped = true
+	close(n.stop)
+	for _, p := range n.peers {
+		p.link.close()
+	}
+	n.changed.Broadcast()
+	n.mu.Unlock()
+	// Wait for an entry being applied
+	n.applyMu.Lock()
+	n.mu.Lock()
+	n.storage.close()
+	n.mu.Unlock()
+	n.applyMu.Unlock()
+}
+
+func (n *raftNode) lastIndex() int64 {
+	return n.snapshot.index + int64(len(n.log))
+}
+
+// entry returns the entry at index, which must be in the log.
+func (n *raftNode) entry(index int64) raftEntry {
+	return n.log[index-n.snapshot.index-1]
+}
+
+// termAt returns the term of the entry at index, or -1 when the log doesn't
+// have it anymore or yet.
+func (n *raftNode) termAt(index int64) int64 {
+	switch {
+	case index == n.snapshot.index:
+		return n.snapshot.term
+	case index < n.snapshot.index || index > n.lastIndex():
+		return -1
+	}
+	return n.entry(index).Term
+}
+
+// membersAt returns the configuration as of the entry at index.
+func (n *raftNode) membersAt(index int64) map[string]string {
+	for i := index; i > n.snapshot.index; i-- {
+		if e := n.entry(i); e.Kind == raftConfig {
+			members, _ := parseRaftMembers(strings.Join(e.Parts, " "))
+			return members
+		}
+	}
+	return n.snapshot.members
+}
+
+// majority reports whether count members make a majority.
+func (n *raftNode) majority(count int) bool {
+	return count > len(n.members)/2
+}
+
+func (n *raftNode) resetDeadline() {
+	n.deadline = time.Now().Add(n.electionTimeout + time.Duration(rand.Int63n(int64(n.electionTimeout))))
+}
+
+// setTerm moves to a later term as a follower. The caller must hold n.mu.
+func (n *raftNode) setTerm(term int64) {
+	n.term, n.votedFor, n.leader = term, "", ""
+	n.persistState()
+	n.becomeFollower()
+}
+
+func (n *raftNode) becomeFollower() {
+	if n.state == raftLeader {
+		log.Printf("Raft node %s steps down in term %d", n.id, n.term)
+	}
+	n.state = raftFollower
+	for _, p := range n.peers {
+		p.link.close()
+	}
+	n.peers = nil
+	n.changed.Broadcast()
+}
+
+func (n *raftNode) persistState() {
+	if err := n.storage.saveState(n.term, n.votedFor); err != nil {
+		log.Printf("Error saving the raft state: %v", err)
+	}
+}
+
+// appendEntries adds entries to the end of the log and to its file. The
+// caller must hold n.mu.
+func (n *raftNode) appendEntries(entries ...raftEntry) {
+	if err := n.storage.appendLog(entries); err != nil {
+		// Acknowledging entries that aren't on disk would break the
+		// guarantees raft mode is for
+		log.Fatalf("Error writing the raft log: %v", err)
+	}
+	n.log = append(n.log, entries...)
+	for _, e := range entries {
+		if e.Kind == raftConfig {
+			n.applyConfig()
+		}
+	}
+}
+
+// truncateFrom drops the entries from index on. The caller must hold n.mu.
+func (n *raftNode) truncateFrom(index int64) {
+	n.log = n.log[:index-n.snapshot.index-1]
+	// The entries waited for are gone for good
+	for i, w := range n.waiters {
+		if i >= index && !w.done {
+			w.done, w.reply = true, "ERR the write was lost to a leader change, it may be retried"
+		}
+	}
+	n.changed.Broadcast()
+	if err := n.storage.rewriteLog(n.log); err != nil {
+		log.Fatalf("Error writing the raft log: %v", err)
+	}
+	n.applyConfig()
+}
+
+// applyConfig makes the latest configuration of the log the current one,
+// and has a leader replicate to the new members. The caller must hold n.mu.
+func (n *raftNode) applyConfig() {
+	n.members = n.membersAt(n.lastIndex())
+	if n.state != raftLeader {
+		return
+	}
+	for id, p := range n.peers {
+		if _, ok := n.members[id]; !ok {
+			p.link.close()
+			delete(n.peers, id)
+		}
+	}
+	for id, addr := range n.members {
+		if _, ok := n.peers[id]; !ok && id != n.id {
+			p := &raftPeer{id: id, link: &serverLink{addr: addr, auth: requirePass}, nextIndex: n.lastIndex() + 1, trigger: make(chan struct{}, 1)}
+			n.peers[id] = p
+			go n.replicate(p, n.term)
+		}
+	}
+}
+
+// run starts an election whenever the leader wasn't heard from in time.
+// Nodes that aren't members don't, so removed nodes can't disrupt the
+// cluster.
+func (n *raftNode) run() {
+	ticker := time.NewTicker(n.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+		n.mu.Lock()
+		_, member := n.members[n.id]
+		if n.state != raftLeader && member && time.Now().After(n.deadline) {
+			n.campaign()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// campaign starts an election in the next term. The caller must hold n.mu.
+func (n *raftNode) campaign() {
+	n.term++
+	n.votedFor = n.id
+	n.persistState()
+	n.state = raftCandidate
+	n.leader = ""
+	n.resetDeadline()
+	term := n.term
+	lastIndex := n.lastIndex()
+	args := []string{"RAFT", "REQUESTVOTE", strconv.FormatInt(term, 10), n.id,
+		strconv.FormatInt(lastIndex, 10), strconv.FormatInt(n.termAt(lastIndex), 10)}
+	log.Printf("Raft node %s starts an election in term %d", n.id, term)
+
+	votes := 1
+	if n.majority(votes) {
+		n.becomeLeader()
+		return
+	}
+	for id, addr := range n.members {
+		if id == n.id {
+			continue
+		}
+		go func(link *serverLink) {
+			defer link.close()
+			reply, err := link.do(n.electionTimeout, args...)
+			fields := strings.Fields(reply)
+			if err != nil || len(fields) != 2 {
+				return
+			}
+			replyTerm, _ := strconv.ParseInt(fields[0], 10, 64)
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if replyTerm > n.term {
+				n.setTerm(replyTerm)
+				return
+			}
+			if n.state != raftCandidate || n.term != term || fields[1] != "1" {
+				return
+			}
+			votes++
+			if n.majority(votes) {
+				n.becomeLeader()
+			}
+		}(&serverLink{addr: addr, auth: requirePass})
+	}
+}
+
+// becomeLeader starts replicating to the other members, with an empty
+// entry of the new term: entries of earlier terms only count as committed
+// once one of its own is. The caller must hold n.mu.
+func (n *raftNode) becomeLeader() {
+	log.Printf("Raft node %s is the leader of term %d", n.id, n.term)
+	n.state = raftLeader
+	n.leader = n.id
+	n.peers = make(map[string]*raftPeer)
+	n.leaderStart = n.lastIndex() + 1
+	n.appendEntries(raftEntry{Index: n.leaderStart, Term: n.term, Kind: raftNoop})
+	n.applyConfig()
+	n.advanceCommit()
+	n.changed.Broadcast()
+}
+
+// replicate keeps the peer up to date for as long as this node leads in
+// term, sending empty AppendEntries as heartbeats when there's nothing new.
+func (n *raftNode) replicate(p *raftPeer, term int64) {
+	ticker := time.NewTicker(n.heartbeat)
+	defer ticker.Stop()
+	for {
+		n.mu.Lock()
+		if n.stopped || n.state != raftLeader || n.term != term || n.peers[p.id] != p {
+			n.mu.Unlock()
+			return
+		}
+		sentAt := time.Now()
+		var args []string
+		var lastSent int64
+		if p.nextIndex <= n.snapshot.index {
+			data, err := os.ReadFile(n.storage.path(raftSnapshotFile))
+			if err != nil {
+				log.Printf("Error reading the raft snapshot: %v", err)
+				n.mu.Unlock()
+				return
+			}
+			args = []string{"RAFT", "INSTALLSNAPSHOT", strconv.FormatInt(term, 10), n.id, string(data)}
+			lastSent = n.snapshot.index
+		} else {
+			prev := p.nextIndex - 1
+			args = []string{"RAFT", "APPENDENTRIES", strconv.FormatInt(term, 10), n.id,
+				strconv.FormatInt(prev, 10), strconv.FormatInt(n.termAt(prev), 10), strconv.FormatInt(n.commitIndex, 10)}
+			for i := p.nextIndex; i <= n.lastIndex() && i < p.nextIndex+raftMaxBatch; i++ {
+				args = append(args, string(n.entry(i).encode()))
+				lastSent = i
+			}
+		}
+		n.mu.Unlock()
+
+		reply, err := p.link.do(max(n.electionTimeout, time.Second), args...)
+		if err == nil && n.handleReplicateReply(p, term, sentAt, lastSent, args[1] == "INSTALLSNAPSHOT", reply) {
+			continue
+		}
+		select {
+		case <-n.stop:
+			return
+		case <-p.trigger:
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleReplicateReply takes in the answer of a peer to AppendEntries or
+// InstallSnapshot. It reports whether there's more to send right away.
+func (n *raftNode) handleReplicateReply(p *raftPeer, term int64, sentAt time.Time, lastSent int64, snapshot bool, reply string) bool {
+	fields := strings.Fields(reply)
+	if len(fields) == 0 {
+		return false
+	}
+	replyTerm, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if replyTerm > n.term {
+		n.setTerm(replyTerm)
+		return false
+	}
+	if n.state != raftLeader || n.term != term || n.peers[p.id] != p {
+		return false
+	}
+	p.ackSent = sentAt
+	n.changed.Broadcast()
+	if snapshot {
+		p.matchIndex = max(p.matchIndex, lastSent)
+		p.nextIndex = p.matchIndex + 1
+		return p.nextIndex <= n.lastIndex()
+	}
+	if len(fields) != 3 {
+		return false
+	}
+	hint, _ := strconv.ParseInt(fields[2], 10, 64)
+	if fields[1] == "1" {
+		if lastSent > p.matchIndex {
+			p.matchIndex = lastSent
+			n.advanceCommit()
+		}
+		p.nextIndex = max(p.nextIndex, p.matchIndex+1)
+		return p.nextIndex <= n.lastIndex()
+	}
+	// The follower's log doesn't match at nextIndex-1, back up to where it
+	// may
+	next := max(min(p.nextIndex-1, hint+1), 1)
+	progress := next < p.nextIndex
+	p.nextIndex = next
+	return progress
+}
+
+// advanceCommit commits the latest entry of the current term that a
+// majority has. The caller must hold n.mu.
+func (n *raftNode) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex && n.termAt(index) == n.term; index-- {
+		count := 0
+		for id := range n.members {
+			if id == n.id || n.peers[id] != nil && n.peers[id].matchIndex >= index {
+				count++
+			}
+		}
+		if n.majority(count) {
+			n.setCommitIndex(index)
+			return
+		}
+	}
+}
+
+func (n *raftNode) setCommitIndex(index int64) {
+	if index <= n.commitIndex {
+		return
+	}
+	n.commitIndex = index
+	select {
+	case n.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+// applyLoop runs the committed entries in order.
+func (n *raftNode) applyLoop() {
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.applyCh:
+		}
+		for n.applyNext() {
+		}
+		n.maybeSnapshot()
+	}
+}
+
+// applyNext applies the next committed entry, if there is one.
+func (n *raftNode) applyNext() bool {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	if n.stopped || n.lastApplied >= n.commitIndex {
+		n.mu.Unlock()
+		return false
+	}
+	e := n.entry(n.lastApplied + 1)
+	n.mu.Unlock()
+
+	reply := ""
+	switch e.Kind {
+	case raftCommand:
+		if e.DB >= 0 && e.DB < len(n.dbs) && len(e.Parts) > 0 {
+			reply = n.dbs[e.DB].applyCommand(e.Parts)
+		}
+	case raftConfig:
+		reply = "OK"
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.lastApplied = e.Index
+	if w := n.waiters[e.Index]; w != nil {
+		w.done, w.reply = true, reply
+		if w.term != e.Term {
+			w.reply = "ERR the write was lost to a leader change, it may be retried"
+		}
+	}
+	if _, member := n.members[n.id]; e.Kind == raftConfig && !member && n.state == raftLeader && e.Index <= n.commitIndex {
+		// A leader removed from the cluster hands over once that's committed
+		n.becomeFollower()
+		n.leader = ""
+	}
+	n.changed.Broadcast()
+	return true
+}
+
+// applyCommand runs a command taken from the log. The leader checked
+// maxmemory before proposing it, and checking or evicting again here would
+// make the nodes differ.
+func (kv *KeyValueStore) applyCommand(parts []string) string {
+	if commandTable[parts[0]].flags&flagWrite != 0 {
+		propagateMu.Lock()
+		defer propagateMu.Unlock()
+	}
+	totalCommandsProcessed.Add(1)
+	return kv.dispatchCommand(parts)
+}
+
+// maybeSnapshot compacts the log once it holds enough applied entries. The
+// copy of the dataset is taken between two entries, and written out in the
+// background.
+func (n *raftNode) maybeSnapshot() {
+	n.applyMu.Lock()
+	n.mu.Lock()
+	if n.stopped || n.snapshotting || n.lastApplied-n.snapshot.index < n.snapshotEntries {
+		n.mu.Unlock()
+		n.applyMu.Unlock()
+		return
+	}
+	info := raftSnapshotInfo{index: n.lastApplied, term: n.termAt(n.lastApplied), members: n.membersAt(n.lastApplied)}
+	n.snapshotting = true
+	n.mu.Unlock()
+	propagateMu.Lock()
+	snap := startSnapshot(n.dbs)
+	propagateMu.Unlock()
+	n.applyMu.Unlock()
+
+	go func() {
+		err := n.storage.writeSnapshot(snap.finish(), info)
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		n.snapshotting = false
+		if err != nil {
+			log.Printf("Error writing the raft snapshot: %v", err)
+			return
+		}
+		if n.stopped || info.index <= n.snapshot.index {
+			return
+		}
+		n.log = append([]raftEntry(nil), n.log[info.index-n.snapshot.index:]...)
+		n.snapshot = info
+		if err := n.storage.rewriteLog(n.log); err != nil {
+			log.Fatalf("Error writing the raft log: %v", err)
+		}
+		log.Printf("Raft node %s compacted its log up to %d", n.id, info.index)
+	}()
+}
+
+// waitLocked waits until done returns true or timeout passes, and reports
+// which. The caller must hold n.mu.
+func (n *raftNode) waitLocked(timeout time.Duration, done func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	timer := time.AfterFunc(timeout, func() {
+		n.mu.Lock()
+		n.changed.Broadcast()
+		n.mu.Unlock()
+	})
+	defer timer.Stop()
+	for !done() {
+		if n.stopped || time.Now().After(deadline) {
+			return false
+		}
+		n.changed.Wait()
+	}
+	return true
+}
+
+// notLeaderLocked returns the error to send clients of a node that isn't
+// the leader, "" on the leader. The caller must hold n.mu.
+func (n *raftNode) notLeaderLocked() string {
+	if n.state == raftLeader {
+		return ""
+	}
+	if addr, ok := n.members[n.leader]; ok && n.leader != "" {
+		return "NOTLEADER " + addr
+	}
+	return "NOLEADER No raft leader elected yet"
+}
+
+// commitTimeout is how long clients wait for their write to be committed.
+func (n *raftNode) commitTimeout() time.Duration {
+	return 10 * n.electionTimeout
+}
+
+// propose appends an entry to the log of the leader and waits until it was
+// applied, returning its reply.
+func (n *raftNode) propose(kind string, db int, parts []string) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if reply := n.notLeaderLocked(); reply != "" {
+		return reply
+	}
+	e := raftEntry{Index: n.lastIndex() + 1, Term: n.term, Kind: kind, DB: db, Parts: parts}
+	n.appendEntries(e)
+	w := &raftWaiter{term: e.Term}
+	n.waiters[e.Index] = w
+	defer delete(n.waiters, e.Index)
+	for _, p := range n.peers {
+		select {
+		case p.trigger <- struct{}{}:
+		default:
+		}
+	}
+	n.advanceCommit()
+	if !n.waitLocked(n.commitTimeout(), func() bool { return w.done }) {
+		return "TIMEOUT the write wasn't committed in time, it may still be"
+	}
+	return w.reply
+}
+
+// readBarrier waits until this node can serve a linearizable read: it is
+// still the leader according to a majority, and has applied everything
+// committed when the read arrived. It returns an error, or "".
+func (n *raftNode) readBarrier() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if reply := n.notLeaderLocked(); reply != "" {
+		return reply
+	}
+	term := n.term
+	leading := func() bool { return n.state == raftLeader && n.term == term }
+	// A new leader only knows what's committed once an entry of its own is
+	if !n.waitLocked(n.commitTimeout(), func() bool { return !leading() || n.commitIndex >= n.leaderStart }) || !leading() {
+		return "TIMEOUT the leader couldn't confirm it still is"
+	}
+	readIndex := n.commitIndex
+	start := time.Now()
+	for _, p := range n.peers {
+		select {
+		case p.trigger <- struct{}{}:
+		default:
+		}
+	}
+	confirmed := func() bool {
+		count := 0
+		for id := range n.members {
+			if id == n.id || n.peers[id] != nil && !n.peers[id].ackSent.Before(start) {
+				count++
+			}
+		}
+		return n.majority(count)
+	}
+	if !n.waitLocked(n.commitTimeout(), func() bool { return !leading() || confirmed() }) || !leading() {
+		return "TIMEOUT the leader couldn't confirm it still is"
+	}
+	if !n.waitLocked(n.commitTimeout(), func() bool { return n.lastApplied >= readIndex }) {
+		return "TIMEOUT the leader couldn't catch up"
+	}
+	return ""
+}
+
+// clientCommand runs a command of a client on database db in raft mode.
+// Writes go through the log and reads wait for the read index. It reports
+// false for the commands that just run locally.
+func (n *raftNode) clientCommand(db int, parts []string) (string, bool) {
+	parts[0] = strings.ToUpper(parts[0])
+	if why, ok := raftRefused[parts[0]]; ok {
+		return fmt.Sprintf("ERR %s is not allowed in raft mode, %s", parts[0], why), true
+	}
+	flags := commandTable[parts[0]].flags
+	switch {
+	case flags&flagWrite != 0:
+		// Memory is checked once, here on the leader, as every node applies
+		// the entries whatever its own usage
+		n.mu.Lock()
+		reply := n.notLeaderLocked()
+		n.mu.Unlock()
+		if reply != "" {
+			return reply, true
+		}
+		if flags&flagDenyOOM != 0 && maxMemory > 0 && n.dbs[db].usedMemory() > maxMemory {
+			return oomReply, true
+		}
+		return n.propose(raftCommand, db, deterministicCommand(parts)), true
+	case flags&flagReadOnly != 0:
+		if reply := n.readBarrier(); reply != "" {
+			return reply, true
+		}
+	}
+	return "", false
+}
+
+// requestVote implements RAFT REQUESTVOTE term candidate lastIndex lastTerm.
+// A node that heard from its leader lately refuses, so a node cut off for a
+// while can't depose a working leader.
+func (n *raftNode) requestVote(parts []string) string {
+	term, err1 := strconv.ParseInt(parts[2], 10, 64)
+	lastIndex, err2 := strconv.ParseInt(parts[4], 10, 64)
+	lastTerm, err3 := strconv.ParseInt(parts[5], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return "ERR value is not an integer or out of range"
+	}
+	candidate := parts[3]
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.state == raftLeader || n.leader != "" && n.leader != candidate && time.Since(n.leaderContact) < n.electionTimeout {
+		return fmt.Sprintf("%d 0", n.term)
+	}
+	if term > n.term {
+		n.setTerm(term)
+	}
+	myLast := n.lastIndex()
+	upToDate := lastTerm > n.termAt(myLast) || lastTerm == n.termAt(myLast) && lastIndex >= myLast
+	if term < n.term || !upToDate || n.votedFor != "" && n.votedFor != candidate {
+		return fmt.Sprintf("%d 0", n.term)
+	}
+	n.votedFor = candidate
+	n.persistState()
+	n.resetDeadline()
+	return fmt.Sprintf("%d 1", n.term)
+}
+
+// acceptLeader records that leader leads term, which is at least ours. The
+// caller must hold n.mu.
+func (n *raftNode) acceptLeader(term int64, leader string) {
+	if term > n.term {
+		n.setTerm(term)
+	} else if n.state != raftFollower {
+		n.becomeFollower()
+	}
+	n.leader = leader
+	n.leaderContact = time.Now()
+	n.resetDeadline()
+}
+
+// appendEntriesRPC implements RAFT APPENDENTRIES term leader prevIndex
+// prevTerm leaderCommit [entry ...]. It replies with our term, whether the
+// entries were taken and the index the leader should go on from.
+func (n *raftNode) appendEntriesRPC(parts []string) string {
+	term, err1 := strconv.ParseInt(parts[2], 10, 64)
+	prevIndex, err2 := strconv.ParseInt(parts[4], 10, 64)
+	prevTerm, err3 := strconv.ParseInt(parts[5], 10, 64)
+	leaderCommit, err4 := strconv.ParseInt(parts[6], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return "ERR value is not an integer or out of range"
+	}
+	entries := make([]raftEntry, 0, len(parts)-7)
+	for _, encoded := range parts[7:] {
+		fields, err := readAOFCommand(bufio.NewReader(strings.NewReader(encoded)))
+		if err != nil {
+			return "ERR bad raft entry: " + err.Error()
+		}
+		e, err := decodeRaftEntry(fields)
+		if err != nil {
+			return "ERR " + err.Error()
+		}
+		entries = append(entries, e)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if term < n.term {
+		return fmt.Sprintf("%d 0 %d", n.term, n.lastIndex())
+	}
+	n.acceptLeader(term, parts[3])
+	if prevIndex > n.lastIndex() {
+		return fmt.Sprintf("%d 0 %d", n.term, n.lastIndex())
+	}
+	if prevIndex >= n.snapshot.index && n.termAt(prevIndex) != prevTerm {
+		// Skip the whole conflicting term rather than one entry at a time
+		conflict := n.termAt(prevIndex)
+		hint := prevIndex - 1
+		for hint > n.snapshot.index && n.termAt(hint) == conflict {
+			hint--
+		}
+		return fmt.Sprintf("%d 0 %d", n.term, hint)
+	}
+	var added []raftEntry
+	for i, e := range entries {
+		if e.Index <= n.snapshot.index {
+			continue
+		}
+		if e.Index <= n.lastIndex() {
+			if n.termAt(e.Index) == e.Term {
+				continue
+			}
+			n.truncateFrom(e.Index)
+		}
+		added = entries[i:]
+		break
+	}
+	if len(added) > 0 {
+		n.appendEntries(added...)
+	}
+	lastNew := prevIndex + int64(len(entries))
+	n.setCommitIndex(min(leaderCommit, lastNew))
+	return fmt.Sprintf("%d 1 %d", n.term, lastNew)
+}
+
+// installSnapshot implements RAFT INSTALLSNAPSHOT term leader data, where
+// data is a snapshot file. It replaces the dataset of a follower too far
+// behind the log of the leader.
+func (n *raftNode) installSnapshot(parts []string) string {
+	term, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return "ERR value is not an integer or out of range"
+	}
+	fresh := newDatabases(len(n.dbs))
+	info, err := readRaftSnapshot(bytes.NewReader([]byte(parts[4])), fresh)
+	if err != nil {
+		return "ERR bad raft snapshot: " + err.Error()
+	}
+
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	if term < n.term {
+		defer n.mu.Unlock()
+		return strconv.FormatInt(n.term, 10)
+	}
+	n.acceptLeader(term, parts[3])
+	if info.index <= n.lastApplied {
+		defer n.mu.Unlock()
+		return strconv.FormatInt(n.term, 10)
+	}
+	if err := n.storage.saveSnapshot([]byte(parts[4])); err != nil {
+		defer n.mu.Unlock()
+		return "ERR " + err.Error()
+	}
+	if n.termAt(info.index) == info.term {
+		n.log = append([]raftEntry(nil), n.log[info.index-n.snapshot.index:]...)
+	} else {
+		n.log = nil
+	}
+	n.snapshot = info
+	if err := n.storage.rewriteLog(n.log); err != nil {
+		log.Fatalf("Error writing the raft log: %v", err)
+	}
+	n.members = n.membersAt(n.lastIndex())
+	n.commitIndex = max(n.commitIndex, info.index)
+	n.lastApplied = info.index
+	replyTerm := n.term
+	n.mu.Unlock()
+
+	propagateMu.Lock()
+	for i, kv := range n.dbs {
+		kv.takeOver(fresh[i])
+	}
+	propagateMu.Unlock()
+	log.Printf("Raft node %s installed a snapshot up to %d", n.id, info.index)
+	return strconv.FormatInt(replyTerm, 10)
+}
+
+// changeMembers proposes the configuration members, once no other change
+// is under way.
+func (n *raftNode) changeMembers(change func(members map[string]string) string) string {
+	n.mu.Lock()
+	if reply := n.notLeaderLocked(); reply != "" {
+		n.mu.Unlock()
+		return reply
+	}
+	if n.commitIndex < n.leaderStart {
+		n.mu.Unlock()
+		return "TRYAGAIN the new leader hasn't committed an entry yet"
+	}
+	for i := n.lastIndex(); i > n.commitIndex; i-- {
+		if n.entry(i).Kind == raftConfig {
+			n.mu.Unlock()
+			return "ERR another membership change is in progress"
+		}
+	}
+	members := make(map[string]string, len(n.members))
+	for id, addr := range n.members {
+		members[id] = addr
+	}
+	if reply := change(members); reply != "" {
+		n.mu.Unlock()
+		return reply
+	}
+	n.mu.Unlock()
+	return n.propose(raftConfig, 0, formatRaftMembers(members))
+}
+
+// nodes describes the members for RAFT NODES, one per line.
+func (n *raftNode) nodes() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ids := make([]string, 0, len(n.members))
+	for id := range n.members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	lines := make([]string, len(ids))
+	for i, id := range ids {
+		role := raftFollower
+		if id == n.leader {
+			role = raftLeader
+		}
+		if id == n.id {
+			role += ",myself"
+		}
+		line := fmt.Sprintf("%s %s %s", id, n.members[id], role)
+		if p := n.peers[id]; p != nil {
+			line += fmt.Sprintf(" match %d", p.matchIndex)
+		}
+		lines[i] = line
+	}
+	return strings.Join(lines, "\n")
+}
+
+// raftInfo returns the lines of the INFO raft section.
+func raftInfo() string {
+	if raft == nil {
+		return "raft_enabled:0\r\n"
+	}
+	n := raft
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var b strings.Builder
+	b.WriteString("raft_enabled:1\r\n")
+	b.WriteString(fmt.Sprintf("raft_node_id:%s\r\n", n.id))
+	b.WriteString(fmt.Sprintf("raft_role:%s\r\n", n.state))
+	b.WriteString(fmt.Sprintf("raft_leader_id:%s\r\n", n.leader))
+	b.WriteString(fmt.Sprintf("raft_current_term:%d\r\n", n.term))
+	b.WriteString(fmt.Sprintf("raft_commit_index:%d\r\n", n.commitIndex))
+	b.WriteString(fmt.Sprintf("raft_last_applied:%d\r\n", n.lastApplied))
+	b.WriteString(fmt.Sprintf("raft_last_log_index:%d\r\n", n.lastIndex()))
+	b.WriteString(fmt.Sprintf("raft_snapshot_index:%d\r\n", n.snapshot.index))
+	b.WriteString(fmt.Sprintf("raft_members:%d\r\n", len(n.members)))
+	return b.String()
+}
+
+// command implements the RAFT subcommands, those members send each other
+// and those for clients.
+func (n *raftNode) command(parts []string) string {
+	n.mu.Lock()
+	stopped := n.stopped
+	n.mu.Unlock()
+	if stopped {
+		return "ERR raft node is shutting down"
+	}
+	subcommand := strings.ToUpper(parts[1])
+	switch {
+	case subcommand == "REQUESTVOTE" && len(parts) == 6:
+		return n.requestVote(parts)
+	case subcommand == "APPENDENTRIES" && len(parts) >= 7:
+		return n.appendEntriesRPC(parts)
+	case subcommand == "INSTALLSNAPSHOT" && len(parts) == 5:
+		return n.installSnapshot(parts)
+	case subcommand == "ADDNODE" && len(parts) == 4:
+		id, addr := parts[2], parts[3]
+		return n.changeMembers(func(members map[string]string) string {
+			if _, ok := members[id]; ok {
+				return "ERR node " + id + " is already a member"
+			}
+			members[id] = addr
+			return ""
+		})
+	case subcommand == "REMOVENODE" && len(parts) == 3:
+		id := parts[2]
+		return n.changeMembers(func(members map[string]string) string {
+			if _, ok := members[id]; !ok {
+				return "ERR node " + id + " is not a member"
+			}
+			if len(members) == 1 {
+				return "ERR can't remove the last member"
+			}
+			delete(members, id)
+			return ""
+		})
+	case subcommand == "NODES" && len(parts) == 2:
+		return n.nodes()
+	case subcommand == "LEADER" && len(parts) == 2:
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if addr, ok := n.members[n.leader]; ok && n.leader != "" {
+			return n.leader + " " + addr
+		}
+		return "(nil)"
+	}
+	return fmt.Sprintf("ERR unknown subcommand or wrong number of arguments for '%s'", parts[1])
+}
+
+// raftClientCommand runs the command of a client through the raft node, if
+// there is one. It reports false for the commands that run as usual.
+func raftClientCommand(db int, parts []string) (string, bool) {
+	if raft == nil {
+		return "", false
+	}
+	return raft.clientCommand(db, parts)
+}
+
+// RaftCommand implements RAFT subcommand [argument ...].
+func RaftCommand(parts []string) string {
+	if len(parts) < 2 {
+		return "ERR wrong number of arguments for 'raft' command"
+	}
+	if raft == nil {
+		return "ERR raft mode is not enabled"
+	}
+	return raft.command(parts)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dhravya/radish/redisproto"
+)
+
+// testRaftCluster runs raft nodes in the test process, each with its own
+// databases, directory and listener.
+type testRaftCluster struct {
+	t               *testing.T
+	snapshotEntries int64
+	// members is the -raft-cluster the first members are started with
+	members map[string]string
+	mu      sync.Mutex
+	nodes   map[string]*testRaftMember
+}
+
+type testRaftMember struct {
+	id   string
+	addr string
+	dir  string
+	// node is nil while the member is down
+	node *raftNode
+}
+
+func startTestRaftCluster(t *testing.T, ids []string, snapshotEntries int64) *testRaftCluster {
+	t.Helper()
+	c := &testRaftCluster{t: t, snapshotEntries: snapshotEntries, nodes: make(map[string]*testRaftMember)}
+	c.members = make(map[string]string)
+	for _, id := range ids {
+		m := c.listen(id)
+		c.members[id] = m.addr
+	}
+	for _, id := range ids {
+		c.start(id, c.members)
+	}
+	return c
+}
+
+// listen makes a member that isn't running yet.
+func (c *testRaftCluster) listen(id string) *testRaftMember {
+	c.t.Helper()
+	m := &testRaftMember{id: id, dir: c.t.TempDir()}
+	ln := listenTest(c.t, nil)
+	m.addr = ln.Addr().String()
+	c.mu.Lock()
+	c.nodes[id] = m
+	c.mu.Unlock()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go c.serve(m, conn)
+		}
+	}()
+	return m
+}
+
+func (c *testRaftCluster) serve(m *testRaftMember, conn net.Conn) {
+	defer conn.Close()
+	parser := redisproto.NewParser(conn)
+	writer := redisproto.NewWriter(bufio.NewWriter(conn))
+	for {
+		command, err := parser.ReadCommand()
+		if err != nil {
+			return
+		}
+		node := c.node(m.id)
+		if node == nil {
+			return
+		}
+		writer.WriteBulkString(node.command(commandParts(command)))
+		writer.Flush()
+	}
+}
+
+// start runs the member from what its directory holds.
+func (c *testRaftCluster) start(id string, members map[string]string) {
+	c.t.Helper()
+	c.mu.Lock()
+	m := c.nodes[id]
+	c.mu.Unlock()
+	node, err := newRaftNode(id, newDatabases(1), m.dir, members, 200*time.Millisecond, c.snapshotEntries)
+	if err != nil {
+		c.t.Fatalf("Expected raft node %s to start, Got: %v", id, err)
+	}
+	c.mu.Lock()
+	m.node = node
+	c.mu.Unlock()
+	c.t.Cleanup(node.close)
+}
+
+// stop takes the member down, like a crashed server.
+func (c *testRaftCluster) stop(id string) {
+	c.mu.Lock()
+	node := c.nodes[id].node
+	c.nodes[id].node = nil
+	c.mu.Unlock()
+	node.close()
+}
+
+func (c *testRaftCluster) node(id string) *raftNode {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nodes[id].node
+}
+
+// leader waits until one of the running members leads, and returns its id.
+func (c *testRaftCluster) leader() string {
+	c.t.Helper()
+	var leader string
+	waitUntil(c.t, "a raft leader to be elected", func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for id, m := range c.nodes {
+			if m.node == nil {
+				continue
+			}
+			m.node.mu.Lock()
+			leading := m.node.state == raftLeader
+			m.node.mu.Unlock()
+			if leading {
+				leader = id
+				return true
+			}
+		}
+		return false
+	})
+	return leader
+}
+
+// do runs a client command on the member.
+func (c *testRaftCluster) do(id string, args ...string) string {
+	node := c.node(id)
+	if strings.EqualFold(args[0], "RAFT") {
+		return node.command(args)
+	}
+	if reply, handled := node.clientCommand(0, args); handled {
+		return reply
+	}
+	return node.dbs[0].executeCommand(args)
+}
+
+// waitApplied waits until the member has value at key.
+func (c *testRaftCluster) waitApplied(id, key, value string) {
+	c.t.Helper()
+	waitUntil(c.t, fmt.Sprintf("%s to be set to %s on %s", key, value, id), func() bool {
+		node := c.node(id)
+		return node != nil && node.dbs[0].executeCommand([]string{"GET", key}) == value
+	})
+}
+
+func TestRaftReplicatesWrites(t *testing.T) {
+	c := startTestRaftCluster(t, []string{"a", "b", "c"}, 1000)
+	leader := c.leader()
+
+	if reply := c.do(leader, "SET", "k", "v"); reply != "OK" {
+		t.Fatalf("Expected the write to be committed, Got: %q", reply)
+	}
+	if reply := c.do(leader, "INCRBY", "n", "5"); reply != "(integer) 5" {
+		t.Fatalf("Expected the reply of the applied command, Got: %q", reply)
+	}
+	if reply := c.do(leader, "GET", "k"); reply != "v" {
+		t.Fatalf("Expected the leader to read its write, Got: %q", reply)
+	}
+	if reply := c.do(leader, "SPOP", "s"); !strings.HasPrefix(reply, "ERR SPOP is not allowed in raft mode") {
+		t.Fatalf("Expected SPOP to be refused, Got: %q", reply)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		c.waitApplied(id, "k", "v")
+		c.waitApplied(id, "n", "5")
+		if id == leader {
+			continue
+		}
+		expected := "NOTLEADER " + c.nodes[leader].addr
+		if reply := c.do(id, "SET", "k", "w"); reply != expected {
+			t.Fatalf("Expected a follower to redirect writes, Got: %q", reply)
+		}
+		if reply := c.do(id, "GET", "k"); reply != expected {
+			t.Fatalf("Expected a follower to redirect reads, Got: %q", reply)
+		}
+	}
+	if reply := c.do(leader, "RAFT", "LEADER"); reply != leader+" "+c.nodes[leader].addr {
+		t.Fatalf("Expected RAFT LEADER to name the leader, Got: %q", reply)
+	}
+}
+
+func TestRaftFailover(t *testing.T) {
+	c := startTestRaftCluster(t, []string{"a", "b", "c"}, 1000)
+	old := c.leader()
+	if reply := c.do(old, "SET", "k", "1"); reply != "OK" {
+		t.Fatalf("Expected the write to be committed, Got: %q", reply)
+	}
+
+	c.stop(old)
+	leader := c.leader()
+	if leader == old {
+		t.Fatalf("Expected another leader than %s", old)
+	}
+	if reply := c.do(leader, "GET", "k"); reply != "1" {
+		t.Fatalf("Expected the new leader to have the committed write, Got: %q", reply)
+	}
+	if reply := c.do(leader, "SET", "k", "2"); reply != "OK" {
+		t.Fatalf("Expected a majority to still commit writes, Got: %q", reply)
+	}
+
+	// The old leader recovers from its log and catches up as a follower
+	c.start(old, c.members)
+	c.waitApplied(old, "k", "2")
+	if reply := c.do(old, "SET", "k", "3"); !strings.HasPrefix(reply, "NOTLEADER ") {
+		t.Fatalf("Expected the old leader to follow, Got: %q", reply)
+	}
+}
+
+func TestRaftChecksMemoryOnlyOnTheLeader(t *testing.T) {
+	c := startTestRaftCluster(t, []string{"a", "b", "c"}, 1000)
+	leader := c.leader()
+	if reply := c.do(leader, "SET", "k", "v"); reply != "OK" {
+		t.Fatalf("Expected the write to be committed, Got: %q", reply)
+	}
+
+	maxMemory, maxMemoryPolicy = 1, policyAllKeysRandom
+	defer func() { maxMemory, maxMemoryPolicy = 0, policyNoEviction }()
+	if reply := c.do(leader, "SET", "x", "1"); reply != oomReply {
+		t.Fatalf("Expected the leader to refuse the write, Got: %q", reply)
+	}
+	// An entry already in the log is applied everywhere, without evicting
+	if reply := c.node(leader).propose(raftCommand, 0, []string{"SET", "x", "1"}); reply != "OK" {
+		t.Fatalf("Expected the entry to be applied, Got: %q", reply)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		c.waitApplied(id, "x", "1")
+		if reply := c.node(id).dbs[0].executeCommand([]string{"GET", "k"}); reply != "v" {
+			t.Fatalf("Expected nothing to be evicted on %s, Got: %q", id, reply)
+		}
+	}
+}
+
+func TestRaftSnapshotsAndMembership(t *testing.T) {
+	c := startTestRaftCluster(t, []string{"a", "b", "c"}, 5)
+	leader := c.leader()
+	for i := 0; i < 20; i++ {
+		if reply := c.do(leader, "SET", fmt.Sprintf("k%d", i), fmt.Sprint(i)); reply != "OK" {
+			t.Fatalf("Expected the write to be committed, Got: %q", reply)
+		}
+	}
+	waitUntil(t, "the leader to compact its log", func() bool {
+		n := c.node(leader)
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		return n.snapshot.index >= 5 && !n.snapshotting
+	})
+
+	// A new member gets the snapshot and the rest of the log
+	d := c.listen("d")
+	c.start("d", nil)
+	if reply := c.do(leader, "RAFT", "ADDNODE", "d", d.addr); reply != "OK" {
+		t.Fatalf("Expected the node to be added, Got: %q", reply)
+	}
+	c.waitApplied("d", "k0", "0")
+	c.waitApplied("d", "k19", "19")
+	if reply := c.do(leader, "RAFT", "ADDNODE", "d", d.addr); reply != "ERR node d is already a member" {
+		t.Fatalf("Expected a member not to be added twice, Got: %q", reply)
+	}
+
+	var follower string
+	for _, id := range []string{"a", "b", "c"} {
+		if id != leader {
+			follower = id
+			break
+		}
+	}
+	if reply := c.do(leader, "RAFT", "REMOVENODE", follower); reply != "OK" {
+		t.Fatalf("Expected the node to be removed, Got: %q", reply)
+	}
+	nodes := c.do(leader, "RAFT", "NODES")
+	if strings.Count(nodes, "\n") != 2 || strings.Contains(nodes, follower+" ") || !strings.Contains(nodes, leader+" "+c.nodes[leader].addr+" leader,myself") {
+		t.Fatalf("Expected three members led by %s, Got: %q", leader, nodes)
+	}
+	if reply := c.do(leader, "SET", "after", "removal"); reply != "OK" {
+		t.Fatalf("Expected the new configuration to commit writes, Got: %q", reply)
+	}
+	c.waitApplied("d", "after", "removal")
+
+	// Every member recovers its dataset from its snapshot and log
+	for _, id := range []string{"a", "b", "c", "d"} {
+		c.stop(id)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		c.start(id, c.members)
+	}
+	c.start("d", nil)
+	leader = c.leader()
+	if leader == follower {
+		t.Fatalf("Expected the removed node not to lead")
+	}
+	if reply := c.do(leader, "GET", "k7"); reply != "7" {
+		t.Fatalf("Expected the dataset to survive a restart, Got: %q", reply)
+	}
+	if reply := c.do(leader, "GET", "after"); reply != "removal" {
+		t.Fatalf("Expected the dataset to survive a restart, Got: %q", reply)
+	}
+}
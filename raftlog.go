@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Raft node keeps three files in its directory. "state" holds the current
+// term and who the node voted for in it, replaced atomically whenever
+// either changes. "log" holds the entries after the last snapshot, each one
+// written as a RESP command like in the append-only file and synced before
+// the node acknowledges it. "snapshot.rdb" holds the dataset as of an index
+// of the log, with the index, its term and the members of the cluster then
+// in aux fields.
+
+const (
+	raftStateFile    = "state"
+	raftLogFile      = "log"
+	raftSnapshotFile = "snapshot.rdb"
+)
+
+// Kinds of Raft log entries
+const (
+	raftCommand = "command"
+	raftConfig  = "config"
+	raftNoop    = "noop"
+)
+
+// raftEntry is an entry of the Raft log. Parts is the write command to run
+// on database DB, or the members of the cluster as id=addr for a config
+// entry.
+type raftEntry struct {
+	Index int64
+	Term  int64
+	Kind  string
+	DB    int
+	Parts []string
+}
+
+func (e raftEntry) encode() []byte {
+	return appendRESPCommand(nil, append([]string{
+		strconv.FormatInt(e.Index, 10), strconv.FormatInt(e.Term, 10), e.Kind, strconv.Itoa(e.DB),
+	}, e.Parts...)...)
+}
+
+func decodeRaftEntry(fields []string) (raftEntry, error) {
+	if len(fields) < 4 {
+		return raftEntry{}, errors.New("short raft entry")
+	}
+	index, err1 := strconv.ParseInt(fields[0], 10, 64)
+	term, err2 := strconv.ParseInt(fields[1], 10, 64)
+	db, err3 := strconv.Atoi(fields[3])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return raftEntry{}, fmt.Errorf("bad raft entry header %q", fields[:4])
+	}
+	return raftEntry{Index: index, Term: term, Kind: fields[2], DB: db, Parts: fields[4:]}, nil
+}
+
+// parseRaftMembers parses members given as id=addr, separated by spaces or
+// commas.
+func parseRaftMembers(s string) (map[string]string, error) {
+	members := make(map[string]string)
+	for _, member := range strings.FieldsFunc(s, func(r rune) bool { return r == ' ' || r == ',' }) {
+		id, addr, ok := strings.Cut(member, "=")
+		if !ok || id == "" || addr == "" {
+			return nil, fmt.Errorf("expected id=host:port, got %q", member)
+		}
+		members[id] = addr
+	}
+	return members, nil
+}
+
+// formatRaftMembers returns members as sorted id=addr strings.
+func formatRaftMembers(members map[string]string) []string {
+	list := make([]string, 0, len(members))
+	for id, addr := range members {
+		list = append(list, id+"="+addr)
+	}
+	sort.Strings(list)
+	return list
+}
+
+type raftStorage struct {
+	dir     string
+	logFile *os.File
+}
+
+func openRaftStorage(dir string) (*raftStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &raftStorage{dir: dir}, nil
+}
+
+func (st *raftStorage) path(name string) string {
+	return filepath.Join(st.dir, name)
+}
+
+// replaceFile writes a file through a temporary one, so it is either
+// replaced as a whole or not at all.
+func (st *raftStorage) replaceFile(name string, write func(io.Writer) error) error {
+	tmp, err := os.CreateTemp(st.dir, name+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), st.path(name))
+}
+
+func (st *raftStorage) loadState() (int64, string, error) {
+	b, err := os.ReadFile(st.path(raftStateFile))
+	if os.IsNotExist(err) {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	var term int64
+	var votedFor string
+	if _, err := fmt.Sscanf(string(b), "%d %s", &term, &votedFor); err != nil {
+		return 0, "", fmt.Errorf("bad raft state file: %w", err)
+	}
+	if votedFor == "-" {
+		votedFor = ""
+	}
+	return term, votedFor, nil
+}
+
+func (st *raftStorage) saveState(term int64, votedFor string) error {
+	if votedFor == "" {
+		votedFor = "-"
+	}
+	return st.replaceFile(raftStateFile, func(w io.Writer) error {
+		_, err := fmt.Fprintf(w, "%d %s\n", term, votedFor)
+		return err
+	})
+}
+
+// loadLog reads the entries of the log file. A last entry cut short by a
+// crash was never acknowledged, and is dropped.
+func (st *raftStorage) loadLog() ([]raftEntry, error) {
+	file, err := os.Open(st.path(raftLogFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	var entries []raftEntry
+	for {
+		fields, err := readAOFCommand(r)
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			log.Printf("Dropping the truncated last entry of the raft log")
+			return entries, st.rewriteLog(entries)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad raft log: %w", err)
+		}
+		entry, err := decodeRaftEntry(fields)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+}
+
+func (st *raftStorage) openLog() error {
+	file, err := os.OpenFile(st.path(raftLogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	st.logFile = file
+	return nil
+}
+
+// appendLog adds entries to the log file and syncs it.
+func (st *raftStorage) appendLog(entries []raftEntry) error {
+	if st.logFile == nil {
+		if err := st.openLog(); err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	for _, e := range entries {
+		buf.Write(e.encode())
+	}
+	if _, err := st.logFile.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return st.logFile.Sync()
+}
+
+// rewriteLog replaces the log file with entries, after dropping a conflicting
+// end of it or the part a snapshot covers.
+func (st *raftStorage) rewriteLog(entries []raftEntry) error {
+	if st.logFile != nil {
+		st.logFile.Close()
+		st.logFile = nil
+	}
+	err := st.replaceFile(raftLogFile, func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		for _, e := range entries {
+			bw.Write(e.encode())
+		}
+		return bw.Flush()
+	})
+	if err != nil {
+		return err
+	}
+	return st.openLog()
+}
+
+// raftSnapshotInfo is what a snapshot file says about itself.
+type raftSnapshotInfo struct {
+	index   int64
+	term    int64
+	members map[string]string
+}
+
+// readRaftSnapshot loads a snapshot into dbs, which are expected to be
+// empty.
+func readRaftSnapshot(r io.Reader, dbs []*KeyValueStore) (raftSnapshotInfo, error) {
+	aux := make(map[string]string)
+	if err := readRDB(r, dbs, aux); err != nil {
+		return raftSnapshotInfo{}, err
+	}
+	index, err1 := strconv.ParseInt(aux["raft-index"], 10, 64)
+	term, err2 := strconv.ParseInt(aux["raft-term"], 10, 64)
+	members, err3 := parseRaftMembers(aux["raft-members"])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return raftSnapshotInfo{}, errors.New("snapshot without raft index, term or members")
+	}
+	return raftSnapshotInfo{index: index, term: term, members: members}, nil
+}
+
+// loadSnapshot loads the snapshot file into dbs, if there is one.
+func (st *raftStorage) loadSnapshot(dbs []*KeyValueStore) (raftSnapshotInfo, bool, error) {
+	file, err := os.Open(st.path(raftSnapshotFile))
+	if os.IsNotExist(err) {
+		return raftSnapshotInfo{}, false, nil
+	}
+	if err != nil {
+		return raftSnapshotInfo{}, false, err
+	}
+	defer file.Close()
+	info, err := readRaftSnapshot(bufio.NewReader(file), dbs)
+	if err != nil {
+		return raftSnapshotInfo{}, false, fmt.Errorf("bad raft snapshot: %w", err)
+	}
+	return info, true, nil
+}
+
+// writeSnapshot writes dbs as the snapshot of the log up to info.index.
+func (st *raftStorage) writeSnapshot(dbs []*KeyValueStore, info raftSnapshotInfo) error {
+	return st.replaceFile(raftSnapshotFile, func(w io.Writer) error {
+		return writeRDB(w, dbs,
+			[2]string{"raft-index", strconv.FormatInt(info.index, 10)},
+			[2]string{"raft-term", strconv.FormatInt(info.term, 10)},
+			[2]string{"raft-members", strings.Join(formatRaftMembers(info.members), ",")})
+	})
+}
+
+// saveSnapshot stores a snapshot received from the leader as it is.
+func (st *raftStorage) saveSnapshot(data []byte) error {
+	return st.replaceFile(raftSnapshotFile, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+func (st *raftStorage) close() {
+	if st.logFile != nil {
+		st.logFile.Close()
+		st.logFile = nil
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/dhravya/radish/internal/rdb"
+)
+
+// Values are serialized in the Redis RDB object format, which is what DUMP
+// hands out, RESTORE takes back and RDB files are made of. Collections held
+// in a compact encoding are written as the listpack or intset they are, like
+// Redis 7 does, lists always as a quicklist of listpacks, and hashes whose
+// fields carry TTLs use the hash-with-metadata type of RDB 12. Reading also
+// accepts the ziplist based types of older versions. Streams can be read
+// but not stored, so they are skipped.
+
+// errRDBStreamSkipped is returned for a stream value once it has been read
+// past, as there is nowhere to store it.
+var errRDBStreamSkipped = errors.New("streams are not supported")
+
+// appendRDBValue writes the type byte and the serialized value of v.
+func appendRDBValue(b []byte, v keyValue) []byte {
+	switch v.typ {
+	case "string":
+		b = append(b, rdb.TypeString)
+		b = rdb.AppendString(b, v.str)
+	case "list":
+		b = append(b, rdb.TypeListQuicklist2)
+		nodes := v.list.packedNodes()
+		b = rdb.AppendLen(b, uint64(len(nodes)))
+		for _, node := range nodes {
+			b = rdb.AppendLen(b, rdb.QuicklistNodePacked)
+			b = rdb.AppendBytes(b, node)
+		}
+	case "set":
+		switch v.set.enc {
+		case setEncodingIntset:
+			b = append(b, rdb.TypeSetIntset)
+			b = rdb.AppendBytes(b, rdb.AppendIntset(nil, v.set.ints))
+		case setEncodingListpack:
+			b = append(b, rdb.TypeSetListpack)
+			b = rdb.AppendBytes(b, v.set.lp)
+		default:
+			b = append(b, rdb.TypeSet)
+			b = rdb.AppendLen(b, uint64(v.set.Len()))
+			v.set.Range(func(member string) bool {
+				b = rdb.AppendString(b, member)
+				return true
+			})
+		}
+	case "zset":
+		if v.zset.zsl == nil {
+			b = append(b, rdb.TypeZSetListpack)
+			b = rdb.AppendBytes(b, v.zset.lp)
+			break
+		}
+		b = append(b, rdb.TypeZSet2)
+		b = rdb.AppendLen(b, uint64(v.zset.Len()))
+		// Highest scores first, so loading only ever inserts at the head
+		for _, m := range v.zset.RangeByRank(0, v.zset.Len()-1, true) {
+			b = rdb.AppendString(b, m.Member)
+			b = rdb.AppendDouble(b, m.Score)
+		}
+	case "hash":
+		if len(v.fieldTTLs) == 0 && v.hash.dict == nil {
+			b = append(b, rdb.TypeHashListpack)
+			b = rdb.AppendBytes(b, v.hash.lp)
+			break
+		}
+		if len(v.fieldTTLs) == 0 {
+			b = append(b, rdb.TypeHash)
+			b = rdb.AppendLen(b, uint64(v.hash.Len()))
+			v.hash.Range(func(field, value string) bool {
+				b = rdb.AppendString(b, field)
+				b = rdb.AppendString(b, value)
+				return true
+			})
+			break
+		}
+		// Field TTLs are stored relative to the earliest one, 0 meaning none
+		minExpire := int64(math.MaxInt64)
+		for _, expiration := range v.fieldTTLs {
+			minExpire = min(minExpire, expiration.UnixMilli())
+		}
+		b = append(b, rdb.TypeHashMetadata)
+		b = binary.LittleEndian.AppendUint64(b, uint64(minExpire))
+		b = rdb.AppendLen(b, uint64(v.hash.Len()))
+		v.hash.Range(func(field, value string) bool {
+			ttl := uint64(0)
+			if expiration, ok := v.fieldTTLs[field]; ok {
+				ttl = uint64(expiration.UnixMilli()-minExpire) + 1
+			}
+			b = rdb.AppendLen(b, ttl)
+			b = rdb.AppendString(b, field)
+			b = rdb.AppendString(b, value)
+			return true
+		})
+	}
+	return b
+}
+
+// keyValueFromRDB converts a value read from RDB data.
+func keyValueFromRDB(v rdb.Value) (keyValue, error) {
+	switch v.Type {
+	case "string":
+		return keyValue{typ: "string", str: v.String}, nil
+	case "list":
+		return keyValue{typ: "list", list: listFromSlice(v.Elements)}, nil
+	case "set":
+		set := NewSet()
+		for _, member := range v.Elements {
+			set.Add(member)
+		}
+		return keyValue{typ: "set", set: set}, nil
+	case "zset":
+		zset := NewSortedSet()
+		for _, m := range v.Members {
+			zset.Add(m.Member, m.Score)
+		}
+		return keyValue{typ: "zset", zset: zset}, nil
+	case "hash":
+		h := keyValue{typ: "hash", hash: NewHash()}
+		for _, f := range v.Fields {
+			h.hash.Set(f.Field, f.Value)
+		}
+		for field, deadline := range v.FieldTTLs {
+			if h.fieldTTLs == nil {
+				h.fieldTTLs = make(map[string]time.Time)
+			}
+			h.fieldTTLs[field] = time.UnixMilli(deadline)
+		}
+		return h, nil
+	}
+	return keyValue{}, errRDBStreamSkipped
+}
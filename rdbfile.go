@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dhravya/radish/internal/rdb"
+)
+
+// A data file whose name ends in .rdb is written as a Redis RDB file, so it
+// can be fed to RDB tools, and a dump.rdb written by Redis can be loaded to
+// migrate its data. The file starts with the "REDIS" magic and a four digit
+// version, followed by aux fields describing the server. Every non-empty
+// database then gets a SELECTDB opcode and a RESIZEDB hint, followed by its
+// keys, each preceded by its expire time and, under an LRU or LFU policy, by
+// its idle time or access frequency. An EOF opcode and the CRC-64 of
+// everything before it end the file.
+
+// rdbRedisVersion is the Redis release whose file format is written, reported
+// in the redis-ver aux field for tools that check it.
+const rdbRedisVersion = "7.4.0"
+
+// isRDBFile reports whether dataFile should be written in the RDB format.
+func isRDBFile(dataFile string) bool {
+	return strings.HasSuffix(dataFile, ".rdb")
+}
+
+// writeRDB writes databases to w as an RDB file, with extra aux fields after
+// the usual ones. The caller must hold their locks.
+func writeRDB(w io.Writer, databases []*KeyValueStore, extra ...[2]string) error {
+	bw := bufio.NewWriter(w)
+	var crc uint64
+	write := func(b []byte) error {
+		crc = rdb.CRC64(crc, b)
+		_, err := bw.Write(b)
+		return err
+	}
+
+	b := fmt.Appendf(nil, "%s%04d", rdb.Magic, rdb.Version)
+	aux := [][2]string{
+		{"redis-ver", rdbRedisVersion},
+		{"redis-bits", "64"},
+		{"ctime", strconv.FormatInt(time.Now().Unix(), 10)},
+		{"used-mem", strconv.FormatUint(readMemStats().Alloc, 10)},
+		{"aof-base", "0"},
+	}
+	aux = append(aux, extra...)
+	for _, field := range aux {
+		b = append(b, rdb.OpcodeAux)
+		b = rdb.AppendString(b, field[0])
+		b = rdb.AppendString(b, field[1])
+	}
+	if err := write(b); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for i, kv := range databases {
+		var keys []string
+		expires := 0
+		kv.eachKey(func(key string) {
+			if v, _ := kv.getKeyValue(key); rdbValueEmpty(v) {
+				return
+			}
+			keys = append(keys, key)
+			if _, ok := kv.Expirations[key]; ok {
+				expires++
+			}
+		})
+		if len(keys) == 0 {
+			continue
+		}
+		b = append(b[:0], rdb.OpcodeSelectDB)
+		b = rdb.AppendLen(b, uint64(i))
+		b = append(b, rdb.OpcodeResizeDB)
+		b = rdb.AppendLen(b, uint64(len(keys)))
+		b = rdb.AppendLen(b, uint64(expires))
+		if err := write(b); err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			v, _ := kv.getKeyValue(key)
+			b = b[:0]
+			if !v.expireAt.IsZero() {
+				b = append(b, rdb.OpcodeExpireTimeMS)
+				b = binary.LittleEndian.AppendUint64(b, uint64(v.expireAt.UnixMilli()))
+			}
+			switch maxMemoryPolicy {
+			case policyAllKeysLRU, policyVolatileLRU:
+				access := kv.keyAccessOf(key)
+				b = append(b, rdb.OpcodeIdle)
+				b = rdb.AppendLen(b, uint64(max(now.Sub(access.lastAccess)/time.Second, 0)))
+			case policyAllKeysLFU, policyVolatileLFU:
+				access := kv.keyAccessOf(key)
+				b = append(b, rdb.OpcodeFreq, access.decayedCounter(now))
+			}
+			// The value starts with its type, which goes before the key
+			value := appendRDBValue(nil, v)
+			b = append(b, value[0])
+			b = rdb.AppendString(b, key)
+			b = append(b, value[1:]...)
+			if err := write(b); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := write([]byte{rdb.OpcodeEOF}); err != nil {
+		return err
+	}
+	if _, err := bw.Write(binary.LittleEndian.AppendUint64(nil, crc)); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// rdbValueEmpty reports whether v is a collection without elements, which
+// Redis never writes and refuses to load.
+func rdbValueEmpty(v keyValue) bool {
+	switch v.typ {
+	case "list":
+		return v.list.Len() == 0
+	case "hash":
+		return v.hash.Len() == 0
+	case "set":
+		return v.set.Len() == 0
+	case "zset":
+		return v.zset.Len() == 0
+	}
+	return false
+}
+
+// readRDB loads an RDB file into databases, which are expected to be empty.
+// Keys that have expired are dropped, and streams, which have nowhere to go,
+// are skipped with a warning. The aux fields are stored in aux unless it is
+// nil.
+func readRDB(r io.Reader, databases []*KeyValueStore, aux map[string]string) error {
+	now := time.Now()
+	loaded, skipped := 0, 0
+	_, err := rdb.NewReader(r).ReadFile(rdb.Handler{
+		Aux: func(field, value string) {
+			if aux != nil {
+				aux[field] = value
+			}
+		},
+		SelectDB: func(db int) error {
+			if db >= len(databases) {
+				return fmt.Errorf("RDB file uses database %d, but only %d databases are configured", db, len(databases))
+			}
+			return nil
+		},
+		Function: func() {
+			log.Printf("Skipped a function library in the RDB file, functions are not supported")
+		},
+		Key: func(k rdb.Key) error {
+			v, err := keyValueFromRDB(k.Value)
+			if errors.Is(err, errRDBStreamSkipped) {
+				skipped++
+				return nil
+			}
+			if k.ExpireAt != 0 {
+				v.expireAt = time.UnixMilli(k.ExpireAt)
+				if !now.Before(v.expireAt) {
+					return nil
+				}
+			}
+			db := databases[k.DB]
+			db.deleteKey(k.Key)
+			db.setKeyValue(k.Key, v)
+			db.expireHashFields(k.Key)
+			if k.Idle >= 0 || k.Freq >= 0 {
+				db.setKeyAccess(k.Key, k.Idle, k.Freq)
+			}
+			loaded++
+			return nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if skipped > 0 {
+		log.Printf("Skipped %d streams in the RDB file, streams are not supported", skipped)
+	}
+	log.Printf("Loaded %d keys from the RDB file", loaded)
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dhravya/radish/internal/rdb"
+)
+
+func TestRDBFileRoundTrip(t *testing.T) {
+	databases := newDatabases(2)
+	kv := databases[0]
+	kv.executeCommand([]string{"SET", "string", "binary\x00\r\nvalue"})
+	kv.executeCommand([]string{"SET", "ttl", "v"})
+	kv.executeCommand([]string{"PEXPIRE", "ttl", "100000"})
+	kv.executeCommand([]string{"RPUSH", "small", "a", "1"})
+	kv.executeCommand([]string{"RPUSH", "big", "head", strings.Repeat("x", 9000)})
+	for i := 0; i < 2000; i++ {
+		kv.executeCommand([]string{"RPUSH", "big", strconv.Itoa(i)})
+	}
+	kv.executeCommand([]string{"HSET", "hash", "f1", "v1", "f2", "v2"})
+	kv.executeCommand([]string{"HSET", "ttlhash", "f1", "v1", "f2", "v2"})
+	kv.executeCommand([]string{"HEXPIRE", "ttlhash", "100", "FIELDS", "1", "f1"})
+	kv.executeCommand([]string{"SADD", "ints", "3", "-1", "70000"})
+	kv.executeCommand([]string{"SADD", "strs", "a", "b"})
+	kv.executeCommand([]string{"SADD", "large", strings.Repeat("m", 100)})
+	kv.executeCommand([]string{"ZADD", "zset", "1.5", "a", "-inf", "b"})
+	kv.executeCommand([]string{"ZADD", "zlarge", "2", strings.Repeat("z", 100)})
+	kv.Lists["empty"] = NewList()
+	databases[1].executeCommand([]string{"SET", "other", "db"})
+
+	var buf bytes.Buffer
+	if err := writeRDB(&buf, databases); err != nil {
+		t.Fatalf("Expected the file to be written, Got: %v", err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("REDIS0012")) {
+		t.Fatalf("Expected the RDB header, Got: %q", buf.Bytes()[:9])
+	}
+
+	loaded := newDatabases(2)
+	if err := readRDB(bytes.NewReader(buf.Bytes()), loaded, nil); err != nil {
+		t.Fatalf("Expected the file to load, Got: %v", err)
+	}
+	for _, key := range []string{"string", "ttl", "small", "big", "hash", "ints", "strs", "large", "zset", "zlarge"} {
+		original, _ := kv.getKeyValue(key)
+		restored, exists := loaded[0].getKeyValue(key)
+		if !exists {
+			t.Fatalf("Expected %s to be loaded", key)
+		}
+		if string(createDumpPayload(original)) != string(createDumpPayload(restored)) {
+			t.Fatalf("Expected %s to survive a round trip", key)
+		}
+		if kv.objectEncoding(key) != loaded[0].objectEncoding(key) {
+			t.Fatalf("Expected %s to keep the %s encoding, Got: %s", key, kv.objectEncoding(key), loaded[0].objectEncoding(key))
+		}
+	}
+	if got := loaded[0].Expirations["ttl"]; !got.Equal(kv.Expirations["ttl"].Truncate(time.Millisecond)) {
+		t.Fatalf("Expected the TTL to survive, Got: %v", got)
+	}
+	if time.Until(loaded[0].HashFieldExpirations["ttlhash"]["f1"]) < 99*time.Second {
+		t.Fatalf("Expected the field TTL to survive")
+	}
+	if loaded[0].keyExists("empty") {
+		t.Fatalf("Expected the empty list to be left out")
+	}
+	if got := loaded[1].executeCommand([]string{"GET", "other"}); got != "db" {
+		t.Fatalf("Expected the second database to be loaded, Got: %q", got)
+	}
+
+	corrupted := bytes.Clone(buf.Bytes())
+	corrupted[len(corrupted)-20] ^= 0xff
+	if err := readRDB(bytes.NewReader(corrupted), newDatabases(2), nil); !errors.Is(err, rdb.ErrBadFormat) {
+		t.Fatalf("Expected a corrupted file to be rejected, Got: %v", err)
+	}
+	if err := readRDB(bytes.NewReader(buf.Bytes()), newDatabases(1), nil); err == nil {
+		t.Fatalf("Expected a missing database to be an error")
+	}
+}
+
+func TestRDBFileLoadsOlderEncodings(t *testing.T) {
+	file := []byte("REDIS0009")
+
+	// An intset of three 16 bit integers
+	intset := binary.LittleEndian.AppendUint32(nil, 2)
+	intset = binary.LittleEndian.AppendUint32(intset, 3)
+	for _, n := range []uint16{1, 2, 3} {
+		intset = binary.LittleEndian.AppendUint16(intset, n)
+	}
+	file = append(file, rdb.TypeSetIntset)
+	file = rdb.AppendString(file, "set")
+	file = rdb.AppendString(file, string(intset))
+
+	// A ziplist holding "ab" and the immediate integer 5
+	entries := []byte{0x00, 0x02, 'a', 'b', 0x04, 0xf6}
+	ziplist := binary.LittleEndian.AppendUint32(nil, uint32(10+len(entries)+1))
+	ziplist = binary.LittleEndian.AppendUint32(ziplist, 14)
+	ziplist = binary.LittleEndian.AppendUint16(ziplist, 2)
+	ziplist = append(append(ziplist, entries...), 0xff)
+	file = append(file, rdb.OpcodeExpireTime)
+	file = binary.LittleEndian.AppendUint32(file, uint32(time.Now().Add(time.Hour).Unix()))
+	file = append(file, rdb.TypeListZiplist)
+	file = rdb.AppendString(file, "list")
+	file = rdb.AppendString(file, string(ziplist))
+
+	// "abcabcabcabc" compressed with LZF
+	file = append(file, rdb.TypeString)
+	file = rdb.AppendString(file, "lzf")
+	file = append(file, 0xc3, 7, 12) // The LZF encoding, then both lengths
+	file = append(file, "\x02abc\xe0\x00\x02"...)
+
+	file = append(file, rdb.OpcodeExpireTimeMS)
+	file = binary.LittleEndian.AppendUint64(file, uint64(time.Now().Add(-time.Second).UnixMilli()))
+	file = append(file, rdb.TypeString)
+	file = rdb.AppendString(file, "expired")
+	file = rdb.AppendString(file, "v")
+
+	// A zero checksum is not verified
+	file = append(file, rdb.OpcodeEOF, 0, 0, 0, 0, 0, 0, 0, 0)
+
+	databases := newDatabases(1)
+	if err := readRDB(bytes.NewReader(file), databases, nil); err != nil {
+		t.Fatalf("Expected the file to load, Got: %v", err)
+	}
+	kv := databases[0]
+	if got := kv.executeCommand([]string{"SMEMBERS", "set"}); got != "1 2 3" {
+		t.Fatalf("Expected the intset members, Got: %q", got)
+	}
+	if got := kv.executeCommand([]string{"LRANGE", "list", "0", "-1"}); got != "ab 5" {
+		t.Fatalf("Expected the ziplist elements, Got: %q", got)
+	}
+	if time.Until(kv.Expirations["list"]) < 59*time.Minute {
+		t.Fatalf("Expected the expire time in seconds to be loaded")
+	}
+	if got := kv.executeCommand([]string{"GET", "lzf"}); got != "abcabcabcabc" {
+		t.Fatalf("Expected the LZF string to be expanded, Got: %q", got)
+	}
+	if kv.keyExists("expired") {
+		t.Fatalf("Expected the expired key to be dropped")
+	}
+}
@@ -16,8 +16,8 @@ var (
 	ErrLineTooLong     = errors.New("LineTooLong")
 
 	ReadBufferInitSize = 1 << 16
-	MaxNumArg          = 20
-	MaxBulkSize        = 1 << 16
+	MaxNumArg          = 1024 * 1024
+	MaxBulkSize        = 512 * 1024 * 1024
 	MaxTelnetLine      = 1 << 10
 	spaceSlice         = []byte{' '}
 	emptyBulk          = [0]byte{}
@@ -59,6 +59,8 @@ type Parser struct {
 	buffer        []byte
 	parsePosition int
 	writeIndex    int
+	maxNumArg     int
+	maxBulkSize   int
 }
 
 func max(a, b int) int {
@@ -68,7 +70,18 @@ func max(a, b int) int {
 	return b
 }
 func NewParser(reader io.Reader) *Parser {
-	return &Parser{reader: reader, buffer: make([]byte, ReadBufferInitSize)}
+	return &Parser{
+		reader:      reader,
+		buffer:      make([]byte, ReadBufferInitSize),
+		maxNumArg:   MaxNumArg,
+		maxBulkSize: MaxBulkSize,
+	}
+}
+
+// SetLimits sets the most arguments and the largest bulk that the commands
+// read from now on may have. They are MaxNumArg and MaxBulkSize by default.
+func (r *Parser) SetLimits(maxNumArg, maxBulkSize int) {
+	r.maxNumArg, r.maxBulkSize = maxNumArg, maxBulkSize
 }
 
 // ensure that we have enough space for writing 'req' byte
@@ -170,10 +183,14 @@ func (r *Parser) parseBinary() (*Command, error) {
 		return nil, r.discardNewLine() // null array
 	case numArg < -1:
 		return nil, ErrInvalidNumArg
-	case numArg > MaxNumArg:
+	case numArg > r.maxNumArg:
 		return nil, ErrInvalidNumArg
 	}
-	argv := make([][]byte, 0, numArg)
+	argc := numArg
+	if argc > 1024 {
+		argc = 1024 // grow as arguments actually arrive
+	}
+	argv := make([][]byte, 0, argc)
 	for i := 0; i < numArg; i++ {
 		if e = r.requireNBytes(1); e != nil {
 			return nil, e
@@ -194,15 +211,13 @@ func (r *Parser) parseBinary() (*Command, error) {
 			argv = append(argv, nil) // null bulk
 		case plen == 0:
 			argv = append(argv, emptyBulk[:]) // empty bulk
-		case plen > 0 && plen <= MaxBulkSize:
-			if e = r.requireNBytes(plen); e != nil {
+		case plen > 0 && plen <= r.maxBulkSize:
+			// Bulks are binary safe, so only the CRLF right after the
+			// announced length can tell whether the length was right
+			if e = r.requireNBytes(plen + 2); e != nil {
 				return nil, e
 			}
-			eol := bytes.IndexByte(r.buffer[r.parsePosition:], '\n')
-			if eol == -1 {
-				return nil, ErrInvalidBulkSize
-			}
-			if r.parsePosition+plen+1 != eol+r.parsePosition {
+			if r.buffer[r.parsePosition+plen] != '\r' || r.buffer[r.parsePosition+plen+1] != '\n' {
 				return nil, ErrInvalidBulkSize
 			}
 			argv = append(argv, r.buffer[r.parsePosition:(r.parsePosition+plen)])
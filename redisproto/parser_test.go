@@ -39,3 +39,51 @@ func TestParser_BulkString3(t *testing.T) {
 		t.Error("Expected InvalidBulkSize error")
 	}
 }
+
+func TestParser_ManyArgs(t *testing.T) {
+	var sb strings.Builder
+	sb.WriteString("*101\r\n$4\r\nhset\r\n")
+	for i := 0; i < 100; i++ {
+		sb.WriteString("$1\r\nx\r\n")
+	}
+	parser := NewParser(strings.NewReader(sb.String()))
+	cmd, err := parser.ReadCommand()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cmd.ArgCount() != 101 {
+		t.Errorf("Expected 101 arguments, Got: %d", cmd.ArgCount())
+	}
+}
+
+func TestParser_BinaryBulk(t *testing.T) {
+	value := "a\nb\r\nc\x00"
+	parser := NewParser(strings.NewReader("*2\r\n$7\r\nrestore\r\n$7\r\n" + value + "\r\n"))
+	cmd, err := parser.ReadCommand()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(cmd.Get(1)) != value {
+		t.Errorf("Expected %q, Got: %q", value, cmd.Get(1))
+	}
+}
+
+func TestParser_Limits(t *testing.T) {
+	parser := NewParser(strings.NewReader("*3\r\n$3\r\nget\r\n$1\r\nk\r\n$1\r\nx\r\n"))
+	parser.SetLimits(2, 4)
+	if _, err := parser.ReadCommand(); err != ErrInvalidNumArg {
+		t.Fatalf("Expected too many arguments to be refused, Got: %v", err)
+	}
+
+	parser = NewParser(strings.NewReader("*2\r\n$3\r\nget\r\n$5\r\nvalue\r\n"))
+	parser.SetLimits(2, 4)
+	if _, err := parser.ReadCommand(); err != ErrInvalidBulkSize {
+		t.Fatalf("Expected a bulk over the limit to be refused, Got: %v", err)
+	}
+
+	parser = NewParser(strings.NewReader("*2\r\n$3\r\nget\r\n$4\r\nfour\r\n"))
+	parser.SetLimits(2, 4)
+	if cmd, err := parser.ReadCommand(); err != nil || string(cmd.Get(1)) != "four" {
+		t.Fatalf("Expected a command within the limits, Got: %v", err)
+	}
+}
@@ -0,0 +1,961 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dhravya/radish/redisproto"
+)
+
+// Replication works like in Redis. A replica connects to its master, goes
+// through a short handshake and sends PSYNC with the replication ID and
+// offset it got to. The offset counts the bytes of the stream of write
+// commands the master propagates, so it means the same on the master and on
+// every replica. When the master still holds the stream from that offset on
+// in its backlog, it replies +CONTINUE and sends the missing part. Otherwise
+// it replies +FULLRESYNC, sends an RDB snapshot of its dataset and then the
+// commands propagated since the snapshot started. From then on the replica
+// applies the stream as it comes, acknowledging the offset it reached every
+// second, and refuses writes from clients. Replicas pass the stream on to
+// their own replicas exactly as they received it. A replica promoted with
+// REPLICAOF NO ONE keeps the ID of its old master as its secondary ID, so the
+// other replicas of that master can partially resync with it.
+
+var (
+	// replBacklogSize is how much of the stream is kept for partial resyncs
+	replBacklogSize int64 = 1 << 20
+	// masterAuth is the password to AUTH with on the master, if any
+	masterAuth string
+	// serverPort is the port this server listens on, which replicas tell
+	// their master about
+	serverPort int
+)
+
+const (
+	// replPingPeriod is how often a master sends PING down the stream, so
+	// its replicas can tell an idle master from a dead one
+	replPingPeriod = 10 * time.Second
+	// replTimeout is how long either side waits on the other before giving
+	// up on the link
+	replTimeout        = 60 * time.Second
+	replAckPeriod      = time.Second
+	replReconnectDelay = time.Second
+	// replicaOutputLimit is how much of the stream a replica may be behind
+	// on before it is disconnected
+	replicaOutputLimit = 256 << 20
+)
+
+// noReplID is reported as the secondary ID when there is none.
+const noReplID = "0000000000000000000000000000000000000000"
+
+var errReplicationStopped = errors.New("replication stopped")
+
+// replicaMode is set while this server is a replica, so the commands that
+// behave differently there can check it without locking.
+var replicaMode atomic.Bool
+
+type replicationState struct {
+	mu sync.Mutex
+	// id is the replication ID of the stream, and offset the number of
+	// bytes of it produced or received so far
+	id     string
+	offset int64
+	// id2 is the ID of the stream this one took over from, which replicas
+	// can still continue from up to secondOffset
+	id2          string
+	secondOffset int64
+	// backlog holds the end of the stream, nil until a replica connects
+	backlog *replBacklog
+	// acked is closed and replaced whenever a replica acknowledges an offset
+	acked chan struct{}
+	// db is the database the stream last selected, -1 when the next
+	// command has to be preceded by a SELECT
+	db       int
+	replicas []*replica
+	// master is the link to the master, nil on a master
+	master *masterLink
+}
+
+var replication = newReplicationState()
+
+func newReplicationState() *replicationState {
+	return &replicationState{id: newReplID(), id2: noReplID, secondOffset: -1, db: -1, acked: make(chan struct{})}
+}
+
+func newReplID() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// replBacklog is a ring buffer holding the last bytes of the stream.
+type replBacklog struct {
+	buf []byte
+	// next is where the next byte goes in buf
+	next int
+	// histlen is how many bytes buf holds, and end the offset of the last
+	histlen int64
+	end     int64
+}
+
+// newReplBacklog returns a backlog of size bytes for a stream that is at
+// offset.
+func newReplBacklog(size, offset int64) *replBacklog {
+	return &replBacklog{buf: make([]byte, size), end: offset}
+}
+
+func (b *replBacklog) append(p []byte) {
+	b.end += int64(len(p))
+	b.histlen = min(b.histlen+int64(len(p)), int64(len(b.buf)))
+	if len(p) > len(b.buf) {
+		p = p[len(p)-len(b.buf):]
+	}
+	for len(p) > 0 {
+		n := copy(b.buf[b.next:], p)
+		b.next = (b.next + n) % len(b.buf)
+		p = p[n:]
+	}
+}
+
+// firstOffset returns the offset of the first byte the backlog holds.
+func (b *replBacklog) firstOffset() int64 {
+	return b.end - b.histlen + 1
+}
+
+// since returns the stream from offset on, if the backlog still holds it.
+func (b *replBacklog) since(offset int64) ([]byte, bool) {
+	if offset < b.firstOffset() || offset > b.end+1 {
+		return nil, false
+	}
+	n := int(b.end + 1 - offset)
+	out := make([]byte, 0, n)
+	start := (b.next - n + len(b.buf)) % len(b.buf)
+	if start+n <= len(b.buf) {
+		return append(out, b.buf[start:start+n]...), true
+	}
+	out = append(out, b.buf[start:]...)
+	return append(out, b.buf[:start+n-len(b.buf)]...), true
+}
+
+// currentOffset returns the offset the stream is at.
+func (r *replicationState) currentOffset() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.offset
+}
+
+// feed appends a command that changed database db to the stream. The offset
+// moves on even while there is no backlog, for WAITAOF. The caller must hold
+// propagateMu.
+func (r *replicationState) feed(db int, parts []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var b []byte
+	if db != r.db {
+		b = appendRESPCommand(b, "SELECT", strconv.Itoa(db))
+		r.db = db
+	}
+	r.feedLocked(appendRESPCommand(b, parts...))
+}
+
+// feedLocked appends b to the stream and sends it to the replicas. The
+// caller must hold propagateMu and r.mu.
+func (r *replicationState) feedLocked(b []byte) {
+	r.offset += int64(len(b))
+	if r.backlog == nil {
+		return
+	}
+	r.backlog.append(b)
+	live := r.replicas[:0]
+	for _, rep := range r.replicas {
+		if rep.send(b) {
+			live = append(live, rep)
+		}
+	}
+	clear(r.replicas[len(live):])
+	r.replicas = live
+}
+
+// pingReplicas sends PING down the stream every replPingPeriod while there
+// are replicas.
+func (r *replicationState) pingReplicas() {
+	for range time.Tick(replPingPeriod) {
+		propagateMu.Lock()
+		r.mu.Lock()
+		if r.master == nil && len(r.replicas) > 0 {
+			r.feedLocked(appendRESPCommand(nil, "PING"))
+		}
+		r.mu.Unlock()
+		propagateMu.Unlock()
+	}
+}
+
+// disconnectReplicasLocked drops every replica, which reconnect and find
+// out what changed. The caller must hold r.mu.
+func (r *replicationState) disconnectReplicasLocked() {
+	for _, rep := range r.replicas {
+		rep.mu.Lock()
+		rep.closeLocked()
+		rep.mu.Unlock()
+	}
+	r.replicas = nil
+}
+
+func (r *replicationState) removeReplica(rep *replica) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, other := range r.replicas {
+		if other == rep {
+			r.replicas = append(r.replicas[:i], r.replicas[i+1:]...)
+			return
+		}
+	}
+}
+
+// replica is a replica connected to this server.
+type replica struct {
+	conn net.Conn
+	addr string
+	// port is the port the replica listens on, from REPLCONF
+	port int
+	mu   sync.Mutex
+	// pending is the part of the stream not written to the replica yet
+	pending []byte
+	closed  bool
+	// state is "wait_bgsave" while the snapshot is taken, "send_bulk" while
+	// it is sent, then "online"
+	state string
+	// wake is signaled when there is something pending, and closed with
+	// the replica
+	wake chan struct{}
+	// ackOffset is the offset the replica last acknowledged, at ackTime in
+	// Unix seconds, and aofAckOffset the one it has in its append-only file
+	// on disk, -1 without one
+	ackOffset    atomic.Int64
+	ackTime      atomic.Int64
+	aofAckOffset atomic.Int64
+}
+
+func (rep *replica) name() string {
+	return net.JoinHostPort(rep.addr, strconv.Itoa(rep.port))
+}
+
+func (rep *replica) setState(state string) {
+	rep.mu.Lock()
+	rep.state = state
+	rep.mu.Unlock()
+}
+
+// send queues b for the replica and reports whether it is still connected.
+func (rep *replica) send(b []byte) bool {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	if rep.closed {
+		return false
+	}
+	if len(rep.pending)+len(b) > replicaOutputLimit {
+		log.Printf("Replica %s is too far behind, disconnecting it", rep.name())
+		rep.closeLocked()
+		return false
+	}
+	rep.pending = append(rep.pending, b...)
+	select {
+	case rep.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (rep *replica) closeLocked() {
+	if !rep.closed {
+		rep.closed = true
+		rep.conn.Close()
+		close(rep.wake)
+	}
+}
+
+func (rep *replica) close() {
+	rep.mu.Lock()
+	rep.closeLocked()
+	rep.mu.Unlock()
+	replication.removeReplica(rep)
+}
+
+// writeLoop runs sync, which brings the replica up to the start of what is
+// pending, then writes the stream to it as it comes.
+func (rep *replica) writeLoop(sync func() error) {
+	defer rep.close()
+	if err := sync(); err != nil {
+		log.Printf("Synchronization with replica %s failed: %v", rep.name(), err)
+		return
+	}
+	rep.setState("online")
+	log.Printf("Synchronization with replica %s succeeded", rep.name())
+	for {
+		rep.mu.Lock()
+		b := rep.pending
+		rep.pending = nil
+		rep.mu.Unlock()
+		if len(b) > 0 {
+			rep.conn.SetWriteDeadline(time.Now().Add(replTimeout))
+			if _, err := rep.conn.Write(b); err != nil {
+				log.Printf("Lost the connection with replica %s: %v", rep.name(), err)
+				return
+			}
+		}
+		if _, ok := <-rep.wake; !ok {
+			return
+		}
+	}
+}
+
+// serveReplica takes over a connection that sent PSYNC, after the rest of
+// the handshake set listeningPort. It returns once the replica is gone.
+func serveReplica(conn net.Conn, parser *redisproto.Parser, parts []string, listeningPort int) {
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	rep := &replica{conn: conn, addr: host, port: listeningPort, state: "wait_bgsave", wake: make(chan struct{}, 1)}
+	rep.ackTime.Store(time.Now().Unix())
+	rep.aofAckOffset.Store(-1)
+	sync, errMsg := replication.addReplica(rep, parts)
+	if errMsg != "" {
+		conn.Write([]byte("-" + errMsg + "\r\n"))
+		return
+	}
+	go rep.writeLoop(sync)
+
+	// All a replica sends from now on are acknowledgements
+	for {
+		command, err := parser.ReadCommand()
+		if err != nil {
+			rep.close()
+			return
+		}
+		parts := commandParts(command)
+		if len(parts) < 3 || !strings.EqualFold(parts[0], "REPLCONF") || !strings.EqualFold(parts[1], "ACK") {
+			continue
+		}
+		if offset, err := strconv.ParseInt(parts[2], 10, 64); err == nil {
+			rep.ackOffset.Store(offset)
+			rep.ackTime.Store(time.Now().Unix())
+		}
+		if len(parts) == 5 && strings.EqualFold(parts[3], "FACK") {
+			if offset, err := strconv.ParseInt(parts[4], 10, 64); err == nil {
+				rep.aofAckOffset.Store(offset)
+			}
+		}
+		replication.notifyAcked()
+	}
+}
+
+// notifyAcked wakes up the clients waiting for replicas to acknowledge.
+func (r *replicationState) notifyAcked() {
+	r.mu.Lock()
+	close(r.acked)
+	r.acked = make(chan struct{})
+	r.mu.Unlock()
+}
+
+// addReplica answers PSYNC replid offset, where offset is the first byte of
+// the stream the replica is missing, and registers rep. It returns the
+// function bringing the replica up to date, or an error message.
+func (r *replicationState) addReplica(rep *replica, parts []string) (func() error, string) {
+	if len(parts) != 3 {
+		return nil, "ERR wrong number of arguments for 'psync' command"
+	}
+	// The offset, the backlog and the snapshot line up exactly, as no
+	// write command runs meanwhile
+	propagateMu.Lock()
+	defer propagateMu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.master != nil && r.master.state != "connected" {
+		return nil, "NOMASTERLINK Can't SYNC while not connected with my master"
+	}
+
+	if offset, err := strconv.ParseInt(parts[2], 10, 64); err == nil {
+		if missing, ok := r.continueFrom(parts[1], offset); ok {
+			log.Printf("Partial resynchronization request from %s accepted, sending %d bytes of backlog", rep.name(), len(missing))
+			header := []byte("+CONTINUE " + r.id + "\r\n")
+			rep.pending = missing
+			r.replicas = append(r.replicas, rep)
+			return func() error {
+				_, err := rep.conn.Write(header)
+				return err
+			}, ""
+		}
+	}
+
+	if r.backlog == nil {
+		// Nothing was fed to the stream without a backlog, so start anew
+		if r.master == nil {
+			r.id, r.id2, r.secondOffset = newReplID(), noReplID, -1
+		}
+		r.backlog = newReplBacklog(replBacklogSize, r.offset)
+	}
+	log.Printf("Starting a full resynchronization with replica %s", rep.name())
+	header := fmt.Appendf(nil, "+FULLRESYNC %s %d\r\n", r.id, r.offset)
+	aux := [][2]string{{"repl-id", r.id}, {"repl-offset", strconv.FormatInt(r.offset, 10)}}
+	if r.db >= 0 {
+		aux = append(aux, [2]string{"repl-stream-db", strconv.Itoa(r.db)})
+	}
+	if r.master == nil {
+		// Be explicit about the database of the next command all the same
+		r.db = -1
+	}
+	snapshot := startSnapshot(databases)
+	r.replicas = append(r.replicas, rep)
+	return func() error {
+		copies := snapshot.finish()
+		if _, err := rep.conn.Write(header); err != nil {
+			return err
+		}
+		rep.setState("send_bulk")
+		var payload bytes.Buffer
+		if err := writeRDB(&payload, copies, aux...); err != nil {
+			return err
+		}
+		rep.conn.SetWriteDeadline(time.Time{})
+		if _, err := fmt.Fprintf(rep.conn, "$%d\r\n", payload.Len()); err != nil {
+			return err
+		}
+		_, err := rep.conn.Write(payload.Bytes())
+		return err
+	}, ""
+}
+
+// continueFrom returns the stream from offset on, for a replica that
+// followed the stream with the given ID up to there.
+func (r *replicationState) continueFrom(id string, offset int64) ([]byte, bool) {
+	if r.backlog == nil {
+		return nil, false
+	}
+	if id != r.id && (id != r.id2 || offset > r.secondOffset) {
+		return nil, false
+	}
+	return r.backlog.since(offset)
+}
+
+// replconfCommand implements REPLCONF option value [option value ...], which
+// replicas send during the handshake.
+func replconfCommand(parts []string, listeningPort *int) string {
+	if len(parts)%2 == 0 {
+		return "ERR syntax error"
+	}
+	for i := 1; i < len(parts); i += 2 {
+		switch strings.ToLower(parts[i]) {
+		case "listening-port":
+			port, err := strconv.Atoi(parts[i+1])
+			if err != nil || port < 0 || port > 65535 {
+				return "ERR invalid listening port"
+			}
+			*listeningPort = port
+		case "capa", "ip-address":
+			// Nothing depends on them
+		default:
+			return fmt.Sprintf("ERR Unrecognized REPLCONF option: %s", parts[i])
+		}
+	}
+	return "OK"
+}
+
+// masterLink is the connection of a replica to its master. It reconnects
+// until it is closed.
+type masterLink struct {
+	host string
+	port int
+	stop chan struct{}
+	// state is "connect", "connecting", "handshake", "sync" or "connected",
+	// like in ROLE. It is guarded by replication.mu.
+	state string
+	// lastIO is when anything was last read from the master, in Unix seconds
+	lastIO atomic.Int64
+	// mu guards conn and writes to it
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (link *masterLink) addr() string {
+	return net.JoinHostPort(link.host, strconv.Itoa(link.port))
+}
+
+func (link *masterLink) setState(state string) {
+	replication.mu.Lock()
+	link.state = state
+	replication.mu.Unlock()
+}
+
+func (link *masterLink) stopped() bool {
+	select {
+	case <-link.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops the link. The caller must hold replication.mu.
+func (link *masterLink) close() {
+	close(link.stop)
+	link.mu.Lock()
+	if link.conn != nil {
+		link.conn.Close()
+	}
+	link.mu.Unlock()
+}
+
+// setConn makes conn the connection to the master, unless the link was
+// closed meanwhile.
+func (link *masterLink) setConn(conn net.Conn) bool {
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	if link.stopped() {
+		return false
+	}
+	link.conn = conn
+	return true
+}
+
+func (link *masterLink) write(b []byte) error {
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	link.conn.SetWriteDeadline(time.Now().Add(replTimeout))
+	_, err := link.conn.Write(b)
+	return err
+}
+
+func (link *masterLink) run() {
+	for {
+		err := link.sync()
+		if link.stopped() {
+			return
+		}
+		log.Printf("Lost the link with master %s: %v", link.addr(), err)
+		link.setState("connect")
+		select {
+		case <-link.stop:
+			return
+		case <-time.After(replReconnectDelay):
+		}
+	}
+}
+
+// sync connects to the master, resynchronizes with it and applies the
+// stream until the connection breaks.
+func (link *masterLink) sync() error {
+	link.setState("connecting")
+	c, err := dialRedis(link.addr(), replTimeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if !link.setConn(c.conn) {
+		return errReplicationStopped
+	}
+
+	link.setState("handshake")
+	if masterAuth != "" {
+		if err := c.expectOK("AUTH", masterAuth); err != nil {
+			return fmt.Errorf("AUTH: %w", err)
+		}
+	}
+	if reply, err := c.Do("PING"); err != nil || reply != "PONG" {
+		if err == nil {
+			err = redisError(reply)
+		}
+		return fmt.Errorf("PING: %w", err)
+	}
+	if err := c.expectOK("REPLCONF", "listening-port", strconv.Itoa(serverPort)); err != nil {
+		return fmt.Errorf("REPLCONF: %w", err)
+	}
+	if err := c.expectOK("REPLCONF", "capa", "psync2"); err != nil {
+		return fmt.Errorf("REPLCONF: %w", err)
+	}
+
+	// The master sends nothing unasked until it gets PSYNC, so nothing is
+	// left behind in the buffer of c
+	c.conn.SetDeadline(time.Time{})
+	r := bufio.NewReader(&linkReader{link: link, conn: c.conn})
+	replication.mu.Lock()
+	id, offset := replication.id, replication.offset
+	replication.mu.Unlock()
+	if err := link.write(appendRESPCommand(nil, "PSYNC", id, strconv.FormatInt(offset+1, 10))); err != nil {
+		return err
+	}
+	line, err := readReplLine(r)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 3 && fields[0] == "+FULLRESYNC":
+		offset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad reply to PSYNC: %s", line)
+		}
+		if err := link.fullSync(r, fields[1], offset); err != nil {
+			return err
+		}
+	case len(fields) >= 1 && len(fields) <= 2 && fields[0] == "+CONTINUE":
+		if err := link.continued(fields[1:]); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("PSYNC: %s", strings.TrimPrefix(line, "-"))
+	}
+
+	link.setState("connected")
+	done := make(chan struct{})
+	defer close(done)
+	go link.sendAcks(done)
+	return link.applyStream(r)
+}
+
+// readReplLine reads a line the master sent outside of the stream.
+func readReplLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+// fullSync loads the dataset of the master in place of this server's one.
+func (link *masterLink) fullSync(r *bufio.Reader, id string, offset int64) error {
+	link.setState("sync")
+	line, err := readReplLine(r)
+	if err != nil {
+		return err
+	}
+	size, err := strconv.ParseInt(strings.TrimPrefix(line, "$"), 10, 64)
+	if err != nil || !strings.HasPrefix(line, "$") || size < 0 {
+		return fmt.Errorf("bad dataset length from the master: %q", line)
+	}
+	log.Printf("Full resynchronization with master %s, receiving %d bytes", link.addr(), size)
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return err
+	}
+	fresh := newDatabases(len(databases))
+	aux := make(map[string]string)
+	if err := readRDB(bytes.NewReader(payload), fresh, aux); err != nil {
+		return fmt.Errorf("loading the dataset of the master: %w", err)
+	}
+	db := -1
+	if s, ok := aux["repl-stream-db"]; ok {
+		if db, err = strconv.Atoi(s); err != nil || db < 0 || db >= len(databases) {
+			return fmt.Errorf("bad repl-stream-db from the master: %q", s)
+		}
+	}
+
+	propagateMu.Lock()
+	defer propagateMu.Unlock()
+	if link.stopped() {
+		return errReplicationStopped
+	}
+	if appendOnly != nil {
+		if err := appendOnly.replaceDataset(fresh); err != nil {
+			log.Printf("Error rewriting the append only file after the resynchronization: %v", err)
+		} else {
+			appendOnly.fsyncedOffset.Store(offset)
+		}
+	}
+	for i, kv := range databases {
+		kv.takeOver(fresh[i])
+	}
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+	replication.id, replication.offset = id, offset
+	replication.id2, replication.secondOffset = noReplID, -1
+	replication.backlog = newReplBacklog(replBacklogSize, offset)
+	replication.db = db
+	// Replicas of this server followed the dataset that was just dropped
+	replication.disconnectReplicasLocked()
+	return nil
+}
+
+// continued switches to the replication ID the master sent with +CONTINUE,
+// if it is a new one.
+func (link *masterLink) continued(fields []string) error {
+	propagateMu.Lock()
+	defer propagateMu.Unlock()
+	if link.stopped() {
+		return errReplicationStopped
+	}
+	r := replication
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	log.Printf("Partial resynchronization with master %s accepted", link.addr())
+	if len(fields) == 1 && fields[0] != r.id {
+		r.id2, r.secondOffset = r.id, r.offset+1
+		r.id = fields[0]
+		r.disconnectReplicasLocked()
+	}
+	if r.backlog == nil {
+		r.backlog = newReplBacklog(replBacklogSize, r.offset)
+	}
+	return nil
+}
+
+// takeOver replaces the data of kv with the one of fresh, like SWAPDB does.
+// The caller must hold propagateMu.
+func (kv *KeyValueStore) takeOver(fresh *KeyValueStore) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.preserveAll()
+	kv.Strings = fresh.Strings
+	kv.Lists = fresh.Lists
+	kv.Hashes = fresh.Hashes
+	kv.Sets = fresh.Sets
+	kv.SortedSets = fresh.SortedSets
+	kv.Expirations = fresh.Expirations
+	kv.HashFieldExpirations = fresh.HashFieldExpirations
+	kv.accessMu.Lock()
+	kv.access = fresh.access
+	kv.accessMu.Unlock()
+	kv.dropKeyIndex()
+	for key := range kv.blocked {
+		kv.signalKeyReady(key)
+	}
+}
+
+// applyStream runs the commands the master sends until the connection
+// breaks, and passes them on to this server's own replicas.
+func (link *masterLink) applyStream(r *bufio.Reader) error {
+	for {
+		parts, err := readAOFCommand(r)
+		if err != nil {
+			return err
+		}
+		getAck, err := link.apply(parts)
+		if err != nil {
+			return err
+		}
+		if getAck {
+			// The master may be waiting for the append-only file too
+			if appendOnly != nil && appendOnly.fsyncedOffset.Load() < replication.currentOffset() {
+				if err := appendOnly.fsync(); err != nil {
+					log.Printf("Error syncing the append only file: %v", err)
+				}
+			}
+			if err := link.sendAck(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// apply runs a command of the stream, and reports whether the master asked
+// for an acknowledgement.
+func (link *masterLink) apply(parts []string) (bool, error) {
+	propagateMu.Lock()
+	defer propagateMu.Unlock()
+	if link.stopped() {
+		return false, errReplicationStopped
+	}
+	r := replication
+	raw := appendRESPCommand(nil, parts...)
+	parts[0] = strings.ToUpper(parts[0])
+	getAck := false
+	switch parts[0] {
+	case "SELECT":
+		db, errMsg := -1, "ERR SELECT requires 1 argument"
+		if len(parts) == 2 {
+			db, errMsg = parseDBIndex(parts[1])
+		}
+		if errMsg != "" {
+			return false, fmt.Errorf("master sent a bad SELECT: %s", errMsg)
+		}
+		r.mu.Lock()
+		r.db = db
+		r.mu.Unlock()
+	case "PING":
+	case "REPLCONF":
+		getAck = len(parts) >= 2 && strings.EqualFold(parts[1], "GETACK")
+	default:
+		r.mu.Lock()
+		db := max(r.db, 0)
+		r.mu.Unlock()
+		databases[db].runCommand(parts)
+	}
+	r.mu.Lock()
+	r.feedLocked(raw)
+	r.mu.Unlock()
+	return getAck, nil
+}
+
+// sendAck acknowledges the offset reached, and with an append-only file the
+// one it holds on disk.
+func (link *masterLink) sendAck() error {
+	ack := []string{"REPLCONF", "ACK", strconv.FormatInt(replication.currentOffset(), 10)}
+	if appendOnly != nil {
+		ack = append(ack, "FACK", strconv.FormatInt(appendOnly.fsyncedOffset.Load(), 10))
+	}
+	return link.write(appendRESPCommand(nil, ack...))
+}
+
+// sendAcks acknowledges the offset reached every replAckPeriod until done
+// is closed.
+func (link *masterLink) sendAcks(done chan struct{}) {
+	ticker := time.NewTicker(replAckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if link.sendAck() != nil {
+			return
+		}
+	}
+}
+
+// linkReader reads from the master, giving up once it has been silent for
+// replTimeout.
+type linkReader struct {
+	link *masterLink
+	conn net.Conn
+}
+
+func (lr *linkReader) Read(p []byte) (int, error) {
+	lr.conn.SetReadDeadline(time.Now().Add(replTimeout))
+	n, err := lr.conn.Read(p)
+	if n > 0 {
+		lr.link.lastIO.Store(time.Now().Unix())
+	}
+	return n, err
+}
+
+// ReplicaOfCommand implements REPLICAOF host port, and REPLICAOF NO ONE to
+// stop replicating. SLAVEOF is its old name.
+func ReplicaOfCommand(parts []string) string {
+	if len(parts) != 3 {
+		return "ERR wrong number of arguments for 'replicaof' command"
+	}
+	if strings.EqualFold(parts[1], "NO") && strings.EqualFold(parts[2], "ONE") {
+		replication.promote()
+		return "OK"
+	}
+	port, err := strconv.Atoi(parts[2])
+	if err != nil || port < 1 || port > 65535 {
+		return "ERR Invalid master port"
+	}
+	return replication.follow(parts[1], port)
+}
+
+// follow makes this server a replica of the master at host and port.
+func (r *replicationState) follow(host string, port int) string {
+	propagateMu.Lock()
+	defer propagateMu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.master != nil && r.master.host == host && r.master.port == port {
+		return "OK Already connected to specified master"
+	}
+	if r.master != nil {
+		r.master.close()
+	}
+	r.disconnectReplicasLocked()
+	link := &masterLink{host: host, port: port, stop: make(chan struct{}), state: "connect"}
+	r.master = link
+	replicaMode.Store(true)
+	log.Printf("Replicating %s", link.addr())
+	go link.run()
+	return "OK"
+}
+
+// promote makes this server a master. The stream it got so far continues
+// under a new ID, so the other replicas of its master can carry on from it.
+func (r *replicationState) promote() {
+	propagateMu.Lock()
+	defer propagateMu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.master == nil {
+		return
+	}
+	r.master.close()
+	r.master = nil
+	replicaMode.Store(false)
+	r.id2, r.secondOffset = r.id, r.offset+1
+	r.id = newReplID()
+	r.db = -1
+	r.disconnectReplicasLocked()
+	log.Printf("Stopped replicating, now a master with replication ID %s", r.id)
+}
+
+// RoleCommand implements ROLE.
+func RoleCommand() string {
+	r := replication
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.master != nil {
+		return fmt.Sprintf("slave %s %d %s %d", r.master.host, r.master.port, r.master.state, r.offset)
+	}
+	reply := []string{"master", strconv.FormatInt(r.offset, 10)}
+	for _, rep := range r.replicas {
+		reply = append(reply, rep.addr, strconv.Itoa(rep.port), strconv.FormatInt(rep.ackOffset.Load(), 10))
+	}
+	return strings.Join(reply, " ")
+}
+
+// info returns the lines of the INFO replication section.
+func (r *replicationState) info() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var b strings.Builder
+	now := time.Now().Unix()
+	if link := r.master; link != nil {
+		status, lastIO := "down", int64(-1)
+		if link.state == "connected" {
+			status = "up"
+		}
+		if at := link.lastIO.Load(); at > 0 {
+			lastIO = now - at
+		}
+		b.WriteString("role:slave\r\n")
+		b.WriteString(fmt.Sprintf("master_host:%s\r\n", link.host))
+		b.WriteString(fmt.Sprintf("master_port:%d\r\n", link.port))
+		b.WriteString(fmt.Sprintf("master_link_status:%s\r\n", status))
+		b.WriteString(fmt.Sprintf("master_last_io_seconds_ago:%d\r\n", lastIO))
+		b.WriteString(fmt.Sprintf("master_sync_in_progress:%d\r\n", boolToInt(link.state == "sync")))
+		b.WriteString(fmt.Sprintf("slave_repl_offset:%d\r\n", r.offset))
+		b.WriteString("slave_read_only:1\r\n")
+	} else {
+		b.WriteString("role:master\r\n")
+	}
+	b.WriteString(fmt.Sprintf("connected_slaves:%d\r\n", len(r.replicas)))
+	for i, rep := range r.replicas {
+		rep.mu.Lock()
+		state := rep.state
+		rep.mu.Unlock()
+		b.WriteString(fmt.Sprintf("slave%d:ip=%s,port=%d,state=%s,offset=%d,lag=%d\r\n",
+			i, rep.addr, rep.port, state, rep.ackOffset.Load(), now-rep.ackTime.Load()))
+	}
+	b.WriteString(fmt.Sprintf("master_replid:%s\r\n", r.id))
+	b.WriteString(fmt.Sprintf("master_replid2:%s\r\n", r.id2))
+	b.WriteString(fmt.Sprintf("master_repl_offset:%d\r\n", r.offset))
+	b.WriteString(fmt.Sprintf("second_repl_offset:%d\r\n", r.secondOffset))
+	b.WriteString(fmt.Sprintf("repl_backlog_active:%d\r\n", boolToInt(r.backlog != nil)))
+	b.WriteString(fmt.Sprintf("repl_backlog_size:%d\r\n", replBacklogSize))
+	if r.backlog != nil {
+		b.WriteString(fmt.Sprintf("repl_backlog_first_byte_offset:%d\r\n", r.backlog.firstOffset()))
+		b.WriteString(fmt.Sprintf("repl_backlog_histlen:%d\r\n", r.backlog.histlen))
+	} else {
+		b.WriteString("repl_backlog_first_byte_offset:0\r\n")
+		b.WriteString("repl_backlog_histlen:0\r\n")
+	}
+	return b.String()
+}
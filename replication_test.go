@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dhravya/radish/redisproto"
+)
+
+// startTestReplication makes dbs the databases of a server that is a master
+// without replicas.
+func startTestReplication(t *testing.T, dbs []*KeyValueStore) {
+	t.Helper()
+	reset := func() {
+		replication.promote()
+		propagateMu.Lock()
+		defer propagateMu.Unlock()
+		r := replication
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.disconnectReplicasLocked()
+		r.id, r.offset, r.id2, r.secondOffset = newReplID(), 0, noReplID, -1
+		r.backlog, r.db = nil, -1
+	}
+	reset()
+	databases = dbs
+	t.Cleanup(func() {
+		reset()
+		databases = nil
+	})
+}
+
+// listenTest listens on a local port, serving connections with serve.
+func listenTest(t *testing.T, serve func(net.Conn)) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected to listen, Got: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	if serve != nil {
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go serve(conn)
+			}
+		}()
+	}
+	return ln
+}
+
+func TestReplBacklogWrapsAround(t *testing.T) {
+	b := newReplBacklog(8, 10)
+	b.append([]byte("abcde"))
+	if got, ok := b.since(11); !ok || string(got) != "abcde" {
+		t.Fatalf("Expected the whole backlog, Got: %q, %v", got, ok)
+	}
+	b.append([]byte("fghij"))
+	if b.firstOffset() != 13 || b.histlen != 8 {
+		t.Fatalf("Expected the backlog to start at 13, Got: %d", b.firstOffset())
+	}
+	if got, ok := b.since(14); !ok || string(got) != "defghij" {
+		t.Fatalf("Expected the wrapped around part, Got: %q, %v", got, ok)
+	}
+	if got, ok := b.since(21); !ok || len(got) != 0 {
+		t.Fatalf("Expected nothing to be missing at the end, Got: %q, %v", got, ok)
+	}
+	if _, ok := b.since(12); ok {
+		t.Fatal("Expected an offset before the backlog to be refused")
+	}
+	if _, ok := b.since(22); ok {
+		t.Fatal("Expected an offset after the stream to be refused")
+	}
+	b.append([]byte("0123456789"))
+	if got, _ := b.since(b.firstOffset()); string(got) != "23456789" {
+		t.Fatalf("Expected the last 8 bytes, Got: %q", got)
+	}
+}
+
+// psync sends PSYNC on a connection to the master and returns the reply.
+func psync(t *testing.T, c *redisClient, id string, offset int64) string {
+	t.Helper()
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c.writer.WriteBulkStrings([]string{"PSYNC", id, strconv.FormatInt(offset, 10)})
+	c.writer.Flush()
+	line, err := c.readLine()
+	if err != nil {
+		t.Fatalf("Expected a reply to PSYNC, Got: %v", err)
+	}
+	return line
+}
+
+func expectStream(t *testing.T, c *redisClient, commands ...string) {
+	t.Helper()
+	for _, expected := range commands {
+		parts, err := readAOFCommand(c.reader)
+		if err != nil || strings.Join(parts, " ") != expected {
+			t.Fatalf("Expected %q in the stream, Got: %q, %v", expected, parts, err)
+		}
+	}
+}
+
+func TestMasterFullAndPartialResync(t *testing.T) {
+	startTestReplication(t, newDatabases(2))
+	databases[1].executeCommand([]string{"SET", "before", "1"})
+	addr := listenTest(t, handleConnection).Addr().String()
+
+	c, err := dialRedis(addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Expected to connect, Got: %v", err)
+	}
+	defer c.Close()
+	if err := c.expectOK("REPLCONF", "listening-port", "7000", "capa", "psync2"); err != nil {
+		t.Fatalf("Expected REPLCONF to succeed, Got: %v", err)
+	}
+	fields := strings.Fields(psync(t, c, "?", -1))
+	if start := strconv.FormatInt(replication.currentOffset(), 10); len(fields) != 3 || fields[0] != "+FULLRESYNC" || fields[2] != start {
+		t.Fatalf("Expected a full resync at offset %s, Got: %q", start, fields)
+	}
+	id := fields[1]
+	size, err := c.readLine()
+	if err != nil || !strings.HasPrefix(size, "$") {
+		t.Fatalf("Expected the length of the dataset, Got: %q, %v", size, err)
+	}
+	n, _ := strconv.Atoi(size[1:])
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		t.Fatalf("Expected the dataset, Got: %v", err)
+	}
+	copies := newDatabases(2)
+	if err := readRDB(bytes.NewReader(payload), copies, nil); err != nil {
+		t.Fatalf("Expected the dataset to load, Got: %v", err)
+	}
+	if got := copies[1].executeCommand([]string{"GET", "before"}); got != "1" {
+		t.Fatalf("Expected the dataset to hold the key, Got: %q", got)
+	}
+
+	databases[1].executeCommand([]string{"SET", "k", "v"})
+	databases[1].executeCommand([]string{"EXPIRE", "k", "100"})
+	expectStream(t, c, "SELECT 1", "SET k v")
+	if parts, _ := readAOFCommand(c.reader); parts[0] != "PEXPIREAT" {
+		t.Fatalf("Expected EXPIRE to be sent as PEXPIREAT, Got: %q", parts)
+	}
+	offset := replication.currentOffset()
+	c.writer.WriteBulkStrings([]string{"REPLCONF", "ACK", strconv.FormatInt(offset, 10)})
+	c.writer.Flush()
+	expected := fmt.Sprintf("master %d 127.0.0.1 7000 %d", offset, offset)
+	for deadline := time.Now().Add(5 * time.Second); RoleCommand() != expected; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected ROLE to report the acknowledged offset, Got: %q", RoleCommand())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	info := databases[0].executeCommand([]string{"INFO", "replication"})
+	if !strings.Contains(info, "role:master") || !strings.Contains(info, fmt.Sprintf("slave0:ip=127.0.0.1,port=7000,state=online,offset=%d", offset)) {
+		t.Fatalf("Expected INFO to list the replica, Got: %q", info)
+	}
+	c.Close()
+
+	// Writes made while the replica is away come from the backlog
+	databases[0].executeCommand([]string{"SET", "missed", "1"})
+	c, err = dialRedis(addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Expected to connect, Got: %v", err)
+	}
+	defer c.Close()
+	if reply := psync(t, c, id, offset+1); reply != "+CONTINUE "+id {
+		t.Fatalf("Expected a partial resync, Got: %q", reply)
+	}
+	expectStream(t, c, "SELECT 0", "SET missed 1")
+
+	c2, err := dialRedis(addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Expected to connect, Got: %v", err)
+	}
+	defer c2.Close()
+	if reply := psync(t, c2, "unknown", offset+1); !strings.HasPrefix(reply, "+FULLRESYNC "+id+" ") {
+		t.Fatalf("Expected an unknown ID to get a full resync, Got: %q", reply)
+	}
+}
+
+// fakeMasterHandshake answers the handshake of a replica and returns the
+// arguments of its PSYNC.
+func fakeMasterHandshake(t *testing.T, conn net.Conn, r *bufio.Reader) []string {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for {
+		parts, err := readAOFCommand(r)
+		if err != nil {
+			t.Fatalf("Expected the replica to go through the handshake, Got: %v", err)
+		}
+		switch strings.ToUpper(parts[0]) {
+		case "PING":
+			conn.Write([]byte("+PONG\r\n"))
+		case "REPLCONF":
+			conn.Write([]byte("+OK\r\n"))
+		case "PSYNC":
+			return parts
+		default:
+			t.Fatalf("Unexpected command during the handshake: %q", parts)
+		}
+	}
+}
+
+// expectAck reads from the replica until it acknowledges offset.
+func expectAck(t *testing.T, r *bufio.Reader, offset int64) {
+	t.Helper()
+	expected := "REPLCONF ACK " + strconv.FormatInt(offset, 10)
+	for {
+		parts, err := readAOFCommand(r)
+		if err != nil {
+			t.Fatalf("Expected %q, Got: %v", expected, err)
+		}
+		if strings.Join(parts, " ") == expected {
+			return
+		}
+	}
+}
+
+func TestReplicaFollowsMaster(t *testing.T) {
+	startTestReplication(t, newDatabases(2))
+	databases[0].executeCommand([]string{"SET", "dropped", "1"})
+	start := strconv.FormatInt(replication.currentOffset()+1, 10)
+	ln := listenTest(t, nil)
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	if got := ReplicaOfCommand([]string{"REPLICAOF", host, port}); got != "OK" {
+		t.Fatalf("Expected REPLICAOF to succeed, Got: %q", got)
+	}
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	if parts := fakeMasterHandshake(t, conn, r); len(parts) != 3 || parts[2] != start {
+		t.Fatalf("Expected PSYNC from offset %s, Got: %q", start, parts)
+	}
+	source := newDatabases(2)
+	source[0].executeCommand([]string{"SET", "synced", "1"})
+	var rdb bytes.Buffer
+	if err := writeRDB(&rdb, source, [2]string{"repl-stream-db", "1"}); err != nil {
+		t.Fatal(err)
+	}
+	masterID := strings.Repeat("ab", 20)
+	fmt.Fprintf(conn, "+FULLRESYNC %s 100\r\n$%d\r\n", masterID, rdb.Len())
+	conn.Write(rdb.Bytes())
+	stream := appendRESPCommand(nil, "SET", "k", "v")
+	stream = appendRESPCommand(stream, "SELECT", "0")
+	stream = appendRESPCommand(stream, "INCR", "n")
+	stream = appendRESPCommand(stream, "REPLCONF", "GETACK", "*")
+	conn.Write(stream)
+	offset := 100 + int64(len(stream))
+	expectAck(t, r, offset)
+
+	for _, c := range []struct {
+		db       int
+		command  []string
+		expected string
+	}{
+		{0, []string{"GET", "dropped"}, "(nil)"},
+		{0, []string{"GET", "synced"}, "1"},
+		{1, []string{"GET", "k"}, "v"},
+		{0, []string{"GET", "n"}, "1"},
+	} {
+		if got := databases[c.db].executeCommand(c.command); got != c.expected {
+			t.Fatalf("%v: expected %q, Got: %q", c.command, c.expected, got)
+		}
+	}
+	command, _ := redisproto.NewParser(bytes.NewReader(appendRESPCommand(nil, "SET", "x", "1"))).ReadCommand()
+	if got := databases[0].CommandHandler(command); got != "READONLY You can't write against a read only replica." {
+		t.Fatalf("Expected writes to be refused, Got: %q", got)
+	}
+	info := databases[0].executeCommand([]string{"INFO", "replication"})
+	for _, line := range []string{"role:slave", "master_link_status:up", fmt.Sprintf("slave_repl_offset:%d", offset), "master_replid:" + masterID} {
+		if !strings.Contains(info, line+"\r\n") {
+			t.Fatalf("Expected INFO to hold %s, Got: %q", line, info)
+		}
+	}
+
+	// After losing the master, the replica asks to continue where it was
+	conn.Close()
+	conn, err = ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r = bufio.NewReader(conn)
+	if parts := fakeMasterHandshake(t, conn, r); parts[1] != masterID || parts[2] != strconv.FormatInt(offset+1, 10) {
+		t.Fatalf("Expected PSYNC to continue from %d, Got: %q", offset+1, parts)
+	}
+	conn.Write([]byte("+CONTINUE\r\n"))
+	stream = appendRESPCommand(nil, "SET", "more", "1")
+	stream = appendRESPCommand(stream, "REPLCONF", "GETACK", "*")
+	conn.Write(stream)
+	offset += int64(len(stream))
+	expectAck(t, r, offset)
+	if got := databases[0].executeCommand([]string{"GET", "more"}); got != "1" {
+		t.Fatalf("Expected the stream to go on after the partial resync, Got: %q", got)
+	}
+
+	if got := ReplicaOfCommand([]string{"REPLICAOF", "NO", "ONE"}); got != "OK" {
+		t.Fatalf("Expected REPLICAOF NO ONE to succeed, Got: %q", got)
+	}
+	info = databases[0].executeCommand([]string{"INFO", "replication"})
+	for _, line := range []string{"role:master", "master_replid2:" + masterID, fmt.Sprintf("second_repl_offset:%d", offset+1)} {
+		if !strings.Contains(info, line+"\r\n") {
+			t.Fatalf("Expected INFO to hold %s, Got: %q", line, info)
+		}
+	}
+	if got := databases[0].CommandHandler(command); got != "OK" {
+		t.Fatalf("Expected writes to be accepted after the promotion, Got: %q", got)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/dhravya/radish/redisproto"
+)
+
+// Replies are strings that clients get as a single bulk string, the way
+// redis-cli would print them. Replies made by multiBulkReply are the
+// exception: they carry the RESP encoding of an array behind
+// multiBulkPrefix, so that elements holding spaces reach the client intact.
+const multiBulkPrefix = "\x00multibulk\x00"
+
+// multiBulkReply returns a reply that is written as an array of elements.
+func multiBulkReply(elements []string) string {
+	return multiBulkPrefix + string(appendRESPCommand(nil, elements...))
+}
+
+// writeReply writes reply to a client.
+func writeReply(w *redisproto.Writer, reply string) error {
+	if resp, ok := strings.CutPrefix(reply, multiBulkPrefix); ok {
+		_, err := w.Write([]byte(resp))
+		return err
+	}
+	return w.WriteBulkString(reply)
+}
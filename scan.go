@@ -0,0 +1,241 @@
+package main
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The SCAN family of commands walks names in the order of a fixed 52-bit hash
+// of the name. The cursor handed back to the client is simply the next hash
+// value to continue from, so the server keeps no iteration state and every
+// element that is present for the whole scan is returned exactly once, no
+// matter how the collection grows or shrinks in between calls.
+//
+// The keyspace and collections in their hashtable encoding keep a scanIndex,
+// the names ordered by hash, so a call only walks the names it returns. It
+// is built the first time it is needed and kept up to date from then on.
+// Compact encodings are small enough to be hashed whole on every call.
+
+const (
+	defaultScanCount = 10
+	// scanHashBits keeps hashes exact as skiplist scores
+	scanHashBits = 52
+)
+
+type scanOptions struct {
+	cursor   uint64
+	match    string
+	count    int
+	typ      string
+	noValues bool
+}
+
+func scanHash(name string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return h.Sum64() >> (64 - scanHashBits)
+}
+
+// parseScanArgs parses "cursor [MATCH pattern] [COUNT count]" starting at
+// parts[start]. TYPE and NOVALUES are only accepted when the caller allows
+// them.
+func parseScanArgs(parts []string, start int, allowType, allowNoValues bool) (scanOptions, string) {
+	opts := scanOptions{count: defaultScanCount}
+	if len(parts) <= start {
+		return opts, "ERR wrong number of arguments for '" + strings.ToLower(parts[0]) + "' command"
+	}
+	cursor, err := strconv.ParseUint(parts[start], 10, 64)
+	if err != nil {
+		return opts, "ERR invalid cursor"
+	}
+	opts.cursor = cursor
+	for i := start + 1; i < len(parts); i++ {
+		switch strings.ToUpper(parts[i]) {
+		case "MATCH":
+			if i+1 >= len(parts) {
+				return opts, "ERR syntax error"
+			}
+			opts.match = parts[i+1]
+			i++
+		case "COUNT":
+			if i+1 >= len(parts) {
+				return opts, "ERR syntax error"
+			}
+			count, err := strconv.Atoi(parts[i+1])
+			if err != nil {
+				return opts, "ERR value is not an integer or out of range"
+			}
+			if count < 1 {
+				return opts, "ERR syntax error"
+			}
+			opts.count = count
+			i++
+		case "TYPE":
+			if !allowType || i+1 >= len(parts) {
+				return opts, "ERR syntax error"
+			}
+			opts.typ = strings.ToLower(parts[i+1])
+			i++
+		case "NOVALUES":
+			if !allowNoValues {
+				return opts, "ERR syntax error"
+			}
+			opts.noValues = true
+		default:
+			return opts, "ERR syntax error"
+		}
+	}
+	return opts, ""
+}
+
+// scanBatch returns up to count names, produced by each, whose scan hash is
+// at or after cursor, together with the cursor for the next call. A next
+// cursor of 0 means the iteration is complete. Names sharing the hash of the
+// last returned name are always returned together so that the cursor never
+// splits them.
+func scanBatch(cursor uint64, count int, each func(yield func(name string))) ([]string, uint64) {
+	batch := &scanHeap{}
+	remaining := 0
+	each(func(name string) {
+		h := scanHash(name)
+		if h < cursor {
+			return
+		}
+		remaining++
+		if batch.Len() < count {
+			heap.Push(batch, scanEntry{h, name})
+		} else if h < (*batch)[0].hash {
+			(*batch)[0] = scanEntry{h, name}
+			heap.Fix(batch, 0)
+		}
+	})
+	if batch.Len() == 0 {
+		return []string{}, 0
+	}
+
+	boundary := (*batch)[0].hash
+	names := make([]string, 0, batch.Len())
+	seen := make(map[string]struct{}, batch.Len())
+	for _, e := range *batch {
+		names = append(names, e.name)
+		seen[e.name] = struct{}{}
+	}
+	if remaining == len(names) {
+		return names, 0
+	}
+	// Pick up the names colliding with the boundary hash that did not fit
+	each(func(name string) {
+		if _, ok := seen[name]; !ok && scanHash(name) == boundary {
+			names = append(names, name)
+		}
+	})
+	if remaining == len(names) {
+		return names, 0
+	}
+	return names, boundary + 1
+}
+
+// scanIndex holds names ordered by scan hash, in a skiplist scored by it.
+type scanIndex struct {
+	zsl *skiplist
+}
+
+// scanIndexMu is held while an index is built, which readers of the
+// collection may get to do concurrently under the read lock.
+var scanIndexMu sync.Mutex
+
+// buildScanIndex indexes the names produced by each.
+func buildScanIndex(each func(yield func(name string))) *scanIndex {
+	idx := &scanIndex{zsl: newSkiplist()}
+	each(idx.add)
+	return idx
+}
+
+func (idx *scanIndex) len() int {
+	return idx.zsl.length
+}
+
+// add indexes name, unless it already is.
+func (idx *scanIndex) add(name string) {
+	score := float64(scanHash(name))
+	if idx.zsl.rank(score, name) == 0 {
+		idx.zsl.insert(score, name)
+	}
+}
+
+func (idx *scanIndex) remove(name string) {
+	idx.zsl.delete(float64(scanHash(name)), name)
+}
+
+// batch is scanBatch over the index: it returns up to count names whose
+// scan hash is at or after cursor, plus the ones sharing the hash of the
+// last of them, and the cursor for the next call.
+func (idx *scanIndex) batch(cursor uint64, count int) ([]string, uint64) {
+	names := []string{}
+	x := idx.zsl.firstInRange(scoreRange{min: float64(cursor), max: math.Inf(1)})
+	for ; x != nil; x = x.level[0].forward {
+		if len(names) >= count && x.score != x.backward.score {
+			return names, uint64(x.score)
+		}
+		names = append(names, x.member)
+	}
+	return names, 0
+}
+
+// sample returns up to n distinct names, each as likely to be picked as any
+// other. Floyd's algorithm draws n distinct ranks with n random numbers.
+func (idx *scanIndex) sample(n int) []string {
+	if n > idx.zsl.length {
+		n = idx.zsl.length
+	}
+	picked := make(map[int]struct{}, n)
+	names := make([]string, 0, n)
+	for j := idx.zsl.length - n + 1; j <= idx.zsl.length; j++ {
+		rank := rand.Intn(j) + 1
+		if _, taken := picked[rank]; taken {
+			rank = j
+		}
+		picked[rank] = struct{}{}
+		names = append(names, idx.zsl.byRank(rank).member)
+	}
+	return names
+}
+
+type scanEntry struct {
+	hash uint64
+	name string
+}
+
+// scanHeap is a max-heap on the scan hash, used to keep the smallest hashes.
+type scanHeap []scanEntry
+
+func (h scanHeap) Len() int            { return len(h) }
+func (h scanHeap) Less(i, j int) bool  { return h[i].hash > h[j].hash }
+func (h scanHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *scanHeap) Push(x interface{}) { *h = append(*h, x.(scanEntry)) }
+func (h *scanHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// filterMatch drops the names that do not match pattern. An empty pattern
+// matches everything.
+func filterMatch(names []string, pattern string) []string {
+	if pattern == "" || pattern == "*" {
+		return names
+	}
+	matched := names[:0]
+	for _, name := range names {
+		if stringMatch(pattern, name, false) {
+			matched = append(matched, name)
+		}
+	}
+	return matched
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestScanBatchReturnsEveryName(t *testing.T) {
+	names := make(map[string]struct{})
+	for i := 0; i < 100; i++ {
+		names["key:"+strconv.Itoa(i)] = struct{}{}
+	}
+	each := func(yield func(string)) {
+		for name := range names {
+			yield(name)
+		}
+	}
+
+	seen := make(map[string]int)
+	cursor := uint64(0)
+	for i := 0; ; i++ {
+		batch, next := scanBatch(cursor, 7, each)
+		for _, name := range batch {
+			seen[name]++
+		}
+		// Grow the collection while the scan is in progress
+		names["added:"+strconv.Itoa(i)] = struct{}{}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+
+	for i := 0; i < 100; i++ {
+		name := "key:" + strconv.Itoa(i)
+		if seen[name] != 1 {
+			t.Errorf("Expected %s to be returned once, Got: %d", name, seen[name])
+		}
+	}
+}
+
+func TestParseScanArgs(t *testing.T) {
+	opts, errMsg := parseScanArgs([]string{"HSCAN", "h", "42", "MATCH", "a*", "COUNT", "5", "NOVALUES"}, 2, false, true)
+	if errMsg != "" {
+		t.Fatalf("Unexpected error: %s", errMsg)
+	}
+	if opts.cursor != 42 || opts.match != "a*" || opts.count != 5 || !opts.noValues {
+		t.Errorf("Unexpected options: %+v", opts)
+	}
+	if _, errMsg := parseScanArgs([]string{"HSCAN", "h", "0", "TYPE", "string"}, 2, false, true); errMsg == "" {
+		t.Error("Expected TYPE to be rejected")
+	}
+}
+
+func TestScanIndexBatches(t *testing.T) {
+	idx := buildScanIndex(func(yield func(string)) {
+		for i := 0; i < 100; i++ {
+			yield("key:" + strconv.Itoa(i))
+		}
+	})
+	idx.add("key:0")
+	if idx.len() != 100 {
+		t.Fatalf("Expected names to be indexed once, Got: %d", idx.len())
+	}
+
+	seen := make(map[string]int)
+	cursor := uint64(0)
+	for i := 0; ; i++ {
+		batch, next := idx.batch(cursor, 7)
+		if len(batch) > 8 {
+			t.Fatalf("Expected about 7 names per call, Got: %d", len(batch))
+		}
+		for _, name := range batch {
+			seen[name]++
+		}
+		// Change the index while the scan is in progress
+		idx.add("added:" + strconv.Itoa(i))
+		idx.remove("key:" + strconv.Itoa(99-i))
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	for i := 0; i < 50; i++ {
+		name := "key:" + strconv.Itoa(i)
+		if seen[name] != 1 {
+			t.Errorf("Expected %s to be returned once, Got: %d", name, seen[name])
+		}
+	}
+}
+
+func TestKeyIndexFollowsWrites(t *testing.T) {
+	kv := NewKeyValueStore()
+	kv.executeCommand([]string{"SET", "before", "v"})
+	kv.mu.RLock()
+	kv.keyIndex(false)
+	kv.mu.RUnlock()
+
+	rng := rand.New(rand.NewSource(1))
+	key := func() string { return "k" + strconv.Itoa(rng.Intn(20)) }
+	commands := []func() []string{
+		func() []string { return []string{"SET", key(), "v"} },
+		func() []string { return []string{"DEL", key(), key()} },
+		func() []string { return []string{"RPUSH", key(), "a"} },
+		func() []string { return []string{"LPOP", key()} },
+		func() []string { return []string{"HSET", key(), "f", "v"} },
+		func() []string { return []string{"HDEL", key(), "f"} },
+		func() []string { return []string{"SADD", key(), "m"} },
+		func() []string { return []string{"SREM", key(), "m"} },
+		func() []string { return []string{"ZADD", key(), "1", "m"} },
+		func() []string { return []string{"ZREM", key(), "m"} },
+		func() []string { return []string{"SUNIONSTORE", key(), key()} },
+		func() []string { return []string{"RENAME", key(), key()} },
+		func() []string { return []string{"EXPIRE", key(), "100"} },
+		func() []string { return []string{"PERSIST", key()} },
+	}
+	for i := 0; i < 2000; i++ {
+		kv.executeCommand(commands[rng.Intn(len(commands))]())
+	}
+
+	indexed := func(idx *scanIndex) map[string]bool {
+		names := make(map[string]bool)
+		for x := idx.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+			names[x.member] = true
+		}
+		return names
+	}
+	keys, volatile := indexed(kv.keys), indexed(kv.volatileKeys)
+	for k := range keys {
+		if !kv.keyStored(k) {
+			t.Errorf("Expected %s not to be indexed", k)
+		}
+	}
+	for k := range kv.Expirations {
+		if !volatile[k] {
+			t.Errorf("Expected %s to be indexed as volatile", k)
+		}
+	}
+	// The same name may be held in more than one type map
+	stored := make(map[string]bool)
+	kv.eachKey(func(k string) {
+		stored[k] = true
+		if !keys[k] {
+			t.Errorf("Expected %s to be indexed", k)
+		}
+	})
+	if len(keys) != len(stored) || len(volatile) != len(kv.Expirations) {
+		t.Fatalf("Expected %d and %d indexed keys, Got: %d and %d", len(stored), len(kv.Expirations), len(keys), len(volatile))
+	}
+}
+
+func TestCollectionScanIndexes(t *testing.T) {
+	kv := NewKeyValueStore()
+	for i := 0; i < 300; i++ {
+		member := "m" + strconv.Itoa(i)
+		kv.executeCommand([]string{"HSET", "h", member, "v"})
+		kv.executeCommand([]string{"SADD", "s", member})
+		kv.executeCommand([]string{"ZADD", "z", strconv.Itoa(i), member})
+	}
+	for _, scan := range [][]string{{"HSCAN", "h"}, {"SSCAN", "s"}, {"ZSCAN", "z"}} {
+		seen := make(map[string]int)
+		cursor := "0"
+		for i := 0; ; i++ {
+			reply := strings.Fields(kv.executeCommand(append(scan, cursor, "COUNT", "10")))
+			step := 1
+			if scan[0] != "SSCAN" {
+				step = 2
+			}
+			if n := (len(reply) - 1) / step; n > 11 {
+				t.Fatalf("%s: expected about 10 members per call, Got: %d", scan[0], n)
+			}
+			for j := 1; j < len(reply); j += step {
+				seen[reply[j]]++
+			}
+			// Members removed and added during the scan may or may not be
+			// returned, the others are returned once
+			removed := "m" + strconv.Itoa(299-i)
+			switch scan[0] {
+			case "HSCAN":
+				kv.executeCommand([]string{"HDEL", "h", removed})
+				kv.executeCommand([]string{"HSET", "h", "new" + strconv.Itoa(i), "v"})
+			case "SSCAN":
+				kv.executeCommand([]string{"SREM", "s", removed})
+				kv.executeCommand([]string{"SADD", "s", "new" + strconv.Itoa(i)})
+			default:
+				kv.executeCommand([]string{"ZREM", "z", removed})
+				kv.executeCommand([]string{"ZADD", "z", "0", "new" + strconv.Itoa(i)})
+			}
+			if cursor = reply[0]; cursor == "0" {
+				break
+			}
+		}
+		for i := 0; i < 200; i++ {
+			if member := "m" + strconv.Itoa(i); seen[member] != 1 {
+				t.Fatalf("%s: expected %s to be returned once, Got: %d", scan[0], member, seen[member])
+			}
+		}
+	}
+}
+
+func TestScanIndexSample(t *testing.T) {
+	idx := buildScanIndex(func(yield func(string)) {
+		for i := 0; i < 10; i++ {
+			yield("key:" + strconv.Itoa(i))
+		}
+	})
+	for _, n := range []int{1, 5, 10, 20} {
+		sample := idx.sample(n)
+		distinct := make(map[string]bool)
+		for _, name := range sample {
+			distinct[name] = true
+		}
+		if want := min(n, 10); len(sample) != want || len(distinct) != want {
+			t.Fatalf("Expected %d distinct names, Got: %q", want, sample)
+		}
+	}
+	if sample := buildScanIndex(func(func(string)) {}).sample(5); len(sample) != 0 {
+		t.Fatalf("Expected an empty sample, Got: %q", sample)
+	}
+}
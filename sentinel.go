@@ -0,0 +1,1165 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dhravya/radish/redisproto"
+)
+
+// Sentinel mode (-sentinel) runs radish as a monitor of masters and their
+// replicas instead of a data server, like Redis Sentinel. Every sentinel
+// polls the instances with INFO replication, which also tells it about the
+// replicas of a master. A master that doesn't reply for down-after
+// milliseconds is subjectively down. A sentinel then asks the others with
+// SENTINEL IS-MASTER-DOWN-BY-ADDR, and when quorum of them agree the master
+// is objectively down. To fail it over, a sentinel starts a new epoch and
+// asks the others for their vote in it; each one votes for the first
+// sentinel that asks in an epoch. The one that gets a majority promotes the
+// replica with the highest replication offset with REPLICAOF NO ONE, points
+// the other replicas at it, and bumps the configuration epoch of the master.
+// Sentinels tell each other about their configuration by sending
+// PUBLISH __sentinel__:hello to each other every period, and the one with
+// the highest epoch wins. A sentinel learns about the others from the hellos
+// it receives, so each one only needs to be given one of the others.
+// Everything that happens is published as an event on the channel of its
+// name, like +switch-master.
+
+const (
+	sentinelHelloChannel = "__sentinel__:hello"
+	defaultSentinelPort  = 26379
+	// sentinelPeriod is how often a sentinel checks every instance and
+	// sends its hellos
+	sentinelPeriod = time.Second
+	// sentinelReconfDelay is, in periods, how long a replica has to report
+	// the wrong master before it gets pointed at the right one, to leave
+	// time for hellos about a failover to arrive
+	sentinelReconfDelay = 4
+	// sentinelPublishedLimit is how many events a subscriber can fall
+	// behind on before it misses some
+	sentinelPublishedLimit = 1024
+)
+
+// sentinelInstance is a master or replica as a sentinel last saw it.
+type sentinelInstance struct {
+	host string
+	port int
+	link *serverLink
+	// lastOK is when it last replied to INFO, or when it was added
+	lastOK time.Time
+	sdown  bool
+	// role, masterHost, masterPort, linkUp and offset are what its INFO
+	// replication said, and roleSince is when that last changed
+	role       string
+	masterHost string
+	masterPort int
+	linkUp     bool
+	offset     int64
+	roleSince  time.Time
+	// reconfAt is when it was last told which master to replicate
+	reconfAt time.Time
+}
+
+func newSentinelInstance(host string, port int) *sentinelInstance {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	now := time.Now()
+	return &sentinelInstance{host: host, port: port, link: &serverLink{addr: addr, auth: masterAuth}, lastOK: now, roleSince: now}
+}
+
+func (inst *sentinelInstance) addr() string {
+	return inst.link.addr
+}
+
+// monitoredMaster is a master a sentinel watches, under the name it was
+// given.
+type monitoredMaster struct {
+	name     string
+	quorum   int
+	master   *sentinelInstance
+	replicas map[string]*sentinelInstance
+	// configEpoch is the epoch of the failover that made master the master
+	configEpoch int64
+	odown       bool
+	// leader is who this sentinel voted for to fail the master over in
+	// leaderEpoch
+	leader      string
+	leaderEpoch int64
+	// failoverState is the step of the failover in progress, "" when there
+	// is none, and failoverStart when the last one started or when this
+	// sentinel last voted for another one's
+	failoverState string
+	failoverStart time.Time
+}
+
+// describe names an instance of the master the way events do.
+func (m *monitoredMaster) describe(inst *sentinelInstance) string {
+	if inst == m.master {
+		return fmt.Sprintf("master %s %s %d", m.name, inst.host, inst.port)
+	}
+	return fmt.Sprintf("slave %s %s %d @ %s %s %d", inst.addr(), inst.host, inst.port, m.name, m.master.host, m.master.port)
+}
+
+// sortedReplicas returns the replicas ordered by address.
+func (m *monitoredMaster) sortedReplicas() []*sentinelInstance {
+	replicas := make([]*sentinelInstance, 0, len(m.replicas))
+	for _, r := range m.replicas {
+		replicas = append(replicas, r)
+	}
+	sort.Slice(replicas, func(i, j int) bool { return replicas[i].addr() < replicas[j].addr() })
+	return replicas
+}
+
+// sentinelPeer is another sentinel, known by its ID.
+type sentinelPeer struct {
+	id   string
+	host string
+	port int
+	link *serverLink
+}
+
+type sentinel struct {
+	mu sync.Mutex
+	id string
+	// port and announceIP are the address other sentinels reach this one
+	// at, where an empty announceIP leaves it to them to find out
+	port       int
+	announceIP string
+	period     time.Duration
+	// downAfter is how long an instance may not reply before it is down,
+	// and failoverTimeout how long a failover may take
+	downAfter       time.Duration
+	failoverTimeout time.Duration
+	currentEpoch    int64
+	masters         map[string]*monitoredMaster
+	peers           map[string]*sentinelPeer
+	// seeds are the addresses of other sentinels whose ID isn't known yet
+	seeds  []string
+	events *sentinelEvents
+	stop   chan struct{}
+}
+
+func newSentinel(port int, downAfter, failoverTimeout time.Duration) *sentinel {
+	return &sentinel{
+		id:              newReplID(),
+		port:            port,
+		period:          sentinelPeriod,
+		downAfter:       downAfter,
+		failoverTimeout: failoverTimeout,
+		masters:         make(map[string]*monitoredMaster),
+		peers:           make(map[string]*sentinelPeer),
+		events:          newSentinelEvents(),
+		stop:            make(chan struct{}),
+	}
+}
+
+// event logs an event and publishes it on the channel of its kind.
+func (s *sentinel) event(kind, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	log.Printf("%s %s", kind, message)
+	s.events.publish(kind, message)
+}
+
+// monitor starts watching the master at host and port under name.
+func (s *sentinel) monitor(name, host string, port, quorum int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.masters[name]; ok {
+		return "ERR Duplicated master name"
+	}
+	m := &monitoredMaster{name: name, quorum: quorum, master: newSentinelInstance(host, port), replicas: make(map[string]*sentinelInstance)}
+	s.masters[name] = m
+	s.event("+monitor", "%s quorum %d", m.describe(m.master), quorum)
+	return "OK"
+}
+
+// masterByAddr returns the monitored master at host and port, if any.
+func (s *sentinel) masterByAddr(host string, port int) *monitoredMaster {
+	for _, m := range s.masters {
+		if m.master.host == host && m.master.port == port {
+			return m
+		}
+	}
+	return nil
+}
+
+func (s *sentinel) run() {
+	ticker := time.NewTicker(s.period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+		s.resolveSeeds()
+		s.mu.Lock()
+		masters := make([]*monitoredMaster, 0, len(s.masters))
+		for _, m := range s.masters {
+			masters = append(masters, m)
+		}
+		s.mu.Unlock()
+		var wg sync.WaitGroup
+		for _, m := range masters {
+			wg.Add(1)
+			go func(m *monitoredMaster) {
+				defer wg.Done()
+				s.check(m)
+			}(m)
+		}
+		wg.Wait()
+		s.sendHellos()
+	}
+}
+
+func (s *sentinel) close() {
+	close(s.stop)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.masters {
+		m.master.link.close()
+		for _, r := range m.replicas {
+			r.link.close()
+		}
+	}
+	for _, peer := range s.peers {
+		peer.link.close()
+	}
+}
+
+// check polls the master and its replicas, and acts on what it finds.
+func (s *sentinel) check(m *monitoredMaster) {
+	s.mu.Lock()
+	if s.masters[m.name] != m {
+		s.mu.Unlock()
+		return
+	}
+	instances := append([]*sentinelInstance{m.master}, m.sortedReplicas()...)
+	s.mu.Unlock()
+
+	replies := make([]string, len(instances))
+	errs := make([]error, len(instances))
+	var wg sync.WaitGroup
+	for i, inst := range instances {
+		wg.Add(1)
+		go func(i int, inst *sentinelInstance) {
+			defer wg.Done()
+			replies[i], errs[i] = inst.link.do(s.period, "INFO", "replication")
+		}(i, inst)
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	now := time.Now()
+	for i, inst := range instances {
+		if errs[i] == nil {
+			s.updateInstance(m, inst, parseInfo(replies[i]), now)
+		}
+	}
+	s.checkDown(m, now)
+	stray := s.strayReplicas(m, now)
+	master := m.master
+	sdown := master.sdown
+	s.mu.Unlock()
+
+	for _, r := range stray {
+		if _, err := r.link.do(s.period, "REPLICAOF", master.host, strconv.Itoa(master.port)); err != nil {
+			continue
+		}
+		s.mu.Lock()
+		if r.role == "master" {
+			s.event("+convert-to-slave", "%s", m.describe(r))
+		} else {
+			s.event("+fix-slave-config", "%s", m.describe(r))
+		}
+		s.mu.Unlock()
+	}
+	if sdown {
+		s.checkObjectivelyDown(m, master)
+	}
+}
+
+// parseInfo returns the fields of an INFO reply.
+func parseInfo(reply string) map[string]string {
+	info := make(map[string]string)
+	for _, line := range strings.Split(reply, "\r\n") {
+		if key, value, ok := strings.Cut(line, ":"); ok && !strings.HasPrefix(line, "#") {
+			info[key] = value
+		}
+	}
+	return info
+}
+
+// updateInstance records what the INFO replication of an instance said. A
+// master also tells about its replicas. The caller must hold s.mu.
+func (s *sentinel) updateInstance(m *monitoredMaster, inst *sentinelInstance, info map[string]string, now time.Time) {
+	role := info["role"]
+	if role == "" {
+		return
+	}
+	inst.lastOK = now
+	masterHost, masterPort := "", 0
+	if role == "slave" {
+		masterHost = info["master_host"]
+		masterPort, _ = strconv.Atoi(info["master_port"])
+		inst.linkUp = info["master_link_status"] == "up"
+		inst.offset, _ = strconv.ParseInt(info["slave_repl_offset"], 10, 64)
+	}
+	if role != inst.role || masterHost != inst.masterHost || masterPort != inst.masterPort {
+		inst.role, inst.masterHost, inst.masterPort = role, masterHost, masterPort
+		inst.roleSince = now
+	}
+	if inst != m.master || role != "master" {
+		return
+	}
+	for i := 0; ; i++ {
+		line, ok := info["slave"+strconv.Itoa(i)]
+		if !ok {
+			break
+		}
+		fields := make(map[string]string)
+		for _, field := range strings.Split(line, ",") {
+			if key, value, ok := strings.Cut(field, "="); ok {
+				fields[key] = value
+			}
+		}
+		port, err := strconv.Atoi(fields["port"])
+		if err != nil || fields["ip"] == "" {
+			continue
+		}
+		addr := net.JoinHostPort(fields["ip"], fields["port"])
+		if _, ok := m.replicas[addr]; ok || addr == m.master.addr() {
+			continue
+		}
+		r := newSentinelInstance(fields["ip"], port)
+		m.replicas[addr] = r
+		s.event("+slave", "%s", m.describe(r))
+	}
+}
+
+// checkDown marks the instances that haven't replied for too long as
+// subjectively down, and the others as up again. The caller must hold s.mu.
+func (s *sentinel) checkDown(m *monitoredMaster, now time.Time) {
+	for _, inst := range append([]*sentinelInstance{m.master}, m.sortedReplicas()...) {
+		down := now.Sub(inst.lastOK) > s.downAfter
+		if down == inst.sdown {
+			continue
+		}
+		inst.sdown = down
+		if down {
+			s.event("+sdown", "%s", m.describe(inst))
+		} else {
+			s.event("-sdown", "%s", m.describe(inst))
+		}
+	}
+	if m.odown && !m.master.sdown {
+		m.odown = false
+		s.event("-odown", "%s", m.describe(m.master))
+	}
+}
+
+// strayReplicas returns the replicas that have been reporting a master other
+// than the one of m for long enough to be pointed at it. Nothing is touched
+// while the master is down or being failed over. The caller must hold s.mu.
+func (s *sentinel) strayReplicas(m *monitoredMaster, now time.Time) []*sentinelInstance {
+	if m.master.sdown || m.master.role != "master" || m.failoverState != "" {
+		return nil
+	}
+	var stray []*sentinelInstance
+	delay := sentinelReconfDelay * s.period
+	for _, r := range m.sortedReplicas() {
+		if r.sdown || r.role == "" {
+			continue
+		}
+		if r.role == "slave" && r.masterHost == m.master.host && r.masterPort == m.master.port {
+			continue
+		}
+		if now.Sub(r.roleSince) > delay && now.Sub(r.reconfAt) > delay {
+			r.reconfAt = now
+			stray = append(stray, r)
+		}
+	}
+	return stray
+}
+
+// checkObjectivelyDown asks the other sentinels whether master is down too,
+// and starts a failover once quorum of them agree.
+func (s *sentinel) checkObjectivelyDown(m *monitoredMaster, master *sentinelInstance) {
+	s.mu.Lock()
+	epoch := strconv.FormatInt(s.currentEpoch, 10)
+	peers := s.peerList()
+	s.mu.Unlock()
+
+	replies := s.askPeers(peers, "SENTINEL", "IS-MASTER-DOWN-BY-ADDR", master.host, strconv.Itoa(master.port), epoch, "*")
+	down := 1
+	for _, reply := range replies {
+		if strings.HasPrefix(reply, "1 ") {
+			down++
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m.master != master || !master.sdown {
+		return
+	}
+	if odown := down >= m.quorum; odown != m.odown {
+		m.odown = odown
+		if odown {
+			s.event("+odown", "%s #quorum %d/%d", m.describe(master), down, m.quorum)
+		} else {
+			s.event("-odown", "%s", m.describe(master))
+		}
+	}
+	if m.odown && m.failoverState == "" && time.Since(m.failoverStart) > 2*s.failoverTimeout {
+		m.failoverState = "wait-start"
+		m.failoverStart = time.Now()
+		go s.tryFailover(m)
+	}
+}
+
+// peerList returns the other sentinels. The caller must hold s.mu.
+func (s *sentinel) peerList() []*sentinelPeer {
+	peers := make([]*sentinelPeer, 0, len(s.peers))
+	for _, peer := range s.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// askPeers sends a command to every peer at once, and returns the replies
+// of those that answered.
+func (s *sentinel) askPeers(peers []*sentinelPeer, args ...string) []string {
+	replies := make([]string, len(peers))
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		wg.Add(1)
+		go func(i int, peer *sentinelPeer) {
+			defer wg.Done()
+			if reply, err := peer.link.do(s.period, args...); err == nil {
+				replies[i] = reply
+			}
+		}(i, peer)
+	}
+	wg.Wait()
+	return replies
+}
+
+// voteLeader votes for the sentinel id to fail m over in epoch, unless this
+// sentinel already voted in that epoch or a later one. It returns who it
+// voted for last. The caller must hold s.mu.
+func (s *sentinel) voteLeader(m *monitoredMaster, id string, epoch int64) (string, int64) {
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+		s.event("+new-epoch", "%d", epoch)
+	}
+	if m.leaderEpoch < epoch && s.currentEpoch <= epoch {
+		m.leader, m.leaderEpoch = id, epoch
+		s.event("+vote-for-leader", "%s %d", id, epoch)
+		if id != s.id {
+			// Leave the other sentinel time to fail it over
+			m.failoverStart = time.Now()
+		}
+	}
+	return m.leader, m.leaderEpoch
+}
+
+// tryFailover asks the other sentinels to elect this one to fail m over,
+// and does it when a majority of them and at least quorum agree. Sentinels
+// wait a random part of a period first, so they don't all ask at once and
+// split the vote.
+func (s *sentinel) tryFailover(m *monitoredMaster) {
+	s.mu.Lock()
+	votedEpoch := m.leaderEpoch
+	s.mu.Unlock()
+	time.Sleep(time.Duration(rand.Int63n(int64(s.period))))
+
+	s.mu.Lock()
+	if s.masters[m.name] != m || !m.odown || m.leaderEpoch != votedEpoch {
+		// Another sentinel asked for our vote meanwhile
+		m.failoverState = ""
+		s.mu.Unlock()
+		return
+	}
+	s.currentEpoch++
+	epoch := s.currentEpoch
+	s.event("+new-epoch", "%d", epoch)
+	s.event("+try-failover", "%s", m.describe(m.master))
+	s.voteLeader(m, s.id, epoch)
+	master := m.master
+	peers := s.peerList()
+	s.mu.Unlock()
+
+	epochStr := strconv.FormatInt(epoch, 10)
+	replies := s.askPeers(peers, "SENTINEL", "IS-MASTER-DOWN-BY-ADDR", master.host, strconv.Itoa(master.port), epochStr, s.id)
+	votes := 1
+	for _, reply := range replies {
+		if fields := strings.Fields(reply); len(fields) == 3 && fields[1] == s.id && fields[2] == epochStr {
+			votes++
+		}
+	}
+
+	s.mu.Lock()
+	if votes < votesNeeded(len(peers)+1, m.quorum) || m.master != master {
+		s.event("-failover-abort-not-elected", "%s", m.describe(master))
+		m.failoverState = ""
+		s.mu.Unlock()
+		return
+	}
+	s.event("+elected-leader", "%s", m.describe(master))
+	s.mu.Unlock()
+	s.failover(m, epoch)
+}
+
+// votesNeeded returns how many votes a sentinel needs to lead a failover: a
+// majority of the sentinels monitoring the master, itself included, and at
+// least the quorum.
+func votesNeeded(sentinels, quorum int) int {
+	return max(sentinels/2+1, quorum)
+}
+
+// selectReplica picks the replica to promote: the one with the highest
+// replication offset among those that replied lately, the lowest address
+// on a tie. The caller must hold s.mu.
+func (s *sentinel) selectReplica(m *monitoredMaster) *sentinelInstance {
+	var best *sentinelInstance
+	for _, r := range m.sortedReplicas() {
+		if r.sdown || r.role != "slave" || time.Since(r.lastOK) > 5*s.period {
+			continue
+		}
+		if best == nil || r.offset > best.offset {
+			best = r
+		}
+	}
+	return best
+}
+
+// failover promotes a replica of m and points the other replicas at it, as
+// the leader of epoch.
+func (s *sentinel) failover(m *monitoredMaster, epoch int64) {
+	s.mu.Lock()
+	old := m.master
+	m.failoverState = "select-slave"
+	s.event("+failover-state-select-slave", "%s", m.describe(old))
+	promoted := s.selectReplica(m)
+	if promoted == nil {
+		s.event("-failover-abort-no-good-slave", "%s", m.describe(old))
+		m.failoverState = ""
+		s.mu.Unlock()
+		return
+	}
+	s.event("+selected-slave", "%s", m.describe(promoted))
+	m.failoverState = "send-slaveof-noone"
+	s.event("+failover-state-send-slaveof-noone", "%s", m.describe(promoted))
+	s.mu.Unlock()
+
+	abort := func(kind string) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.event(kind, "%s", m.describe(old))
+		m.failoverState = ""
+	}
+	if _, err := promoted.link.do(s.period, "REPLICAOF", "NO", "ONE"); err != nil {
+		abort("-failover-abort-slave-timeout")
+		return
+	}
+	s.mu.Lock()
+	m.failoverState = "wait-promotion"
+	s.event("+failover-state-wait-promotion", "%s", m.describe(promoted))
+	s.mu.Unlock()
+	for deadline := time.Now().Add(s.failoverTimeout); ; {
+		reply, err := promoted.link.do(s.period, "INFO", "replication")
+		if err == nil && parseInfo(reply)["role"] == "master" {
+			break
+		}
+		if time.Now().After(deadline) {
+			abort("-failover-abort-slave-timeout")
+			return
+		}
+		time.Sleep(s.period / 10)
+	}
+
+	s.mu.Lock()
+	s.event("+promoted-slave", "%s", m.describe(promoted))
+	m.failoverState = "reconf-slaves"
+	s.event("+failover-state-reconf-slaves", "%s", m.describe(old))
+	var others []*sentinelInstance
+	for _, r := range m.sortedReplicas() {
+		if r != promoted {
+			others = append(others, r)
+		}
+	}
+	s.mu.Unlock()
+	for _, r := range others {
+		if _, err := r.link.do(s.period, "REPLICAOF", promoted.host, strconv.Itoa(promoted.port)); err == nil {
+			s.mu.Lock()
+			r.reconfAt = time.Now()
+			s.event("+slave-reconf-sent", "%s", m.describe(r))
+			s.mu.Unlock()
+		}
+	}
+
+	s.mu.Lock()
+	s.event("+failover-end", "%s", m.describe(old))
+	s.switchMaster(m, promoted.host, promoted.port, epoch)
+	s.mu.Unlock()
+	s.sendHellos()
+}
+
+// switchMaster makes the instance at host and port the master of m, as of
+// epoch. The old master stays on as a replica, to be pointed at the new one
+// when it comes back. The caller must hold s.mu.
+func (s *sentinel) switchMaster(m *monitoredMaster, host string, port int, epoch int64) {
+	old := m.master
+	s.event("+switch-master", "%s %s %d %s %d", m.name, old.host, old.port, host, port)
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	next, ok := m.replicas[addr]
+	if !ok {
+		next = newSentinelInstance(host, port)
+	}
+	delete(m.replicas, addr)
+	if old.addr() != addr {
+		m.replicas[old.addr()] = old
+	}
+	next.lastOK, next.sdown = time.Now(), false
+	m.master = next
+	m.configEpoch = epoch
+	m.odown = false
+	m.failoverState = ""
+}
+
+// sendHellos tells every other sentinel about the current epoch and the
+// configuration of every master.
+func (s *sentinel) sendHellos() {
+	s.mu.Lock()
+	var hellos []string
+	for _, m := range s.masters {
+		hellos = append(hellos, fmt.Sprintf("%s,%d,%s,%d,%s,%s,%d,%d",
+			s.announceIP, s.port, s.id, s.currentEpoch, m.name, m.master.host, m.master.port, m.configEpoch))
+	}
+	peers := s.peerList()
+	s.mu.Unlock()
+	for _, hello := range hellos {
+		s.askPeers(peers, "PUBLISH", sentinelHelloChannel, hello)
+	}
+}
+
+// resolveSeeds asks the sentinels given by address for their ID, and adds
+// those that answer as peers.
+func (s *sentinel) resolveSeeds() {
+	s.mu.Lock()
+	seeds := s.seeds
+	s.mu.Unlock()
+	for _, addr := range seeds {
+		link := &serverLink{addr: addr, auth: requirePass}
+		id, err := link.do(s.period, "SENTINEL", "MYID")
+		link.close()
+		host, portStr, _ := net.SplitHostPort(addr)
+		port, _ := strconv.Atoi(portStr)
+		if err != nil || len(id) != len(s.id) {
+			continue
+		}
+		s.mu.Lock()
+		for i, seed := range s.seeds {
+			if seed == addr {
+				s.seeds = append(s.seeds[:i:i], s.seeds[i+1:]...)
+				break
+			}
+		}
+		s.addPeer(id, host, port)
+		s.mu.Unlock()
+	}
+}
+
+// addPeer adds or updates the sentinel id at host and port. The caller must
+// hold s.mu.
+func (s *sentinel) addPeer(id, host string, port int) {
+	if id == s.id {
+		return
+	}
+	peer, ok := s.peers[id]
+	if ok && peer.host == host && peer.port == port {
+		return
+	}
+	if ok {
+		peer.link.close()
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	s.peers[id] = &sentinelPeer{id: id, host: host, port: port, link: &serverLink{addr: addr, auth: requirePass}}
+	for _, m := range s.masters {
+		s.event("+sentinel", "sentinel %s %s %d @ %s %s %d", id, host, port, m.name, m.master.host, m.master.port)
+	}
+}
+
+// receiveHello handles a hello from another sentinel connected from
+// remoteIP. A newer configuration of a master replaces ours.
+func (s *sentinel) receiveHello(hello, remoteIP string) {
+	fields := strings.Split(hello, ",")
+	if len(fields) != 8 {
+		return
+	}
+	port, err1 := strconv.Atoi(fields[1])
+	epoch, err2 := strconv.ParseInt(fields[3], 10, 64)
+	masterPort, err3 := strconv.Atoi(fields[6])
+	configEpoch, err4 := strconv.ParseInt(fields[7], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return
+	}
+	ip := fields[0]
+	if ip == "" {
+		ip = remoteIP
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addPeer(fields[2], ip, port)
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+		s.event("+new-epoch", "%d", epoch)
+	}
+	m, ok := s.masters[fields[4]]
+	if !ok || configEpoch <= m.configEpoch {
+		return
+	}
+	if m.master.host == fields[5] && m.master.port == masterPort {
+		m.configEpoch = configEpoch
+		return
+	}
+	s.event("+config-update-from", "sentinel %s %s %d @ %s %s %d", fields[2], ip, port, m.name, m.master.host, m.master.port)
+	s.switchMaster(m, fields[5], masterPort, configEpoch)
+}
+
+// command runs a command sent to the sentinel from remoteIP, other than
+// the pub/sub ones.
+func (s *sentinel) command(parts []string, remoteIP string) string {
+	switch strings.ToUpper(parts[0]) {
+	case "PING":
+		return "PONG"
+	case "SENTINEL":
+		return s.sentinelCommand(parts)
+	case "PUBLISH":
+		if len(parts) != 3 {
+			return "ERR wrong number of arguments for 'publish' command"
+		}
+		if parts[1] != sentinelHelloChannel {
+			return "ERR Only HELLO messages are accepted by Sentinel instances."
+		}
+		s.receiveHello(parts[2], remoteIP)
+		return "(integer) 1"
+	case "ROLE":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		names := []string{"sentinel"}
+		for name := range s.masters {
+			names = append(names, name)
+		}
+		sort.Strings(names[1:])
+		return strings.Join(names, " ")
+	case "INFO":
+		return s.info()
+	}
+	return "ERR unknown command"
+}
+
+// sentinelCommand implements SENTINEL subcommand [argument ...].
+func (s *sentinel) sentinelCommand(parts []string) string {
+	if len(parts) < 2 {
+		return "ERR wrong number of arguments for 'sentinel' command"
+	}
+	subcommand := strings.ToUpper(parts[1])
+	if subcommand == "MONITOR" && len(parts) == 6 {
+		port, err := strconv.Atoi(parts[4])
+		if err != nil || port < 1 || port > 65535 {
+			return "ERR Invalid port"
+		}
+		quorum, err := strconv.Atoi(parts[5])
+		if err != nil || quorum < 1 {
+			return "ERR Quorum must be 1 or greater."
+		}
+		return s.monitor(parts[2], parts[3], port, quorum)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case subcommand == "MYID" && len(parts) == 2:
+		return s.id
+	case subcommand == "MASTERS" && len(parts) == 2:
+		names := make([]string, 0, len(s.masters))
+		for name := range s.masters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		lines := make([]string, len(names))
+		for i, name := range names {
+			lines[i] = s.masterLine(s.masters[name])
+		}
+		return strings.Join(lines, "\n")
+	case subcommand == "IS-MASTER-DOWN-BY-ADDR" && len(parts) == 6:
+		port, err1 := strconv.Atoi(parts[3])
+		epoch, err2 := strconv.ParseInt(parts[4], 10, 64)
+		if err1 != nil || err2 != nil {
+			return "ERR value is not an integer or out of range"
+		}
+		m := s.masterByAddr(parts[2], port)
+		down := m != nil && m.master.sdown
+		leader, leaderEpoch := "*", int64(0)
+		if m != nil && parts[5] != "*" {
+			leader, leaderEpoch = s.voteLeader(m, parts[5], epoch)
+		}
+		return fmt.Sprintf("%d %s %d", boolToInt(down), leader, leaderEpoch)
+	case len(parts) != 3:
+		return fmt.Sprintf("ERR Unknown subcommand or wrong number of arguments for '%s'. Try SENTINEL HELP.", parts[1])
+	}
+
+	m, ok := s.masters[parts[2]]
+	if !ok {
+		if subcommand == "GET-MASTER-ADDR-BY-NAME" {
+			return "(nil)"
+		}
+		return "ERR No such master with that name"
+	}
+	switch subcommand {
+	case "GET-MASTER-ADDR-BY-NAME":
+		return fmt.Sprintf("%s %d", m.master.host, m.master.port)
+	case "MASTER":
+		return s.masterLine(m)
+	case "REPLICAS", "SLAVES":
+		var lines []string
+		for _, r := range m.sortedReplicas() {
+			flags := "slave"
+			if r.sdown {
+				flags += ",s_down"
+			}
+			linkStatus := "err"
+			if r.linkUp {
+				linkStatus = "ok"
+			}
+			lines = append(lines, fmt.Sprintf("name %s ip %s port %d flags %s role-reported %s master-link-status %s master-host %s master-port %d slave-repl-offset %d",
+				r.addr(), r.host, r.port, flags, r.role, linkStatus, r.masterHost, r.masterPort, r.offset))
+		}
+		return strings.Join(lines, "\n")
+	case "SENTINELS":
+		var lines []string
+		for _, peer := range s.peerList() {
+			lines = append(lines, fmt.Sprintf("name %s ip %s port %d runid %s flags sentinel", peer.id, peer.host, peer.port, peer.id))
+		}
+		sort.Strings(lines)
+		return strings.Join(lines, "\n")
+	case "REMOVE":
+		delete(s.masters, m.name)
+		s.event("-monitor", "%s", m.describe(m.master))
+		return "OK"
+	case "FAILOVER":
+		// Like in Redis, a forced failover doesn't ask the other sentinels
+		if m.failoverState != "" {
+			return "INPROG Failover already in progress"
+		}
+		if s.selectReplica(m) == nil {
+			return "NOGOODSLAVE No suitable replica to promote"
+		}
+		s.currentEpoch++
+		s.event("+new-epoch", "%d", s.currentEpoch)
+		s.event("+try-failover", "%s", m.describe(m.master))
+		s.voteLeader(m, s.id, s.currentEpoch)
+		m.failoverState = "wait-start"
+		m.failoverStart = time.Now()
+		go s.failover(m, s.currentEpoch)
+		return "OK"
+	}
+	return fmt.Sprintf("ERR Unknown subcommand or wrong number of arguments for '%s'. Try SENTINEL HELP.", parts[1])
+}
+
+// masterLine describes a master for SENTINEL MASTERS and MASTER. The caller
+// must hold s.mu.
+func (s *sentinel) masterLine(m *monitoredMaster) string {
+	flags := "master"
+	if m.master.sdown {
+		flags += ",s_down"
+	}
+	if m.odown {
+		flags += ",o_down"
+	}
+	if m.failoverState != "" {
+		flags += ",failover_in_progress"
+	}
+	failoverState := m.failoverState
+	if failoverState == "" {
+		failoverState = "none"
+	}
+	return fmt.Sprintf("name %s ip %s port %d flags %s num-slaves %d num-other-sentinels %d quorum %d config-epoch %d failover-state %s down-after-milliseconds %d failover-timeout %d",
+		m.name, m.master.host, m.master.port, flags, len(m.replicas), len(s.peers), m.quorum, m.configEpoch,
+		failoverState, s.downAfter.Milliseconds(), s.failoverTimeout.Milliseconds())
+}
+
+// info returns the reply to INFO in sentinel mode.
+func (s *sentinel) info() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var b strings.Builder
+	b.WriteString("# Server\r\n")
+	b.WriteString(fmt.Sprintf("uptime_in_seconds:%d\r\n", int(time.Since(serverStartTime).Seconds())))
+	b.WriteString("\r\n# Sentinel\r\n")
+	b.WriteString(fmt.Sprintf("sentinel_masters:%d\r\n", len(s.masters)))
+	b.WriteString(fmt.Sprintf("sentinel_current_epoch:%d\r\n", s.currentEpoch))
+	names := make([]string, 0, len(s.masters))
+	for name := range s.masters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		m := s.masters[name]
+		status := "ok"
+		if m.odown {
+			status = "odown"
+		} else if m.master.sdown {
+			status = "sdown"
+		}
+		b.WriteString(fmt.Sprintf("master%d:name=%s,status=%s,address=%s,slaves=%d,sentinels=%d\r\n",
+			i, name, status, m.master.addr(), len(m.replicas), len(s.peers)+1))
+	}
+	return b.String()
+}
+
+// sentinelEvents delivers the events of a sentinel to its subscribers.
+type sentinelEvents struct {
+	mu          sync.Mutex
+	subscribers map[*eventSubscriber]struct{}
+}
+
+// eventSubscriber is a connection in subscribed mode. messages carries the
+// replies to push to it.
+type eventSubscriber struct {
+	channels map[string]bool
+	patterns map[string]bool
+	messages chan []string
+}
+
+func newSentinelEvents() *sentinelEvents {
+	return &sentinelEvents{subscribers: make(map[*eventSubscriber]struct{})}
+}
+
+func (e *sentinelEvents) subscribe() *eventSubscriber {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	sub := &eventSubscriber{channels: make(map[string]bool), patterns: make(map[string]bool), messages: make(chan []string, sentinelPublishedLimit)}
+	e.subscribers[sub] = struct{}{}
+	return sub
+}
+
+func (e *sentinelEvents) unsubscribe(sub *eventSubscriber) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.subscribers, sub)
+	close(sub.messages)
+}
+
+// change runs SUBSCRIBE, PSUBSCRIBE, UNSUBSCRIBE or PUNSUBSCRIBE for sub,
+// and returns the replies to send, one per channel or pattern. It reports
+// whether sub is still subscribed to anything.
+func (e *sentinelEvents) change(sub *eventSubscriber, kind string, names []string) ([][]interface{}, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	set := sub.channels
+	if strings.HasPrefix(kind, "p") {
+		set = sub.patterns
+	}
+	subscribing := !strings.Contains(kind, "unsubscribe")
+	if !subscribing && len(names) == 0 {
+		for name := range set {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	var replies [][]interface{}
+	for _, name := range names {
+		if subscribing {
+			set[name] = true
+		} else {
+			delete(set, name)
+		}
+		replies = append(replies, []interface{}{kind, name, len(sub.channels) + len(sub.patterns)})
+	}
+	if len(replies) == 0 {
+		replies = append(replies, []interface{}{kind, nil, len(sub.channels) + len(sub.patterns)})
+	}
+	return replies, len(sub.channels)+len(sub.patterns) > 0
+}
+
+// publish sends message to the subscribers of channel, skipping those too
+// far behind.
+func (e *sentinelEvents) publish(channel, message string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for sub := range e.subscribers {
+		var pushes [][]string
+		if sub.channels[channel] {
+			pushes = append(pushes, []string{"message", channel, message})
+		}
+		for pattern := range sub.patterns {
+			if stringMatch(pattern, channel, false) {
+				pushes = append(pushes, []string{"pmessage", pattern, channel, message})
+			}
+		}
+		for _, push := range pushes {
+			select {
+			case sub.messages <- push:
+			default:
+			}
+		}
+	}
+}
+
+// handleConnection serves a client of the sentinel. Once it subscribes to
+// events, it only gets to subscribe, unsubscribe and PING.
+func (s *sentinel) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	parser := redisproto.NewParser(conn)
+	writer := redisproto.NewWriter(bufio.NewWriter(conn))
+	authenticated := requirePass == ""
+	limitParser(parser, authenticated)
+	remoteIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	// writeMu keeps events from being written in the middle of a reply
+	var writeMu sync.Mutex
+	var sub *eventSubscriber
+	subscribed := false
+	defer func() {
+		if sub != nil {
+			s.events.unsubscribe(sub)
+		}
+	}()
+
+	for {
+		command, err := parser.ReadCommand()
+		if err != nil {
+			if _, ok := err.(*redisproto.ProtocolError); !ok {
+				break
+			}
+			writeMu.Lock()
+			ew := writer.WriteError(err.Error())
+			writer.Flush()
+			writeMu.Unlock()
+			if ew != nil {
+				break
+			}
+			continue
+		}
+		parts := commandParts(command)
+		name := strings.ToUpper(parts[0])
+		var response string
+		var pushes [][]interface{}
+		switch {
+		case name == "AUTH":
+			response, authenticated = authCommand(command, authenticated)
+			limitParser(parser, authenticated)
+		case !authenticated:
+			response = "NOAUTH Authentication required."
+		case name == "SUBSCRIBE" || name == "PSUBSCRIBE" || name == "UNSUBSCRIBE" || name == "PUNSUBSCRIBE":
+			if len(parts) < 2 && (name == "SUBSCRIBE" || name == "PSUBSCRIBE") {
+				response = fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name))
+				break
+			}
+			if sub == nil {
+				sub = s.events.subscribe()
+				go forwardEvents(sub, writer, &writeMu)
+			}
+			pushes, subscribed = s.events.change(sub, strings.ToLower(name), parts[1:])
+		case subscribed && name != "PING":
+			response = fmt.Sprintf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", strings.ToLower(name))
+		default:
+			response = s.command(parts, remoteIP)
+		}
+
+		writeMu.Lock()
+		var ew error
+		for _, push := range pushes {
+			if ew == nil {
+				ew = writer.WriteObjects(push...)
+			}
+		}
+		if response != "" && ew == nil {
+			ew = writer.WriteBulkString(response)
+		}
+		if command.IsLast() && ew == nil {
+			ew = writer.Flush()
+		}
+		writeMu.Unlock()
+		if ew != nil {
+			break
+		}
+	}
+}
+
+// forwardEvents writes the events of sub to its connection until it
+// unsubscribes.
+func forwardEvents(sub *eventSubscriber, writer *redisproto.Writer, writeMu *sync.Mutex) {
+	for message := range sub.messages {
+		writeMu.Lock()
+		writer.WriteBulkStrings(message)
+		writer.Flush()
+		writeMu.Unlock()
+	}
+}
+
+// stringListFlag is a flag that can be given several times.
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *stringListFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// runSentinel runs this process as a sentinel listening on port, monitoring
+// the masters given as "name host port quorum" and starting from the other
+// sentinels at peers.
+func runSentinel(port int, monitors []string, peers string, announceIP string, downAfter, failoverTimeout time.Duration) {
+	s := newSentinel(port, downAfter, failoverTimeout)
+	s.announceIP = announceIP
+	for _, monitor := range monitors {
+		fields := strings.Fields(monitor)
+		if len(fields) != 4 {
+			fmt.Println("Invalid sentinel-monitor, expected a name, a host, a port and a quorum:", monitor)
+			return
+		}
+		reply := s.sentinelCommand(append([]string{"SENTINEL", "MONITOR"}, fields...))
+		if reply != "OK" {
+			fmt.Println("Invalid sentinel-monitor:", reply)
+			return
+		}
+	}
+	for _, addr := range strings.Fields(peers) {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			fmt.Println("Invalid sentinel-peers:", err)
+			return
+		}
+		s.seeds = append(s.seeds, addr)
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		fmt.Println("Error listening:", err.Error())
+		return
+	}
+	defer listener.Close()
+	fmt.Printf("Sentinel %s listening on :%d\n", s.id, port)
+	go s.run()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Println("Error accepting: ", err.Error())
+			return
+		}
+		go s.handleConnection(conn)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dhravya/radish/redisproto"
+)
+
+// fakeGroup is a set of fake instances that answer INFO replication,
+// REPLICAOF and PING like a master and its replicas would.
+type fakeGroup struct {
+	mu        sync.Mutex
+	instances []*fakeInstance
+}
+
+type fakeInstance struct {
+	group *fakeGroup
+	ln    net.Listener
+	port  int
+	// role, master and offset are guarded by group.mu, like the rest
+	role       string
+	master     int
+	offset     int64
+	promotions int
+	down       bool
+	conns      map[net.Conn]bool
+}
+
+func (g *fakeGroup) start(t *testing.T, master int, offset int64) *fakeInstance {
+	t.Helper()
+	inst := &fakeInstance{group: g, role: "master", master: master, offset: offset, conns: make(map[net.Conn]bool)}
+	if master != 0 {
+		inst.role = "slave"
+	}
+	inst.listen(t, "127.0.0.1:0")
+	inst.port = inst.ln.Addr().(*net.TCPAddr).Port
+	g.mu.Lock()
+	g.instances = append(g.instances, inst)
+	g.mu.Unlock()
+	t.Cleanup(inst.kill)
+	return inst
+}
+
+func (inst *fakeInstance) listen(t *testing.T, addr string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Expected to listen, Got: %v", err)
+	}
+	inst.group.mu.Lock()
+	inst.ln, inst.down = ln, false
+	inst.group.mu.Unlock()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			inst.group.mu.Lock()
+			inst.conns[conn] = true
+			inst.group.mu.Unlock()
+			go inst.serve(conn)
+		}
+	}()
+}
+
+// kill makes the instance stop answering, like a crashed server.
+func (inst *fakeInstance) kill() {
+	inst.group.mu.Lock()
+	defer inst.group.mu.Unlock()
+	inst.ln.Close()
+	inst.down = true
+	for conn := range inst.conns {
+		conn.Close()
+	}
+	inst.conns = make(map[net.Conn]bool)
+}
+
+func (inst *fakeInstance) serve(conn net.Conn) {
+	defer conn.Close()
+	parser := redisproto.NewParser(conn)
+	writer := redisproto.NewWriter(bufio.NewWriter(conn))
+	for {
+		command, err := parser.ReadCommand()
+		if err != nil {
+			return
+		}
+		parts := commandParts(command)
+		writer.WriteBulkString(inst.command(parts))
+		writer.Flush()
+	}
+}
+
+func (inst *fakeInstance) command(parts []string) string {
+	g := inst.group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch strings.ToUpper(parts[0]) {
+	case "INFO":
+		if inst.role == "slave" {
+			return fmt.Sprintf("# Replication\r\nrole:slave\r\nmaster_host:127.0.0.1\r\nmaster_port:%d\r\nmaster_link_status:up\r\nslave_repl_offset:%d\r\n", inst.master, inst.offset)
+		}
+		info := "# Replication\r\nrole:master\r\n"
+		i := 0
+		for _, other := range g.instances {
+			if other.role == "slave" && other.master == inst.port && !other.down {
+				info += fmt.Sprintf("slave%d:ip=127.0.0.1,port=%d,state=online,offset=%d,lag=0\r\n", i, other.port, other.offset)
+				i++
+			}
+		}
+		return info
+	case "REPLICAOF":
+		if strings.EqualFold(parts[1], "NO") {
+			inst.role, inst.master = "master", 0
+			inst.promotions++
+		} else {
+			inst.role = "slave"
+			inst.master, _ = strconv.Atoi(parts[2])
+		}
+		return "OK"
+	}
+	return "PONG"
+}
+
+// replicaOf returns the port of the master of the instance, 0 on a master.
+func (inst *fakeInstance) replicaOf() int {
+	inst.group.mu.Lock()
+	defer inst.group.mu.Unlock()
+	return inst.master
+}
+
+func startTestSentinels(t *testing.T, n, masterPort int) []*sentinel {
+	t.Helper()
+	sentinels := make([]*sentinel, n)
+	for i := range sentinels {
+		s := newSentinel(0, 300*time.Millisecond, time.Second)
+		s.period = 50 * time.Millisecond
+		s.port = listenTest(t, s.handleConnection).Addr().(*net.TCPAddr).Port
+		s.monitor("mymaster", "127.0.0.1", masterPort, 2)
+		sentinels[i] = s
+	}
+	// Each sentinel is only told about the next one
+	for i, s := range sentinels {
+		s.seeds = []string{fmt.Sprintf("127.0.0.1:%d", sentinels[(i+1)%n].port)}
+		go s.run()
+		t.Cleanup(s.close)
+	}
+	return sentinels
+}
+
+func waitUntil(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); !done(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSentinelFailover(t *testing.T) {
+	group := &fakeGroup{}
+	master := group.start(t, 0, 0)
+	best := group.start(t, master.port, 100)
+	other := group.start(t, master.port, 50)
+	sentinels := startTestSentinels(t, 3, master.port)
+
+	waitUntil(t, "the sentinels to find the replicas and each other", func() bool {
+		for _, s := range sentinels {
+			reply := s.sentinelCommand([]string{"SENTINEL", "MASTER", "mymaster"})
+			if !strings.Contains(reply, "num-slaves 2 num-other-sentinels 2 ") {
+				return false
+			}
+		}
+		return true
+	})
+	events, err := dialRedis(fmt.Sprintf("127.0.0.1:%d", sentinels[2].port), 10*time.Second)
+	if err != nil {
+		t.Fatalf("Expected to connect, Got: %v", err)
+	}
+	defer events.Close()
+	if reply, _ := events.Do("SUBSCRIBE", "+switch-master"); reply != "subscribe +switch-master (integer) 1" {
+		t.Fatalf("Expected to subscribe, Got: %q", reply)
+	}
+
+	master.kill()
+	expected := fmt.Sprintf("message +switch-master mymaster 127.0.0.1 %d 127.0.0.1 %d", master.port, best.port)
+	if reply, err := events.readReply(); reply != expected {
+		t.Fatalf("Expected %q, Got: %q, %v", expected, reply, err)
+	}
+	waitUntil(t, "every sentinel to know the new master", func() bool {
+		for _, s := range sentinels {
+			if reply := s.sentinelCommand([]string{"SENTINEL", "GET-MASTER-ADDR-BY-NAME", "mymaster"}); reply != fmt.Sprintf("127.0.0.1 %d", best.port) {
+				return false
+			}
+		}
+		return true
+	})
+	waitUntil(t, "the other replica to follow the new master", func() bool { return other.replicaOf() == best.port })
+	group.mu.Lock()
+	promotions := best.promotions
+	group.mu.Unlock()
+	if promotions != 1 {
+		t.Fatalf("Expected a single promotion, Got: %d", promotions)
+	}
+
+	// The old master comes back as a replica of the new one
+	master.listen(t, fmt.Sprintf("127.0.0.1:%d", master.port))
+	waitUntil(t, "the old master to be converted to a replica", func() bool { return master.replicaOf() == best.port })
+}
+
+func TestSentinelVotesOncePerEpoch(t *testing.T) {
+	s := newSentinel(0, time.Second, time.Second)
+	s.monitor("mymaster", "127.0.0.1", 6379, 2)
+	ask := func(epoch, id string) string {
+		return s.sentinelCommand([]string{"SENTINEL", "IS-MASTER-DOWN-BY-ADDR", "127.0.0.1", "6379", epoch, id})
+	}
+	if reply := ask("1", "a"); reply != "0 a 1" {
+		t.Fatalf("Expected a vote for the first sentinel asking, Got: %q", reply)
+	}
+	if reply := ask("1", "b"); reply != "0 a 1" {
+		t.Fatalf("Expected the vote to stand for the epoch, Got: %q", reply)
+	}
+	if reply := ask("2", "b"); reply != "0 b 2" {
+		t.Fatalf("Expected a vote in a later epoch, Got: %q", reply)
+	}
+	if reply := ask("3", "*"); reply != "0 * 0" {
+		t.Fatalf("Expected no vote when only asked whether the master is down, Got: %q", reply)
+	}
+	if reply := s.sentinelCommand([]string{"SENTINEL", "IS-MASTER-DOWN-BY-ADDR", "127.0.0.1", "6380", "4", "c"}); reply != "0 * 0" {
+		t.Fatalf("Expected no vote for an unknown master, Got: %q", reply)
+	}
+	if s.currentEpoch != 2 {
+		t.Fatalf("Expected the epoch to follow the others, Got: %d", s.currentEpoch)
+	}
+}
+
+func TestVotesNeededCountsEverySentinel(t *testing.T) {
+	for _, c := range []struct{ sentinels, quorum, expected int }{
+		{1, 1, 1},
+		{2, 1, 2},
+		{3, 2, 2},
+		{4, 2, 3},
+		{5, 4, 4},
+	} {
+		if got := votesNeeded(c.sentinels, c.quorum); got != c.expected {
+			t.Fatalf("Expected %d votes out of %d sentinels with quorum %d, Got: %d", c.expected, c.sentinels, c.quorum, got)
+		}
+	}
+}
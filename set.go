@@ -0,0 +1,294 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+)
+
+// Set is the value type behind sets. Like in Redis, a set of integers is
+// kept as a sorted array of them (an intset) while it has no more than
+// set-max-intset-entries members, other small sets are kept as a listpack,
+// and larger ones as a map. Sets never go back to a compact encoding. A nil
+// *Set behaves as an empty set.
+type Set struct {
+	enc  setEncoding
+	ints []int64
+	lp   listpack
+	dict map[string]struct{}
+	// scan indexes the members of dict once SSCAN needed it
+	scan *scanIndex
+}
+
+type setEncoding int
+
+const (
+	setEncodingIntset setEncoding = iota
+	setEncodingListpack
+	setEncodingHashtable
+)
+
+// NewSet returns an empty set. It starts as an intset, which the first
+// member that is not an integer converts.
+func NewSet() *Set {
+	return &Set{enc: setEncodingIntset}
+}
+
+// setFromMap builds a set holding the members of m, in the encoding their
+// number and kind call for.
+func setFromMap(m map[string]struct{}) *Set {
+	s := NewSet()
+	for member := range m {
+		s.Add(member)
+	}
+	return s
+}
+
+// Encoding names the representation of the set the way OBJECT ENCODING does.
+func (s *Set) Encoding() string {
+	switch s.enc {
+	case setEncodingIntset:
+		return "intset"
+	case setEncodingListpack:
+		return "listpack"
+	}
+	return "hashtable"
+}
+
+func (s *Set) Len() int {
+	if s == nil {
+		return 0
+	}
+	switch s.enc {
+	case setEncodingIntset:
+		return len(s.ints)
+	case setEncodingListpack:
+		return s.lp.Len()
+	}
+	return len(s.dict)
+}
+
+// searchInts returns where n is or would be in the intset.
+func (s *Set) searchInts(n int64) (int, bool) {
+	i := sort.Search(len(s.ints), func(i int) bool { return s.ints[i] >= n })
+	return i, i < len(s.ints) && s.ints[i] == n
+}
+
+// findListpack returns the position of member in the listpack, or -1.
+func (s *Set) findListpack(member string) int {
+	for pos := s.lp.first(); !s.lp.atEnd(pos); {
+		e, next := s.lp.next(pos)
+		if e.equals(member) {
+			return pos
+		}
+		pos = next
+	}
+	return -1
+}
+
+func (s *Set) Contains(member string) bool {
+	if s == nil {
+		return false
+	}
+	switch s.enc {
+	case setEncodingIntset:
+		n, ok := lpInt(member)
+		if !ok {
+			return false
+		}
+		_, found := s.searchInts(n)
+		return found
+	case setEncodingListpack:
+		return s.findListpack(member) >= 0
+	}
+	_, ok := s.dict[member]
+	return ok
+}
+
+// Add adds member and reports whether it is new.
+func (s *Set) Add(member string) bool {
+	if s.enc == setEncodingIntset {
+		n, ok := lpInt(member)
+		if ok {
+			i, found := s.searchInts(n)
+			if found {
+				return false
+			}
+			if len(s.ints) < setMaxIntsetEntries {
+				s.ints = append(s.ints, 0)
+				copy(s.ints[i+1:], s.ints[i:])
+				s.ints[i] = n
+				return true
+			}
+		}
+		if s.Contains(member) {
+			return false
+		}
+		if ok || len(s.ints) >= setMaxListpackEntries || len(member) > setMaxListpackValue {
+			s.convert(setEncodingHashtable)
+		} else {
+			s.convert(setEncodingListpack)
+		}
+	}
+	if s.enc == setEncodingListpack {
+		if s.findListpack(member) >= 0 {
+			return false
+		}
+		if s.lp.Len() < setMaxListpackEntries && len(member) <= setMaxListpackValue {
+			s.lp = s.lp.append(member)
+			return true
+		}
+		s.convert(setEncodingHashtable)
+	}
+	if _, exists := s.dict[member]; exists {
+		return false
+	}
+	s.dict[member] = struct{}{}
+	if s.scan != nil {
+		s.scan.add(member)
+	}
+	return true
+}
+
+// Remove deletes member and reports whether it was there.
+func (s *Set) Remove(member string) bool {
+	if s == nil {
+		return false
+	}
+	switch s.enc {
+	case setEncodingIntset:
+		n, ok := lpInt(member)
+		if !ok {
+			return false
+		}
+		i, found := s.searchInts(n)
+		if found {
+			s.ints = append(s.ints[:i], s.ints[i+1:]...)
+		}
+		return found
+	case setEncodingListpack:
+		pos := s.findListpack(member)
+		if pos < 0 {
+			return false
+		}
+		s.lp = s.lp.remove(pos, 1)
+		return true
+	}
+	_, exists := s.dict[member]
+	delete(s.dict, member)
+	if exists && s.scan != nil {
+		s.scan.remove(member)
+	}
+	return exists
+}
+
+// Range calls fn for every member until it returns false.
+func (s *Set) Range(fn func(member string) bool) {
+	if s == nil {
+		return
+	}
+	switch s.enc {
+	case setEncodingIntset:
+		for _, n := range s.ints {
+			if !fn(strconv.FormatInt(n, 10)) {
+				return
+			}
+		}
+	case setEncodingListpack:
+		for pos := s.lp.first(); !s.lp.atEnd(pos); {
+			var e lpEntry
+			e, pos = s.lp.next(pos)
+			if !fn(e.String()) {
+				return
+			}
+		}
+	default:
+		for member := range s.dict {
+			if !fn(member) {
+				return
+			}
+		}
+	}
+}
+
+// Scan returns up to about count members for SSCAN, like scanBatch does.
+func (s *Set) Scan(cursor uint64, count int) ([]string, uint64) {
+	if s == nil || s.enc != setEncodingHashtable {
+		return scanBatch(cursor, count, func(yield func(string)) {
+			s.Range(func(member string) bool {
+				yield(member)
+				return true
+			})
+		})
+	}
+	scanIndexMu.Lock()
+	if s.scan == nil {
+		s.scan = buildScanIndex(func(yield func(string)) {
+			for member := range s.dict {
+				yield(member)
+			}
+		})
+	}
+	scanIndexMu.Unlock()
+	return s.scan.batch(cursor, count)
+}
+
+// Members returns every member, in no particular order for a hashtable.
+func (s *Set) Members() []string {
+	members := make([]string, 0, s.Len())
+	s.Range(func(member string) bool {
+		members = append(members, member)
+		return true
+	})
+	return members
+}
+
+// RandomMembers returns up to count distinct members picked at random.
+func (s *Set) RandomMembers(count int) []string {
+	if s.enc == setEncodingHashtable {
+		// Go randomizes map iteration order, which is good enough here
+		picked := make([]string, 0, min(count, s.Len()))
+		s.Range(func(member string) bool {
+			if len(picked) == count {
+				return false
+			}
+			picked = append(picked, member)
+			return true
+		})
+		return picked
+	}
+	members := s.Members()
+	rand.Shuffle(len(members), func(i, j int) { members[i], members[j] = members[j], members[i] })
+	return members[:min(count, len(members))]
+}
+
+func (s *Set) clone() *Set {
+	c := &Set{enc: s.enc}
+	switch s.enc {
+	case setEncodingIntset:
+		c.ints = append([]int64(nil), s.ints...)
+	case setEncodingListpack:
+		c.lp = append(listpack(nil), s.lp...)
+	default:
+		c.dict = make(map[string]struct{}, len(s.dict))
+		for member := range s.dict {
+			c.dict[member] = struct{}{}
+		}
+	}
+	return c
+}
+
+// convert switches the set to enc, which must be a larger encoding.
+func (s *Set) convert(enc setEncoding) {
+	members := s.Members()
+	s.ints, s.lp = nil, nil
+	s.enc = enc
+	if enc == setEncodingListpack {
+		s.lp = listpackOf(members...)
+		return
+	}
+	s.dict = make(map[string]struct{}, len(members)+1)
+	for _, member := range members {
+		s.dict[member] = struct{}{}
+	}
+}
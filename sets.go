@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type setOperation int
+
+const (
+	setUnion setOperation = iota
+	setInter
+	setDiff
+)
+
+// setAlgebra computes the union, intersection or difference of the sets at
+// keys. Missing keys behave as empty sets. The caller must hold the lock.
+func (kv *KeyValueStore) setAlgebra(op setOperation, keys []string) map[string]struct{} {
+	result := make(map[string]struct{})
+	switch op {
+	case setUnion:
+		for _, key := range keys {
+			kv.Sets[key].Range(func(member string) bool {
+				result[member] = struct{}{}
+				return true
+			})
+		}
+	case setInter:
+		// Start from the smallest set so the work is bounded by it
+		sets := make([]*Set, len(keys))
+		for i, key := range keys {
+			sets[i] = kv.Sets[key]
+			if sets[i].Len() == 0 {
+				return result
+			}
+		}
+		sort.Slice(sets, func(i, j int) bool { return sets[i].Len() < sets[j].Len() })
+		sets[0].Range(func(member string) bool {
+			for _, set := range sets[1:] {
+				if !set.Contains(member) {
+					return true
+				}
+			}
+			result[member] = struct{}{}
+			return true
+		})
+	case setDiff:
+		kv.Sets[keys[0]].Range(func(member string) bool {
+			result[member] = struct{}{}
+			return true
+		})
+		for _, key := range keys[1:] {
+			kv.Sets[key].Range(func(member string) bool {
+				delete(result, member)
+				return true
+			})
+		}
+	}
+	return result
+}
+
+func sortedMembers(set map[string]struct{}) []string {
+	members := make([]string, 0, len(set))
+	for member := range set {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// SetAlgebraCommand implements SUNION, SINTER and SDIFF.
+func (kv *KeyValueStore) SetAlgebraCommand(parts []string, op setOperation) string {
+	if len(parts) < 2 {
+		return fmt.Sprintf("ERR %s requires at least 1 argument", parts[0])
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	result := kv.setAlgebra(op, parts[1:])
+	if len(result) == 0 {
+		return "(empty set)"
+	}
+	return strings.Join(sortedMembers(result), " ")
+}
+
+// SetAlgebraStoreCommand implements SUNIONSTORE, SINTERSTORE and SDIFFSTORE.
+// The destination is overwritten whatever its type, and with its TTL, and is
+// removed when the result is empty.
+func (kv *KeyValueStore) SetAlgebraStoreCommand(parts []string, op setOperation) string {
+	if len(parts) < 3 {
+		return fmt.Sprintf("ERR %s requires at least 2 arguments", parts[0])
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	destination := parts[1]
+	result := kv.setAlgebra(op, parts[2:])
+	kv.deleteKey(destination)
+	if len(result) > 0 {
+		kv.Sets[destination] = setFromMap(result)
+	}
+	return fmt.Sprintf("(integer) %d", len(result))
+}
+
+func (kv *KeyValueStore) SCardCommand(parts []string) string {
+	if len(parts) != 2 {
+		return "ERR SCARD requires 1 argument"
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	return fmt.Sprintf("(integer) %d", kv.Sets[parts[1]].Len())
+}
+
+// SInterCardCommand implements SINTERCARD numkeys key [key ...] [LIMIT limit].
+// A limit of 0 means unlimited.
+func (kv *KeyValueStore) SInterCardCommand(parts []string) string {
+	if len(parts) < 3 {
+		return "ERR SINTERCARD requires at least 2 arguments"
+	}
+	numKeys, err := strconv.Atoi(parts[1])
+	if err != nil || numKeys <= 0 {
+		return "ERR numkeys should be greater than 0"
+	}
+	if len(parts) < 2+numKeys {
+		return "ERR Number of keys can't be greater than number of args"
+	}
+	keys := parts[2 : 2+numKeys]
+	limit := 0
+	rest := parts[2+numKeys:]
+	if len(rest) > 0 {
+		if len(rest) != 2 || strings.ToUpper(rest[0]) != "LIMIT" {
+			return "ERR syntax error"
+		}
+		limit, err = strconv.Atoi(rest[1])
+		if err != nil || limit < 0 {
+			return "ERR LIMIT can't be negative"
+		}
+	}
+
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	sets := make([]*Set, len(keys))
+	for i, key := range keys {
+		sets[i] = kv.Sets[key]
+		if sets[i].Len() == 0 {
+			return "(integer) 0"
+		}
+	}
+	sort.Slice(sets, func(i, j int) bool { return sets[i].Len() < sets[j].Len() })
+	count := 0
+	sets[0].Range(func(member string) bool {
+		for _, set := range sets[1:] {
+			if !set.Contains(member) {
+				return true
+			}
+		}
+		count++
+		return limit == 0 || count < limit
+	})
+	return fmt.Sprintf("(integer) %d", count)
+}
+
+func (kv *KeyValueStore) SMIsMemberCommand(parts []string) string {
+	if len(parts) < 3 {
+		return "ERR SMISMEMBER requires at least 2 arguments"
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	set := kv.Sets[parts[1]]
+	results := make([]int64, 0, len(parts)-2)
+	for _, member := range parts[2:] {
+		if set.Contains(member) {
+			results = append(results, 1)
+		} else {
+			results = append(results, 0)
+		}
+	}
+	return joinInts(results)
+}
+
+func (kv *KeyValueStore) SMoveCommand(parts []string) string {
+	if len(parts) != 4 {
+		return "ERR SMOVE requires 3 arguments"
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	source, destination, member := parts[1], parts[2], parts[3]
+	if !kv.Sets[source].Contains(member) {
+		return "(integer) 0"
+	}
+	if source == destination {
+		return "(integer) 1"
+	}
+	kv.Sets[source].Remove(member)
+	if kv.Sets[source].Len() == 0 {
+		kv.deleteKey(source)
+	}
+	if _, exists := kv.Sets[destination]; !exists {
+		kv.Sets[destination] = NewSet()
+	}
+	kv.Sets[destination].Add(member)
+	return "(integer) 1"
+}
+
+// SPopCommand implements SPOP key [count].
+func (kv *KeyValueStore) SPopCommand(parts []string) string {
+	if len(parts) != 2 && len(parts) != 3 {
+		return "ERR SPOP requires 1 or 2 arguments"
+	}
+	count := 1
+	if len(parts) == 3 {
+		var err error
+		count, err = strconv.Atoi(parts[2])
+		if err != nil || count < 0 {
+			return "ERR value is out of range, must be positive"
+		}
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	key := parts[1]
+	set := kv.Sets[key]
+	if set.Len() == 0 {
+		if len(parts) == 2 {
+			return "(nil)"
+		}
+		return "(empty set)"
+	}
+
+	popped := set.RandomMembers(count)
+	for _, member := range popped {
+		set.Remove(member)
+	}
+	if set.Len() == 0 {
+		kv.deleteKey(key)
+	}
+	// Which members were popped is down to chance, so log which ones
+	if len(popped) > 0 {
+		propagateInstead(append([]string{"SREM", key}, popped...))
+	}
+	if len(popped) == 0 {
+		return "(empty set)"
+	}
+	return strings.Join(popped, " ")
+}
+
+// SRandMemberCommand implements SRANDMEMBER key [count]. A negative count may
+// return the same member more than once.
+func (kv *KeyValueStore) SRandMemberCommand(parts []string) string {
+	if len(parts) != 2 && len(parts) != 3 {
+		return "ERR SRANDMEMBER requires 1 or 2 arguments"
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	set := kv.Sets[parts[1]]
+	if len(parts) == 2 {
+		if set.Len() == 0 {
+			return "(nil)"
+		}
+		return set.RandomMembers(1)[0]
+	}
+
+	count, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return "ERR value is not an integer or out of range"
+	}
+	if set.Len() == 0 || count == 0 {
+		return "(empty set)"
+	}
+	members := set.Members()
+	if count < 0 {
+		picked := make([]string, -count)
+		for i := range picked {
+			picked[i] = members[rand.Intn(len(members))]
+		}
+		return strings.Join(picked, " ")
+	}
+	rand.Shuffle(len(members), func(i, j int) { members[i], members[j] = members[j], members[i] })
+	if count < len(members) {
+		members = members[:count]
+	}
+	return strings.Join(members, " ")
+}
+
+// SScanCommand implements SSCAN key cursor [MATCH pattern] [COUNT count].
+func (kv *KeyValueStore) SScanCommand(parts []string) string {
+	if len(parts) < 3 {
+		return "ERR SSCAN requires at least 2 arguments"
+	}
+	opts, errMsg := parseScanArgs(parts, 2, false, false)
+	if errMsg != "" {
+		return errMsg
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	set := kv.Sets[parts[1]]
+	members, next := set.Scan(opts.cursor, opts.count)
+	members = filterMatch(members, opts.match)
+	return strings.Join(append([]string{strconv.FormatUint(next, 10)}, members...), " ")
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSetAlgebra(t *testing.T) {
+	kv := NewKeyValueStore()
+	kv.executeCommand([]string{"SADD", "a", "1", "2", "3", "4"})
+	kv.executeCommand([]string{"SADD", "b", "3", "4", "5"})
+	kv.executeCommand([]string{"SADD", "c", "4", "6"})
+	checkCommands(t, kv, []commandCase{
+		{[]string{"SUNION", "a", "b", "missing"}, "1 2 3 4 5"},
+		{[]string{"SINTER", "a", "b", "c"}, "4"},
+		{[]string{"SINTER", "a", "missing"}, "(empty set)"},
+		{[]string{"SDIFF", "a", "b", "c"}, "1 2"},
+		{[]string{"SDIFF", "missing", "a"}, "(empty set)"},
+		{[]string{"SINTERSTORE", "dst", "a", "b"}, "(integer) 2"},
+		{[]string{"SMEMBERS", "dst"}, "3 4"},
+		// The destination may be one of the sources
+		{[]string{"SUNIONSTORE", "dst", "dst", "c"}, "(integer) 3"},
+		{[]string{"SDIFFSTORE", "dst", "dst", "dst"}, "(integer) 0"},
+		{[]string{"EXISTS", "dst"}, "(integer) 0"},
+
+		{[]string{"SINTERCARD", "2", "a", "b"}, "(integer) 2"},
+		{[]string{"SINTERCARD", "2", "a", "b", "LIMIT", "1"}, "(integer) 1"},
+		{[]string{"SINTERCARD", "2", "a", "b", "LIMIT", "0"}, "(integer) 2"},
+		{[]string{"SINTERCARD", "3", "a", "b", "missing"}, "(integer) 0"},
+		{[]string{"SINTERCARD", "2", "a", "b", "LIMIT", "-1"}, "ERR LIMIT can't be negative"},
+		{[]string{"SINTERCARD", "3", "a", "b"}, "ERR Number of keys can't be greater than number of args"},
+		{[]string{"SINTERCARD", "0", "a"}, "ERR numkeys should be greater than 0"},
+		{[]string{"SINTERCARD", "1", "a", "LIMTI", "1"}, "ERR syntax error"},
+	})
+}
+
+func TestSetStoreOverwritesDestination(t *testing.T) {
+	kv := NewKeyValueStore()
+	kv.executeCommand([]string{"SADD", "a", "1", "2"})
+	kv.executeCommand([]string{"SET", "dst", "string"})
+	kv.executeCommand([]string{"EXPIRE", "dst", "100"})
+	checkCommands(t, kv, []commandCase{
+		{[]string{"SUNIONSTORE", "dst", "a"}, "(integer) 2"},
+		{[]string{"TYPE", "dst"}, "set"},
+		{[]string{"TTL", "dst"}, "(integer) -1"},
+		{[]string{"SMEMBERS", "dst"}, "1 2"},
+	})
+	kv.executeCommand([]string{"DEL", "dst"})
+	kv.executeCommand([]string{"RPUSH", "dst", "x"})
+	checkCommands(t, kv, []commandCase{
+		{[]string{"SINTERSTORE", "dst", "a", "missing"}, "(integer) 0"},
+		{[]string{"EXISTS", "dst"}, "(integer) 0"},
+	})
+}
+
+func TestSetMembership(t *testing.T) {
+	kv := NewKeyValueStore()
+	kv.executeCommand([]string{"SADD", "src", "a", "b"})
+	checkCommands(t, kv, []commandCase{
+		{[]string{"SMISMEMBER", "src", "a", "z", "b"}, "1 0 1"},
+		{[]string{"SMISMEMBER", "missing", "a"}, "0"},
+		{[]string{"SCARD", "src"}, "(integer) 2"},
+		{[]string{"SCARD", "missing"}, "(integer) 0"},
+		{[]string{"SMOVE", "src", "dst", "a"}, "(integer) 1"},
+		{[]string{"SMOVE", "src", "dst", "a"}, "(integer) 0"},
+		{[]string{"SMOVE", "missing", "dst", "a"}, "(integer) 0"},
+		{[]string{"SMOVE", "src", "src", "b"}, "(integer) 1"},
+		{[]string{"SISMEMBER", "src", "b"}, "(integer) 1"},
+		{[]string{"SMOVE", "src", "dst", "b"}, "(integer) 1"},
+		{[]string{"EXISTS", "src"}, "(integer) 0"},
+		{[]string{"SMEMBERS", "dst"}, "a b"},
+	})
+}
+
+func TestEmptiedSetLosesItsTTL(t *testing.T) {
+	kv := NewKeyValueStore()
+	for _, empty := range [][]string{
+		{"SREM", "s", "a"},
+		{"SMOVE", "s", "dst", "a"},
+		{"SPOP", "s"},
+	} {
+		kv.executeCommand([]string{"SADD", "s", "a"})
+		kv.executeCommand([]string{"EXPIRE", "s", "100"})
+		kv.executeCommand(empty)
+		checkCommands(t, kv, []commandCase{
+			{[]string{"EXISTS", "s"}, "(integer) 0"},
+			{[]string{"SADD", "s", "a"}, "(integer) 1"},
+			{[]string{"TTL", "s"}, "(integer) -1"},
+		})
+		kv.executeCommand([]string{"DEL", "s"})
+	}
+}
+
+func TestSetRandomMembers(t *testing.T) {
+	kv := NewKeyValueStore()
+	kv.executeCommand([]string{"SADD", "s", "a", "b", "c"})
+	checkCommands(t, kv, []commandCase{
+		{[]string{"SRANDMEMBER", "missing"}, "(nil)"},
+		{[]string{"SRANDMEMBER", "missing", "-2"}, "(empty set)"},
+		{[]string{"SRANDMEMBER", "s", "0"}, "(empty set)"},
+		{[]string{"SPOP", "s", "-1"}, "ERR value is out of range, must be positive"},
+		{[]string{"SPOP", "missing"}, "(nil)"},
+		{[]string{"SPOP", "missing", "2"}, "(empty set)"},
+	})
+
+	positive := strings.Fields(kv.executeCommand([]string{"SRANDMEMBER", "s", "10"}))
+	sort.Strings(positive)
+	if strings.Join(positive, " ") != "a b c" {
+		t.Fatalf("Expected a positive count to return each member at most once, Got: %q", positive)
+	}
+	negative := strings.Fields(kv.executeCommand([]string{"SRANDMEMBER", "s", "-10"}))
+	if len(negative) != 10 {
+		t.Fatalf("Expected a negative count to return exactly that many members, Got: %q", negative)
+	}
+	for _, member := range negative {
+		if !kv.Sets["s"].Contains(member) {
+			t.Fatalf("Expected members of the set, Got: %q", member)
+		}
+	}
+
+	popped := strings.Fields(kv.executeCommand([]string{"SPOP", "s", "2"}))
+	if len(popped) != 2 || kv.Sets["s"].Len() != 1 {
+		t.Fatalf("Expected 2 members to be popped, Got: %q", popped)
+	}
+	for _, member := range popped {
+		if kv.Sets["s"].Contains(member) {
+			t.Fatalf("Expected %s to be removed", member)
+		}
+	}
+	kv.executeCommand([]string{"SPOP", "s", "5"})
+	if got := kv.executeCommand([]string{"EXISTS", "s"}); got != "(integer) 0" {
+		t.Fatalf("Expected popping every member to remove the key, Got: %q", got)
+	}
+}
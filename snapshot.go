@@ -0,0 +1,133 @@
+package main
+
+import "sync/atomic"
+
+// Snapshots are point-in-time copies of the databases, taken for saves and
+// append-only file rewrites without stopping clients. Starting one only
+// lists the keys of every database. The values are then copied a batch at a
+// time, and a write command copies the old value of a key it is about to
+// change first, if that key wasn't copied yet. The copy ends up holding the
+// dataset as it was when the snapshot started, and can be written out
+// without holding any lock.
+
+// snapshotBatchSize is how many keys are copied per hold of the lock.
+const snapshotBatchSize = 1000
+
+// snapshotsRunning counts the snapshots being taken, so write commands only
+// look for keys to copy while there are some.
+var snapshotsRunning atomic.Int32
+
+// dbSnapshot is the part of a snapshot taking a copy of one database.
+type dbSnapshot struct {
+	copy *KeyValueStore
+	keys []string
+	// done holds the keys whose value as of the start is settled, either
+	// copied or known to have been missing then
+	done map[string]struct{}
+}
+
+type snapshot struct {
+	dbs   []*KeyValueStore
+	parts []*dbSnapshot
+}
+
+// startSnapshot starts a snapshot of dbs. The caller must hold propagateMu,
+// so that every write command either ran before the snapshot or copies
+// what it changes.
+func startSnapshot(dbs []*KeyValueStore) *snapshot {
+	s := &snapshot{dbs: dbs, parts: make([]*dbSnapshot, len(dbs))}
+	copies := newDatabases(len(dbs))
+	for i, kv := range dbs {
+		part := &dbSnapshot{copy: copies[i], done: make(map[string]struct{})}
+		kv.mu.Lock()
+		kv.eachKey(func(key string) {
+			part.keys = append(part.keys, key)
+		})
+		kv.snapshots = append(kv.snapshots, part)
+		kv.mu.Unlock()
+		s.parts[i] = part
+	}
+	snapshotsRunning.Add(1)
+	return s
+}
+
+// finish copies the keys not copied yet and returns the copies of the
+// databases.
+func (s *snapshot) finish() []*KeyValueStore {
+	copies := make([]*KeyValueStore, len(s.dbs))
+	for i, kv := range s.dbs {
+		part := s.parts[i]
+		for start := 0; start < len(part.keys); start += snapshotBatchSize {
+			end := min(start+snapshotBatchSize, len(part.keys))
+			kv.mu.Lock()
+			for _, key := range part.keys[start:end] {
+				part.copyKey(kv, key)
+			}
+			kv.mu.Unlock()
+		}
+
+		kv.mu.Lock()
+		for j, running := range kv.snapshots {
+			if running == part {
+				kv.snapshots = append(kv.snapshots[:j], kv.snapshots[j+1:]...)
+				break
+			}
+		}
+		kv.mu.Unlock()
+		copies[i] = part.copy
+	}
+	snapshotsRunning.Add(-1)
+	return copies
+}
+
+// copyKey copies the value of key in kv, unless its value as of the start
+// of the snapshot is already settled. The caller must hold the write lock.
+func (part *dbSnapshot) copyKey(kv *KeyValueStore, key string) {
+	if _, done := part.done[key]; done {
+		return
+	}
+	part.done[key] = struct{}{}
+	v, exists := kv.getKeyValue(key)
+	if !exists || kv.keyExpired(key) {
+		return
+	}
+	part.copy.setKeyValue(key, v.clone())
+	kv.accessMu.Lock()
+	if access, exists := kv.access[key]; exists {
+		clock := *access
+		part.copy.access[key] = &clock
+	}
+	kv.accessMu.Unlock()
+}
+
+// preserveKeys copies keys for the snapshots being taken of kv, before
+// they are changed. The caller must hold the write lock.
+func (kv *KeyValueStore) preserveKeys(keys ...string) {
+	for _, part := range kv.snapshots {
+		for _, key := range keys {
+			part.copyKey(kv, key)
+		}
+	}
+}
+
+// preserveAll copies every key for the snapshots being taken of kv, before
+// the whole database is changed at once. The caller must hold the write
+// lock.
+func (kv *KeyValueStore) preserveAll() {
+	for _, part := range kv.snapshots {
+		for _, key := range part.keys {
+			part.copyKey(kv, key)
+		}
+	}
+}
+
+// preserveCommandKeys copies the keys the write command in parts may
+// change, for the snapshots being taken of kv.
+func (kv *KeyValueStore) preserveCommandKeys(parts []string) {
+	if snapshotsRunning.Load() == 0 {
+		return
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.preserveKeys(commandKeys(parts)...)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotKeepsTheStartingValues(t *testing.T) {
+	dbs := newDatabases(2)
+	databases = dbs
+	defer func() { databases = nil }()
+	kv := dbs[0]
+	for i := 0; i < 3*snapshotBatchSize; i++ {
+		kv.executeCommand([]string{"SET", fmt.Sprintf("key:%d", i), "before"})
+	}
+	kv.executeCommand([]string{"RPUSH", "list", "a", "b"})
+	kv.executeCommand([]string{"SET", "moved", "before"})
+	dbs[1].executeCommand([]string{"SET", "flushed", "before"})
+
+	propagateMu.Lock()
+	s := startSnapshot(dbs)
+	propagateMu.Unlock()
+	kv.executeCommand([]string{"SET", "key:0", "after"})
+	kv.executeCommand([]string{"DEL", "key:1"})
+	kv.executeCommand([]string{"SET", "new", "after"})
+	kv.executeCommand([]string{"RPUSH", "list", "c"})
+	kv.executeCommand([]string{"MOVE", "moved", "1"})
+	dbs[1].executeCommand([]string{"FLUSHDB"})
+	copies := s.finish()
+
+	if snapshotsRunning.Load() != 0 || len(kv.snapshots) != 0 {
+		t.Fatalf("Expected the snapshot to be done")
+	}
+	for _, check := range []struct {
+		db       int
+		command  []string
+		expected string
+	}{
+		{0, []string{"GET", "key:0"}, "before"},
+		{0, []string{"GET", "key:1"}, "before"},
+		{0, []string{"GET", "new"}, "(nil)"},
+		{0, []string{"LRANGE", "list", "0", "-1"}, "a b"},
+		{0, []string{"GET", "moved"}, "before"},
+		{1, []string{"GET", "moved"}, "(nil)"},
+		{1, []string{"GET", "flushed"}, "before"},
+		{0, []string{"DBSIZE"}, fmt.Sprintf("(integer) %d", 3*snapshotBatchSize+2)},
+	} {
+		if got := copies[check.db].executeCommand(check.command); got != check.expected {
+			t.Fatalf("%v: expected %q, Got: %q", check.command, check.expected, got)
+		}
+	}
+	if got := kv.executeCommand([]string{"GET", "key:0"}); got != "after" {
+		t.Fatalf("Expected the database to keep its writes, Got: %q", got)
+	}
+}
+
+func TestSaveWhileWriting(t *testing.T) {
+	dbs := newDatabases(1)
+	for i := 0; i < 5000; i++ {
+		dbs[0].executeCommand([]string{"SET", fmt.Sprintf("key:%d", i), "v"})
+	}
+	p := newPersistence(dbs, filepath.Join(t.TempDir(), "data.gob"))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5000; i++ {
+			dbs[0].executeCommand([]string{"INCR", fmt.Sprintf("counter:%d", i%10)})
+		}
+	}()
+	if got := p.SaveCommand(); got != "OK" {
+		t.Fatalf("Expected SAVE to succeed, Got: %q", got)
+	}
+	<-done
+
+	loaded := newPersistence(newDatabases(1), p.dataFile)
+	if err := loaded.loadData(); err != nil {
+		t.Fatalf("Expected the data file to load, Got: %v", err)
+	}
+	if got := loaded.databases[0].executeCommand([]string{"GET", "key:4999"}); got != "v" {
+		t.Fatalf("Expected the saved keys to load, Got: %q", got)
+	}
+}
@@ -0,0 +1,866 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// formatScore formats a score the way Redis replies with it.
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	// Integral scores such as geohashes are printed in full, like Redis does
+	if score == math.Trunc(score) && math.Abs(score) < 1e17 {
+		return strconv.FormatFloat(score, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+// formatMembers joins members, followed by their scores when withScores is
+// set, into a reply.
+func formatMembers(members []sortedSetMember, withScores bool) string {
+	if len(members) == 0 {
+		return "(empty sorted set)"
+	}
+	result := make([]string, 0, len(members)*2)
+	for _, m := range members {
+		result = append(result, m.Member)
+		if withScores {
+			result = append(result, formatScore(m.Score))
+		}
+	}
+	return strings.Join(result, " ")
+}
+
+// storeSortedSet replaces whatever is at key, and its TTL, with a sorted set
+// of members, or deletes the key when there are none. The caller must hold
+// the write lock.
+func (kv *KeyValueStore) storeSortedSet(key string, members []sortedSetMember) int {
+	kv.deleteKey(key)
+	if len(members) == 0 {
+		return 0
+	}
+	sortedSet := NewSortedSet()
+	for _, m := range members {
+		sortedSet.Add(m.Member, m.Score)
+	}
+	kv.SortedSets[key] = sortedSet
+	kv.signalKeyReady(key)
+	return sortedSet.Len()
+}
+
+// removeSortedSetIfEmpty deletes the sorted set at key, along with its TTL,
+// once its last member is gone.
+func (kv *KeyValueStore) removeSortedSetIfEmpty(key string) {
+	if sortedSet, exists := kv.SortedSets[key]; exists && sortedSet.Len() == 0 {
+		kv.deleteKey(key)
+	}
+}
+
+// ZAddCommand implements
+// ZADD key [NX | XX] [GT | LT] [CH] [INCR] score member [score member ...]
+func (kv *KeyValueStore) ZAddCommand(parts []string) string {
+	var nx, xx, gt, lt, ch, incr bool
+	i := 2
+options:
+	for ; i < len(parts); i++ {
+		switch strings.ToUpper(parts[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		case "CH":
+			ch = true
+		case "INCR":
+			incr = true
+		default:
+			break options
+		}
+	}
+	pairs := parts[i:]
+	if len(parts) < 4 || len(pairs) == 0 || len(pairs)%2 != 0 {
+		return "ERR ZADD requires an even number of arguments"
+	}
+	if nx && xx {
+		return "ERR XX and NX options at the same time are not compatible"
+	}
+	if (gt && lt) || (gt && nx) || (lt && nx) {
+		return "ERR GT, LT, and/or NX options at the same time are not compatible"
+	}
+	if incr && len(pairs) != 2 {
+		return "ERR INCR option supports a single increment-element pair"
+	}
+	// Validate every score first so a bad one leaves the set untouched
+	scores := make([]float64, 0, len(pairs)/2)
+	for j := 0; j < len(pairs); j += 2 {
+		score, err := parseFloatArg(pairs[j])
+		if err != nil {
+			return "ERR value is not a valid float"
+		}
+		scores = append(scores, score)
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	key := parts[1]
+	sortedSet, exists := kv.SortedSets[key]
+	if !exists {
+		if xx {
+			if incr {
+				return "(nil)"
+			}
+			return "(integer) 0"
+		}
+		sortedSet = NewSortedSet()
+		kv.SortedSets[key] = sortedSet
+	}
+
+	added, changed := 0, 0
+	var incrResult string
+	for j, score := range scores {
+		member := pairs[2*j+1]
+		current, present := sortedSet.Score(member)
+		if (present && nx) || (!present && xx) {
+			incrResult = "(nil)"
+			continue
+		}
+		if incr {
+			score += current
+			if math.IsNaN(score) {
+				kv.removeSortedSetIfEmpty(key)
+				return "ERR resulting score is not a number (NaN)"
+			}
+		}
+		if present && ((gt && score <= current) || (lt && score >= current)) {
+			incrResult = "(nil)"
+			continue
+		}
+		incrResult = formatScore(score)
+		if !present {
+			added++
+		} else if score != current {
+			changed++
+		}
+		sortedSet.Add(member, score)
+	}
+	kv.removeSortedSetIfEmpty(key)
+	if added > 0 {
+		kv.signalKeyReady(key)
+	}
+
+	if incr {
+		return incrResult
+	}
+	if ch {
+		return fmt.Sprintf("(integer) %d", added+changed)
+	}
+	return fmt.Sprintf("(integer) %d", added)
+}
+
+func (kv *KeyValueStore) ZIncrByCommand(parts []string) string {
+	if len(parts) != 4 {
+		return "ERR ZINCRBY requires 3 arguments"
+	}
+	increment, err := parseFloatArg(parts[2])
+	if err != nil {
+		return "ERR value is not a valid float"
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	key, member := parts[1], parts[3]
+	sortedSet, exists := kv.SortedSets[key]
+	if !exists {
+		sortedSet = NewSortedSet()
+		kv.SortedSets[key] = sortedSet
+	}
+	current, _ := sortedSet.Score(member)
+	score := current + increment
+	if math.IsNaN(score) {
+		kv.removeSortedSetIfEmpty(key)
+		return "ERR resulting score is not a number (NaN)"
+	}
+	if sortedSet.Add(member, score) {
+		kv.signalKeyReady(key)
+	}
+	return formatScore(score)
+}
+
+func (kv *KeyValueStore) ZScoreCommand(parts []string) string {
+	if len(parts) != 3 {
+		return "ERR ZSCORE requires 2 arguments"
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	if sortedSet, exists := kv.SortedSets[parts[1]]; exists {
+		if score, ok := sortedSet.Score(parts[2]); ok {
+			return formatScore(score)
+		}
+	}
+	return "(nil)"
+}
+
+func (kv *KeyValueStore) ZMScoreCommand(parts []string) string {
+	if len(parts) < 3 {
+		return "ERR ZMSCORE requires at least 2 arguments"
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	sortedSet := kv.SortedSets[parts[1]]
+	result := make([]string, 0, len(parts)-2)
+	for _, member := range parts[2:] {
+		if sortedSet != nil {
+			if score, ok := sortedSet.Score(member); ok {
+				result = append(result, formatScore(score))
+				continue
+			}
+		}
+		result = append(result, "(nil)")
+	}
+	return strings.Join(result, " ")
+}
+
+func (kv *KeyValueStore) ZCardCommand(parts []string) string {
+	if len(parts) != 2 {
+		return "ERR ZCARD requires 1 argument"
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	if sortedSet, exists := kv.SortedSets[parts[1]]; exists {
+		return fmt.Sprintf("(integer) %d", sortedSet.Len())
+	}
+	return "(integer) 0"
+}
+
+// ZCountCommand implements ZCOUNT and, when byLex is set, ZLEXCOUNT.
+func (kv *KeyValueStore) ZCountCommand(parts []string, byLex bool) string {
+	if len(parts) != 4 {
+		return fmt.Sprintf("ERR %s requires 3 arguments", parts[0])
+	}
+	spec, errMsg := parseRangeSpec(parts[2], parts[3], byLex)
+	if errMsg != "" {
+		return errMsg
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	if sortedSet, exists := kv.SortedSets[parts[1]]; exists {
+		return fmt.Sprintf("(integer) %d", sortedSet.Count(spec))
+	}
+	return "(integer) 0"
+}
+
+func parseRangeSpec(min, max string, byLex bool) (zrangeSpec, string) {
+	if byLex {
+		spec, err := parseLexRange(min, max)
+		if err != nil {
+			return nil, "ERR min or max not valid string range item"
+		}
+		return spec, ""
+	}
+	spec, err := parseScoreRange(min, max)
+	if err != nil {
+		return nil, "ERR min or max is not a float"
+	}
+	return spec, ""
+}
+
+// ZRankCommand implements ZRANK and, when reverse is set, ZREVRANK:
+// key member [WITHSCORE]
+func (kv *KeyValueStore) ZRankCommand(parts []string, reverse bool) string {
+	if len(parts) != 3 && len(parts) != 4 {
+		return fmt.Sprintf("ERR %s requires 2 or 3 arguments", parts[0])
+	}
+	withScore := len(parts) == 4
+	if withScore && strings.ToUpper(parts[3]) != "WITHSCORE" {
+		return "ERR syntax error"
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	sortedSet, exists := kv.SortedSets[parts[1]]
+	if !exists {
+		return "(nil)"
+	}
+	rank, ok := sortedSet.Rank(parts[2], reverse)
+	if !ok {
+		return "(nil)"
+	}
+	if withScore {
+		score, _ := sortedSet.Score(parts[2])
+		return fmt.Sprintf("%d %s", rank, formatScore(score))
+	}
+	return fmt.Sprintf("(integer) %d", rank)
+}
+
+// zrangeRequest holds a parsed range query shared by ZRANGE, ZRANGESTORE and
+// the legacy range commands.
+type zrangeRequest struct {
+	key        string
+	min, max   string
+	byScore    bool
+	byLex      bool
+	reverse    bool
+	withScores bool
+	offset     int
+	limit      int
+	hasLimit   bool
+}
+
+// parseZRangeOptions parses [BYSCORE | BYLEX] [REV] [LIMIT offset count]
+// [WITHSCORES]. Options that the calling command does not accept must be
+// rejected by the caller.
+func parseZRangeOptions(req *zrangeRequest, options []string, allowWithScores bool) string {
+	req.limit = -1
+	for i := 0; i < len(options); i++ {
+		switch strings.ToUpper(options[i]) {
+		case "BYSCORE":
+			req.byScore = true
+		case "BYLEX":
+			req.byLex = true
+		case "REV":
+			req.reverse = true
+		case "WITHSCORES":
+			if !allowWithScores {
+				return "ERR syntax error"
+			}
+			req.withScores = true
+		case "LIMIT":
+			if i+2 >= len(options) {
+				return "ERR syntax error"
+			}
+			offset, err1 := strconv.Atoi(options[i+1])
+			limit, err2 := strconv.Atoi(options[i+2])
+			if err1 != nil || err2 != nil {
+				return "ERR value is not an integer or out of range"
+			}
+			req.offset, req.limit, req.hasLimit = offset, limit, true
+			i += 2
+		default:
+			return "ERR syntax error"
+		}
+	}
+	if req.byScore && req.byLex {
+		return "ERR syntax error"
+	}
+	if req.hasLimit && !req.byScore && !req.byLex {
+		return "ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX"
+	}
+	if req.withScores && req.byLex {
+		return "ERR syntax error, WITHSCORES not supported in combination with BYLEX"
+	}
+	return ""
+}
+
+// zrange runs a parsed range query. The caller must hold the lock.
+func (kv *KeyValueStore) zrange(req *zrangeRequest) ([]sortedSetMember, string) {
+	sortedSet, exists := kv.SortedSets[req.key]
+	if req.byScore || req.byLex {
+		min, max := req.min, req.max
+		if req.reverse {
+			// Reversed queries take the bounds as max min
+			min, max = max, min
+		}
+		spec, errMsg := parseRangeSpec(min, max, req.byLex)
+		if errMsg != "" {
+			return nil, errMsg
+		}
+		if !exists {
+			return nil, ""
+		}
+		return sortedSet.Range(spec, req.reverse, req.offset, req.limit), ""
+	}
+
+	start, err1 := strconv.Atoi(req.min)
+	stop, err2 := strconv.Atoi(req.max)
+	if err1 != nil || err2 != nil {
+		return nil, "ERR value is not an integer or out of range"
+	}
+	if !exists {
+		return nil, ""
+	}
+	length := sortedSet.Len()
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	return sortedSet.RangeByRank(start, stop, req.reverse), ""
+}
+
+// ZRangeCommand implements
+// ZRANGE key start stop [BYSCORE | BYLEX] [REV] [LIMIT offset count] [WITHSCORES]
+func (kv *KeyValueStore) ZRangeCommand(parts []string) string {
+	if len(parts) < 4 {
+		return "ERR ZRANGE requires at least 3 arguments"
+	}
+	req := &zrangeRequest{key: parts[1], min: parts[2], max: parts[3]}
+	if errMsg := parseZRangeOptions(req, parts[4:], true); errMsg != "" {
+		return errMsg
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	members, errMsg := kv.zrange(req)
+	if errMsg != "" {
+		return errMsg
+	}
+	return formatMembers(members, req.withScores)
+}
+
+// ZRangeStoreCommand implements
+// ZRANGESTORE dst src min max [BYSCORE | BYLEX] [REV] [LIMIT offset count]
+func (kv *KeyValueStore) ZRangeStoreCommand(parts []string) string {
+	if len(parts) < 5 {
+		return "ERR ZRANGESTORE requires at least 4 arguments"
+	}
+	req := &zrangeRequest{key: parts[2], min: parts[3], max: parts[4]}
+	if errMsg := parseZRangeOptions(req, parts[5:], false); errMsg != "" {
+		return errMsg
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	members, errMsg := kv.zrange(req)
+	if errMsg != "" {
+		return errMsg
+	}
+	return fmt.Sprintf("(integer) %d", kv.storeSortedSet(parts[1], members))
+}
+
+// ZLegacyRangeCommand implements ZREVRANGE, ZRANGEBYSCORE, ZREVRANGEBYSCORE,
+// ZRANGEBYLEX and ZREVRANGEBYLEX on top of the unified ZRANGE.
+func (kv *KeyValueStore) ZLegacyRangeCommand(parts []string, byScore, byLex, reverse bool) string {
+	if len(parts) < 4 {
+		return fmt.Sprintf("ERR %s requires at least 3 arguments", parts[0])
+	}
+	req := &zrangeRequest{key: parts[1], min: parts[2], max: parts[3], byScore: byScore, byLex: byLex, reverse: reverse}
+	for _, option := range parts[4:] {
+		// The legacy commands only take WITHSCORES and LIMIT
+		switch strings.ToUpper(option) {
+		case "BYSCORE", "BYLEX", "REV":
+			return "ERR syntax error"
+		}
+	}
+	if errMsg := parseZRangeOptions(req, parts[4:], !byLex); errMsg != "" {
+		return errMsg
+	}
+	req.byScore, req.byLex, req.reverse = byScore, byLex, reverse
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	members, errMsg := kv.zrange(req)
+	if errMsg != "" {
+		return errMsg
+	}
+	return formatMembers(members, req.withScores)
+}
+
+// ZRemRangeCommand implements ZREMRANGEBYRANK, ZREMRANGEBYSCORE and
+// ZREMRANGEBYLEX.
+func (kv *KeyValueStore) ZRemRangeCommand(parts []string, byScore, byLex bool) string {
+	if len(parts) != 4 {
+		return fmt.Sprintf("ERR %s requires 3 arguments", parts[0])
+	}
+	req := &zrangeRequest{key: parts[1], min: parts[2], max: parts[3], byScore: byScore, byLex: byLex, limit: -1}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	members, errMsg := kv.zrange(req)
+	if errMsg != "" {
+		return errMsg
+	}
+	if sortedSet, exists := kv.SortedSets[req.key]; exists {
+		for _, m := range members {
+			sortedSet.Remove(m.Member)
+		}
+		kv.removeSortedSetIfEmpty(req.key)
+	}
+	return fmt.Sprintf("(integer) %d", len(members))
+}
+
+// popFrom pops up to count members from the first non-empty sorted set among
+// keys. The caller must hold the write lock.
+func (kv *KeyValueStore) popFrom(keys []string, count int, max bool) (string, []sortedSetMember) {
+	for _, key := range keys {
+		sortedSet, exists := kv.SortedSets[key]
+		if !exists || sortedSet.Len() == 0 {
+			continue
+		}
+		popped := sortedSet.Pop(count, max)
+		kv.removeSortedSetIfEmpty(key)
+		return key, popped
+	}
+	return "", nil
+}
+
+// ZPopCommand implements ZPOPMIN and, when max is set, ZPOPMAX: key [count]
+func (kv *KeyValueStore) ZPopCommand(parts []string, max bool) string {
+	if len(parts) != 2 && len(parts) != 3 {
+		return fmt.Sprintf("ERR %s requires 1 or 2 arguments", parts[0])
+	}
+	count := 1
+	if len(parts) == 3 {
+		var err error
+		count, err = strconv.Atoi(parts[2])
+		if err != nil || count < 0 {
+			return "ERR value is out of range, must be positive"
+		}
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	_, popped := kv.popFrom(parts[1:2], count, max)
+	return formatMembers(popped, true)
+}
+
+// BZPopCommand implements BZPOPMIN and, when max is set, BZPOPMAX:
+// key [key ...] timeout
+func (kv *KeyValueStore) BZPopCommand(parts []string, max bool) string {
+	if len(parts) < 3 {
+		return fmt.Sprintf("ERR %s requires at least 2 arguments", parts[0])
+	}
+	timeout, errMsg := parseBlockingTimeout(parts[len(parts)-1])
+	if errMsg != "" {
+		return errMsg
+	}
+	keys := parts[1 : len(parts)-1]
+	return kv.blockUntil(keys, timeout, func() (string, bool) {
+		key, popped := kv.popFrom(keys, 1, max)
+		if len(popped) == 0 {
+			return "", false
+		}
+		return key + " " + formatMembers(popped, true), true
+	})
+}
+
+// parseZMPop parses numkeys key [key ...] <MIN | MAX> [COUNT count].
+func parseZMPop(args []string) (keys []string, max bool, count int, errMsg string) {
+	if len(args) < 3 {
+		return nil, false, 0, "ERR syntax error"
+	}
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil || numKeys <= 0 {
+		return nil, false, 0, "ERR numkeys should be greater than 0"
+	}
+	if len(args) < 2+numKeys {
+		return nil, false, 0, "ERR syntax error"
+	}
+	keys = args[1 : 1+numKeys]
+	switch strings.ToUpper(args[1+numKeys]) {
+	case "MIN":
+	case "MAX":
+		max = true
+	default:
+		return nil, false, 0, "ERR syntax error"
+	}
+	count = 1
+	rest := args[2+numKeys:]
+	if len(rest) > 0 {
+		if len(rest) != 2 || strings.ToUpper(rest[0]) != "COUNT" {
+			return nil, false, 0, "ERR syntax error"
+		}
+		count, err = strconv.Atoi(rest[1])
+		if err != nil || count <= 0 {
+			return nil, false, 0, "ERR count should be greater than 0"
+		}
+	}
+	return keys, max, count, ""
+}
+
+// ZMPopCommand implements ZMPOP numkeys key [key ...] <MIN | MAX> [COUNT count].
+// The reply is the key the members were popped from, followed by the members
+// and their scores.
+func (kv *KeyValueStore) ZMPopCommand(parts []string) string {
+	keys, max, count, errMsg := parseZMPop(parts[1:])
+	if errMsg != "" {
+		return errMsg
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	key, popped := kv.popFrom(keys, count, max)
+	if len(popped) == 0 {
+		return "(nil)"
+	}
+	return key + " " + formatMembers(popped, true)
+}
+
+// BZMPopCommand implements
+// BZMPOP timeout numkeys key [key ...] <MIN | MAX> [COUNT count]
+func (kv *KeyValueStore) BZMPopCommand(parts []string) string {
+	if len(parts) < 2 {
+		return "ERR BZMPOP requires at least 4 arguments"
+	}
+	timeout, errMsg := parseBlockingTimeout(parts[1])
+	if errMsg != "" {
+		return errMsg
+	}
+	keys, max, count, errMsg := parseZMPop(parts[2:])
+	if errMsg != "" {
+		return errMsg
+	}
+	return kv.blockUntil(keys, timeout, func() (string, bool) {
+		key, popped := kv.popFrom(keys, count, max)
+		if len(popped) == 0 {
+			return "", false
+		}
+		return key + " " + formatMembers(popped, true), true
+	})
+}
+
+type zsetOperation int
+
+const (
+	zsetUnion zsetOperation = iota
+	zsetInter
+	zsetDiff
+)
+
+// zsetInput returns the members of the sorted set, or plain set scored 1, at
+// key. The caller must hold the lock.
+func (kv *KeyValueStore) zsetInput(key string) map[string]float64 {
+	if sortedSet, exists := kv.SortedSets[key]; exists {
+		return sortedSet.ScoreMap()
+	}
+	if set, exists := kv.Sets[key]; exists {
+		members := make(map[string]float64, set.Len())
+		set.Range(func(member string) bool {
+			members[member] = 1
+			return true
+		})
+		return members
+	}
+	return nil
+}
+
+// zsetAlgebra parses numkeys key [key ...] [WEIGHTS weight [weight ...]]
+// [AGGREGATE SUM | MIN | MAX] [WITHSCORES] and computes the result. The
+// caller must hold the lock.
+func (kv *KeyValueStore) zsetAlgebra(op zsetOperation, args []string, allowWithScores bool) ([]sortedSetMember, bool, string) {
+	if len(args) < 2 {
+		return nil, false, "ERR syntax error"
+	}
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil || numKeys <= 0 {
+		return nil, false, "ERR at least 1 input key is needed"
+	}
+	if len(args) < 1+numKeys {
+		return nil, false, "ERR syntax error"
+	}
+	keys := args[1 : 1+numKeys]
+	weights := make([]float64, numKeys)
+	for i := range weights {
+		weights[i] = 1
+	}
+	aggregate := "SUM"
+	withScores := false
+	for i := 1 + numKeys; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "WEIGHTS":
+			if op == zsetDiff || i+numKeys >= len(args) {
+				return nil, false, "ERR syntax error"
+			}
+			for j := 0; j < numKeys; j++ {
+				weight, err := parseFloatArg(args[i+1+j])
+				if err != nil {
+					return nil, false, "ERR weight value is not a float"
+				}
+				weights[j] = weight
+			}
+			i += numKeys
+		case "AGGREGATE":
+			if op == zsetDiff || i+1 >= len(args) {
+				return nil, false, "ERR syntax error"
+			}
+			aggregate = strings.ToUpper(args[i+1])
+			if aggregate != "SUM" && aggregate != "MIN" && aggregate != "MAX" {
+				return nil, false, "ERR syntax error"
+			}
+			i++
+		case "WITHSCORES":
+			if !allowWithScores {
+				return nil, false, "ERR syntax error"
+			}
+			withScores = true
+		default:
+			return nil, false, "ERR syntax error"
+		}
+	}
+
+	combine := func(a, b float64) float64 {
+		switch aggregate {
+		case "MIN":
+			return math.Min(a, b)
+		case "MAX":
+			return math.Max(a, b)
+		}
+		sum := a + b
+		if math.IsNaN(sum) {
+			// inf + -inf, Redis settles on 0
+			return 0
+		}
+		return sum
+	}
+	weigh := func(score, weight float64) float64 {
+		weighted := score * weight
+		if math.IsNaN(weighted) {
+			return 0
+		}
+		return weighted
+	}
+
+	inputs := make([]map[string]float64, numKeys)
+	for i, key := range keys {
+		inputs[i] = kv.zsetInput(key)
+	}
+	result := make(map[string]float64)
+	switch op {
+	case zsetUnion:
+		for i, input := range inputs {
+			for member, score := range input {
+				score = weigh(score, weights[i])
+				if current, ok := result[member]; ok {
+					result[member] = combine(current, score)
+				} else {
+					result[member] = score
+				}
+			}
+		}
+	case zsetInter:
+	members:
+		for member, score := range inputs[0] {
+			total := weigh(score, weights[0])
+			for i, input := range inputs[1:] {
+				other, ok := input[member]
+				if !ok {
+					continue members
+				}
+				total = combine(total, weigh(other, weights[i+1]))
+			}
+			result[member] = total
+		}
+	case zsetDiff:
+		for member, score := range inputs[0] {
+			result[member] = score
+		}
+		for _, input := range inputs[1:] {
+			for member := range input {
+				delete(result, member)
+			}
+		}
+	}
+
+	sorted := NewSortedSet()
+	for member, score := range result {
+		sorted.Add(member, score)
+	}
+	return sorted.Members(), withScores, ""
+}
+
+// ZSetAlgebraCommand implements ZUNION, ZINTER and ZDIFF.
+func (kv *KeyValueStore) ZSetAlgebraCommand(parts []string, op zsetOperation) string {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	members, withScores, errMsg := kv.zsetAlgebra(op, parts[1:], true)
+	if errMsg != "" {
+		return errMsg
+	}
+	return formatMembers(members, withScores)
+}
+
+// ZSetAlgebraStoreCommand implements ZUNIONSTORE, ZINTERSTORE and ZDIFFSTORE.
+func (kv *KeyValueStore) ZSetAlgebraStoreCommand(parts []string, op zsetOperation) string {
+	if len(parts) < 4 {
+		return fmt.Sprintf("ERR %s requires at least 3 arguments", parts[0])
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	members, _, errMsg := kv.zsetAlgebra(op, parts[2:], false)
+	if errMsg != "" {
+		return errMsg
+	}
+	return fmt.Sprintf("(integer) %d", kv.storeSortedSet(parts[1], members))
+}
+
+// ZRandMemberCommand implements ZRANDMEMBER key [count [WITHSCORES]]. A
+// negative count may return the same member more than once.
+func (kv *KeyValueStore) ZRandMemberCommand(parts []string) string {
+	if len(parts) < 2 || len(parts) > 4 {
+		return "ERR ZRANDMEMBER requires 1 to 3 arguments"
+	}
+	withScores := false
+	if len(parts) == 4 {
+		if strings.ToUpper(parts[3]) != "WITHSCORES" {
+			return "ERR syntax error"
+		}
+		withScores = true
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	sortedSet, exists := kv.SortedSets[parts[1]]
+	if len(parts) == 2 {
+		if !exists || sortedSet.Len() == 0 {
+			return "(nil)"
+		}
+		return sortedSet.ByRank(rand.Intn(sortedSet.Len())).Member
+	}
+
+	count, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return "ERR value is not an integer or out of range"
+	}
+	if !exists || count == 0 {
+		return "(empty sorted set)"
+	}
+	var picked []sortedSetMember
+	if count < 0 {
+		picked = make([]sortedSetMember, -count)
+		for i := range picked {
+			picked[i] = sortedSet.ByRank(rand.Intn(sortedSet.Len()))
+		}
+	} else {
+		picked = sortedSet.Members()
+		rand.Shuffle(len(picked), func(i, j int) { picked[i], picked[j] = picked[j], picked[i] })
+		if count < len(picked) {
+			picked = picked[:count]
+		}
+	}
+	return formatMembers(picked, withScores)
+}
+
+// ZScanCommand implements ZSCAN key cursor [MATCH pattern] [COUNT count]. The
+// reply is the next cursor followed by the members and their scores.
+func (kv *KeyValueStore) ZScanCommand(parts []string) string {
+	if len(parts) < 3 {
+		return "ERR ZSCAN requires at least 2 arguments"
+	}
+	opts, errMsg := parseScanArgs(parts, 2, false, false)
+	if errMsg != "" {
+		return errMsg
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	sortedSet, exists := kv.SortedSets[parts[1]]
+	if !exists {
+		return "0"
+	}
+	members, next := sortedSet.Scan(opts.cursor, opts.count)
+	members = filterMatch(members, opts.match)
+
+	result := []string{strconv.FormatUint(next, 10)}
+	for _, member := range members {
+		score, _ := sortedSet.Score(member)
+		result = append(result, member, formatScore(score))
+	}
+	return strings.Join(result, " ")
+}
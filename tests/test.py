@@ -57,7 +57,7 @@ def test_hashes():
     print("Testing hash operations...")
     key = "myhash"
 
-    assert send_command(f"HSET {key} field1 value1") == "OK"
+    assert send_command(f"HSET {key} field1 value1") == "(integer) 1"
     assert send_command(f"HGET {key} field1") == "value1"
     assert send_command(f"HMSET {key} field2 value2 field3 value3") == "OK"
     assert send_command(f"HMGET {key} field1 field2 field3") == "value1 value2 value3"
@@ -72,3 +72,11 @@ func DecodeArgs(command string) []string {
 
 	return decodedParts
 }
+
+// boolToInt returns 1 for true and 0 for false, the way INFO reports flags.
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// WAIT and WAITAOF block the client until its last write reached enough
+// replicas, or enough copies of the append-only file on disk. Every
+// connection remembers the replication offset after its last write, and the
+// replicas acknowledge the offsets they applied and synced. A waiting client
+// asks the replicas for an acknowledgement right away with REPLCONF GETACK
+// rather than waiting for the next periodic one.
+
+// parseWaitTimeout parses the timeout of WAIT and WAITAOF, in milliseconds,
+// where 0 means no timeout.
+func parseWaitTimeout(s string) (time.Duration, string) {
+	timeout, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, "ERR timeout is not an integer or out of range"
+	}
+	if timeout < 0 {
+		return 0, "ERR timeout is negative"
+	}
+	return time.Duration(timeout) * time.Millisecond, ""
+}
+
+// waitCommand implements WAIT numreplicas timeout for a connection whose
+// last write brought the stream to offset. It replies with the number of
+// replicas that acknowledged it.
+func waitCommand(parts []string, offset int64) string {
+	if len(parts) != 3 {
+		return "ERR wrong number of arguments for 'wait' command"
+	}
+	if replicaMode.Load() {
+		return "ERR WAIT cannot be used with replica instances."
+	}
+	numReplicas, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return "ERR value is not an integer or out of range"
+	}
+	timeout, errMsg := parseWaitTimeout(parts[2])
+	if errMsg != "" {
+		return errMsg
+	}
+	return fmt.Sprintf("(integer) %d", replication.waitForAcks(offset, numReplicas, timeout, false))
+}
+
+// waitAOFCommand implements WAITAOF numlocal numreplicas timeout for a
+// connection whose last write brought the stream to offset. It replies with
+// whether the local append-only file has it on disk and the number of
+// replicas whose append-only file has.
+func waitAOFCommand(parts []string, offset int64) string {
+	if len(parts) != 4 {
+		return "ERR wrong number of arguments for 'waitaof' command"
+	}
+	if replicaMode.Load() {
+		return "ERR WAITAOF cannot be used with replica instances."
+	}
+	numLocal, err := strconv.Atoi(parts[1])
+	if err != nil || numLocal < 0 {
+		return "ERR value is not an integer or out of range"
+	}
+	numReplicas, err := strconv.Atoi(parts[2])
+	if err != nil || numReplicas < 0 {
+		return "ERR value is not an integer or out of range"
+	}
+	timeout, errMsg := parseWaitTimeout(parts[3])
+	if errMsg != "" {
+		return errMsg
+	}
+	if numLocal > 0 && appendOnly == nil {
+		return "ERR WAITAOF cannot be used when numlocal is set but appendonly is disabled."
+	}
+
+	local := int64(0)
+	if appendOnly != nil {
+		// Syncing now beats waiting for the next sync, and is the only way
+		// under appendfsync no
+		if numLocal > 0 && appendOnly.fsyncedOffset.Load() < offset {
+			if err := appendOnly.fsync(); err != nil {
+				return "ERR " + err.Error()
+			}
+		}
+		if appendOnly.fsyncedOffset.Load() >= offset {
+			local = 1
+		}
+	}
+	replicas := replication.waitForAcks(offset, numReplicas, timeout, true)
+	return joinInts([]int64{local, int64(replicas)})
+}
+
+// countAcks returns how many replicas acknowledged offset, or having it on
+// disk with aof. The caller must hold r.mu.
+func (r *replicationState) countAcks(offset int64, aof bool) int {
+	acked := 0
+	for _, rep := range r.replicas {
+		ack := rep.ackOffset.Load()
+		if aof {
+			ack = rep.aofAckOffset.Load()
+		}
+		if ack >= offset {
+			acked++
+		}
+	}
+	return acked
+}
+
+// waitForAcks waits until numReplicas replicas acknowledged offset, or
+// having it on disk with aof, or until timeout passes if it isn't 0. It
+// returns how many did.
+func (r *replicationState) waitForAcks(offset int64, numReplicas int, timeout time.Duration, aof bool) int {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	asked := false
+	for {
+		r.mu.Lock()
+		acked := r.countAcks(offset, aof)
+		wake := r.acked
+		r.mu.Unlock()
+		if acked >= numReplicas {
+			return acked
+		}
+		if !asked {
+			r.askForAcks()
+			asked = true
+		}
+		select {
+		case <-wake:
+		case <-expired:
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			return r.countAcks(offset, aof)
+		}
+	}
+}
+
+// askForAcks sends REPLCONF GETACK down the stream, which replicas answer
+// with an acknowledgement once they got there.
+func (r *replicationState) askForAcks() {
+	propagateMu.Lock()
+	defer propagateMu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.master == nil && len(r.replicas) > 0 {
+		r.feedLocked(appendRESPCommand(nil, "REPLCONF", "GETACK", "*"))
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connectTestReplica connects to the master at addr as a replica listening
+// on port, and skips over the dataset of its full resync.
+func connectTestReplica(t *testing.T, addr, port string) *redisClient {
+	t.Helper()
+	c, err := dialRedis(addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Expected to connect, Got: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if err := c.expectOK("REPLCONF", "listening-port", port); err != nil {
+		t.Fatalf("Expected REPLCONF to succeed, Got: %v", err)
+	}
+	if reply := psync(t, c, "?", -1); !strings.HasPrefix(reply, "+FULLRESYNC ") {
+		t.Fatalf("Expected a full resync, Got: %q", reply)
+	}
+	size, err := c.readLine()
+	n, _ := strconv.Atoi(strings.TrimPrefix(size, "$"))
+	if err != nil || n <= 0 {
+		t.Fatalf("Expected the length of the dataset, Got: %q, %v", size, err)
+	}
+	if _, err := io.CopyN(io.Discard, c.reader, int64(n)); err != nil {
+		t.Fatalf("Expected the dataset, Got: %v", err)
+	}
+	return c
+}
+
+func sendAck(t *testing.T, c *redisClient, ack ...string) {
+	t.Helper()
+	c.writer.WriteBulkStrings(append([]string{"REPLCONF", "ACK"}, ack...))
+	if err := c.writer.Flush(); err != nil {
+		t.Fatalf("Expected the acknowledgement to be sent, Got: %v", err)
+	}
+}
+
+func TestWaitForReplicas(t *testing.T) {
+	startTestReplication(t, newDatabases(1))
+	addr := listenTest(t, handleConnection).Addr().String()
+	replica := connectTestReplica(t, addr, "7001")
+	client, err := dialRedis(addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Expected to connect, Got: %v", err)
+	}
+	defer client.Close()
+
+	if reply, _ := client.Do("WAIT", "1", "0"); reply != "(integer) 1" {
+		t.Fatalf("Expected WAIT to return at once before any write, Got: %q", reply)
+	}
+	client.Do("SET", "k", "v")
+	start := time.Now()
+	if reply, _ := client.Do("WAIT", "1", "50"); reply != "(integer) 0" || time.Since(start) < 50*time.Millisecond {
+		t.Fatalf("Expected WAIT to time out, Got: %q after %v", reply, time.Since(start))
+	}
+
+	result := make(chan string)
+	go func() {
+		reply, _ := client.Do("WAIT", "1", "0")
+		result <- reply
+	}()
+	// Each WAIT asks for an acknowledgement
+	expectStream(t, replica, "SELECT 0", "SET k v", "REPLCONF GETACK *", "REPLCONF GETACK *")
+	sendAck(t, replica, strconv.FormatInt(replication.currentOffset(), 10))
+	select {
+	case reply := <-result:
+		if reply != "(integer) 1" {
+			t.Fatalf("Expected WAIT to count the replica, Got: %q", reply)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected WAIT to return once the replica acknowledged the write")
+	}
+
+	if reply, _ := client.Do("WAIT", "x", "0"); reply != "ERR value is not an integer or out of range" {
+		t.Fatalf("Expected a bad number of replicas to be refused, Got: %q", reply)
+	}
+	if reply, _ := client.Do("WAIT", "1", "-1"); reply != "ERR timeout is negative" {
+		t.Fatalf("Expected a negative timeout to be refused, Got: %q", reply)
+	}
+}
+
+func TestWaitAOF(t *testing.T) {
+	dbs := newDatabases(1)
+	startTestReplication(t, dbs)
+	if reply := waitAOFCommand([]string{"WAITAOF", "1", "0", "0"}, 0); !strings.HasPrefix(reply, "ERR WAITAOF cannot be used when numlocal is set") {
+		t.Fatalf("Expected WAITAOF to need the append only file, Got: %q", reply)
+	}
+	startTestAppendOnly(t, dbs)
+	addr := listenTest(t, handleConnection).Addr().String()
+	replica := connectTestReplica(t, addr, "7002")
+
+	dbs[0].executeCommand([]string{"SET", "k", "v"})
+	offset := replication.currentOffset()
+	if reply := waitAOFCommand([]string{"WAITAOF", "1", "0", "0"}, offset); reply != "1 0" {
+		t.Fatalf("Expected the write to be synced locally, Got: %q", reply)
+	}
+	if synced := appendOnly.fsyncedOffset.Load(); synced < offset {
+		t.Fatalf("Expected the synced offset to reach %d, Got: %d", offset, synced)
+	}
+
+	// A replica without an append only file never counts
+	sendAck(t, replica, strconv.FormatInt(offset, 10))
+	if reply := waitAOFCommand([]string{"WAITAOF", "1", "1", "50"}, offset); reply != "1 0" {
+		t.Fatalf("Expected the replica not to count, Got: %q", reply)
+	}
+	sendAck(t, replica, strconv.FormatInt(offset, 10), "FACK", strconv.FormatInt(offset, 10))
+	if reply := waitAOFCommand([]string{"WAITAOF", "1", "1", "0"}, offset); reply != "1 1" {
+		t.Fatalf("Expected the replica to count once it synced, Got: %q", reply)
+	}
+}
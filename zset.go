@@ -0,0 +1,779 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"math/rand"
+	"slices"
+	"strings"
+)
+
+// SortedSet is the value type behind sorted sets. Like Redis it pairs a dict
+// from member to score, for O(1) score lookups, with a skiplist ordered by
+// (score, member), which gives O(log n) insertion, removal, rank and range
+// queries. Small sets are kept as a listpack of members each followed by
+// their score in the same order instead, with dict and zsl left nil, until
+// they outgrow zset-max-listpack-entries or zset-max-listpack-value.
+type SortedSet struct {
+	lp   listpack
+	dict map[string]float64
+	zsl  *skiplist
+	// scan indexes the members of dict once ZSCAN needed it
+	scan *scanIndex
+}
+
+const (
+	skiplistMaxLevel = 32
+	skiplistP        = 0.25
+)
+
+type skiplistLevel struct {
+	forward *skiplistNode
+	// span is the number of nodes the forward link jumps over, used to
+	// compute ranks without walking the bottom level.
+	span int
+}
+
+type skiplistNode struct {
+	member   string
+	score    float64
+	backward *skiplistNode
+	level    []skiplistLevel
+}
+
+type skiplist struct {
+	header *skiplistNode
+	tail   *skiplistNode
+	length int
+	level  int
+}
+
+func newSkiplistNode(level int, score float64, member string) *skiplistNode {
+	return &skiplistNode{
+		member: member,
+		score:  score,
+		level:  make([]skiplistLevel, level),
+	}
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		header: newSkiplistNode(skiplistMaxLevel, 0, ""),
+		level:  1,
+	}
+}
+
+func randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Float64() < skiplistP {
+		level++
+	}
+	return level
+}
+
+// nodeLess reports whether node sorts before the element (score, member).
+func nodeLess(node *skiplistNode, score float64, member string) bool {
+	return node.score < score || (node.score == score && node.member < member)
+}
+
+func nodeLessOrEqual(node *skiplistNode, score float64, member string) bool {
+	return node.score < score || (node.score == score && node.member <= member)
+}
+
+// insert adds a new element. The caller must make sure member is not already
+// in the list.
+func (zsl *skiplist) insert(score float64, member string) *skiplistNode {
+	var update [skiplistMaxLevel]*skiplistNode
+	var rank [skiplistMaxLevel]int
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		if i < zsl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && nodeLess(x.level[i].forward, score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := randomLevel()
+	if level > zsl.level {
+		for i := zsl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = zsl.header
+			update[i].level[i].span = zsl.length
+		}
+		zsl.level = level
+	}
+
+	x = newSkiplistNode(level, score, member)
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = (rank[0] - rank[i]) + 1
+	}
+	for i := level; i < zsl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != zsl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		zsl.tail = x
+	}
+	zsl.length++
+	return x
+}
+
+func (zsl *skiplist) deleteNode(x *skiplistNode, update *[skiplistMaxLevel]*skiplistNode) {
+	for i := 0; i < zsl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		zsl.tail = x.backward
+	}
+	for zsl.level > 1 && zsl.header.level[zsl.level-1].forward == nil {
+		zsl.level--
+	}
+	zsl.length--
+}
+
+// delete removes the element (score, member) and reports whether it existed.
+func (zsl *skiplist) delete(score float64, member string) bool {
+	var update [skiplistMaxLevel]*skiplistNode
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && nodeLess(x.level[i].forward, score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	x = x.level[0].forward
+	if x != nil && x.score == score && x.member == member {
+		zsl.deleteNode(x, &update)
+		return true
+	}
+	return false
+}
+
+// updateScore moves member from curScore to newScore, reusing the node when
+// the element keeps its position.
+func (zsl *skiplist) updateScore(curScore float64, member string, newScore float64) {
+	var update [skiplistMaxLevel]*skiplistNode
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && nodeLess(x.level[i].forward, curScore, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	x = x.level[0].forward
+
+	if (x.backward == nil || nodeLess(x.backward, newScore, member)) &&
+		(x.level[0].forward == nil || !nodeLess(x.level[0].forward, newScore, member)) {
+		x.score = newScore
+		return
+	}
+	zsl.deleteNode(x, &update)
+	zsl.insert(newScore, member)
+}
+
+// rank returns the 1-based rank of (score, member), or 0 when it is missing.
+func (zsl *skiplist) rank(score float64, member string) int {
+	rank := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && nodeLessOrEqual(x.level[i].forward, score, member) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+		if x != zsl.header && x.member == member {
+			return rank
+		}
+	}
+	return 0
+}
+
+// byRank returns the node at the 1-based rank, or nil when out of range.
+func (zsl *skiplist) byRank(rank int) *skiplistNode {
+	traversed := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
+
+func NewSortedSet() *SortedSet {
+	return &SortedSet{lp: newListpack()}
+}
+
+// Encoding names the representation of the set the way OBJECT ENCODING does.
+func (z *SortedSet) Encoding() string {
+	if z.zsl == nil {
+		return "listpack"
+	}
+	return "skiplist"
+}
+
+// convert switches a listpack encoded set to the dict and skiplist.
+func (z *SortedSet) convert() {
+	members := z.Members()
+	z.lp = nil
+	z.dict = make(map[string]float64, len(members)+1)
+	z.zsl = newSkiplist()
+	for _, m := range members {
+		z.zsl.insert(m.Score, m.Member)
+		z.dict[m.Member] = m.Score
+	}
+}
+
+func lpScore(e lpEntry) float64 {
+	if e.isInt {
+		return float64(e.num)
+	}
+	score, _ := parseFloatArg(string(e.str))
+	return score
+}
+
+// lpFind returns the position of member in the listpack, or -1, along with
+// its score.
+func (z *SortedSet) lpFind(member string) (int, float64) {
+	for pos := z.lp.first(); !z.lp.atEnd(pos); {
+		e, scorePos := z.lp.next(pos)
+		score, next := z.lp.next(scorePos)
+		if e.equals(member) {
+			return pos, lpScore(score)
+		}
+		pos = next
+	}
+	return -1, 0
+}
+
+// lpInsert adds member, which must not be in the listpack, at its rank.
+func (z *SortedSet) lpInsert(member string, score float64) {
+	pos := z.lp.first()
+	for !z.lp.atEnd(pos) {
+		e, scorePos := z.lp.next(pos)
+		s, next := z.lp.next(scorePos)
+		if current := lpScore(s); current > score || current == score && e.String() > member {
+			break
+		}
+		pos = next
+	}
+	z.lp = z.lp.insert(pos, member, formatScore(score))
+}
+
+func (z *SortedSet) Len() int {
+	if z.zsl == nil {
+		return z.lp.Len() / 2
+	}
+	return len(z.dict)
+}
+
+func (z *SortedSet) Score(member string) (float64, bool) {
+	if z.zsl == nil {
+		pos, score := z.lpFind(member)
+		return score, pos >= 0
+	}
+	score, ok := z.dict[member]
+	return score, ok
+}
+
+// Add inserts member with score, or updates its score if it is already
+// present. It reports whether a new member was added.
+func (z *SortedSet) Add(member string, score float64) bool {
+	if z.zsl == nil {
+		pos, current := z.lpFind(member)
+		if pos >= 0 {
+			if current != score {
+				z.lp = z.lp.remove(pos, 2)
+				z.lpInsert(member, score)
+			}
+			return false
+		}
+		if z.Len() < zsetMaxListpackEntries && len(member) <= zsetMaxListpackValue {
+			z.lpInsert(member, score)
+			return true
+		}
+		z.convert()
+	}
+	if current, ok := z.dict[member]; ok {
+		if current != score {
+			z.zsl.updateScore(current, member, score)
+			z.dict[member] = score
+		}
+		return false
+	}
+	z.zsl.insert(score, member)
+	z.dict[member] = score
+	if z.scan != nil {
+		z.scan.add(member)
+	}
+	return true
+}
+
+func (z *SortedSet) Remove(member string) bool {
+	if z.zsl == nil {
+		pos, _ := z.lpFind(member)
+		if pos < 0 {
+			return false
+		}
+		z.lp = z.lp.remove(pos, 2)
+		return true
+	}
+	score, ok := z.dict[member]
+	if !ok {
+		return false
+	}
+	z.zsl.delete(score, member)
+	delete(z.dict, member)
+	if z.scan != nil {
+		z.scan.remove(member)
+	}
+	return true
+}
+
+// Rank returns the 0-based rank of member, counting from the highest score
+// when reverse is set.
+func (z *SortedSet) Rank(member string, reverse bool) (int, bool) {
+	var rank int
+	if z.zsl == nil {
+		rank = 1
+		pos := z.lp.first()
+		for ; !z.lp.atEnd(pos); rank++ {
+			e, scorePos := z.lp.next(pos)
+			if e.equals(member) {
+				break
+			}
+			pos = z.lp.skip(scorePos)
+		}
+		if z.lp.atEnd(pos) {
+			return 0, false
+		}
+	} else {
+		score, ok := z.dict[member]
+		if !ok {
+			return 0, false
+		}
+		rank = z.zsl.rank(score, member)
+	}
+	if reverse {
+		return z.Len() - rank, true
+	}
+	return rank - 1, true
+}
+
+// RangeByRank returns the members between the 0-based ranks start and stop,
+// both inclusive and already clamped to the set, in ascending order or in
+// descending order when reverse is set.
+func (z *SortedSet) RangeByRank(start, stop int, reverse bool) []sortedSetMember {
+	length := z.Len()
+	if start < 0 || start > stop || start >= length {
+		return nil
+	}
+	result := make([]sortedSetMember, 0, stop-start+1)
+	if z.zsl == nil {
+		members := z.lpMembers()
+		for i := start; i <= stop && i < length; i++ {
+			if reverse {
+				result = append(result, members[length-1-i])
+			} else {
+				result = append(result, members[i])
+			}
+		}
+		return result
+	}
+	var x *skiplistNode
+	if reverse {
+		x = z.zsl.byRank(length - start)
+	} else {
+		x = z.zsl.byRank(start + 1)
+	}
+	for i := start; i <= stop && x != nil; i++ {
+		result = append(result, sortedSetMember{Member: x.member, Score: x.score})
+		if reverse {
+			x = x.backward
+		} else {
+			x = x.level[0].forward
+		}
+	}
+	return result
+}
+
+// ByRank returns the member at the 0-based rank, which must be in range.
+func (z *SortedSet) ByRank(rank int) sortedSetMember {
+	if z.zsl == nil {
+		return z.RangeByRank(rank, rank, false)[0]
+	}
+	x := z.zsl.byRank(rank + 1)
+	return sortedSetMember{Member: x.member, Score: x.score}
+}
+
+// Scan returns up to about count members for ZSCAN, like scanBatch does.
+func (z *SortedSet) Scan(cursor uint64, count int) ([]string, uint64) {
+	if z.zsl == nil {
+		return scanBatch(cursor, count, func(yield func(string)) {
+			for _, m := range z.lpMembers() {
+				yield(m.Member)
+			}
+		})
+	}
+	scanIndexMu.Lock()
+	if z.scan == nil {
+		z.scan = buildScanIndex(func(yield func(string)) {
+			for member := range z.dict {
+				yield(member)
+			}
+		})
+	}
+	scanIndexMu.Unlock()
+	return z.scan.batch(cursor, count)
+}
+
+// ScoreMap returns the scores by member. For a skiplist encoded set this is
+// the dict itself, which the caller must not modify.
+func (z *SortedSet) ScoreMap() map[string]float64 {
+	if z.zsl != nil {
+		return z.dict
+	}
+	scores := make(map[string]float64, z.Len())
+	for _, m := range z.lpMembers() {
+		scores[m.Member] = m.Score
+	}
+	return scores
+}
+
+// lpMembers decodes every member of a listpack encoded set, in rank order.
+func (z *SortedSet) lpMembers() []sortedSetMember {
+	members := make([]sortedSetMember, 0, z.Len())
+	for pos := z.lp.first(); !z.lp.atEnd(pos); {
+		var member, score lpEntry
+		member, pos = z.lp.next(pos)
+		score, pos = z.lp.next(pos)
+		members = append(members, sortedSetMember{Member: member.String(), Score: lpScore(score)})
+	}
+	return members
+}
+
+func (z *SortedSet) clone() *SortedSet {
+	if z.zsl == nil {
+		return &SortedSet{lp: append(listpack(nil), z.lp...)}
+	}
+	c := &SortedSet{dict: make(map[string]float64, z.Len()), zsl: newSkiplist()}
+	for x := z.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+		c.zsl.insert(x.score, x.member)
+		c.dict[x.member] = x.score
+	}
+	return c
+}
+
+// GobEncode writes the members in rank order, the skiplist itself is rebuilt
+// on decode.
+func (z *SortedSet) GobEncode() ([]byte, error) {
+	members := z.Members()
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(members); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (z *SortedSet) GobDecode(data []byte) error {
+	var members []sortedSetMember
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&members); err != nil {
+		return err
+	}
+	*z = *NewSortedSet()
+	for _, m := range members {
+		z.Add(m.Member, m.Score)
+	}
+	return nil
+}
+
+// zrangeSpec describes an interval of a sorted set, either by score or, for
+// sets where all members share the same score, lexicographically.
+type zrangeSpec interface {
+	// aboveMin reports whether node is past the lower end of the interval.
+	aboveMin(node *skiplistNode) bool
+	// belowMax reports whether node is before the upper end of the interval.
+	belowMax(node *skiplistNode) bool
+	// empty reports whether the interval cannot contain anything.
+	empty() bool
+}
+
+type scoreRange struct {
+	min, max                   float64
+	minExclusive, maxExclusive bool
+}
+
+func (r scoreRange) aboveMin(node *skiplistNode) bool {
+	if r.minExclusive {
+		return node.score > r.min
+	}
+	return node.score >= r.min
+}
+
+func (r scoreRange) belowMax(node *skiplistNode) bool {
+	if r.maxExclusive {
+		return node.score < r.max
+	}
+	return node.score <= r.max
+}
+
+func (r scoreRange) empty() bool {
+	return r.min > r.max || (r.min == r.max && (r.minExclusive || r.maxExclusive))
+}
+
+// lexRange bounds are either a member, or -/+ infinity when the
+// corresponding Inf flag is set.
+type lexRange struct {
+	min, max                   string
+	minExclusive, maxExclusive bool
+	minInf, maxInf             int // -1 for "-", +1 for "+", 0 for a member
+}
+
+func (r lexRange) aboveMin(node *skiplistNode) bool {
+	switch r.minInf {
+	case -1:
+		return true
+	case 1:
+		return false
+	}
+	if r.minExclusive {
+		return node.member > r.min
+	}
+	return node.member >= r.min
+}
+
+func (r lexRange) belowMax(node *skiplistNode) bool {
+	switch r.maxInf {
+	case 1:
+		return true
+	case -1:
+		return false
+	}
+	if r.maxExclusive {
+		return node.member < r.max
+	}
+	return node.member <= r.max
+}
+
+func (r lexRange) empty() bool {
+	if r.minInf == 1 || r.maxInf == -1 {
+		return true
+	}
+	if r.minInf == -1 || r.maxInf == 1 {
+		return false
+	}
+	return r.min > r.max || (r.min == r.max && (r.minExclusive || r.maxExclusive))
+}
+
+// parseScoreBound parses a score bound such as "1.5", "(1.5", "-inf" or "+inf".
+func parseScoreBound(s string) (float64, bool, error) {
+	exclusive := strings.HasPrefix(s, "(")
+	if exclusive {
+		s = s[1:]
+	}
+	f, err := parseFloatArg(s)
+	return f, exclusive, err
+}
+
+func parseScoreRange(min, max string) (scoreRange, error) {
+	var r scoreRange
+	var err error
+	if r.min, r.minExclusive, err = parseScoreBound(min); err != nil {
+		return r, err
+	}
+	if r.max, r.maxExclusive, err = parseScoreBound(max); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+// parseLexBound parses a lex bound: "-", "+", "[member" or "(member".
+func parseLexBound(s string) (string, bool, int, error) {
+	switch {
+	case s == "-":
+		return "", false, -1, nil
+	case s == "+":
+		return "", false, 1, nil
+	case strings.HasPrefix(s, "["):
+		return s[1:], false, 0, nil
+	case strings.HasPrefix(s, "("):
+		return s[1:], true, 0, nil
+	}
+	return "", false, 0, errors.New("invalid lex bound")
+}
+
+func parseLexRange(min, max string) (lexRange, error) {
+	var r lexRange
+	var err error
+	if r.min, r.minExclusive, r.minInf, err = parseLexBound(min); err != nil {
+		return r, err
+	}
+	if r.max, r.maxExclusive, r.maxInf, err = parseLexBound(max); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+// firstInRange returns the lowest ranked node inside spec, or nil.
+func (zsl *skiplist) firstInRange(spec zrangeSpec) *skiplistNode {
+	if spec.empty() {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !spec.aboveMin(x.level[i].forward) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if x == nil || !spec.belowMax(x) {
+		return nil
+	}
+	return x
+}
+
+// lastInRange returns the highest ranked node inside spec, or nil.
+func (zsl *skiplist) lastInRange(spec zrangeSpec) *skiplistNode {
+	if spec.empty() {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && spec.belowMax(x.level[i].forward) {
+			x = x.level[i].forward
+		}
+	}
+	if x == zsl.header || !spec.aboveMin(x) {
+		return nil
+	}
+	return x
+}
+
+// Count returns the number of members inside spec.
+func (z *SortedSet) Count(spec zrangeSpec) int {
+	if z.zsl == nil {
+		return len(z.lpRange(spec, false))
+	}
+	first := z.zsl.firstInRange(spec)
+	if first == nil {
+		return 0
+	}
+	last := z.zsl.lastInRange(spec)
+	return z.zsl.rank(last.score, last.member) - z.zsl.rank(first.score, first.member) + 1
+}
+
+// Range returns the members inside spec, skipping the first offset matches
+// and returning at most limit of them when limit is not negative. With
+// reverse set the walk starts from the highest ranked member.
+func (z *SortedSet) Range(spec zrangeSpec, reverse bool, offset, limit int) []sortedSetMember {
+	if z.zsl == nil {
+		matches := z.lpRange(spec, reverse)
+		if offset < 0 || offset >= len(matches) {
+			return nil
+		}
+		matches = matches[offset:]
+		if limit >= 0 && limit < len(matches) {
+			matches = matches[:limit]
+		}
+		return matches
+	}
+	var x *skiplistNode
+	if reverse {
+		x = z.zsl.lastInRange(spec)
+	} else {
+		x = z.zsl.firstInRange(spec)
+	}
+	if x == nil || offset < 0 {
+		return nil
+	}
+	if offset > 0 {
+		rank := z.zsl.rank(x.score, x.member)
+		if reverse {
+			rank -= offset
+		} else {
+			rank += offset
+		}
+		x = z.zsl.byRank(rank)
+	}
+
+	result := make([]sortedSetMember, 0)
+	for x != nil && limit != 0 {
+		if reverse && !spec.aboveMin(x) || !reverse && !spec.belowMax(x) {
+			break
+		}
+		result = append(result, sortedSetMember{Member: x.member, Score: x.score})
+		if reverse {
+			x = x.backward
+		} else {
+			x = x.level[0].forward
+		}
+		limit--
+	}
+	return result
+}
+
+// lpRange returns every member of a listpack encoded set inside spec, in
+// descending order when reverse is set.
+func (z *SortedSet) lpRange(spec zrangeSpec, reverse bool) []sortedSetMember {
+	if spec.empty() {
+		return nil
+	}
+	members := z.lpMembers()
+	if reverse {
+		slices.Reverse(members)
+	}
+	matches := members[:0]
+	var node skiplistNode
+	for _, m := range members {
+		node.member, node.score = m.Member, m.Score
+		if spec.aboveMin(&node) && spec.belowMax(&node) {
+			matches = append(matches, m)
+		}
+	}
+	return matches
+}
+
+// Members returns every member in ascending order.
+func (z *SortedSet) Members() []sortedSetMember {
+	return z.RangeByRank(0, z.Len()-1, false)
+}
+
+// Pop removes and returns up to count of the lowest ranked members, or of
+// the highest ranked ones when max is set.
+func (z *SortedSet) Pop(count int, max bool) []sortedSetMember {
+	if count > z.Len() {
+		count = z.Len()
+	}
+	if count <= 0 {
+		return nil
+	}
+	popped := z.RangeByRank(0, count-1, max)
+	for _, m := range popped {
+		z.Remove(m.Member)
+	}
+	return popped
+}
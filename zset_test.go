@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func checkSortedSet(t *testing.T, z *SortedSet, reference map[string]float64) {
+	t.Helper()
+	expected := make([]sortedSetMember, 0, len(reference))
+	for member, score := range reference {
+		expected = append(expected, sortedSetMember{member, score})
+	}
+	sort.Slice(expected, func(i, j int) bool {
+		if expected[i].Score != expected[j].Score {
+			return expected[i].Score < expected[j].Score
+		}
+		return expected[i].Member < expected[j].Member
+	})
+
+	if z.Len() != len(expected) {
+		t.Fatalf("Expected length %d, Got: %d", len(expected), z.Len())
+	}
+	got := z.RangeByRank(0, z.Len()-1, false)
+	for i, m := range expected {
+		if got[i] != m {
+			t.Fatalf("Rank %d: expected %v, Got: %v", i, m, got[i])
+		}
+		if rank, _ := z.Rank(m.Member, false); rank != i {
+			t.Fatalf("Expected rank of %s to be %d, Got: %d", m.Member, i, rank)
+		}
+		if rank, _ := z.Rank(m.Member, true); rank != len(expected)-1-i {
+			t.Fatalf("Expected reverse rank of %s to be %d, Got: %d", m.Member, len(expected)-1-i, rank)
+		}
+	}
+	reversed := z.RangeByRank(0, z.Len()-1, true)
+	for i, m := range reversed {
+		if m != expected[len(expected)-1-i] {
+			t.Fatalf("Reverse rank %d: expected %v, Got: %v", i, expected[len(expected)-1-i], m)
+		}
+	}
+}
+
+func TestSortedSetRandomOperations(t *testing.T) {
+	z := NewSortedSet()
+	reference := make(map[string]float64)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		member := "m" + strconv.Itoa(rng.Intn(300))
+		switch rng.Intn(3) {
+		case 0, 1:
+			score := float64(rng.Intn(50)) / 2
+			_, existed := reference[member]
+			if added := z.Add(member, score); added == existed {
+				t.Fatalf("Add(%s) reported added=%v for existing=%v", member, added, existed)
+			}
+			reference[member] = score
+		case 2:
+			_, existed := reference[member]
+			if removed := z.Remove(member); removed != existed {
+				t.Fatalf("Remove(%s) = %v, expected %v", member, removed, existed)
+			}
+			delete(reference, member)
+		}
+	}
+	checkSortedSet(t, z, reference)
+}
+
+func TestSortedSetTiesOrderedByMember(t *testing.T) {
+	z := NewSortedSet()
+	z.Add("c", 1)
+	z.Add("a", 1)
+	z.Add("b", 1)
+	z.Add("z", 0.5)
+	got := z.RangeByRank(0, 3, false)
+	expected := []string{"z", "a", "b", "c"}
+	for i, m := range got {
+		if m.Member != expected[i] {
+			t.Errorf("Expected %s at rank %d, Got: %s", expected[i], i, m.Member)
+		}
+	}
+}
+
+func TestSortedSetGobRoundTrip(t *testing.T) {
+	z := NewSortedSet()
+	z.Add("a", 1.5)
+	z.Add("b", -2)
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(map[string]*SortedSet{"z": z}); err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]*SortedSet
+	if err := gob.NewDecoder(&buf).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	checkSortedSet(t, decoded["z"], map[string]float64{"a": 1.5, "b": -2})
+}
+
+func TestSortedSetRangeByScore(t *testing.T) {
+	z := NewSortedSet()
+	for i, member := range []string{"a", "b", "c", "d", "e"} {
+		z.Add(member, float64(i+1))
+	}
+	spec, err := parseScoreRange("(1", "4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := z.Count(spec); count != 3 {
+		t.Errorf("Expected 3 members in (1, 4], Got: %d", count)
+	}
+	got := z.Range(spec, true, 1, 1)
+	if len(got) != 1 || got[0].Member != "c" {
+		t.Errorf("Expected [c], Got: %v", got)
+	}
+	spec, _ = parseScoreRange("6", "+inf")
+	if got := z.Range(spec, false, 0, -1); len(got) != 0 {
+		t.Errorf("Expected no members, Got: %v", got)
+	}
+}
+
+func TestSortedSetRangeByLex(t *testing.T) {
+	z := NewSortedSet()
+	for _, member := range []string{"apple", "banana", "cherry", "date"} {
+		z.Add(member, 0)
+	}
+	spec, err := parseLexRange("[b", "(d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := z.Range(spec, false, 0, -1)
+	if len(got) != 2 || got[0].Member != "banana" || got[1].Member != "cherry" {
+		t.Errorf("Expected [banana cherry], Got: %v", got)
+	}
+	spec, _ = parseLexRange("+", "-")
+	if count := z.Count(spec); count != 0 {
+		t.Errorf("Expected an empty range, Got: %d", count)
+	}
+}
+
+func TestSortedSetStoreOverwritesDestination(t *testing.T) {
+	kv := NewKeyValueStore()
+	kv.executeCommand([]string{"ZADD", "z", "1", "a", "2", "b"})
+	kv.executeCommand([]string{"GEOADD", "g", "13.361389", "38.115556", "Palermo"})
+	stores := []commandCase{
+		{[]string{"ZUNIONSTORE", "dst", "1", "z"}, "(integer) 2"},
+		{[]string{"ZINTERSTORE", "dst", "1", "z"}, "(integer) 2"},
+		{[]string{"ZDIFFSTORE", "dst", "1", "z"}, "(integer) 2"},
+		{[]string{"ZRANGESTORE", "dst", "z", "0", "-1"}, "(integer) 2"},
+		{[]string{"GEOSEARCHSTORE", "dst", "g", "FROMLONLAT", "13", "38", "BYRADIUS", "100", "km"}, "(integer) 1"},
+	}
+	for _, store := range stores {
+		kv.executeCommand([]string{"DEL", "dst"})
+		kv.executeCommand([]string{"SET", "dst", "string"})
+		kv.executeCommand([]string{"EXPIRE", "dst", "100"})
+		checkCommands(t, kv, []commandCase{
+			store,
+			{[]string{"TYPE", "dst"}, "zset"},
+			{[]string{"TTL", "dst"}, "(integer) -1"},
+		})
+	}
+
+	kv.executeCommand([]string{"HSET", "dst", "f", "v"})
+	checkCommands(t, kv, []commandCase{
+		{[]string{"ZINTERSTORE", "dst", "2", "z", "missing"}, "(integer) 0"},
+		{[]string{"EXISTS", "dst"}, "(integer) 0"},
+	})
+}
+
+func TestEmptiedSortedSetLosesItsTTL(t *testing.T) {
+	kv := NewKeyValueStore()
+	for _, empty := range [][]string{
+		{"ZREM", "z", "a"},
+		{"ZPOPMIN", "z"},
+		{"ZMPOP", "1", "z", "MAX"},
+		{"BZPOPMIN", "z", "0"},
+	} {
+		kv.executeCommand([]string{"ZADD", "z", "1", "a"})
+		kv.executeCommand([]string{"EXPIRE", "z", "100"})
+		kv.executeCommand(empty)
+		checkCommands(t, kv, []commandCase{
+			{[]string{"EXISTS", "z"}, "(integer) 0"},
+			{[]string{"ZADD", "z", "1", "a"}, "(integer) 1"},
+			{[]string{"TTL", "z"}, "(integer) -1"},
+		})
+		kv.executeCommand([]string{"DEL", "z"})
+	}
+}